@@ -0,0 +1,447 @@
+package analyzer
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// UsageKind says what a template does with a variable
+type UsageKind int
+
+const (
+	PRINTED   UsageKind = iota // written to the output, e.g. {{ name }}
+	ITERATED                   // looped over, e.g. {{ for item in items }}
+	COMPARED                   // compared or checked for membership, e.g. {{ if age > 18 }}, {{ switch status }}
+	CONDITION                  // used for its truthiness, e.g. {{ if isAdmin }}, {{ a && b }}
+	TESTED                     // checked with 'is', e.g. {{ if x is defined }}
+	ARGUMENT                   // passed to a macro or function
+	CALLED                     // a method of it is called, e.g. {{ user.FullName() }}
+)
+
+func (k UsageKind) String() string {
+	return [...]string{
+		"PRINTED",
+		"ITERATED",
+		"COMPARED",
+		"CONDITION",
+		"TESTED",
+		"ARGUMENT",
+		"CALLED",
+	}[k]
+}
+
+// Report lists what a template needs from its context and from other templates
+type Report struct {
+	Variables []Variable  // free variables, the context keys the template reads, sorted by name
+	Functions []Reference // functions the template calls that it doesn't define as macros
+	Templates []Reference // templates the template imports
+	Loops     []Loop      // outermost loops, nested loops are in their Loops
+}
+
+// Variable is a context key read by the template and every place it's used
+type Variable struct {
+	Name string
+	Uses []Use
+}
+
+// Use is one place a variable is used
+type Use struct {
+	Kind UsageKind
+	// Path is the chain of keys accessed from the variable, e.g. ["address", "city"] for user.address.city.
+	// An element of an iterated list or map shows up as "[]", so in {{ for item in items }}{{ item['name'] }}
+	// the item's name is used with the path ["[]", "name"] on items.
+	Path []string
+	Pos  lexer.Position
+	// Compared is the literal a COMPARED use is compared with by an equality or ordering operator,
+	// e.g. 18 in {{ age >= 18 }}. It's nil for other comparisons and for anything but literals.
+	Compared *parser.Node
+	// Test is the name of the test a TESTED use goes through, e.g. 'defined'
+	Test string
+	// Boolean is set for a variable that is a whole if or elif condition on its own, the renderer requires it to be a boolean
+	Boolean bool
+	// Optional is set for a key read where the template handles it missing, which evaluates to nil: the left side
+	// of '??', e.g. {{ user.nickname ?? user.name }}, or a condition, e.g. {{ if user.nickname }}
+	Optional bool
+}
+
+// Reference is a name or template used at a position
+type Reference struct {
+	Name string
+	Pos  lexer.Position
+}
+
+// Loop is a for loop and the loops nested in it
+type Loop struct {
+	Var string // loop variable
+	// Source is the path of the iterated variable, e.g. "order.items", or "orders[].items" when the order
+	// is itself a loop variable. It's empty when the loop goes over something else, e.g. a range.
+	Source string
+	Pos    lexer.Position
+	Loops  []Loop
+}
+
+// Paths returns the distinct key paths used on the variable in the order they first appear,
+// formatted like "user.address.city" or "items[].name"
+func (v Variable) Paths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, use := range v.Uses {
+		path := FormatPath(v.Name, use.Path)
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// FormatPath joins a variable name with a key path, e.g. "items[].name"
+func FormatPath(name string, path []string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, key := range path {
+		if key != "[]" {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(key)
+	}
+	return sb.String()
+}
+
+// binding is a name declared by the template. Loop variables over a context variable keep
+// the path they come from, so their uses are reported on it.
+type binding struct {
+	root string // empty when the name isn't derived from a context variable
+	path []string
+}
+
+type analyzer struct {
+	report    *Report
+	variables map[string]*Variable
+	defined   map[string]bool // macros and imported names, they can be called without being functions
+	scopes    []map[string]binding
+	loops     *[]Loop // where loops found now are added
+}
+
+// Analyze reports the variables, functions and templates the template depends on
+func Analyze(nodes []parser.Node) *Report {
+	report := &Report{}
+	a := &analyzer{
+		report:    report,
+		variables: make(map[string]*Variable),
+		defined:   make(map[string]bool),
+		loops:     &report.Loops,
+	}
+	a.collectDefinitions(nodes)
+	a.nodes(nodes)
+
+	for _, variable := range a.variables {
+		report.Variables = append(report.Variables, *variable)
+	}
+	sort.Slice(report.Variables, func(i, j int) bool {
+		return report.Variables[i].Name < report.Variables[j].Name
+	})
+	return report
+}
+
+// collectDefinitions finds the names the template defines anywhere, macros can be called before their definition is reached
+func (a *analyzer) collectDefinitions(nodes []parser.Node) {
+	for _, node := range nodes {
+		switch node.Type {
+		case parser.MACRO_NODE:
+			a.defined[*node.Value] = true
+		case parser.IMPORT_NODE:
+			a.defined[*node.Children[0].Value] = true
+		case parser.IMPORT_NAME:
+			name := *node.Value
+			if len(node.Children) > 0 {
+				name = *node.Children[0].Value
+			}
+			a.defined[name] = true
+			continue
+		}
+		a.collectDefinitions(node.Children)
+	}
+}
+
+func (a *analyzer) nodes(nodes []parser.Node) {
+	for _, node := range nodes {
+		a.node(node)
+	}
+}
+
+// node analyzes a statement or an output tag
+func (a *analyzer) node(node parser.Node) {
+	switch node.Type {
+	case parser.TEXT_NODE:
+
+	case parser.IF_NODE:
+		a.condition(node.Children[0])
+		for _, branch := range node.Children[1:] {
+			switch branch.Type {
+			case parser.ELIF_BRANCH:
+				for _, elif := range branch.Children {
+					a.condition(elif.Children[0])
+					a.nodes(elif.Children[1:])
+				}
+			default:
+				a.nodes(branch.Children)
+			}
+		}
+
+	case parser.FOR_NODE:
+		a.forNode(node)
+
+	case parser.SWITCH_NODE:
+		a.expr(node.Children[0], COMPARED)
+		for _, branch := range node.Children[1:] {
+			if branch.Type == parser.CASE_NODE {
+				a.exprs(branch.Children[0].Children, COMPARED)
+				a.nodes(branch.Children[1].Children)
+			} else {
+				a.nodes(branch.Children)
+			}
+		}
+
+	case parser.MACRO_NODE:
+		scope := map[string]binding{"caller": {}}
+		a.push(scope)
+		for _, param := range node.Children[0].Children {
+			// Defaults can refer to the parameters before them
+			a.exprs(param.Children, ARGUMENT)
+			scope[*param.Value] = binding{}
+		}
+		a.nodes(node.Children[1].Children)
+		a.pop()
+
+	case parser.CALL_BLOCK_NODE:
+		a.expr(node.Children[0], PRINTED)
+		a.push(map[string]binding{"caller": {}})
+		a.nodes(node.Children[1].Children)
+		a.pop()
+
+	case parser.IMPORT_NODE, parser.FROM_IMPORT_NODE:
+		a.report.Templates = append(a.report.Templates, Reference{Name: *node.Value, Pos: node.Pos})
+
+	default:
+		a.expr(node, PRINTED)
+	}
+}
+
+func (a *analyzer) forNode(node parser.Node) {
+	iteratee, iterator := node.Children[0], node.Children[1]
+
+	loop := Loop{Var: *iteratee.Value, Pos: node.Pos}
+	loopVar := binding{}
+	if iterator.Value != nil {
+		iterator = parser.Node{Type: parser.VARIABLE_NODE, Value: iterator.Value, Pos: iterator.Pos}
+	} else {
+		iterator = iterator.Children[0]
+	}
+	if name, path, ok := a.resolve(iterator); ok {
+		loop.Source = FormatPath(name, path)
+		loopVar = binding{root: name, path: append(path[:len(path):len(path)], "[]")}
+	}
+	a.expr(iterator, ITERATED)
+
+	outer := a.loops
+	*outer = append(*outer, loop)
+	a.loops = &(*outer)[len(*outer)-1].Loops
+
+	a.push(map[string]binding{loop.Var: loopVar})
+	a.nodes(node.Children[2].Children)
+	a.pop()
+
+	a.loops = outer
+}
+
+func (a *analyzer) exprs(nodes []parser.Node, kind UsageKind) {
+	for _, node := range nodes {
+		a.expr(node, kind)
+	}
+}
+
+// condition analyzes the condition of an if or elif
+func (a *analyzer) condition(node parser.Node) {
+	a.exprUse(node, Use{Kind: CONDITION, Boolean: node.Type == parser.VARIABLE_NODE})
+}
+
+// expr analyzes an expression whose value is used as kind
+func (a *analyzer) expr(node parser.Node, kind UsageKind) {
+	a.exprUse(node, Use{Kind: kind})
+}
+
+// exprUse analyzes an expression, the variable it is, if any, is used as described by use
+func (a *analyzer) exprUse(node parser.Node, use Use) {
+	kind := use.Kind
+	switch node.Type {
+	case parser.VARIABLE_NODE, parser.OBJECT_ACCESS_NODE:
+		if name, path, ok := a.resolve(node); ok {
+			use.Path, use.Pos = path, node.Pos
+			// Only a missing key is nil, a missing variable fails the render
+			use.Optional = node.Type == parser.OBJECT_ACCESS_NODE && (use.Optional || use.Kind == CONDITION)
+			a.use(name, use)
+			return
+		}
+		// Locals aren't reported, but accesses on other values can still use variables, e.g. [a, b][0]
+		for node.Type == parser.OBJECT_ACCESS_NODE {
+			node = node.Children[0]
+		}
+		if node.Type != parser.VARIABLE_NODE {
+			a.expr(node, kind)
+		}
+
+	case parser.EXPRESSION_NODE:
+		for i, child := range node.Children {
+			if !parser.IsOperator(child.Type) {
+				operandUse := Use{Kind: operandKind(node.Children, i, kind)}
+				operandUse.Optional = i+1 < len(node.Children) && node.Children[i+1].Type == parser.OP_NULL_COALESCE
+				if operandUse.Kind == COMPARED {
+					operandUse.Compared = comparedLiteral(node.Children, i)
+				}
+				a.exprUse(child, operandUse)
+			}
+		}
+
+	case parser.CALL_NODE:
+		callee := node.Children[0]
+		switch {
+		case callee.Type == parser.VARIABLE_NODE && a.lookup(*callee.Value) == nil && !a.defined[*callee.Value]:
+			a.report.Functions = append(a.report.Functions, Reference{Name: *callee.Value, Pos: callee.Pos})
+		case callee.Type == parser.OBJECT_ACCESS_NODE:
+			// Calls on imported templates are macro calls, anything else is a method call
+			if callee.Children[0].Type != parser.VARIABLE_NODE || !a.defined[*callee.Children[0].Value] {
+				a.expr(callee, CALLED)
+			}
+		}
+		for _, arg := range node.Children[1:] {
+			if arg.Type == parser.KEYWORD_ARG {
+				arg = arg.Children[0]
+			}
+			a.expr(arg, ARGUMENT)
+		}
+
+	case parser.TEST_NODE:
+		a.exprUse(node.Children[0], Use{Kind: TESTED, Test: *node.Value})
+
+	case parser.CONDITIONAL_NODE:
+		a.expr(node.Children[0], CONDITION)
+		a.exprs(node.Children[1:], kind)
+
+	case parser.LIST_LITERAL_NODE:
+		a.exprs(node.Children, kind)
+
+	case parser.MAP_LITERAL_NODE:
+		for _, entry := range node.Children {
+			a.exprs(entry.Children, kind)
+		}
+	}
+}
+
+// resolve returns the context variable and key path a variable or a chain of accesses on it refers to,
+// ok is false for locals such as macro parameters and for accesses on anything but a variable
+func (a *analyzer) resolve(node parser.Node) (name string, path []string, ok bool) {
+	var keys []string
+	for node.Type == parser.OBJECT_ACCESS_NODE {
+		keys = append(keys, *node.Children[1].Value)
+		node = node.Children[0]
+	}
+	if node.Type != parser.VARIABLE_NODE {
+		return "", nil, false
+	}
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+
+	name = *node.Value
+	if b := a.lookup(name); b != nil {
+		if b.root == "" {
+			return "", nil, false
+		}
+		return b.root, append(b.path[:len(b.path):len(b.path)], keys...), true
+	}
+	if a.defined[name] {
+		return "", nil, false
+	}
+	return name, keys, true
+}
+
+func (a *analyzer) use(name string, use Use) {
+	variable, exists := a.variables[name]
+	if !exists {
+		variable = &Variable{Name: name}
+		a.variables[name] = variable
+	}
+	variable.Uses = append(variable.Uses, use)
+}
+
+func (a *analyzer) lookup(name string) *binding {
+	for i := len(a.scopes) - 1; i >= 0; i-- {
+		if b, exists := a.scopes[i][name]; exists {
+			return &b
+		}
+	}
+	return nil
+}
+
+func (a *analyzer) push(scope map[string]binding) {
+	a.scopes = append(a.scopes, scope)
+}
+
+func (a *analyzer) pop() {
+	a.scopes = a.scopes[:len(a.scopes)-1]
+}
+
+// comparedLiteral returns the literal the operand at i of a flat expression is compared with by ==, !=, <, >, <= or >=
+func comparedLiteral(nodes []parser.Node, i int) *parser.Node {
+	for _, other := range []struct{ op, operand int }{{i + 1, i + 2}, {i - 1, i - 2}} {
+		if other.operand < 0 || other.operand >= len(nodes) {
+			continue
+		}
+		switch nodes[other.op].Type {
+		case parser.OP_EQUALS, parser.OP_NOT_EQUALS, parser.OP_GT, parser.OP_LT, parser.OP_GTE, parser.OP_LTE:
+		default:
+			continue
+		}
+		switch literal := nodes[other.operand]; literal.Type {
+		case parser.STRING_LITERAL_NODE, parser.NUMBER_LITERAL_NODE, parser.BOOLEAN_LITERAL_NODE, parser.NIL_LITERAL_NODE:
+			return &literal
+		}
+	}
+	return nil
+}
+
+func isComparison(nodeType parser.NodeType) bool {
+	switch nodeType {
+	case parser.OP_EQUALS, parser.OP_NOT_EQUALS, parser.OP_GT, parser.OP_LT, parser.OP_GTE, parser.OP_LTE,
+		parser.OP_IN, parser.OP_NOT_IN, parser.OP_CONTAINS, parser.OP_STARTSWITH, parser.OP_ENDSWITH:
+		return true
+	default:
+		return false
+	}
+}
+
+// operandKind works out how the operand at i of a flat expression is used from the operators around it
+func operandKind(nodes []parser.Node, i int, kind UsageKind) UsageKind {
+	var neighbours []parser.NodeType
+	if i > 0 {
+		neighbours = append(neighbours, nodes[i-1].Type)
+	}
+	if i+1 < len(nodes) {
+		neighbours = append(neighbours, nodes[i+1].Type)
+	}
+
+	result := kind
+	for _, op := range neighbours {
+		switch {
+		case isComparison(op):
+			return COMPARED
+		case op == parser.OP_AND, op == parser.OP_OR, op == parser.OP_BANG:
+			result = CONDITION
+		}
+	}
+	return result
+}
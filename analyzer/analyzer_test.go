@@ -0,0 +1,157 @@
+package analyzer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func analyze(t *testing.T, content string) *Report {
+	t.Helper()
+	tokens, err := lexer.New(content).Tokenize()
+	require.NoError(t, err)
+	ast, err := parser.New(tokens).Parse()
+	require.NoError(t, err)
+	return Analyze(ast)
+}
+
+// usages lists the uses of each variable without their positions, in the 'path:KIND' form
+func usages(report *Report) map[string][]string {
+	result := make(map[string][]string)
+	for _, variable := range report.Variables {
+		for _, use := range variable.Uses {
+			result[variable.Name] = append(result[variable.Name], FormatPath(variable.Name, use.Path)+":"+use.Kind.String())
+		}
+	}
+	return result
+}
+
+func TestAnalyzeVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected map[string][]string
+	}{
+		{
+			name:    "Printed, compared and conditions",
+			content: "{{ name }}{{ if age >= 18 && isAdmin }}{{ user['address'].city }}{{ elif !blocked }}{{ endif }}",
+			expected: map[string][]string{
+				"name":    {"name:PRINTED"},
+				"age":     {"age:COMPARED"},
+				"isAdmin": {"isAdmin:CONDITION"},
+				"user":    {"user.address.city:PRINTED"},
+				"blocked": {"blocked:CONDITION"},
+			},
+		},
+		{
+			name:    "Loop variables are not free and their keys belong to the iterated variable",
+			content: "{{ for order in orders }}{{ order.id }}{{ for line in order['lines'] }}{{ line.sku }}{{ endfor }}{{ endfor }}{{ for i in 1..count }}{{ i }}{{ endfor }}",
+			expected: map[string][]string{
+				"orders": {"orders:ITERATED", "orders[].id:PRINTED", "orders[].lines:ITERATED", "orders[].lines[].sku:PRINTED"},
+				"count":  {"count:ITERATED"},
+			},
+		},
+		{
+			name:    "Switch, tests and conditional expressions",
+			content: "{{ switch status }}{{ case pending }}{{ endswitch }}{{ if email is defined }}{{ endif }}{{ vip ? gold : silver }}{{ nickname ?? name }}",
+			expected: map[string][]string{
+				"status":   {"status:COMPARED"},
+				"pending":  {"pending:COMPARED"},
+				"email":    {"email:TESTED"},
+				"vip":      {"vip:CONDITION"},
+				"gold":     {"gold:PRINTED"},
+				"silver":   {"silver:PRINTED"},
+				"nickname": {"nickname:PRINTED"},
+				"name":     {"name:PRINTED"},
+			},
+		},
+		{
+			name: "Macro parameters and callers are local",
+			content: "{{ macro field(label, type=defaultType) }}{{ label }}{{ type }}{{ caller() }}{{ theme }}{{ endmacro }}" +
+				"{{ call field(title, type='email') }}{{ body }}{{ endcall }}{{ user.FullName() }}{{ 'x' in [tag, 'y'] }}",
+			expected: map[string][]string{
+				"defaultType": {"defaultType:ARGUMENT"},
+				"theme":       {"theme:PRINTED"},
+				"title":       {"title:ARGUMENT"},
+				"body":        {"body:PRINTED"},
+				"user":        {"user.FullName:CALLED"},
+				"tag":         {"tag:COMPARED"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, usages(analyze(t, tt.content)))
+		})
+	}
+}
+
+func TestAnalyzeReport(t *testing.T) {
+	content := "{{ import 'forms.html' as forms }}{{ from 'cards.html' import card as box }}\n" +
+		"{{ for item in items }}\n" +
+		"  {{ for tag in item.tags }}{{ upper(tag) }}{{ forms.input(tag) }}{{ box() }}{{ endfor }}\n" +
+		"{{ endfor }}{{ for i in range(3) }}{{ endfor }}"
+	report := analyze(t, content)
+
+	// pos returns the position of the nth occurrence of s in content
+	pos := func(s string, n int) lexer.Position {
+		offset := -1
+		for range n {
+			offset += strings.Index(content[offset+1:], s) + 1
+		}
+		return lexer.Position{Line: 1, Column: 1}.Advance(content[:offset])
+	}
+
+	require.Equal(t, []Reference{
+		{Name: "forms.html", Pos: pos("{{ import", 1)},
+		{Name: "cards.html", Pos: pos("{{ from", 1)},
+	}, report.Templates)
+
+	require.Equal(t, []Reference{
+		{Name: "upper", Pos: pos("upper", 1)},
+		{Name: "range", Pos: pos("range", 1)},
+	}, report.Functions)
+
+	require.Equal(t, []Loop{
+		{Var: "item", Source: "items", Pos: pos("{{ for", 1), Loops: []Loop{
+			{Var: "tag", Source: "items[].tags", Pos: pos("{{ for", 2)},
+		}},
+		{Var: "i", Pos: pos("{{ for i ", 1)},
+	}, report.Loops)
+
+	require.Len(t, report.Variables, 1)
+	items := report.Variables[0]
+	require.Equal(t, []string{"items", "items[].tags", "items[].tags[]"}, items.Paths())
+	require.Equal(t, pos("items", 1), items.Uses[0].Pos)
+	require.Equal(t, pos("item.tags", 1), items.Uses[1].Pos)
+}
+
+func TestAnalyzeUseDetails(t *testing.T) {
+	report := analyze(t, "{{ if isAdmin }}{{ endif }}{{ if age > 18 && role != 'guest' }}{{ endif }}{{ if email is defined }}{{ endif }}")
+	uses := make(map[string]Use)
+	for _, variable := range report.Variables {
+		uses[variable.Name] = variable.Uses[0]
+	}
+
+	require.True(t, uses["isAdmin"].Boolean)
+	require.False(t, uses["age"].Boolean)
+	require.Equal(t, parser.NUMBER_LITERAL_NODE, uses["age"].Compared.Type)
+	require.Equal(t, "guest", *uses["role"].Compared.Value)
+	require.Nil(t, uses["email"].Compared)
+	require.Equal(t, "defined", uses["email"].Test)
+
+	report = analyze(t, "{{ user.nickname ?? name }}{{ if user.email }}{{ endif }}{{ if flag }}{{ endif }}{{ user.age }}")
+	var optional []string
+	for _, variable := range report.Variables {
+		for _, use := range variable.Uses {
+			if use.Optional {
+				optional = append(optional, FormatPath(variable.Name, use.Path))
+			}
+		}
+	}
+	require.Equal(t, []string{"user.nickname", "user.email"}, optional)
+}
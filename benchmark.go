@@ -24,7 +24,10 @@ type TestCase struct {
 func runBenchmark(template string, context map[string]interface{}) (time.Duration, error) {
 	// Parse template
 	l := lexer.New(template)
-	tokens := l.Tokenize()
+	tokens, err := l.Tokenize()
+	if err != nil {
+		return 0, fmt.Errorf("lex error: %v", err)
+	}
 	p := parser.New(tokens)
 	ast, err := p.Parse()
 	if err != nil {
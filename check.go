@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/lint"
+)
+
+// fileIssue is an issue found by check, as printed in the JSON output
+type fileIssue struct {
+	File    string    `json:"file"`
+	Line    int       `json:"line"`
+	Column  int       `json:"column"`
+	Rule    lint.Rule `json:"rule"`
+	Message string    `json:"message"`
+}
+
+func checkCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "output `format`: text, or json for a list of issues")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: zencefil check [flags] <files or patterns>...\n\n"+
+			"Checks templates for syntax errors, every broken tag in a file is reported, and lint issues. Patterns can use '**' to match any number of directories,\n"+
+			"directories are checked with all the files in them. The exit code is 1 when there are issues.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	patterns, err := parseFlags(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if len(patterns) == 0 {
+		fmt.Fprintf(stderr, "zencefil check: expected files to check\n\n")
+		flags.Usage()
+		return exitUsage
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(stderr, "zencefil check: unknown format '%s', expected text or json\n", *format)
+		return exitUsage
+	}
+
+	files, err := expandPatterns(patterns)
+	if err != nil {
+		fmt.Fprintf(stderr, "zencefil check: %v\n", err)
+		return exitUsage
+	}
+
+	issues := []fileIssue{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(stderr, "zencefil check: %v\n", err)
+			return exitFailure
+		}
+		for _, issue := range lint.Check(string(content)) {
+			issues = append(issues, fileIssue{
+				File:    file,
+				Line:    issue.Pos.Line,
+				Column:  issue.Pos.Column,
+				Rule:    issue.Rule,
+				Message: issue.Message,
+			})
+		}
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(issues)
+	} else {
+		for _, issue := range issues {
+			fmt.Fprintf(stdout, "%s:%d:%d: %s (%s)\n", issue.File, issue.Line, issue.Column, issue.Message, issue.Rule)
+		}
+	}
+
+	if len(issues) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// expandPatterns returns the files matching the patterns, sorted and without duplicates.
+// A pattern matching no files is an error, so a typo doesn't make a check pass.
+func expandPatterns(patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := expandPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match '%s'", pattern)
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+	return slices.Compact(files), nil
+}
+
+func expandPattern(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		info, err := os.Stat(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return []string{pattern}, nil
+		}
+		return walkFiles(pattern, nil)
+	}
+
+	re, err := globRegexp(filepath.ToSlash(pattern))
+	if err != nil {
+		return nil, err
+	}
+	// Walk from the directories before the first wildcard
+	root := "."
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, "*?[") {
+			if i > 0 {
+				root = strings.Join(segments[:i], "/")
+				if root == "" {
+					root = "/"
+				}
+			}
+			break
+		}
+	}
+	return walkFiles(filepath.FromSlash(root), re)
+}
+
+// walkFiles returns the files under root whose path matches re, or all of them when re is nil
+func walkFiles(root string, re *regexp.Regexp) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if re == nil || re.MatchString(filepath.ToSlash(path)) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// globRegexp turns a glob pattern into a regular expression matching whole paths. '*' and '?' don't match '/',
+// '**' matches any number of directories.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.TrimPrefix(pattern, "./")
+	var sb strings.Builder
+	sb.WriteString("^(\\./)?")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated '[' in pattern '%s'", pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
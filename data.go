@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// dataFormats are the formats context can be read from, keyed by file extension
+var dataFormats = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+	".env":  "env",
+}
+
+// loadContext reads the data files in order, later ones overriding the keys of earlier ones, then applies the
+// key=value pairs. A file named '-' is read from stdin, in the given format or as JSON when it's empty.
+func loadContext(files, sets []string, format string, stdin io.Reader) (map[string]interface{}, error) {
+	context := make(map[string]interface{})
+	for _, file := range files {
+		data, err := loadData(file, format, stdin)
+		if err != nil {
+			return nil, err
+		}
+		merge(context, data)
+	}
+	for _, set := range sets {
+		if err := setValue(context, set); err != nil {
+			return nil, err
+		}
+	}
+	return context, nil
+}
+
+func loadData(file, format string, stdin io.Reader) (map[string]interface{}, error) {
+	var content []byte
+	var err error
+	name := file
+	if file == "-" {
+		name = "stdin"
+		content, err = io.ReadAll(stdin)
+		if format == "" {
+			format = "json"
+		}
+	} else {
+		content, err = os.ReadFile(file)
+		if extFormat, known := dataFormats[strings.ToLower(filepath.Ext(file))]; known {
+			format = extFormat
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading data: %w", err)
+	}
+
+	var data map[string]interface{}
+	switch format {
+	case "json":
+		data, err = parseJSON(content)
+	case "yaml":
+		if err = yaml.Unmarshal(content, &data); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	case "toml":
+		data, err = parseTOML(string(content))
+	case "env":
+		data, err = parseEnv(string(content))
+	case "":
+		return nil, fmt.Errorf("%s: unknown data format, use --format to set it", name)
+	default:
+		return nil, fmt.Errorf("unknown data format '%s', expected json, yaml, toml or env", format)
+	}
+	if err != nil {
+		// The other formats start their errors with a position, e.g. 'ctx.json:3:14: ...'
+		return nil, fmt.Errorf("%s:%w", name, err)
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	return data, nil
+}
+
+// parseJSON decodes a JSON object, syntax errors are reported with their line and column
+func parseJSON(content []byte) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	err := json.Unmarshal(content, &data)
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// The offset is just after the byte that couldn't be read
+		return nil, fmt.Errorf("%s: %w", offsetPosition(content, syntaxErr.Offset-1), err)
+	case errors.As(err, &typeErr):
+		return nil, fmt.Errorf("%s: data must be an object, got %s", offsetPosition(content, typeErr.Offset), typeErr.Value)
+	}
+	return data, err
+}
+
+// parseTOML decodes a TOML document, syntax errors are reported with their line and column.
+// Dates and times are read as strings, as they're written in the document.
+func parseTOML(content string) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if _, err := toml.Decode(content, &data); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("%d:%d: %s", parseErr.Position.Line, parseErr.Position.Col, parseErr.Message)
+		}
+		return nil, err
+	}
+	return tomlValue(data).(map[string]interface{}), nil
+}
+
+// tomlValue turns the dates and times of decoded TOML into strings, and arrays of tables into lists
+func tomlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		// Local dates and times are told apart by their location
+		switch v.Location().String() {
+		case "date-local":
+			return v.Format(time.DateOnly)
+		case "time-local":
+			return v.Format("15:04:05.999999999")
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999")
+		}
+		return v.Format(time.RFC3339Nano)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = tomlValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = tomlValue(item)
+		}
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = tomlValue(item)
+		}
+		return items
+	}
+	return value
+}
+
+// offsetPosition turns a byte offset into a 'line:column' position
+func offsetPosition(content []byte, offset int64) string {
+	line, column := 1, 1
+	for _, b := range content[:min(offset, int64(len(content)))] {
+		if b == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return fmt.Sprintf("%d:%d", line, column)
+}
+
+// parseEnv reads KEY=VALUE lines as in .env files. Values can be quoted, double quoted ones support escapes.
+// Lines starting with '#' and an 'export' before the key are ignored.
+func parseEnv(content string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+
+		key, value, found := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("%d: expected KEY=VALUE, got '%s'", line, text)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, fmt.Errorf("%d: unterminated string", line)
+			}
+			value = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(value[1:end])
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("%d: unterminated string", line)
+			}
+			value = value[1 : end+1]
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+		data[key] = value
+	}
+	return data, scanner.Err()
+}
+
+// closingQuote returns the index of the double quote closing the string value starts with, or -1
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// setValue applies a key=value pair, dotted keys such as 'user.name' set keys of nested maps.
+// Values are read as JSON when they are valid JSON, e.g. numbers, booleans and lists, and as strings otherwise.
+func setValue(context map[string]interface{}, set string) error {
+	key, raw, found := strings.Cut(set, "=")
+	if !found || key == "" {
+		return fmt.Errorf("invalid --set '%s', expected key=value", set)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		value = raw
+	}
+
+	keys := strings.Split(key, ".")
+	target := context
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := target[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			target[k] = next
+		}
+		target = next
+	}
+	target[keys[len(keys)-1]] = value
+	return nil
+}
+
+// merge copies the keys of src into dst, maps present in both are merged instead of replaced
+func merge(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			merge(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
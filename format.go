@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/formatter"
+)
+
+// Lines of context around each change in a diff
+const diffContext = 3
+
+func fmtCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	check := flags.Bool("check", false, "don't write files, list the ones that aren't formatted and exit with 1 if there are any")
+	diff := flags.Bool("diff", false, "don't write files, print a unified diff of the changes instead")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: zencefil fmt [flags] <files or patterns>...\n\n"+
+			"Formats templates in place. Patterns can use '**' to match any number of directories,\n"+
+			"directories are formatted with all the files in them. '-' formats stdin and prints the result.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	patterns, err := parseFlags(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if len(patterns) == 0 {
+		fmt.Fprintf(stderr, "zencefil fmt: expected files to format\n\n")
+		flags.Usage()
+		return exitUsage
+	}
+
+	var files []string
+	if len(patterns) == 1 && patterns[0] == "-" {
+		files = patterns
+	} else if files, err = expandPatterns(patterns); err != nil {
+		fmt.Fprintf(stderr, "zencefil fmt: %v\n", err)
+		return exitUsage
+	}
+
+	code := exitOK
+	for _, file := range files {
+		var content []byte
+		if file == "-" {
+			content, err = io.ReadAll(stdin)
+		} else {
+			content, err = os.ReadFile(file)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "zencefil fmt: %v\n", err)
+			code = exitFailure
+			continue
+		}
+
+		formatted, err := formatter.Format(string(content))
+		if err != nil {
+			reportError(stderr, file, err)
+			code = exitFailure
+			continue
+		}
+
+		changed := formatted != string(content)
+		if changed && *check {
+			fmt.Fprintln(stdout, file)
+			code = exitFailure
+		}
+		if changed && *diff {
+			fmt.Fprint(stdout, unifiedDiff(file, string(content), formatted))
+		}
+		switch {
+		case *check || *diff:
+		case file == "-":
+			io.WriteString(stdout, formatted)
+		case changed:
+			if err := os.WriteFile(file, []byte(formatted), 0o644); err != nil {
+				fmt.Fprintf(stderr, "zencefil fmt: %v\n", err)
+				code = exitFailure
+			}
+		}
+	}
+	return code
+}
+
+// unifiedDiff returns the changes from before to after in the unified format, or "" when there are none
+func unifiedDiff(name string, before, after string) string {
+	a, b := splitLines(before), splitLines(after)
+
+	// Only the lines between the common prefix and suffix need to be compared
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if prefix == len(a) && prefix == len(b) {
+		return ""
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of midA[i:] and midB[j:]
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	lcs := make([][]int, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Every line of both sides as kept, removed or added
+	type edit struct {
+		op   byte
+		line string
+	}
+	var edits []edit
+	for _, line := range a[:prefix] {
+		edits = append(edits, edit{' ', line})
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+			edits = append(edits, edit{' ', midA[i]})
+			i++
+			j++
+		case i < len(midA) && (j == len(midB) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', midA[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', midB[j]})
+			j++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, edit{' ', line})
+	}
+
+	// The line each edit is at on both sides
+	lineA, lineB := make([]int, len(edits)), make([]int, len(edits))
+	for k, nextA, nextB := 0, 1, 1; k < len(edits); k++ {
+		lineA[k], lineB[k] = nextA, nextB
+		if edits[k].op != '+' {
+			nextA++
+		}
+		if edits[k].op != '-' {
+			nextB++
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s (formatted)\n", name, name)
+	for start := 0; start < len(edits); start++ {
+		if edits[start].op == ' ' {
+			continue
+		}
+
+		// A hunk goes on until the next change is more than twice the context away
+		end := start
+		for k := start; k < len(edits) && k <= end+2*diffContext; k++ {
+			if edits[k].op != ' ' {
+				end = k
+			}
+		}
+		from, to := max(start-diffContext, 0), min(end+diffContext+1, len(edits))
+		countA, countB := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", lineA[from], countA, lineB[from], countB)
+		for _, e := range edits[from:to] {
+			sb.WriteByte(e.op)
+			sb.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to - 1
+	}
+	return sb.String()
+}
+
+// splitLines splits s after each line break
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
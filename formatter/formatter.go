@@ -0,0 +1,454 @@
+package formatter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// Indent is the indentation added for each block a block tag is nested in
+const Indent = "  "
+
+// Tags starting with these keywords close a block, tags starting with the keys of blockOpeners open one
+var blockClosers = map[string]bool{
+	"endif":     true,
+	"endfor":    true,
+	"endmacro":  true,
+	"endcall":   true,
+	"endswitch": true,
+}
+
+var blockOpeners = map[string]bool{
+	"if":     true,
+	"for":    true,
+	"macro":  true,
+	"call":   true,
+	"switch": true,
+}
+
+// Tags starting with these keywords continue the block they're in, they're indented like its opening tag
+var blockBranches = map[string]bool{
+	"elif":    true,
+	"else":    true,
+	"case":    true,
+	"default": true,
+}
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Format returns the template with its tags written the canonical way, see FormatWithOptions
+func Format(content string) (string, error) {
+	return FormatWithOptions(content, lexer.Options{})
+}
+
+// FormatWithOptions returns the template with every tag reprinted from its node: single spaces inside the delimiters
+// and around binary operators, single quoted strings and no redundant whitespace. Whitespace control markers are kept.
+//
+// Everything outside the tags, text, comments and raw blocks, is copied byte for byte. Block tags starting a line
+// are indented by how deep they're nested, but only when the indentation never reaches the output, that is when the
+// tag starts with '{{-', LstripBlocks is set or it's a line statement. The rendered output never changes.
+func FormatWithOptions(content string, opts lexer.Options) (string, error) {
+	tokens, err := lexer.NewWithOptions(content, opts).Tokenize()
+	if err != nil {
+		return "", err
+	}
+	nodes, err := parser.New(tokens).Parse()
+	if err != nil {
+		return "", err
+	}
+
+	// Tags are found by offset, statements start at their '{{' and output tags at their first token
+	tags := map[int]parser.Node{}
+	indexTags(nodes, tags)
+
+	var sb strings.Builder
+	copied, depth := 0, 0
+	for i := 0; i < len(tokens); i++ {
+		open := tokens[i]
+		if open.Type != lexer.OPEN_CURLY {
+			continue
+		}
+		end := i + 1
+		for end < len(tokens) && tokens[end].Type != lexer.CLOSE_CURLY {
+			end++
+		}
+		if end == len(tokens) || end == i+1 {
+			return "", fmt.Errorf("%s: malformed tag", open.Pos)
+		}
+		closing, first := tokens[end], tokens[i+1]
+
+		var tag string
+		keyword := ""
+		if first.Type == lexer.KEYWORD {
+			keyword = first.Value
+		}
+		switch {
+		case blockClosers[keyword] || keyword == "else" || keyword == "default":
+			tag = keyword
+		case keyword != "":
+			node, ok := tags[open.Pos.Offset]
+			if !ok {
+				return "", fmt.Errorf("%s: no statement found for '%s'", open.Pos, keyword)
+			}
+			tag = statement(node)
+		default:
+			node, ok := tags[first.Pos.Offset]
+			if !ok {
+				return "", fmt.Errorf("%s: no expression found in tag", open.Pos)
+			}
+			tag = Expression(node)
+		}
+
+		// Branches and closing tags line up with the tag opening their block
+		level := depth
+		if blockClosers[keyword] {
+			depth--
+			level = depth
+		} else if blockBranches[keyword] {
+			level = depth - 1
+		} else if blockOpeners[keyword] {
+			depth++
+		}
+
+		text := content[copied:open.Pos.Offset]
+		lineStart := strings.LastIndexByte(text, '\n') + 1
+		startsLine := lineStart > 0 || copied == 0 || content[copied-1] == '\n'
+		isLineStatement := opts.Delimiters.LineStatementPrefix != "" && open.Value == opts.Delimiters.LineStatementPrefix
+		stripped := strings.HasSuffix(open.Value, "-") || isLineStatement || (opts.LstripBlocks && keyword != "")
+		if stripped && startsLine && strings.Trim(text[lineStart:], " \t") == "" {
+			text = text[:lineStart] + strings.Repeat(Indent, max(level, 0))
+		}
+		sb.WriteString(text)
+
+		sb.WriteString(open.Value + " " + tag)
+		if isLineStatement {
+			sb.WriteString(closing.Value)
+		} else {
+			sb.WriteString(" " + closing.Value)
+		}
+		copied = closing.Pos.Offset + len(closing.Value)
+		i = end
+	}
+	sb.WriteString(content[copied:])
+	formatted := sb.String()
+
+	// Formatting must not change what the template does, so the result has to parse to the same nodes
+	reformatted, err := lexer.NewWithOptions(formatted, opts).Tokenize()
+	if err == nil {
+		var reparsed []parser.Node
+		if reparsed, err = parser.New(reformatted).Parse(); err == nil && !Equal(nodes, reparsed) {
+			err = fmt.Errorf("the formatted template differs from the original")
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("formatting failed: %w", err)
+	}
+	return formatted, nil
+}
+
+// indexTags maps the offset each tag is found at to its node
+func indexTags(nodes []parser.Node, tags map[int]parser.Node) {
+	for _, node := range nodes {
+		if node.Type == parser.TEXT_NODE {
+			continue
+		}
+		tags[node.Pos.Offset] = node
+		for _, child := range node.Children {
+			switch child.Type {
+			case parser.THEN_BRANCH, parser.ELSE_BRANCH, parser.FOR_BODY, parser.MACRO_BODY, parser.CALL_BODY, parser.DEFAULT_BRANCH:
+				indexTags(child.Children, tags)
+			case parser.ELIF_BRANCH:
+				for _, item := range child.Children {
+					tags[item.Pos.Offset] = item
+					indexTags(item.Children[1:], tags)
+				}
+			case parser.CASE_NODE:
+				tags[child.Pos.Offset] = child
+				indexTags(child.Children[1].Children, tags)
+			}
+		}
+	}
+}
+
+// Print turns nodes back into template source with the default delimiters. Tags are written like Format writes them,
+// text containing delimiters, which can only come from a raw block, is put back in one.
+func Print(nodes []parser.Node) string {
+	var sb strings.Builder
+	printNodes(&sb, nodes)
+	return sb.String()
+}
+
+func printNodes(sb *strings.Builder, nodes []parser.Node) {
+	for _, node := range nodes {
+		printNode(sb, node)
+	}
+}
+
+func printNode(sb *strings.Builder, node parser.Node) {
+	tag := func(s string) {
+		sb.WriteString("{{ " + s + " }}")
+	}
+
+	switch node.Type {
+	case parser.TEXT_NODE:
+		if strings.Contains(*node.Value, "{{") || strings.Contains(*node.Value, "{#") {
+			sb.WriteString("{{ raw }}" + *node.Value + "{{ endraw }}")
+		} else {
+			sb.WriteString(*node.Value)
+		}
+
+	case parser.IF_NODE:
+		tag(statement(node))
+		for _, child := range node.Children[1:] {
+			switch child.Type {
+			case parser.THEN_BRANCH:
+				printNodes(sb, child.Children)
+			case parser.ELIF_BRANCH:
+				for _, item := range child.Children {
+					tag(statement(item))
+					printNodes(sb, item.Children[1:])
+				}
+			case parser.ELSE_BRANCH:
+				tag("else")
+				printNodes(sb, child.Children)
+			}
+		}
+		tag("endif")
+
+	case parser.FOR_NODE:
+		tag(statement(node))
+		printNodes(sb, node.Children[2].Children)
+		tag("endfor")
+
+	case parser.MACRO_NODE:
+		tag(statement(node))
+		printNodes(sb, node.Children[1].Children)
+		tag("endmacro")
+
+	case parser.CALL_BLOCK_NODE:
+		tag(statement(node))
+		printNodes(sb, node.Children[1].Children)
+		tag("endcall")
+
+	case parser.SWITCH_NODE:
+		tag(statement(node))
+		for _, branch := range node.Children[1:] {
+			if branch.Type == parser.DEFAULT_BRANCH {
+				tag("default")
+				printNodes(sb, branch.Children)
+			} else {
+				tag(statement(branch))
+				printNodes(sb, branch.Children[1].Children)
+			}
+		}
+		tag("endswitch")
+
+	case parser.IMPORT_NODE, parser.FROM_IMPORT_NODE:
+		tag(statement(node))
+
+	default:
+		tag(Expression(node))
+	}
+}
+
+// statement returns what goes inside the opening tag of a statement, e.g. "for item in items"
+func statement(node parser.Node) string {
+	switch node.Type {
+	case parser.IF_NODE:
+		return "if " + Expression(node.Children[0])
+	case parser.ELIF_ITEM:
+		return "elif " + Expression(node.Children[0])
+	case parser.FOR_NODE:
+		iterator := node.Children[1]
+		if len(iterator.Children) > 0 {
+			return "for " + *node.Children[0].Value + " in " + Expression(iterator.Children[0])
+		}
+		return "for " + *node.Children[0].Value + " in " + *iterator.Value
+	case parser.MACRO_NODE:
+		var params []string
+		for _, param := range node.Children[0].Children {
+			if len(param.Children) > 0 {
+				params = append(params, *param.Value+"="+Expression(param.Children[0]))
+			} else {
+				params = append(params, *param.Value)
+			}
+		}
+		return "macro " + *node.Value + "(" + strings.Join(params, ", ") + ")"
+	case parser.CALL_BLOCK_NODE:
+		return "call " + Expression(node.Children[0])
+	case parser.SWITCH_NODE:
+		return "switch " + Expression(node.Children[0])
+	case parser.CASE_NODE:
+		return "case " + expressions(node.Children[0].Children)
+	case parser.IMPORT_NODE:
+		return "import " + quote(*node.Value) + " as " + *node.Children[0].Value
+	case parser.FROM_IMPORT_NODE:
+		var names []string
+		for _, name := range node.Children {
+			if len(name.Children) > 0 {
+				names = append(names, *name.Value+" as "+*name.Children[0].Value)
+			} else {
+				names = append(names, *name.Value)
+			}
+		}
+		return "from " + quote(*node.Value) + " import " + strings.Join(names, ", ")
+	default:
+		return Expression(node)
+	}
+}
+
+// Expression returns the source of an expression node, as written inside a tag or an argument list.
+// Parentheses are only kept where the parser kept them.
+func Expression(node parser.Node) string {
+	if node.Type == parser.EXPRESSION_NODE && len(node.Children) == 1 {
+		return "(" + Expression(node.Children[0]) + ")"
+	}
+	if node.Type == parser.EXPRESSION_NODE && !isNegatedTest(node) {
+		var sb strings.Builder
+		for _, child := range node.Children {
+			switch {
+			case child.Type == parser.OP_BANG:
+				sb.WriteString(*child.Value)
+			case parser.IsOperator(child.Type):
+				sb.WriteString(" " + *child.Value + " ")
+			default:
+				sb.WriteString(operand(child))
+			}
+		}
+		return sb.String()
+	}
+	if node.Type == parser.CONDITIONAL_NODE {
+		return Expression(node.Children[0]) + " ? " + Expression(node.Children[1]) + " : " + Expression(node.Children[2])
+	}
+	return operand(node)
+}
+
+// operand returns the source of a single value of an expression, a nested expression gets parenthesized
+func operand(node parser.Node) string {
+	switch node.Type {
+	case parser.EXPRESSION_NODE:
+		if isNegatedTest(node) {
+			test := node.Children[1]
+			return operand(test.Children[0]) + " is not " + *test.Value
+		}
+		if len(node.Children) == 1 {
+			return Expression(node)
+		}
+		return "(" + Expression(node) + ")"
+	case parser.VARIABLE_NODE, parser.NUMBER_LITERAL_NODE, parser.BOOLEAN_LITERAL_NODE:
+		return *node.Value
+	case parser.NIL_LITERAL_NODE:
+		return "nil"
+	case parser.STRING_LITERAL_NODE:
+		return quote(*node.Value)
+	case parser.LIST_LITERAL_NODE:
+		return "[" + expressions(node.Children) + "]"
+	case parser.MAP_LITERAL_NODE:
+		var entries []string
+		for _, entry := range node.Children {
+			entries = append(entries, Expression(entry.Children[0])+": "+Expression(entry.Children[1]))
+		}
+		return "{" + strings.Join(entries, ", ") + "}"
+	case parser.OBJECT_ACCESS_NODE:
+		key := *node.Children[1].Value
+		switch {
+		case isIdentifier(key):
+			return operand(node.Children[0]) + "." + key
+		case isIndex(key):
+			return operand(node.Children[0]) + "[" + key + "]"
+		default:
+			return operand(node.Children[0]) + "[" + quote(key) + "]"
+		}
+	case parser.CALL_NODE:
+		var args []string
+		for _, arg := range node.Children[1:] {
+			if arg.Type == parser.KEYWORD_ARG {
+				args = append(args, *arg.Value+"="+Expression(arg.Children[0]))
+			} else {
+				args = append(args, Expression(arg))
+			}
+		}
+		return operand(node.Children[0]) + "(" + strings.Join(args, ", ") + ")"
+	case parser.TEST_NODE:
+		return operand(node.Children[0]) + " is " + *node.Value
+	case parser.CONDITIONAL_NODE:
+		// Only found inside parentheses, which are an EXPRESSION_NODE of their own
+		return "(" + Expression(node) + ")"
+	default:
+		if node.Value != nil {
+			return *node.Value
+		}
+		return ""
+	}
+}
+
+func expressions(nodes []parser.Node) string {
+	var items []string
+	for _, node := range nodes {
+		items = append(items, Expression(node))
+	}
+	return strings.Join(items, ", ")
+}
+
+// isNegatedTest reports whether the node is 'x is not test', which the parser turns into '!(x is test)'
+func isNegatedTest(node parser.Node) bool {
+	return node.Type == parser.EXPRESSION_NODE && len(node.Children) == 2 &&
+		node.Children[0].Type == parser.OP_BANG && *node.Children[0].Value == "not" &&
+		node.Children[1].Type == parser.TEST_NODE
+}
+
+// isIdentifier reports whether a key can be written after a '.', keywords and literals can't
+func isIdentifier(key string) bool {
+	if !identifierPattern.MatchString(key) {
+		return false
+	}
+	tokens, err := lexer.New("{{ " + key + " }}").Tokenize()
+	return err == nil && len(tokens) == 3 && tokens[1].Type == lexer.IDENTIFIER
+}
+
+func isIndex(key string) bool {
+	_, err := strconv.Atoi(key)
+	return err == nil && !strings.HasPrefix(key, "+")
+}
+
+// quote writes a string literal in single quotes, escaping what the lexer unescapes
+func quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for _, char := range s {
+		switch char {
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\'':
+			sb.WriteString(`\'`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteRune(char)
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// Equal reports whether two node trees are the same, ignoring positions
+func Equal(a, b []parser.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || (a[i].Value == nil) != (b[i].Value == nil) ||
+			(a[i].Value != nil && *a[i].Value != *b[i].Value) || !Equal(a[i].Children, b[i].Children) {
+			return false
+		}
+	}
+	return true
+}
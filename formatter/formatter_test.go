@@ -0,0 +1,137 @@
+package formatter
+
+import (
+	"testing"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		opts     lexer.Options
+		expected string
+	}{
+		{
+			name:     "Tag spacing",
+			content:  "Hello {{name}}, {{   user.email   }}!",
+			expected: "Hello {{ name }}, {{ user.email }}!",
+		},
+		{
+			name:     "Operator spacing and quotes",
+			content:  `{{ if a&&b||!c }}{{ x??"n/a" }}{{ endif }}{{ (a>1)&&b }}{{ 1..3 }}`,
+			expected: `{{ if a && b || !c }}{{ x ?? 'n/a' }}{{ endif }}{{ (a > 1) && b }}{{ 1 .. 3 }}`,
+		},
+		{
+			name:     "Escaped strings",
+			content:  `{{ "it's \"quoted\"\n" }}`,
+			expected: `{{ 'it\'s "quoted"\n' }}`,
+		},
+		{
+			name:     "Calls, accesses and literals",
+			content:  `{{ greet( user["name"],items[0],title = "Dr" ) }}{{ {"a":[1,2,],b : nil} }}{{ m["a-b"] }}`,
+			expected: `{{ greet(user.name, items[0], title='Dr') }}{{ {'a': [1, 2], b: nil} }}{{ m['a-b'] }}`,
+		},
+		{
+			name:     "Tests and conditionals",
+			content:  `{{ x is not even }}{{ 'Yes' if ok else 'No' }}{{ a?b:c }}{{ (a ? b : c).d }}`,
+			expected: `{{ x is not even }}{{ ok ? 'Yes' : 'No' }}{{ a ? b : c }}{{ (a ? b : c).d }}`,
+		},
+		{
+			name:     "Statements",
+			content:  "{{import 'f.html' as f}}{{ from \"f.html\" import a,b as c }}{{macro m(x,y = 1)}}{{x}}{{endmacro}}{{call m( 1 )}}-{{endcall}}{{ switch s }}{{case 'a','b'}}A{{default}}D{{endswitch}}",
+			expected: "{{ import 'f.html' as f }}{{ from 'f.html' import a, b as c }}{{ macro m(x, y=1) }}{{ x }}{{ endmacro }}{{ call m(1) }}-{{ endcall }}{{ switch s }}{{ case 'a', 'b' }}A{{ default }}D{{ endswitch }}",
+		},
+		{
+			name:     "Text, comments and raw blocks are kept",
+			content:  "  {#  note  #}\n  {{raw}}{{ x }}{{endraw}}  \n\t{{ if x }}\n    {{x}}\n{{ endif }}",
+			expected: "  {#  note  #}\n  {{raw}}{{ x }}{{endraw}}  \n\t{{ if x }}\n    {{ x }}\n{{ endif }}",
+		},
+		{
+			name:     "Indentation where it's trimmed",
+			content:  "{{- for item in items }}\n{{- if item }}\n      {{- item }}\n{{- elif x }}\n-\n        {{- else }}\n-\n{{- endif }}\n{{- endfor }}",
+			expected: "{{- for item in items }}\n  {{- if item }}\n    {{- item }}\n  {{- elif x }}\n-\n  {{- else }}\n-\n  {{- endif }}\n{{- endfor }}",
+		},
+		{
+			name:     "Output tags indented where they're trimmed",
+			content:  "{{- for i in xs }}\n{{- i }}\n  {{ i }}\n{{- endfor }}",
+			expected: "{{- for i in xs }}\n  {{- i }}\n  {{ i }}\n{{- endfor }}",
+		},
+		{
+			name:     "Indentation with LstripBlocks",
+			content:  "{{ for x in xs }}\n{{ switch x }}\n{{ case 1 }}\none\n      {{ default }}\nother\n{{ endswitch }}\n{{ endfor }}\n",
+			opts:     lexer.Options{LstripBlocks: true},
+			expected: "{{ for x in xs }}\n  {{ switch x }}\n  {{ case 1 }}\none\n  {{ default }}\nother\n  {{ endswitch }}\n{{ endfor }}\n",
+		},
+		{
+			name:     "Whitespace control and custom delimiters",
+			content:  "<%-if x-%>\n<<x>>\n<%endif%>",
+			opts:     lexer.Options{Delimiters: lexer.Delimiters{BlockStart: "<%", BlockEnd: "%>", VariableStart: "<<", VariableEnd: ">>"}},
+			expected: "<%- if x -%>\n<< x >>\n<% endif %>",
+		},
+		{
+			name:     "Line statements",
+			content:  "%% for x in xs\n      %%   if x\n{{x}}\n%%endif\n%% endfor\n",
+			opts:     lexer.Options{Delimiters: lexer.Delimiters{LineStatementPrefix: "%%"}},
+			expected: "%% for x in xs\n  %% if x\n{{ x }}\n  %% endif\n%% endfor\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatted, err := FormatWithOptions(tt.content, tt.opts)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, formatted)
+
+			again, err := FormatWithOptions(formatted, tt.opts)
+			require.NoError(t, err)
+			require.Equal(t, formatted, again, "formatting should be idempotent")
+		})
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	_, err := Format("{{ 'x }}")
+	var lexErrors lexer.ErrorList
+	require.ErrorAs(t, err, &lexErrors)
+
+	_, err = Format("{{ if x }}")
+	var parseErr *parser.Error
+	require.ErrorAs(t, err, &parseErr)
+}
+
+func TestPrint(t *testing.T) {
+	templates := []string{
+		"Hello {{ name }}!",
+		"{{ if a && !b }}A{{ elif (c || d) && e }}B{{ else }}C{{ endif }}",
+		"{{ for item in items }}{{ item[0] }}{{ item['a b'] }}{{ endfor }}",
+		"{{ for i in 1 .. 3 }}{{ i is odd ? 'odd' : 'even' }}{{ endfor }}",
+		"{{ macro m(x, y='a') }}{{ x }}{{ caller() }}{{ endmacro }}{{ call m(1, y=2) }}body{{ endcall }}",
+		"{{ switch s }}{{ case 1, 2 }}low{{ default }}high{{ endswitch }}",
+		"{{ from 'f.html' import a as b }}{{ import 'g.html' as g }}{{ g.x(a.b.c, [1, {'k': nil}]) }}",
+		"{{ x is not even && (y is defined) }}",
+		"{{ a ? b ? c : d : e ? f : g }}{{ (a ? b : c) ?? d }}",
+		"{{ raw }}{{ not a tag }}{{ endraw }}",
+	}
+
+	for _, template := range templates {
+		t.Run(template, func(t *testing.T) {
+			nodes := parse(t, template)
+			printed := Print(nodes)
+			require.True(t, Equal(nodes, parse(t, printed)), "printed as %q", printed)
+		})
+	}
+
+	require.Equal(t, "{{ if x }}{{ x.name }}{{ else }}-{{ endif }}", Print(parse(t, `{{if x}}{{x["name"]}}{{else}}-{{endif}}`)))
+}
+
+func parse(t *testing.T, content string) []parser.Node {
+	tokens, err := lexer.New(content).Tokenize()
+	require.NoError(t, err)
+	nodes, err := parser.New(tokens).Parse()
+	require.NoError(t, err)
+	return nodes
+}
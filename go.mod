@@ -3,15 +3,16 @@ module github.com/ogzhanolguncu/zencefil
 go 1.23.1
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/fatih/color v1.17.0
+	github.com/mattn/go-isatty v0.0.20
 	github.com/stretchr/testify v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,19 +1,73 @@
 package lexer
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"iter"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 var keywords = map[string]bool{
-	"if":     true,
-	"elif":   true,
-	"else":   true,
-	"for":    true,
-	"in":     true,
-	"endif":  true,
-	"endfor": true,
+	"if":         true,
+	"elif":       true,
+	"else":       true,
+	"for":        true,
+	"in":         true,
+	"endif":      true,
+	"endfor":     true,
+	"macro":      true,
+	"endmacro":   true,
+	"call":       true,
+	"endcall":    true,
+	"import":     true,
+	"from":       true,
+	"as":         true,
+	"not":        true,
+	"is":         true,
+	"contains":   true,
+	"startswith": true,
+	"endswith":   true,
+	"switch":     true,
+	"case":       true,
+	"default":    true,
+	"endswitch":  true,
+}
+
+// Keywords returns the reserved words of the template language, sorted
+func Keywords() []string {
+	names := make([]string, 0, len(keywords))
+	for keyword := range keywords {
+		names = append(names, keyword)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Tags starting with these keywords are affected by the TrimBlocks and LstripBlocks options
+var blockKeywords = map[string]bool{
+	"if":        true,
+	"elif":      true,
+	"else":      true,
+	"endif":     true,
+	"for":       true,
+	"endfor":    true,
+	"raw":       true,
+	"macro":     true,
+	"endmacro":  true,
+	"call":      true,
+	"endcall":   true,
+	"import":    true,
+	"from":      true,
+	"switch":    true,
+	"case":      true,
+	"default":   true,
+	"endswitch": true,
 }
 
 var Operators = map[string]TokenType{
@@ -31,6 +85,14 @@ var Operators = map[string]TokenType{
 	")":  RPAREN,
 	"[":  OPEN_BRACKET,
 	"]":  CLOSE_BRACKET,
+	",":  COMMA,
+	"=":  ASSIGN,
+	".":  DOT,
+	"..": RANGE,
+	"{":  LBRACE,
+	"}":  RBRACE,
+	":":  COLON,
+	"?":  QUESTION,
 }
 
 type ReadMode int
@@ -64,6 +126,18 @@ const (
 	CLOSE_BRACKET
 	BANG
 	NULL_COALESCE
+	ILLEGAL
+	EOF
+	COMMA
+	ASSIGN
+	DOT
+	RANGE
+	LBRACE
+	RBRACE
+	COLON
+	BOOLEAN
+	NIL
+	QUESTION
 )
 
 func (tt TokenType) String() string {
@@ -89,178 +163,909 @@ func (tt TokenType) String() string {
 		"CLOSE_BRACKET",
 		"BANG",
 		"NULL_COALESCE",
+		"ILLEGAL",
+		"EOF",
+		"COMMA",
+		"ASSIGN",
+		"DOT",
+		"RANGE",
+		"LBRACE",
+		"RBRACE",
+		"COLON",
+		"BOOLEAN",
+		"NIL",
+		"QUESTION",
 	}[tt]
 }
 
+// Position describes a location in the template source.
+type Position struct {
+	Offset int `json:"offset"` // byte offset, starting at 0
+	Line   int `json:"line"`   // line number, starting at 1
+	Column int `json:"column"` // byte offset within the line, starting at 1
+}
+
+// Advance returns the position after text, assuming text starts at p.
+func (p Position) Advance(text string) Position {
+	for i := 0; i < len(text); i++ {
+		p.Offset++
+		p.Column++
+		if text[i] == '\n' {
+			p.Line++
+			p.Column = 1
+		}
+	}
+	return p
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
 type Token struct {
 	Value string
 	Type  TokenType
+	Pos   Position
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("%q at %s", t.Value, t.Pos)
+}
+
+// Error is a problem found while lexing, e.g. an unterminated string.
+type Error struct {
+	Pos     Position
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+}
+
+// ErrorList is returned by Tokenize when the template has one or more lexing errors.
+type ErrorList []*Error
+
+func (el ErrorList) Error() string {
+	messages := make([]string, len(el))
+	for i, err := range el {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Delimiters configures the character sequences that open and close tags.
+// Empty fields fall back to the defaults, '{{ }}' for blocks and variables and '{# #}' for comments.
+type Delimiters struct {
+	BlockStart    string
+	BlockEnd      string
+	VariableStart string
+	VariableEnd   string
+	CommentStart  string
+	CommentEnd    string
+	// LineStatementPrefix turns a line starting with it into a block tag, e.g. '%% for x in xs'. Disabled when empty.
+	LineStatementPrefix string
+}
+
+var DefaultDelimiters = Delimiters{
+	BlockStart:    "{{",
+	BlockEnd:      "}}",
+	VariableStart: "{{",
+	VariableEnd:   "}}",
+	CommentStart:  "{#",
+	CommentEnd:    "#}",
+}
+
+// Options controls the tag syntax and how whitespace around tags is handled.
+type Options struct {
+	Delimiters Delimiters
+	// TrimBlocks removes the first newline after a block tag, e.g. '{{ if x }}' or '{{ endfor }}'.
+	TrimBlocks bool
+	// LstripBlocks removes spaces and tabs from the start of a line up to a block tag.
+	LstripBlocks bool
 }
 
 type Lexer struct {
-	rawText string
-	Tokens  []Token
-	crrPos  int
-	mode    ReadMode
+	Tokens     []Token
+	src        io.Reader
+	buf        []byte // input read so far that may still be needed, buf[0] is at offset bufStart
+	bufStart   int
+	readErr    error
+	mark       int // offset buf must keep, -1 when nothing has to be kept
+	crrPos     int
+	prev       byte // byte before crrPos
+	line       int  // line of crrPos
+	lineOffset int  // offset where the line of crrPos starts
+	mode       ReadMode
+	opts       Options
+	queue      []Token // tokens lexed but not handed out by NextToken yet, starting at queue[queueHead]
+	queueHead  int
+	done       bool
+	sb         strings.Builder // pending text or word
+	errors     ErrorList
+	tagStart   Position  // where the tag being lexed starts
+	tagEnd     string    // closing delimiter of the tag being lexed
+	blockTag   bool      // whether the tag being lexed is a block tag
+	braceDepth int       // open '{' in the tag being lexed, a '}' closes them before it can close the tag
+	lineStart  bool      // whether the pending text starts at the beginning of a line
+	textStart  Position  // where the pending text or word starts
+	textStop   [256]bool // bytes that can start a tag or comment
 }
 
 func New(content string) *Lexer {
-	return &Lexer{
-		crrPos:  0,
-		Tokens:  nil,
-		rawText: content,
-		mode:    TextMode,
+	return NewWithOptions(content, Options{})
+}
+
+func NewWithOptions(content string, opts Options) *Lexer {
+	return NewReader(strings.NewReader(content), opts)
+}
+
+// NewReader creates a lexer that reads the template from r as tokens are requested,
+// so only a small window of the input is held in memory.
+func NewReader(r io.Reader, opts Options) *Lexer {
+	opts.Delimiters = opts.Delimiters.withDefaults()
+	l := &Lexer{
+		src:       r,
+		mark:      -1,
+		crrPos:    0,
+		prev:      '\n',
+		line:      1,
+		Tokens:    nil,
+		mode:      TextMode,
+		opts:      opts,
+		lineStart: true,
 	}
+	// Bytes that may start something other than plain text
+	for _, delimiter := range []string{opts.Delimiters.BlockStart, opts.Delimiters.VariableStart, opts.Delimiters.CommentStart} {
+		l.textStop[delimiter[0]] = true
+	}
+	return l
 }
 
-func (l *Lexer) Tokenize() []Token {
-	var sb strings.Builder
-	for {
-		char, ok := l.advance()
-		if !ok {
-			break
+func (d Delimiters) withDefaults() Delimiters {
+	defaults := []struct {
+		field    *string
+		fallback string
+	}{
+		{&d.BlockStart, DefaultDelimiters.BlockStart},
+		{&d.BlockEnd, DefaultDelimiters.BlockEnd},
+		{&d.VariableStart, DefaultDelimiters.VariableStart},
+		{&d.VariableEnd, DefaultDelimiters.VariableEnd},
+		{&d.CommentStart, DefaultDelimiters.CommentStart},
+		{&d.CommentEnd, DefaultDelimiters.CommentEnd},
+	}
+	for _, def := range defaults {
+		if *def.field == "" {
+			*def.field = def.fallback
 		}
+	}
+	return d
+}
 
-		switch l.mode {
-		case TextMode:
-			peek, _ := l.peek()
-			if char == '{' && peek == '{' {
-				if sb.Len() > 0 {
-					text := sb.String()
-					l.Tokens = append(l.Tokens, Token{Value: text, Type: TEXT})
-					sb.Reset()
-				}
-				l.advance() // consume the second '{'
-				l.Tokens = append(l.Tokens, Token{Value: "{{", Type: OPEN_CURLY})
-				l.mode = TagMode
-			} else {
-				sb.WriteRune(char)
+// Tokenize lexes the whole template. Problems don't stop lexing: they are reported as ILLEGAL tokens
+// and the returned error is an ErrorList holding every one of them.
+func (l *Lexer) Tokenize() ([]Token, error) {
+	for token := range l.All() {
+		l.Tokens = append(l.Tokens, token)
+	}
+
+	if len(l.errors) > 0 {
+		return l.Tokens, l.errors
+	}
+	return l.Tokens, nil
+}
+
+// NextToken lexes just enough of the input to return the next token. Once the input is exhausted it keeps returning an EOF token.
+func (l *Lexer) NextToken() Token {
+	for l.queueHead == len(l.queue) {
+		if l.done {
+			return Token{Type: EOF, Pos: l.pos()}
+		}
+		l.queue, l.queueHead = l.queue[:0], 0
+		l.step()
+	}
+	token := l.queue[l.queueHead]
+	l.queueHead++
+	return token
+}
+
+// All returns an iterator over the remaining tokens, not including EOF.
+func (l *Lexer) All() iter.Seq[Token] {
+	return func(yield func(Token) bool) {
+		for {
+			token := l.NextToken()
+			if token.Type == EOF || !yield(token) {
+				return
 			}
+		}
+	}
+}
+
+// Errors returns the problems found so far.
+func (l *Lexer) Errors() ErrorList {
+	return l.errors
+}
 
+// step lexes the next piece of input, which emits zero or more tokens.
+func (l *Lexer) step() {
+	if !l.atEOF() {
+		switch l.mode {
+		case TextMode:
+			l.lexText()
 		case TagMode:
-			if char == '\'' {
-				// Start of a string literal
-				sb.WriteRune(char)
-				for {
-					innerChar, ok := l.advance()
-					if !ok {
-						break
-					}
-					sb.WriteRune(innerChar)
-					if innerChar == '\'' {
-						// End of string literal found
-						str := sb.String()
-						content := strings.Trim(str, "'") // Remove surrounding quotes
-						l.Tokens = append(l.Tokens, Token{Value: content, Type: STRING})
-						sb.Reset()
-						break
-					}
-				}
-				continue
+			l.lexTag()
+		}
+		return
+	}
+
+	// Handle any remaining text
+	if l.sb.Len() > 0 {
+		if l.mode == TextMode {
+			l.emit(TEXT, l.sb.String(), l.textStart)
+		} else {
+			l.addToken(l.sb.String())
+		}
+		l.sb.Reset()
+	}
+	if l.mode == TagMode {
+		if l.tagEnd == "\n" {
+			// A line statement on the last line is closed by the end of the template
+			l.emit(CLOSE_CURLY, "", l.pos())
+		} else {
+			l.errorf(l.tagStart, "unclosed tag, expected '%s'", l.tagEnd)
+		}
+	}
+	if l.readErr != io.EOF {
+		l.errorf(l.pos(), "read error: %v", l.readErr)
+	}
+	l.done = true
+}
+
+func (l *Lexer) lexText() {
+	d := l.opts.Delimiters
+
+	if d.LineStatementPrefix != "" && l.prev == '\n' {
+		indent := 0
+		for l.fill(indent+1) && (l.rest()[indent] == ' ' || l.rest()[indent] == '\t') {
+			indent++
+		}
+		l.fill(indent + len(d.LineStatementPrefix))
+		if rest := l.rest(); len(rest) >= indent+len(d.LineStatementPrefix) && string(rest[indent:indent+len(d.LineStatementPrefix)]) == d.LineStatementPrefix {
+			// The indentation before a line statement never reaches the output
+			l.skip(indent)
+			l.tagStart = l.pos()
+			l.skip(len(d.LineStatementPrefix))
+			l.blockTag = true
+			l.flushText(false)
+			l.emit(OPEN_CURLY, d.LineStatementPrefix, l.tagStart)
+			l.tagEnd = "\n"
+			l.braceDepth = 0
+			l.mode = TagMode
+			return
+		}
+	}
+
+	start, end, isBlock := l.matchOpening()
+	switch {
+	case start == d.CommentStart:
+		// Comments never reach the parser, so text on both sides of them joins into one token
+		l.skipComment()
+	case isBlock && l.readRawBlock():
+		// The raw block content has already been emitted as text
+	case start != "":
+		l.tagStart = l.pos()
+		l.skip(len(start))
+		openTag := start
+		trimLeft := false
+		if l.hasPrefix("-") {
+			l.skip(1)
+			openTag += "-"
+			trimLeft = true
+		}
+		// When blocks and variables share delimiters only the keyword tells them apart
+		l.blockTag = isBlock && (d.BlockStart != d.VariableStart || blockKeywords[l.peekWord()])
+		l.flushText(trimLeft)
+		l.emit(OPEN_CURLY, openTag, l.tagStart)
+		l.tagEnd = end
+		l.braceDepth = 0
+		l.mode = TagMode
+	default:
+		// Text is copied byte for byte, even if it isn't valid UTF-8
+		if l.sb.Len() == 0 {
+			l.textStart = l.pos()
+		}
+		rest := l.rest()
+		n := 1
+		// Stop after a line break when a line statement might follow it
+		for n < len(rest) && !l.textStop[rest[n]] && !(d.LineStatementPrefix != "" && rest[n-1] == '\n') {
+			n++
+		}
+		l.sb.Write(rest[:n])
+		l.skip(n)
+	}
+}
+
+// matchOpening returns the longest opening delimiter at the current position along with its closing delimiter.
+func (l *Lexer) matchOpening() (start, end string, isBlock bool) {
+	d := l.opts.Delimiters
+	candidates := []struct {
+		start, end string
+		isBlock    bool
+	}{
+		{d.BlockStart, d.BlockEnd, true},
+		{d.VariableStart, d.VariableEnd, false},
+		{d.CommentStart, d.CommentEnd, false},
+	}
+	for _, c := range candidates {
+		if len(c.start) > len(start) && l.hasPrefix(c.start) {
+			start, end, isBlock = c.start, c.end, c.isBlock
+		}
+	}
+	return start, end, isBlock
+}
+
+func (l *Lexer) lexTag() {
+	if l.braceDepth > 0 && l.hasPrefix("}") {
+		l.flushWord()
+		l.emit(RBRACE, "}", l.pos())
+		l.skip(1)
+		l.braceDepth--
+		return
+	}
+
+	if l.tagEnd == "\n" {
+		if newline := l.newlineLength(); newline > 0 {
+			l.closeTag(string(l.rest()[:newline]), newline, false)
+			return
+		}
+	} else if l.hasPrefix("-") && l.hasPrefix("-"+l.tagEnd) {
+		l.closeTag("-"+l.tagEnd, len(l.tagEnd)+1, true)
+		return
+	} else if l.hasPrefix(l.tagEnd) {
+		l.closeTag(l.tagEnd, len(l.tagEnd), false)
+		return
+	}
+
+	pos := l.pos()
+	char, _ := l.advance()
+	if char == '\'' || char == '"' {
+		l.flushWord()
+		l.lexString(char, pos)
+		return
+	}
+
+	if unicode.IsSpace(char) {
+		l.flushWord()
+		return
+	}
+
+	// A '.' followed by a digit is a decimal point, anywhere else it accesses an attribute
+	peek, hasPeek := l.peek()
+	if char == '.' && hasPeek && unicode.IsDigit(peek) && (l.sb.Len() == 0 || startsLikeNumber(l.sb.String())) {
+		if l.sb.Len() == 0 {
+			l.textStart = pos
+		}
+		l.sb.WriteRune(char)
+		return
+	}
+
+	// Check for two-character operators
+	currentChar := string(char)
+	if hasPeek {
+		potentialOp := currentChar + string(peek)
+		if tokenType, exists := Operators[potentialOp]; exists {
+			l.flushWord()
+			l.advance() // consume the second character
+			l.emit(tokenType, potentialOp, pos)
+			return
+		}
+	}
+
+	// Check for single-character operators, e.g '!', '>','<'
+	if tokenType, exists := Operators[currentChar]; exists {
+		l.flushWord()
+		l.emit(tokenType, currentChar, pos)
+		if tokenType == LBRACE {
+			l.braceDepth++
+		}
+		return
+	}
+
+	if !isWordChar(char) {
+		l.flushWord()
+		l.emit(ILLEGAL, currentChar, pos)
+		l.errorf(pos, "unexpected character %q", char)
+		return
+	}
+
+	if l.sb.Len() == 0 {
+		l.textStart = pos
+	}
+	l.sb.WriteRune(char)
+}
+
+// flushWord emits the word collected so far inside a tag, if any.
+func (l *Lexer) flushWord() {
+	if l.sb.Len() > 0 {
+		l.addToken(l.sb.String())
+		l.sb.Reset()
+	}
+}
+
+// Identifiers and numbers are made of these characters
+func isWordChar(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsDigit(char) || strings.ContainsRune("_@$-+", char)
+}
+
+// lexString reads a string literal whose opening quote is already consumed and emits it with escape sequences resolved.
+// Strings can't span lines, so an unterminated string ends at the line break and is emitted as an ILLEGAL token.
+func (l *Lexer) lexString(quote rune, pos Position) {
+	// Keep the literal's source around for ILLEGAL tokens and for backing up
+	l.mark = pos.Offset
+	defer func() { l.mark = -1 }()
+
+	var sb strings.Builder
+	var escapeErr *Error
+	for {
+		char, ok := l.peek()
+		if !ok || char == '\n' {
+			// Most likely the quote was never meant to be closed, so let the tag end where it would without it
+			if end := strings.Index(l.source(pos.Offset), l.tagEnd); end != -1 && l.tagEnd != "\n" {
+				l.rewind(pos.Offset + end)
 			}
+			l.emit(ILLEGAL, l.source(pos.Offset), pos)
+			l.errorf(pos, "unterminated string")
+			return
+		}
+		escapePos := l.pos()
+		l.advance()
 
-			if unicode.IsSpace(char) {
-				if sb.Len() > 0 {
-					l.addToken(sb.String())
-					sb.Reset()
-				}
-				continue
+		switch char {
+		case quote:
+			if escapeErr != nil {
+				l.emit(ILLEGAL, l.source(pos.Offset), pos)
+				l.errors = append(l.errors, escapeErr)
+				return
 			}
-			if char == '}' {
-				peek, _ := l.peek()
-				if peek == '}' {
-					if sb.Len() > 0 {
-						l.addToken(sb.String())
-						sb.Reset()
-					}
-					l.advance() // consume the second '}'
-					l.Tokens = append(l.Tokens, Token{Value: "}}", Type: CLOSE_CURLY})
-					l.mode = TextMode
-					continue
-				}
+			l.emit(STRING, sb.String(), pos)
+			return
+		case '\\':
+			if r, ok := l.readEscape(); ok {
+				sb.WriteRune(r)
+			} else if escapeErr == nil {
+				escapeErr = &Error{Pos: escapePos, Message: fmt.Sprintf("invalid escape sequence %q", l.source(escapePos.Offset))}
 			}
+		default:
+			sb.WriteRune(char)
+		}
+	}
+}
 
-			// Check for two-character operators
-			currentChar := string(char)
-			peek, hasPeek := l.peek()
-			if hasPeek {
-				potentialOp := currentChar + string(peek)
-				if tokenType, exists := Operators[potentialOp]; exists {
-					if sb.Len() > 0 {
-						l.addToken(sb.String())
-						sb.Reset()
-					}
-					l.advance() // consume the second character
-					l.Tokens = append(l.Tokens, Token{Value: potentialOp, Type: tokenType})
-					continue
-				}
-			}
+var escapes = map[rune]rune{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
+}
 
-			// Check for single-character operators, e.g '!', '>','<'
-			if tokenType, exists := Operators[currentChar]; exists {
-				if sb.Len() > 0 {
-					l.addToken(sb.String())
-					sb.Reset()
-				}
-				l.Tokens = append(l.Tokens, Token{Value: currentChar, Type: tokenType})
-				continue
+// readEscape reads the escape sequence after a backslash inside a string literal.
+func (l *Lexer) readEscape() (rune, bool) {
+	char, ok := l.peek()
+	if !ok || char == '\n' {
+		return 0, false
+	}
+	l.advance()
+	if r, exists := escapes[char]; exists {
+		return r, true
+	}
+	if char != 'u' {
+		return 0, false
+	}
+
+	r, ok := l.readHex4()
+	if !ok {
+		return 0, false
+	}
+	// Characters outside the BMP are written as UTF-16 surrogate pairs, e.g. '\uD83D\uDE00'
+	if utf16.IsSurrogate(r) {
+		if !l.hasPrefix("\\u") {
+			return 0, false
+		}
+		l.skip(len("\\u"))
+		low, ok := l.readHex4()
+		if !ok {
+			return 0, false
+		}
+		r = utf16.DecodeRune(r, low)
+		if r == utf8.RuneError {
+			return 0, false
+		}
+	}
+	return r, true
+}
+
+func (l *Lexer) readHex4() (rune, bool) {
+	if !l.fill(4) {
+		return 0, false
+	}
+	code, err := strconv.ParseUint(string(l.rest()[:4]), 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	l.skip(4)
+	return rune(code), true
+}
+
+// closeTag consumes the closing delimiter of width bytes and switches back to text, applying whitespace control.
+func (l *Lexer) closeTag(value string, width int, trimRight bool) {
+	l.flushWord()
+	l.emit(CLOSE_CURLY, value, l.pos())
+	l.skip(width)
+	l.mode = TextMode
+	if trimRight {
+		l.skipWhitespace()
+	} else if l.blockTag && l.opts.TrimBlocks && l.tagEnd != "\n" {
+		l.skip(l.newlineLength())
+	}
+	l.lineStart = l.prev == '\n'
+}
+
+// skipComment consumes the whole comment starting at the current position.
+func (l *Lexer) skipComment() {
+	d := l.opts.Delimiters
+	start := l.pos()
+	l.skip(len(d.CommentStart))
+	if !l.skipPast(d.CommentEnd, nil) {
+		l.errorf(start, "unclosed comment, expected '%s'", d.CommentEnd)
+	}
+}
+
+// skipPast consumes input up to and including the first occurrence of s, copying what comes before s into sb unless it is nil.
+// It returns false if the input ends without s.
+func (l *Lexer) skipPast(s string, sb *strings.Builder) bool {
+	for {
+		l.fill(len(s))
+		rest := l.rest()
+		if i := bytes.Index(rest, []byte(s)); i != -1 {
+			if sb != nil {
+				sb.Write(rest[:i])
+			}
+			l.skip(i + len(s))
+			return true
+		}
+		if l.readErr != nil {
+			if sb != nil {
+				sb.Write(rest)
 			}
+			l.skip(len(rest))
+			return false
+		}
+		// Keep a possible partial match and read more
+		n := max(len(rest)-len(s)+1, 0)
+		if sb != nil {
+			sb.Write(rest[:n])
+		}
+		l.skip(n)
+		l.fill(len(l.rest()) + 1)
+	}
+}
 
-			sb.WriteRune(char)
+// readRawBlock checks whether the tag at the current position is '{{ raw }}'.
+// If so, it flushes the pending text, consumes the whole block and emits its content untouched up to '{{ endraw }}'.
+func (l *Lexer) readRawBlock() bool {
+	open := l.matchTag("raw")
+	if open.length == 0 {
+		return false
+	}
+	d := l.opts.Delimiters
+	l.blockTag = true
+	l.flushText(open.trimLeft)
+	openPos := l.pos()
+	l.skip(open.length)
+
+	contentPos := l.pos()
+	var sb strings.Builder
+	var end tag
+	for {
+		if !l.skipPast(d.BlockStart, &sb) {
+			l.errorf(openPos, "unclosed raw block, expected '%s endraw %s'", d.BlockStart, d.BlockEnd)
+			break
+		}
+		l.rewind(l.crrPos - len(d.BlockStart))
+		if end = l.matchTag("endraw"); end.length > 0 {
+			break
 		}
+		sb.WriteString(d.BlockStart)
+		l.skip(len(d.BlockStart))
 	}
 
-	// Handle any remaining text
-	if sb.Len() > 0 {
-		if l.mode == TextMode {
-			l.Tokens = append(l.Tokens, Token{Value: sb.String(), Type: TEXT})
-		} else {
-			l.addToken(sb.String())
+	content := sb.String()
+	if open.trimRight {
+		trimmed := strings.TrimLeftFunc(content, unicode.IsSpace)
+		contentPos = contentPos.Advance(content[:len(content)-len(trimmed)])
+		content = trimmed
+	}
+	if end.trimLeft {
+		content = strings.TrimRightFunc(content, unicode.IsSpace)
+	} else if l.opts.LstripBlocks {
+		content = lstrip(content, false)
+	}
+	if content != "" {
+		l.emit(TEXT, content, contentPos)
+	}
+	l.skip(end.length)
+
+	if end.trimRight {
+		l.skipWhitespace()
+	} else if l.opts.TrimBlocks {
+		l.skip(l.newlineLength())
+	}
+	l.lineStart = l.prev == '\n'
+	return true
+}
+
+type tag struct {
+	length    int
+	trimLeft  bool
+	trimRight bool
+}
+
+// matchTag checks if the input continues with the block tag '{{ keyword }}', allowing whitespace control markers on both sides.
+// The returned tag has zero length if it doesn't.
+func (l *Lexer) matchTag(keyword string) tag {
+	d := l.opts.Delimiters
+	if !l.hasPrefix(d.BlockStart) {
+		return tag{}
+	}
+	text := l.peekBytes(lookahead)
+	var t tag
+	i := len(d.BlockStart)
+	if bytes.HasPrefix(text[i:], []byte("-")) {
+		t.trimLeft = true
+		i++
+	}
+	i = len(text) - len(bytes.TrimLeftFunc(text[i:], unicode.IsSpace))
+	if !bytes.HasPrefix(text[i:], []byte(keyword)) {
+		return tag{}
+	}
+	i += len(keyword)
+	i = len(text) - len(bytes.TrimLeftFunc(text[i:], unicode.IsSpace))
+	if bytes.HasPrefix(text[i:], []byte("-"+d.BlockEnd)) {
+		t.trimRight = true
+		i++
+	}
+	if !bytes.HasPrefix(text[i:], []byte(d.BlockEnd)) {
+		return tag{}
+	}
+	t.length = i + len(d.BlockEnd)
+	return t
+}
+
+// flushText emits the pending text before a tag, stripping whitespace as requested by '{{-' or LstripBlocks.
+func (l *Lexer) flushText(trimLeft bool) {
+	text := l.sb.String()
+	l.sb.Reset()
+	if trimLeft {
+		text = strings.TrimRightFunc(text, unicode.IsSpace)
+	} else if l.blockTag && l.opts.LstripBlocks {
+		text = lstrip(text, l.lineStart)
+	}
+	if text != "" {
+		l.emit(TEXT, text, l.textStart)
+	}
+}
+
+// lstrip removes the spaces and tabs between the last line break in text and its end.
+// If text has no line break, it is only stripped when it starts a line.
+func lstrip(text string, lineStart bool) string {
+	i := strings.LastIndexByte(text, '\n')
+	if i == -1 && !lineStart {
+		return text
+	}
+	if strings.TrimLeft(text[i+1:], " \t") != "" {
+		return text
+	}
+	return text[:i+1]
+}
+
+// peekWord returns the word after any whitespace following the current position, without consuming anything.
+func (l *Lexer) peekWord() string {
+	rest := bytes.TrimLeftFunc(l.peekBytes(lookahead), unicode.IsSpace)
+	end := bytes.IndexFunc(rest, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	if end == -1 {
+		return string(rest)
+	}
+	return string(rest[:end])
+}
+
+func (l *Lexer) skipWhitespace() {
+	for {
+		peek, ok := l.peek()
+		if !ok || !unicode.IsSpace(peek) {
+			return
 		}
+		l.advance()
 	}
+}
 
-	return l.Tokens
+// newlineLength returns the length of the line break at the current position, or 0 if there is none.
+func (l *Lexer) newlineLength() int {
+	switch {
+	case l.hasPrefix("\r\n"):
+		return len("\r\n")
+	case l.hasPrefix("\n"):
+		return len("\n")
+	default:
+		return 0
+	}
 }
 
+// addToken emits a word found inside a tag, which ends at textStart.
 func (l *Lexer) addToken(text string) {
 	if text == "" {
 		return
 	}
 
 	switch {
+	case text == "true" || text == "false":
+		l.emit(BOOLEAN, text, l.textStart)
+	case text == "nil":
+		l.emit(NIL, text, l.textStart)
 	case keywords[text]:
-		l.Tokens = append(l.Tokens, Token{Value: text, Type: KEYWORD})
+		l.emit(KEYWORD, text, l.textStart)
 	case isNumber(text):
-		l.Tokens = append(l.Tokens, Token{Value: text, Type: NUMBER})
-	case isString(text):
-		str := strings.Trim(text, "'")
-		l.Tokens = append(l.Tokens, Token{Value: str, Type: STRING})
+		l.emit(NUMBER, text, l.textStart)
+	case startsLikeNumber(text):
+		l.emit(ILLEGAL, text, l.textStart)
+		l.errorf(l.textStart, "invalid number %q", text)
 	default:
-		l.Tokens = append(l.Tokens, Token{Value: text, Type: IDENTIFIER})
+		l.emit(IDENTIFIER, text, l.textStart)
+	}
+}
+
+func (l *Lexer) emit(tokenType TokenType, value string, pos Position) {
+	l.queue = append(l.queue, Token{Value: value, Type: tokenType, Pos: pos})
+}
+
+func (l *Lexer) errorf(pos Position, format string, args ...interface{}) {
+	l.errors = append(l.errors, &Error{Pos: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *Lexer) pos() Position {
+	return Position{Offset: l.crrPos, Line: l.line, Column: l.crrPos - l.lineOffset + 1}
+}
+
+// -------- INPUT --------
+
+const (
+	// How many bytes are read from the input at once
+	chunkSize = 4096
+	// How far ahead the lexer looks to recognize tags like '{{ raw }}'
+	lookahead = 256
+)
+
+// rest returns the buffered input from the current position on.
+func (l *Lexer) rest() []byte {
+	return l.buf[l.crrPos-l.bufStart:]
+}
+
+// fill reads from the input until at least n bytes are buffered after the current position.
+// It returns false if the input ends before that.
+func (l *Lexer) fill(n int) bool {
+	for len(l.rest()) < n && l.readErr == nil {
+		l.compact()
+		if cap(l.buf)-len(l.buf) < chunkSize {
+			grown := make([]byte, len(l.buf), 2*cap(l.buf)+chunkSize)
+			copy(grown, l.buf)
+			l.buf = grown
+		}
+		read, err := l.src.Read(l.buf[len(l.buf):cap(l.buf)])
+		l.buf = l.buf[:len(l.buf)+read]
+		if err != nil {
+			l.readErr = err
+		}
+	}
+	return len(l.rest()) >= n
+}
+
+// compact drops the consumed input that is no longer needed, once it makes up a good part of the buffer.
+func (l *Lexer) compact() {
+	keep := l.crrPos
+	if l.mark != -1 && l.mark < keep {
+		keep = l.mark
+	}
+	drop := keep - l.bufStart
+	if drop < chunkSize && drop < len(l.buf)/2 {
+		return
+	}
+	n := copy(l.buf, l.buf[drop:])
+	l.buf = l.buf[:n]
+	l.bufStart = keep
+}
+
+func (l *Lexer) atEOF() bool {
+	return !l.fill(1)
+}
+
+func (l *Lexer) hasPrefix(s string) bool {
+	if !l.fill(len(s)) {
+		return false
+	}
+	return string(l.rest()[:len(s)]) == s
+}
+
+// peekBytes returns up to n bytes from the current position, without consuming them.
+// The result is only valid until the next read.
+func (l *Lexer) peekBytes(n int) []byte {
+	l.fill(n)
+	rest := l.rest()
+	return rest[:min(n, len(rest))]
+}
+
+// source returns the input from offset, which must be kept with mark, up to the current position.
+func (l *Lexer) source(offset int) string {
+	return string(l.buf[offset-l.bufStart : l.crrPos-l.bufStart])
+}
+
+// skip consumes n bytes, keeping track of line breaks.
+func (l *Lexer) skip(n int) {
+	l.fill(n)
+	for _, b := range l.rest()[:n] {
+		if b == '\n' {
+			l.line++
+			l.lineOffset = l.crrPos + 1
+		}
+		l.prev = b
+		l.crrPos++
+	}
+}
+
+// rewind moves back to offset, which must be kept with mark and be on the current line.
+func (l *Lexer) rewind(offset int) {
+	l.crrPos = offset
+	l.prev = '\n'
+	if offset > l.bufStart {
+		l.prev = l.buf[offset-l.bufStart-1]
 	}
 }
 
 func (l *Lexer) advance() (rune, bool) {
-	if l.crrPos >= len(l.rawText) {
+	r, size, ok := l.peekRune()
+	if !ok {
 		return 0, false
 	}
-	r := rune(l.rawText[l.crrPos])
-	l.crrPos++
+	l.skip(size)
 	return r, true
 }
 
 func (l *Lexer) peek() (rune, bool) {
-	if l.crrPos >= len(l.rawText) {
-		return 0, false
+	r, _, ok := l.peekRune()
+	return r, ok
+}
+
+func (l *Lexer) peekRune() (rune, int, bool) {
+	l.fill(utf8.UTFMax)
+	rest := l.rest()
+	if len(rest) == 0 {
+		return 0, 0, false
 	}
-	return rune(l.rawText[l.crrPos]), true
+	r, size := utf8.DecodeRune(rest)
+	return r, size, true
 }
 
 func isNumber(text string) bool {
+	if !startsLikeNumber(text) {
+		return false
+	}
 	_, err := strconv.ParseFloat(text, 64)
 	return err == nil
 }
 
-func isString(text string) bool {
-	return strings.HasPrefix(text, "'") && strings.HasSuffix(text, "'")
+// startsLikeNumber reports whether text starts with a digit, optionally after a sign or a decimal point.
+func startsLikeNumber(text string) bool {
+	text = strings.TrimLeft(text, "+-.")
+	return text != "" && text[0] >= '0' && text[0] <= '9'
 }
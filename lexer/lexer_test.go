@@ -1,14 +1,19 @@
 package lexer
 
 import (
+	"io"
+	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestBasicLexer(t *testing.T) {
 	content := "Hello, {{ name }}! {{ if is_admin }} You are an admin.{{ endif }}"
-	tokens := New(content).Tokenize()
+	tokens, err := New(content).Tokenize()
+	require.NoError(t, err)
 	expected := []Token{
 		{Type: TEXT, Value: "Hello, "},
 		{Type: OPEN_CURLY, Value: "{{"},
@@ -24,18 +29,19 @@ func TestBasicLexer(t *testing.T) {
 		{Type: KEYWORD, Value: "endif"},
 		{Type: CLOSE_CURLY, Value: "}}"},
 	}
-	require.Equal(t, expected, tokens)
+	require.Equal(t, expected, withoutPositions(tokens))
 }
 
 func TestLexerWithoutText(t *testing.T) {
 	content := "{{ name }}"
-	tokens := New(content).Tokenize()
+	tokens, err := New(content).Tokenize()
+	require.NoError(t, err)
 	expected := []Token{
 		{Type: OPEN_CURLY, Value: "{{"},
 		{Type: IDENTIFIER, Value: "name"},
 		{Type: CLOSE_CURLY, Value: "}}"},
 	}
-	require.Equal(t, expected, tokens)
+	require.Equal(t, expected, withoutPositions(tokens))
 }
 
 func TestComplexTemplate(t *testing.T) {
@@ -57,7 +63,8 @@ func TestComplexTemplate(t *testing.T) {
 </body>
 </html>
 `
-	tokens := New(content).Tokenize()
+	tokens, err := New(content).Tokenize()
+	require.NoError(t, err)
 	expected := []Token{
 		{Type: TEXT, Value: "\n<html>\n<body>\n<h1>Welcome, "},
 		{Type: OPEN_CURLY, Value: "{{"},
@@ -97,7 +104,7 @@ func TestComplexTemplate(t *testing.T) {
 		{Type: CLOSE_CURLY, Value: "}}"},
 		{Type: TEXT, Value: "</footer>\n</body>\n</html>\n"},
 	}
-	require.Equal(t, expected, tokens)
+	require.Equal(t, expected, withoutPositions(tokens))
 }
 
 func TestLexerOperators(t *testing.T) {
@@ -227,13 +234,693 @@ func TestLexerOperators(t *testing.T) {
 				{Type: CLOSE_CURLY, Value: "}}"},
 			},
 		},
+		{
+			name:  "call with keyword arguments",
+			input: "{{ forms.field('email', size=2.5) }}",
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "forms"},
+				{Type: DOT, Value: "."},
+				{Type: IDENTIFIER, Value: "field"},
+				{Type: LPAREN, Value: "("},
+				{Type: STRING, Value: "email"},
+				{Type: COMMA, Value: ","},
+				{Type: IDENTIFIER, Value: "size"},
+				{Type: ASSIGN, Value: "="},
+				{Type: NUMBER, Value: "2.5"},
+				{Type: RPAREN, Value: ")"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "macro definition and imports",
+			input: "{{ macro card(title) }}{{ endmacro }}{{ from 'forms.html' import field as f }}",
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "macro"},
+				{Type: IDENTIFIER, Value: "card"},
+				{Type: LPAREN, Value: "("},
+				{Type: IDENTIFIER, Value: "title"},
+				{Type: RPAREN, Value: ")"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "endmacro"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "from"},
+				{Type: STRING, Value: "forms.html"},
+				{Type: KEYWORD, Value: "import"},
+				{Type: IDENTIFIER, Value: "field"},
+				{Type: KEYWORD, Value: "as"},
+				{Type: IDENTIFIER, Value: "f"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "list, map and range literals",
+			input: "{{ [1, true] + {'a': {'b': nil}} + 1..10 }}",
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: OPEN_BRACKET, Value: "["},
+				{Type: NUMBER, Value: "1"},
+				{Type: COMMA, Value: ","},
+				{Type: BOOLEAN, Value: "true"},
+				{Type: CLOSE_BRACKET, Value: "]"},
+				{Type: IDENTIFIER, Value: "+"},
+				{Type: LBRACE, Value: "{"},
+				{Type: STRING, Value: "a"},
+				{Type: COLON, Value: ":"},
+				{Type: LBRACE, Value: "{"},
+				{Type: STRING, Value: "b"},
+				{Type: COLON, Value: ":"},
+				{Type: NIL, Value: "nil"},
+				{Type: RBRACE, Value: "}"},
+				{Type: RBRACE, Value: "}"},
+				{Type: IDENTIFIER, Value: "+"},
+				{Type: NUMBER, Value: "1"},
+				{Type: RANGE, Value: ".."},
+				{Type: NUMBER, Value: "10"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "inline conditionals",
+			input: "{{ a ? 'x' : b ?? 'y' }}{{ 'x' if a else 'y' }}",
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "a"},
+				{Type: QUESTION, Value: "?"},
+				{Type: STRING, Value: "x"},
+				{Type: COLON, Value: ":"},
+				{Type: IDENTIFIER, Value: "b"},
+				{Type: NULL_COALESCE, Value: "??"},
+				{Type: STRING, Value: "y"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: STRING, Value: "x"},
+				{Type: KEYWORD, Value: "if"},
+				{Type: IDENTIFIER, Value: "a"},
+				{Type: KEYWORD, Value: "else"},
+				{Type: STRING, Value: "y"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			lexer := New(tt.input)
-			tokens := lexer.Tokenize()
-			require.Equal(t, tt.expected, tokens)
+			tokens, err := lexer.Tokenize()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, withoutPositions(tokens))
+		})
+	}
+}
+
+func TestLexerCommentsAndRaw(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []Token
+	}{
+		{
+			name:  "comment is stripped",
+			input: "Hello, {# greet the user #}{{ name }}",
+			expected: []Token{
+				{Type: TEXT, Value: "Hello, "},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "name"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "multi-line comment between text",
+			input: "a{# first line\n{{ if x }} is ignored\n #}b",
+			expected: []Token{
+				{Type: TEXT, Value: "ab"},
+			},
+		},
+		{
+			name:  "unterminated comment swallows the rest",
+			input: "a{# never closed {{ name }}",
+			expected: []Token{
+				{Type: TEXT, Value: "a"},
+			},
+		},
+		{
+			name:  "raw block",
+			input: "<div>{{ raw }}{{ message }} {# not a comment #}{{endraw}}</div>",
+			expected: []Token{
+				{Type: TEXT, Value: "<div>"},
+				{Type: TEXT, Value: "{{ message }} {# not a comment #}"},
+				{Type: TEXT, Value: "</div>"},
+			},
+		},
+		{
+			name:  "raw block followed by tag",
+			input: "{{raw}}{{ if }}{{  endraw  }}{{ name }}",
+			expected: []Token{
+				{Type: TEXT, Value: "{{ if }}"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "name"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "identifier starting with raw is not a raw block",
+			input: "{{ rawValue }}",
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "rawValue"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, _ := New(tt.input).Tokenize()
+			require.Equal(t, tt.expected, withoutPositions(tokens))
 		})
 	}
 }
+
+func TestLexerWhitespaceControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		opts     Options
+		expected []Token
+	}{
+		{
+			name:  "trim markers strip whitespace on both sides",
+			input: "<li>  \n  {{- name -}}  \n  </li>",
+			expected: []Token{
+				{Type: TEXT, Value: "<li>"},
+				{Type: OPEN_CURLY, Value: "{{-"},
+				{Type: IDENTIFIER, Value: "name"},
+				{Type: CLOSE_CURLY, Value: "-}}"},
+				{Type: TEXT, Value: "</li>"},
+			},
+		},
+		{
+			name:  "trim marker only on one side",
+			input: "a \n{{ name -}}\n b",
+			expected: []Token{
+				{Type: TEXT, Value: "a \n"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "name"},
+				{Type: CLOSE_CURLY, Value: "-}}"},
+				{Type: TEXT, Value: "b"},
+			},
+		},
+		{
+			name:  "trim blocks removes newline after block tags only",
+			input: "{{ if x }}\n{{ name }}\n{{ endif }}\n",
+			opts:  Options{TrimBlocks: true},
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "if"},
+				{Type: IDENTIFIER, Value: "x"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "name"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: TEXT, Value: "\n"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "endif"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "lstrip blocks removes indentation before block tags only",
+			input: "  {{ for x in xs }}\n    {{ x }}\n  {{ endfor }}",
+			opts:  Options{LstripBlocks: true},
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "for"},
+				{Type: IDENTIFIER, Value: "x"},
+				{Type: KEYWORD, Value: "in"},
+				{Type: IDENTIFIER, Value: "xs"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: TEXT, Value: "\n    "},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "x"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: TEXT, Value: "\n"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "endfor"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "lstrip blocks keeps text on the same line",
+			input: "a {{ if x }}b{{ endif }}",
+			opts:  Options{LstripBlocks: true},
+			expected: []Token{
+				{Type: TEXT, Value: "a "},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "if"},
+				{Type: IDENTIFIER, Value: "x"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: TEXT, Value: "b"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: KEYWORD, Value: "endif"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "trim markers on raw blocks",
+			input: "a\n  {{- raw -}}\n {{ x }} \n{{- endraw -}}\nb",
+			expected: []Token{
+				{Type: TEXT, Value: "a"},
+				{Type: TEXT, Value: "{{ x }}"},
+				{Type: TEXT, Value: "b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := NewWithOptions(tt.input, tt.opts).Tokenize()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, withoutPositions(tokens))
+		})
+	}
+}
+
+func TestLexerDelimiters(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		delimiters Delimiters
+		expected   []Token
+	}{
+		{
+			name:  "multi-character delimiters leave Go templates untouched",
+			input: "{{ .Name }} <% if admin %>${ user['name'] }<%# hidden #%><% endif %>",
+			delimiters: Delimiters{
+				BlockStart:    "<%",
+				BlockEnd:      "%>",
+				VariableStart: "${",
+				VariableEnd:   "}",
+				CommentStart:  "<%#",
+				CommentEnd:    "#%>",
+			},
+			expected: []Token{
+				{Type: TEXT, Value: "{{ .Name }} "},
+				{Type: OPEN_CURLY, Value: "<%"},
+				{Type: KEYWORD, Value: "if"},
+				{Type: IDENTIFIER, Value: "admin"},
+				{Type: CLOSE_CURLY, Value: "%>"},
+				{Type: OPEN_CURLY, Value: "${"},
+				{Type: IDENTIFIER, Value: "user"},
+				{Type: OPEN_BRACKET, Value: "["},
+				{Type: STRING, Value: "name"},
+				{Type: CLOSE_BRACKET, Value: "]"},
+				{Type: CLOSE_CURLY, Value: "}"},
+				{Type: OPEN_CURLY, Value: "<%"},
+				{Type: KEYWORD, Value: "endif"},
+				{Type: CLOSE_CURLY, Value: "%>"},
+			},
+		},
+		{
+			name:       "single-character delimiters",
+			input:      "Hi $name$, [if vip]welcome back[endif]",
+			delimiters: Delimiters{BlockStart: "[", BlockEnd: "]", VariableStart: "$", VariableEnd: "$"},
+			expected: []Token{
+				{Type: TEXT, Value: "Hi "},
+				{Type: OPEN_CURLY, Value: "$"},
+				{Type: IDENTIFIER, Value: "name"},
+				{Type: CLOSE_CURLY, Value: "$"},
+				{Type: TEXT, Value: ", "},
+				{Type: OPEN_CURLY, Value: "["},
+				{Type: KEYWORD, Value: "if"},
+				{Type: IDENTIFIER, Value: "vip"},
+				{Type: CLOSE_CURLY, Value: "]"},
+				{Type: TEXT, Value: "welcome back"},
+				{Type: OPEN_CURLY, Value: "["},
+				{Type: KEYWORD, Value: "endif"},
+				{Type: CLOSE_CURLY, Value: "]"},
+			},
+		},
+		{
+			name:       "whitespace control and raw blocks follow custom delimiters",
+			input:      "a  <%- raw %>{{ x }}<% endraw -%>  b",
+			delimiters: Delimiters{BlockStart: "<%", BlockEnd: "%>"},
+			expected: []Token{
+				{Type: TEXT, Value: "a"},
+				{Type: TEXT, Value: "{{ x }}"},
+				{Type: TEXT, Value: "b"},
+			},
+		},
+		{
+			name:       "line statements",
+			input:      "<ul>\n  %% for item in items\n  <li>{{ item }}</li>\n  %% endfor\n</ul>",
+			delimiters: Delimiters{LineStatementPrefix: "%%"},
+			expected: []Token{
+				{Type: TEXT, Value: "<ul>\n"},
+				{Type: OPEN_CURLY, Value: "%%"},
+				{Type: KEYWORD, Value: "for"},
+				{Type: IDENTIFIER, Value: "item"},
+				{Type: KEYWORD, Value: "in"},
+				{Type: IDENTIFIER, Value: "items"},
+				{Type: CLOSE_CURLY, Value: "\n"},
+				{Type: TEXT, Value: "  <li>"},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "item"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: TEXT, Value: "</li>\n"},
+				{Type: OPEN_CURLY, Value: "%%"},
+				{Type: KEYWORD, Value: "endfor"},
+				{Type: CLOSE_CURLY, Value: "\n"},
+				{Type: TEXT, Value: "</ul>"},
+			},
+		},
+		{
+			name:       "line statement on the last line",
+			input:      "x %% not a statement\n%% endif",
+			delimiters: Delimiters{LineStatementPrefix: "%%"},
+			expected: []Token{
+				{Type: TEXT, Value: "x %% not a statement\n"},
+				{Type: OPEN_CURLY, Value: "%%"},
+				{Type: KEYWORD, Value: "endif"},
+				{Type: CLOSE_CURLY, Value: ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := NewWithOptions(tt.input, Options{Delimiters: tt.delimiters}).Tokenize()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, withoutPositions(tokens))
+		})
+	}
+}
+
+func TestLexerStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []Token
+	}{
+		{
+			name:  "single and double quotes",
+			input: `{{ 'it\'s' == "say \"hi\"" }}`,
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: STRING, Value: "it's"},
+				{Type: EQ, Value: "=="},
+				{Type: STRING, Value: `say "hi"`},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "escape sequences",
+			input: `{{ 'a\nb\tc\\d' ?? "\u011f\u015F" ?? '\uD83D\uDE00' }}`,
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: STRING, Value: "a\nb\tc\\d"},
+				{Type: NULL_COALESCE, Value: "??"},
+				{Type: STRING, Value: "ğş"},
+				{Type: NULL_COALESCE, Value: "??"},
+				{Type: STRING, Value: "😀"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "closing delimiter inside a string",
+			input: "{{ value ?? '}}' }}",
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "value"},
+				{Type: NULL_COALESCE, Value: "??"},
+				{Type: STRING, Value: "}}"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+		{
+			name:  "non-ASCII characters in tags and text",
+			input: "Günaydın {{ kullanıcı == 'Çağrı 🎉' }}!",
+			expected: []Token{
+				{Type: TEXT, Value: "Günaydın "},
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "kullanıcı"},
+				{Type: EQ, Value: "=="},
+				{Type: STRING, Value: "Çağrı 🎉"},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: TEXT, Value: "!"},
+			},
+		},
+		{
+			name:  "unterminated string",
+			input: "{{ name == 'abc }}\nHello",
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: IDENTIFIER, Value: "name"},
+				{Type: EQ, Value: "=="},
+				{Type: ILLEGAL, Value: "'abc "},
+				{Type: CLOSE_CURLY, Value: "}}"},
+				{Type: TEXT, Value: "\nHello"},
+			},
+		},
+		{
+			name:  "invalid escape sequence",
+			input: `{{ 'a\qb' }}`,
+			expected: []Token{
+				{Type: OPEN_CURLY, Value: "{{"},
+				{Type: ILLEGAL, Value: `'a\qb'`},
+				{Type: CLOSE_CURLY, Value: "}}"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, _ := New(tt.input).Tokenize()
+			require.Equal(t, tt.expected, withoutPositions(tokens))
+		})
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected ErrorList
+	}{
+		{
+			name:  "unclosed tag",
+			input: "Hello\n{{ name",
+			expected: ErrorList{
+				{Pos: Position{Offset: 6, Line: 2, Column: 1}, Message: "unclosed tag, expected '}}'"},
+			},
+		},
+		{
+			name:  "unterminated string",
+			input: "{{ name == 'abc }}",
+			expected: ErrorList{
+				{Pos: Position{Offset: 11, Line: 1, Column: 12}, Message: "unterminated string"},
+			},
+		},
+		{
+			name:  "invalid escape sequence",
+			input: `{{ 'a\qb' }}`,
+			expected: ErrorList{
+				{Pos: Position{Offset: 5, Line: 1, Column: 6}, Message: `invalid escape sequence "\\q"`},
+			},
+		},
+		{
+			name:  "unknown characters",
+			input: "{{ a & b }}\n{{ c | d }}",
+			expected: ErrorList{
+				{Pos: Position{Offset: 5, Line: 1, Column: 6}, Message: "unexpected character '&'"},
+				{Pos: Position{Offset: 17, Line: 2, Column: 6}, Message: "unexpected character '|'"},
+			},
+		},
+		{
+			name:  "invalid numbers",
+			input: "{{ 1.2.3 > 12abc }}",
+			expected: ErrorList{
+				{Pos: Position{Offset: 3, Line: 1, Column: 4}, Message: `invalid number "1.2.3"`},
+				{Pos: Position{Offset: 11, Line: 1, Column: 12}, Message: `invalid number "12abc"`},
+			},
+		},
+		{
+			name:  "unclosed raw block",
+			input: "{{ raw }}{{ x }}\n{# never closed",
+			expected: ErrorList{
+				{Pos: Position{Offset: 0, Line: 1, Column: 1}, Message: "unclosed raw block, expected '{{ endraw }}'"},
+			},
+		},
+		{
+			name:  "unclosed comment",
+			input: "a\n  {# never closed",
+			expected: ErrorList{
+				{Pos: Position{Offset: 4, Line: 2, Column: 3}, Message: "unclosed comment, expected '#}'"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.input)
+			_, err := l.Tokenize()
+			require.Equal(t, tt.expected, err)
+			require.Equal(t, tt.expected, l.Errors())
+		})
+	}
+}
+
+func TestLexerPositions(t *testing.T) {
+	tokens, err := New("Hi {{ name }}!\n{{ if ok }}ğ{{ 'x' }}").Tokenize()
+	require.NoError(t, err)
+	expected := []Token{
+		{Type: TEXT, Value: "Hi ", Pos: Position{Offset: 0, Line: 1, Column: 1}},
+		{Type: OPEN_CURLY, Value: "{{", Pos: Position{Offset: 3, Line: 1, Column: 4}},
+		{Type: IDENTIFIER, Value: "name", Pos: Position{Offset: 6, Line: 1, Column: 7}},
+		{Type: CLOSE_CURLY, Value: "}}", Pos: Position{Offset: 11, Line: 1, Column: 12}},
+		{Type: TEXT, Value: "!\n", Pos: Position{Offset: 13, Line: 1, Column: 14}},
+		{Type: OPEN_CURLY, Value: "{{", Pos: Position{Offset: 15, Line: 2, Column: 1}},
+		{Type: KEYWORD, Value: "if", Pos: Position{Offset: 18, Line: 2, Column: 4}},
+		{Type: IDENTIFIER, Value: "ok", Pos: Position{Offset: 21, Line: 2, Column: 7}},
+		{Type: CLOSE_CURLY, Value: "}}", Pos: Position{Offset: 24, Line: 2, Column: 10}},
+		{Type: TEXT, Value: "ğ", Pos: Position{Offset: 26, Line: 2, Column: 12}},
+		{Type: OPEN_CURLY, Value: "{{", Pos: Position{Offset: 28, Line: 2, Column: 14}},
+		{Type: STRING, Value: "x", Pos: Position{Offset: 31, Line: 2, Column: 17}},
+		{Type: CLOSE_CURLY, Value: "}}", Pos: Position{Offset: 35, Line: 2, Column: 21}},
+	}
+	require.Equal(t, expected, tokens)
+}
+
+func TestLexerStreaming(t *testing.T) {
+	inputs := []struct {
+		name  string
+		input string
+		opts  Options
+	}{
+		{name: "tags and text", input: "Hello, {{ name }}!\n{{ if a >= 10 && b != 'x' }}ğ 😀{{ endif }}"},
+		{name: "comments and raw", input: "a{# one\ntwo #}b{{ raw }}{{ x }}{# y #}{{ endraw }}c"},
+		{name: "strings", input: `{{ "it's" == 'say \"hi\"\n' ?? '😀' }}`},
+		{name: "whitespace control", input: "<ul>\n  {{- for x in xs }}\n  <li>{{ x -}}  </li>\n  {{ endfor }}\n</ul>", opts: Options{TrimBlocks: true, LstripBlocks: true}},
+		{name: "line statements", input: "<ul>\n  %% for x in xs\n  <li><< x >></li>\n  %% endfor\n</ul>", opts: Options{
+			Delimiters: Delimiters{BlockStart: "<%", BlockEnd: "%>", VariableStart: "<<", VariableEnd: ">>", LineStatementPrefix: "%%"},
+		}},
+		{name: "errors", input: "{{ 'abc }}\n{{ a & 1.2.3 }}{# open"},
+	}
+
+	for _, tt := range inputs {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, expectedErr := NewWithOptions(tt.input, tt.opts).Tokenize()
+
+			// Reading a byte at a time splits delimiters, escapes and multi-byte characters across reads
+			l := NewReader(iotest.OneByteReader(strings.NewReader(tt.input)), tt.opts)
+			var tokens []Token
+			for token := l.NextToken(); token.Type != EOF; token = l.NextToken() {
+				tokens = append(tokens, token)
+			}
+			require.Equal(t, expected, tokens)
+			require.Equal(t, EOF, l.NextToken().Type)
+			if expectedErr != nil {
+				require.Equal(t, expectedErr, l.Errors())
+			} else {
+				require.Empty(t, l.Errors())
+			}
+
+			var collected []Token
+			for token := range NewWithOptions(tt.input, tt.opts).All() {
+				collected = append(collected, token)
+			}
+			require.Equal(t, expected, collected)
+		})
+	}
+}
+
+func TestLexerBoundedBuffer(t *testing.T) {
+	const size = 8 << 20
+	l := NewReader(largeTemplate(size), Options{})
+	count := 0
+	for range l.All() {
+		count++
+	}
+	require.Empty(t, l.Errors())
+	require.Greater(t, count, size/100)
+	require.Less(t, cap(l.buf), 64<<10)
+}
+
+func BenchmarkTokenize(b *testing.B) {
+	content, err := io.ReadAll(largeTemplate(4 << 20))
+	require.NoError(b, err)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(content)))
+	for range b.N {
+		if _, err := New(string(content)).Tokenize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNextTokenReader(b *testing.B) {
+	const size = 4 << 20
+	b.ReportAllocs()
+	b.SetBytes(size)
+	for range b.N {
+		l := NewReader(largeTemplate(size), Options{})
+		for token := l.NextToken(); token.Type != EOF; token = l.NextToken() {
+		}
+	}
+}
+
+// largeTemplate generates a template of about size bytes without holding it in memory.
+func largeTemplate(size int) io.Reader {
+	chunk := "<li class=\"item\">{{ item.name }} - {{ if item.price > 10 }}{{ 'expensive' }}{{ else }}cheap{{ endif }}</li>\n{# note #}\n"
+	return io.LimitReader(&repeatReader{chunk: chunk}, int64(size/len(chunk)*len(chunk)))
+}
+
+type repeatReader struct {
+	chunk  string
+	offset int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		copied := copy(p[n:], r.chunk[r.offset:])
+		n += copied
+		r.offset = (r.offset + copied) % len(r.chunk)
+	}
+	return n, nil
+}
+
+// withoutPositions clears token positions so tests can focus on types and values.
+func withoutPositions(tokens []Token) []Token {
+	stripped := make([]Token, len(tokens))
+	for i, token := range tokens {
+		token.Pos = Position{}
+		stripped[i] = token
+	}
+	return stripped
+}
+
+func TestFprintTokens(t *testing.T) {
+	tokens, err := New("Hi\n{{ name }}").Tokenize()
+	require.NoError(t, err)
+
+	var sb strings.Builder
+	require.NoError(t, FprintTokens(&sb, tokens, PrintOptions{Color: ColorNever}))
+	require.Equal(t, "TEXT: Hi\\n\nOPEN_CURLY: {{\nIDENTIFIER: name\nCLOSE_CURLY: }}\n", sb.String())
+
+	sb.Reset()
+	require.NoError(t, FprintTokens(&sb, tokens[2:3], PrintOptions{Color: ColorNever, Positions: true}))
+	require.Equal(t, "IDENTIFIER: name (2:4)\n", sb.String())
+
+	sb.Reset()
+	require.NoError(t, FprintTokens(&sb, tokens[2:3], PrintOptions{Color: ColorAlways}))
+	require.Equal(t, "\x1b[36;1mIDENTIFIER\x1b[0;22m: \x1b[33mname\x1b[0m\n", sb.String())
+
+	// Only terminals get colours by default
+	require.True(t, ColorAlways.Enabled(&sb))
+	require.False(t, ColorAuto.Enabled(&sb))
+	require.False(t, ColorNever.Enabled(os.Stdout))
+}
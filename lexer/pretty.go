@@ -2,50 +2,110 @@ package lexer
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 )
 
-func PrettyPrintTokens(tokens []Token) string {
-	var sb strings.Builder
-	prettifyTokens(&sb, tokens, 0)
-	return sb.String()
+// ColorMode says whether dumps of tokens and ASTs are coloured
+type ColorMode int
+
+const (
+	// ColorAuto colours output written to a terminal, unless the NO_COLOR environment variable is set
+	ColorAuto ColorMode = iota
+	ColorAlways
+	ColorNever
+)
+
+// Enabled reports whether output written to w gets colours
+func (m ColorMode) Enabled(w io.Writer) bool {
+	switch m {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && (isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd()))
 }
 
-func prettifyTokens(sb *strings.Builder, tokens []Token, indent int) {
-	tokenTypeColor := color.New(color.FgCyan, color.Bold).SprintFunc()
+// PrintOptions configures dumps of tokens and ASTs
+type PrintOptions struct {
+	Color ColorMode
+	// Positions adds the line and column each token or node starts at, e.g. 'IDENTIFIER: name (1:7)'
+	Positions bool
+}
 
-	for _, token := range tokens {
-		sb.WriteString(strings.Repeat("  ", indent))
+// Palette returns a function colouring text with the given attributes, or leaving it as it is when colours are off.
+// It's shared by the token and AST dumps, e.g. Palette(opts.Color.Enabled(w)).
+func Palette(enabled bool) func(attributes ...color.Attribute) func(a ...interface{}) string {
+	return func(attributes ...color.Attribute) func(a ...interface{}) string {
+		c := color.New(attributes...)
+		if enabled {
+			c.EnableColor()
+		} else {
+			c.DisableColor()
+		}
+		return c.SprintFunc()
+	}
+}
+
+// FprintTokens writes the tokens one per line as 'TYPE: value', with newlines and tabs in values escaped
+func FprintTokens(w io.Writer, tokens []Token, opts PrintOptions) error {
+	paint := Palette(opts.Color.Enabled(w))
+	tokenTypeColor := paint(color.FgCyan, color.Bold)
+	positionColor := paint(color.Faint)
 
+	var sb strings.Builder
+	for _, token := range tokens {
 		var tokenValueColor func(a ...interface{}) string
 		switch token.Type {
 		case TEXT:
-			tokenValueColor = color.New(color.FgGreen).SprintFunc()
+			tokenValueColor = paint(color.FgGreen)
 		case IDENTIFIER:
-			tokenValueColor = color.New(color.FgYellow).SprintFunc()
+			tokenValueColor = paint(color.FgYellow)
 		case KEYWORD:
-			tokenValueColor = color.New(color.FgMagenta).SprintFunc()
-		case NUMBER:
-			tokenValueColor = color.New(color.FgBlue).SprintFunc()
+			tokenValueColor = paint(color.FgMagenta)
+		case NUMBER, BOOLEAN, NIL:
+			tokenValueColor = paint(color.FgBlue)
 		case STRING:
-			tokenValueColor = color.New(color.FgGreen).SprintFunc()
-		case OPEN_CURLY, CLOSE_CURLY:
-			tokenValueColor = color.New(color.FgRed).SprintFunc()
-		case PIPE, AMPERSAND, GT, LT, GTE, LTE, EQ, NEQ, BANG, LPAREN, RPAREN, OPEN_BRACKET, CLOSE_BRACKET:
-			tokenValueColor = color.New(color.FgYellow).SprintFunc()
+			tokenValueColor = paint(color.FgGreen)
+		case OPEN_CURLY, CLOSE_CURLY, ILLEGAL:
+			tokenValueColor = paint(color.FgRed)
+		case PIPE, AMPERSAND, GT, LT, GTE, LTE, EQ, NEQ, BANG, LPAREN, RPAREN, OPEN_BRACKET, CLOSE_BRACKET, COMMA, ASSIGN, DOT, RANGE, LBRACE, RBRACE, COLON, QUESTION:
+			tokenValueColor = paint(color.FgYellow)
 		default:
-			tokenValueColor = color.New(color.FgWhite).SprintFunc()
+			tokenValueColor = paint(color.FgWhite)
 		}
 
 		formattedValue := strings.ReplaceAll(strings.ReplaceAll(token.Value, "\n", "\\n"), "\t", "\\t")
 
 		// Print the token type and value
-		fmt.Fprintf(sb, "%s: %s\n",
-			tokenTypeColor(token.Type),
-			tokenValueColor(formattedValue))
+		fmt.Fprintf(&sb, "%s: %s", tokenTypeColor(token.Type), tokenValueColor(formattedValue))
+		if opts.Positions {
+			fmt.Fprintf(&sb, " %s", positionColor("("+token.Pos.String()+")"))
+		}
+		sb.WriteByte('\n')
 	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// PrettyPrintTokens returns the tokens as FprintTokens writes them, coloured when stdout is a terminal
+func PrettyPrintTokens(tokens []Token) string {
+	opts := PrintOptions{Color: ColorNever}
+	if ColorAuto.Enabled(os.Stdout) {
+		opts.Color = ColorAlways
+	}
+	var sb strings.Builder
+	FprintTokens(&sb, tokens, opts)
+	return sb.String()
 }
 
 // Helper function to use the pretty printer
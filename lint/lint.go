@@ -0,0 +1,518 @@
+package lint
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/ogzhanolguncu/zencefil/analyzer"
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// Rule names a kind of issue
+type Rule string
+
+const (
+	RuleSyntax                 Rule = "syntax"
+	RuleUnclosedBlock          Rule = "unclosed-block"
+	RuleShadowedVariable       Rule = "shadowed-variable"
+	RuleDuplicateCondition     Rule = "duplicate-condition"
+	RuleUnreachableBranch      Rule = "unreachable-branch"
+	RuleIncompatibleComparison Rule = "incompatible-comparison"
+)
+
+// Issue is a problem found in a template
+type Issue struct {
+	Pos     lexer.Position
+	Rule    Rule
+	Message string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: %s (%s)", i.Pos, i.Message, i.Rule)
+}
+
+// blockClosers maps the tags closing a block to the tag opening it
+var blockClosers = map[string]string{
+	"endif":     "if",
+	"endfor":    "for",
+	"endswitch": "switch",
+	"endmacro":  "macro",
+	"endcall":   "call",
+}
+
+// comparisons are the operators comparing two values, with how they are written
+var comparisons = map[parser.NodeType]string{
+	parser.OP_EQUALS:     "==",
+	parser.OP_NOT_EQUALS: "!=",
+	parser.OP_GT:         ">",
+	parser.OP_LT:         "<",
+	parser.OP_GTE:        ">=",
+	parser.OP_LTE:        "<=",
+}
+
+// Check lexes, parses and lints a template, it returns every issue found ordered by position.
+// Lexing and parsing go on after an error: unclosed blocks are closed and parsing goes on with a broken tag
+// left out, so each broken tag is reported. Lint rules only run on templates without syntax errors.
+func Check(content string) []Issue {
+	tokens, err := lexer.New(content).Tokenize()
+	var issues []Issue
+	var lexErrors lexer.ErrorList
+	errors.As(err, &lexErrors)
+	for _, lexErr := range lexErrors {
+		issues = append(issues, Issue{Pos: lexErr.Pos, Rule: RuleSyntax, Message: lexErr.Message})
+	}
+
+	blockIssues, tokens := blocks(tokens)
+	issues = append(issues, blockIssues...)
+	nodes, syntaxIssues := parse(tokens, lexErrors)
+	issues = append(issues, syntaxIssues...)
+	if len(issues) > 0 {
+		return sortIssues(issues)
+	}
+	return sortIssues(Lint(nodes))
+}
+
+// maxSyntaxErrors caps the syntax errors reported for a template
+const maxSyntaxErrors = 50
+
+// standIns take the place of block tags with a syntax error, so the blocks they open or continue still parse
+var standIns = map[string]string{
+	"if":     "{{ if true }}",
+	"elif":   "{{ elif true }}",
+	"for":    "{{ for x in [] }}",
+	"switch": "{{ switch 0 }}",
+	"case":   "{{ case 0 }}",
+	"macro":  "{{ macro m() }}",
+	"call":   "{{ call m() }}",
+}
+
+// parse parses the tokens of a template, after a syntax error it parses them again with the tag the error is in
+// replaced by its stand-in, or left out, until there are no more errors. Errors in tags the lexer found an
+// error in were reported by it already.
+func parse(tokens []lexer.Token, lexErrors lexer.ErrorList) ([]parser.Node, []Issue) {
+	var issues []Issue
+	replaced := make(map[lexer.Position]bool)
+	for len(issues) < maxSyntaxErrors {
+		nodes, err := parser.New(tokens).Parse()
+		if err == nil {
+			return nodes, issues
+		}
+		issue := Issue{Rule: RuleSyntax, Message: err.Error()}
+		var parseErr *parser.Error
+		if !errors.As(err, &parseErr) {
+			return nil, append(issues, issue)
+		}
+		issue.Pos = parseErr.Pos
+
+		// The tag the error is in
+		open, end := -1, -1
+		for i, token := range tokens {
+			if token.Pos.Offset > parseErr.Pos.Offset {
+				break
+			}
+			if token.Type == lexer.OPEN_CURLY {
+				open = i
+			}
+		}
+		for i := open + 1; open >= 0 && i < len(tokens); i++ {
+			if tokens[i].Type == lexer.CLOSE_CURLY {
+				end = i
+				break
+			}
+		}
+		lexed := func(until int) bool {
+			return slices.ContainsFunc(lexErrors, func(lexErr *lexer.Error) bool {
+				return lexErr.Pos.Offset >= tokens[open].Pos.Offset && (until < 0 || lexErr.Pos.Offset <= tokens[until].Pos.Offset)
+			})
+		}
+		if end < 0 || tokens[end].Pos.Offset < parseErr.Pos.Offset {
+			if open >= 0 && lexed(-1) {
+				return nil, issues
+			}
+			return nil, append(issues, issue)
+		}
+		// A stand-in with an error of its own, such as an elif outside of an if, was reported already
+		if !replaced[tokens[open].Pos] && !lexed(end) {
+			issues = append(issues, issue)
+		}
+
+		var standIn []lexer.Token
+		// The stand-in is left out when it fails as well
+		if keyword := tokens[open+1]; keyword.Type == lexer.KEYWORD && standIns[keyword.Value] != "" && !replaced[tokens[open].Pos] {
+			standIn, _ = lexer.New(standIns[keyword.Value]).Tokenize()
+			for i := range standIn {
+				standIn[i].Pos = tokens[open].Pos
+			}
+			replaced[tokens[open].Pos] = true
+		}
+		tokens = slices.Concat(tokens[:open], standIn, tokens[end+1:])
+	}
+	return nil, issues
+}
+
+// Blocks finds block tags that are never closed and closing tags without a block to close
+func Blocks(tokens []lexer.Token) []Issue {
+	issues, _ := blocks(tokens)
+	return issues
+}
+
+// blocks finds the issues Blocks does and returns the tokens with them repaired, so the rest of the template
+// still parses: closing tags without a block are left out, and blocks that are never closed are closed where
+// the block around them is, or at the end of the template
+func blocks(tokens []lexer.Token) ([]Issue, []lexer.Token) {
+	type block struct {
+		keyword string
+		pos     lexer.Position
+	}
+	var open []block
+	var issues []Issue
+	repaired := make([]lexer.Token, 0, len(tokens))
+	unclosed := func(b block) Issue {
+		return Issue{Pos: b.pos, Rule: RuleUnclosedBlock, Message: fmt.Sprintf("'%s' is never closed with 'end%s'", b.keyword, b.keyword)}
+	}
+	closeBlocks := func(blocks []block, pos lexer.Position) {
+		for i := len(blocks) - 1; i >= 0; i-- {
+			issues = append(issues, unclosed(blocks[i]))
+			closer, _ := lexer.New("{{ end" + blocks[i].keyword + " }}").Tokenize()
+			for j := range closer {
+				closer[j].Pos = pos
+			}
+			repaired = append(repaired, closer...)
+		}
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		// Only keywords starting a tag open or close blocks, not those of inline conditionals
+		if tokens[i].Type != lexer.OPEN_CURLY || i+1 == len(tokens) || tokens[i+1].Type != lexer.KEYWORD {
+			repaired = append(repaired, tokens[i])
+			continue
+		}
+		keyword, pos := tokens[i+1].Value, tokens[i].Pos
+		if _, isCloser := blockClosers["end"+keyword]; isCloser {
+			open = append(open, block{keyword: keyword, pos: pos})
+		}
+		opener, isCloser := blockClosers[keyword]
+		if !isCloser {
+			repaired = append(repaired, tokens[i])
+			continue
+		}
+
+		match := -1
+		for j := len(open) - 1; j >= 0; j-- {
+			if open[j].keyword == opener {
+				match = j
+				break
+			}
+		}
+		if match < 0 {
+			issues = append(issues, Issue{Pos: pos, Rule: RuleUnclosedBlock, Message: fmt.Sprintf("'%s' has no '%s' to close", keyword, opener)})
+			for i < len(tokens)-1 && tokens[i].Type != lexer.CLOSE_CURLY {
+				i++
+			}
+			continue
+		}
+		// Blocks opened inside the one being closed weren't closed themselves
+		closeBlocks(open[match+1:], pos)
+		open = open[:match]
+		repaired = append(repaired, tokens[i])
+	}
+
+	// A tag left open at the end of the template was reported by the lexer, it's left out before closing blocks
+	for i := len(repaired) - 1; len(open) > 0 && i >= 0 && repaired[i].Type != lexer.CLOSE_CURLY; i-- {
+		if repaired[i].Type == lexer.OPEN_CURLY {
+			repaired = repaired[:i]
+			break
+		}
+	}
+	end := lexer.Position{Line: 1, Column: 1}
+	if len(tokens) > 0 {
+		last := tokens[len(tokens)-1]
+		end = last.Pos.Advance(last.Value)
+	}
+	closeBlocks(open, end)
+	return issues, repaired
+}
+
+// Lint finds likely mistakes in a parsed template: loop variables shadowing other names, duplicate elif conditions,
+// branches that can't run after an always true condition and comparisons between literals of different types
+func Lint(nodes []parser.Node) []Issue {
+	l := &linter{context: make(map[string]lexer.Position)}
+	for _, variable := range analyzer.Analyze(nodes).Variables {
+		l.context[variable.Name] = variable.Uses[0].Pos
+	}
+	l.nodes(nodes)
+	return sortIssues(l.issues)
+}
+
+// local is a loop variable or macro parameter in scope
+type local struct {
+	kind string
+	pos  lexer.Position
+}
+
+type linter struct {
+	context map[string]lexer.Position // context keys the template reads, with their first use
+	scopes  []map[string]local
+	issues  []Issue
+}
+
+func (l *linter) report(pos lexer.Position, rule Rule, format string, args ...interface{}) {
+	l.issues = append(l.issues, Issue{Pos: pos, Rule: rule, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) nodes(nodes []parser.Node) {
+	for _, node := range nodes {
+		l.node(node)
+	}
+}
+
+func (l *linter) node(node parser.Node) {
+	switch node.Type {
+	case parser.TEXT_NODE:
+
+	case parser.IF_NODE:
+		l.ifNode(node)
+
+	case parser.FOR_NODE:
+		l.forNode(node)
+
+	case parser.SWITCH_NODE:
+		l.expr(node.Children[0])
+		for _, branch := range node.Children[1:] {
+			if branch.Type == parser.CASE_NODE {
+				l.exprs(branch.Children[0].Children)
+				l.nodes(branch.Children[1].Children)
+			} else {
+				l.nodes(branch.Children)
+			}
+		}
+
+	case parser.MACRO_NODE:
+		scope := make(map[string]local)
+		for _, param := range node.Children[0].Children {
+			l.exprs(param.Children)
+			scope[*param.Value] = local{kind: "macro parameter", pos: param.Pos}
+		}
+		l.scopes = append(l.scopes, scope)
+		l.nodes(node.Children[1].Children)
+		l.scopes = l.scopes[:len(l.scopes)-1]
+
+	case parser.CALL_BLOCK_NODE:
+		l.expr(node.Children[0])
+		l.nodes(node.Children[1].Children)
+
+	case parser.IMPORT_NODE, parser.FROM_IMPORT_NODE:
+
+	default:
+		l.expr(node)
+	}
+}
+
+// ifNode checks the conditions of an if statement against the ones before them
+func (l *linter) ifNode(node parser.Node) {
+	conditions := []parser.Node{node.Children[0]}
+	var alwaysTrue *parser.Node
+	if isAlwaysTrue(node.Children[0]) {
+		alwaysTrue = &node.Children[0]
+	}
+	l.expr(node.Children[0])
+
+	for _, branch := range node.Children[1:] {
+		switch branch.Type {
+		case parser.ELIF_BRANCH:
+			for _, elif := range branch.Children {
+				condition := elif.Children[0]
+				switch {
+				case alwaysTrue != nil:
+					l.report(elif.Pos, RuleUnreachableBranch, "elif branch never runs, the condition at %s is always true", alwaysTrue.Pos)
+				default:
+					for _, earlier := range conditions {
+						if sameNode(earlier, condition) {
+							l.report(elif.Pos, RuleDuplicateCondition, "elif condition repeats the condition at %s, its branch never runs", earlier.Pos)
+							break
+						}
+					}
+					if isAlwaysTrue(condition) {
+						alwaysTrue = &elif.Children[0]
+					}
+				}
+				conditions = append(conditions, condition)
+				l.expr(condition)
+				l.nodes(elif.Children[1:])
+			}
+
+		case parser.ELSE_BRANCH:
+			if alwaysTrue != nil {
+				pos := branch.Pos
+				if pos == (lexer.Position{}) {
+					pos = node.Pos
+				}
+				l.report(pos, RuleUnreachableBranch, "else branch never runs, the condition at %s is always true", alwaysTrue.Pos)
+			}
+			l.nodes(branch.Children)
+
+		default:
+			l.nodes(branch.Children)
+		}
+	}
+}
+
+func (l *linter) forNode(node parser.Node) {
+	iteratee := node.Children[0]
+	name := *iteratee.Value
+	if outer, found := l.lookup(name); found {
+		l.report(iteratee.Pos, RuleShadowedVariable, "loop variable '%s' shadows the %s at %s", name, outer.kind, outer.pos)
+	} else if pos, read := l.context[name]; read {
+		l.report(iteratee.Pos, RuleShadowedVariable, "loop variable '%s' shadows the context key '%s' used at %s", name, name, pos)
+	}
+
+	l.expr(node.Children[1])
+	l.scopes = append(l.scopes, map[string]local{name: {kind: "loop variable", pos: iteratee.Pos}})
+	l.nodes(node.Children[2].Children)
+	l.scopes = l.scopes[:len(l.scopes)-1]
+}
+
+func (l *linter) lookup(name string) (local, bool) {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if found, exists := l.scopes[i][name]; exists {
+			return found, true
+		}
+	}
+	return local{}, false
+}
+
+func (l *linter) exprs(nodes []parser.Node) {
+	for _, node := range nodes {
+		l.expr(node)
+	}
+}
+
+// expr checks the comparisons in an expression and in the expressions nested in it
+func (l *linter) expr(node parser.Node) {
+	if node.Type == parser.EXPRESSION_NODE {
+		l.comparisons(node.Children)
+	}
+	l.exprs(node.Children)
+}
+
+// comparisons reports comparisons between literals of different types, e.g. '5' == 5
+func (l *linter) comparisons(nodes []parser.Node) {
+	for i, node := range nodes {
+		op, isComparison := comparisons[node.Type]
+		if !isComparison || i == 0 || i == len(nodes)-1 {
+			continue
+		}
+		// Operators binding tighter than comparisons take the literal as their operand instead
+		if i >= 2 && (nodes[i-2].Type == parser.OP_BANG || nodes[i-2].Type == parser.OP_RANGE) {
+			continue
+		}
+		if i+2 < len(nodes) && nodes[i+2].Type == parser.OP_RANGE {
+			continue
+		}
+
+		left, leftIsLiteral := literalType(nodes[i-1])
+		right, rightIsLiteral := literalType(nodes[i+1])
+		if !leftIsLiteral || !rightIsLiteral {
+			continue
+		}
+
+		// The renderer compares values of different types as they're printed, so '5' == 5 is true
+		switch node.Type {
+		case parser.OP_EQUALS, parser.OP_NOT_EQUALS:
+			if left != right && left != "nil" && right != "nil" {
+				l.report(nodes[i-1].Pos, RuleIncompatibleComparison, "comparing a %s with a %s using '%s' compares them as text", left, right, op)
+			}
+		default:
+			if left != right {
+				l.report(nodes[i-1].Pos, RuleIncompatibleComparison, "ordering a %s against a %s using '%s' compares them as text", left, right, op)
+			}
+		}
+	}
+}
+
+// literalType returns the type of a scalar literal
+func literalType(node parser.Node) (string, bool) {
+	switch node.Type {
+	case parser.STRING_LITERAL_NODE:
+		return "string", true
+	case parser.NUMBER_LITERAL_NODE:
+		return "number", true
+	case parser.BOOLEAN_LITERAL_NODE:
+		return "boolean", true
+	case parser.NIL_LITERAL_NODE:
+		return "nil", true
+	default:
+		return "", false
+	}
+}
+
+// isAlwaysTrue reports whether a condition is made of literals only and evaluates to true
+func isAlwaysTrue(node parser.Node) bool {
+	value, constant := constantValue(node)
+	return constant && value == true
+}
+
+// constantValue evaluates literals, negated literals, and equality comparisons of two literals
+func constantValue(node parser.Node) (interface{}, bool) {
+	switch node.Type {
+	case parser.BOOLEAN_LITERAL_NODE:
+		return *node.Value == "true", true
+	case parser.STRING_LITERAL_NODE:
+		return *node.Value, true
+	case parser.NUMBER_LITERAL_NODE:
+		num, err := strconv.ParseFloat(*node.Value, 64)
+		return num, err == nil
+	case parser.EXPRESSION_NODE:
+	default:
+		return nil, false
+	}
+
+	children := node.Children
+	switch {
+	case len(children) == 1:
+		return constantValue(children[0])
+	case len(children) == 2 && children[0].Type == parser.OP_BANG:
+		value, constant := constantValue(children[1])
+		b, isBool := value.(bool)
+		return !b, constant && isBool
+	case len(children) == 3:
+		left, leftConstant := constantValue(children[0])
+		right, rightConstant := constantValue(children[2])
+		if !leftConstant || !rightConstant {
+			return nil, false
+		}
+		// Values of different types are compared as they're printed, as the renderer does
+		equal := left == right
+		if fmt.Sprintf("%T", left) != fmt.Sprintf("%T", right) {
+			equal = fmt.Sprint(left) == fmt.Sprint(right)
+		}
+		switch children[1].Type {
+		case parser.OP_EQUALS:
+			return equal, true
+		case parser.OP_NOT_EQUALS:
+			return !equal, true
+		}
+	}
+	return nil, false
+}
+
+// sameNode reports whether two nodes are the same expression, wherever they are in the template
+func sameNode(a, b parser.Node) bool {
+	if a.Type != b.Type || (a.Value == nil) != (b.Value == nil) || (a.Value != nil && *a.Value != *b.Value) {
+		return false
+	}
+	return slices.EqualFunc(a.Children, b.Children, sameNode)
+}
+
+func sortIssues(issues []Issue) []Issue {
+	slices.SortStableFunc(issues, func(a, b Issue) int {
+		if a.Pos.Line != b.Pos.Line {
+			return a.Pos.Line - b.Pos.Line
+		}
+		return a.Pos.Column - b.Pos.Column
+	})
+	return issues
+}
@@ -0,0 +1,139 @@
+package lint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{
+			name:    "Clean template",
+			content: "{{ for item in items }}{{ if item.qty > 1 }}{{ item.name }}{{ elif item.qty == 1 }}one{{ else }}none{{ endif }}{{ endfor }}",
+		},
+		{
+			name:     "Lexing errors",
+			content:  "a {{ 'x }}",
+			expected: []string{"1:6: unterminated string (syntax)"},
+		},
+		{
+			name:     "Parsing errors",
+			content:  "{{ x }}\n{{ x y }}",
+			expected: []string{"2:6: error parsing expression: expected '}}', got \"y\" at 2:6 (syntax)"},
+		},
+		{
+			name:    "Every broken tag reported",
+			content: "{{ if x == }}a{{ endif }}\n{{ for in items }}{{ x y }}{{ endfor }}\n{{ x }}{{ x y }}",
+			expected: []string{
+				"1:12: error parsing if statement: unexpected token in expression: \"}}\" at 1:12 (syntax)",
+				"2:8: error parsing for statement: expected iteratee after 'for', got \"in\" at 2:8 (syntax)",
+				"2:24: error parsing for statement: error parsing for body: expected '}}', got \"y\" at 2:24 (syntax)",
+				"3:13: error parsing expression: expected '}}', got \"y\" at 3:13 (syntax)",
+			},
+		},
+		{
+			name:    "Lexing errors don't hide parsing errors",
+			content: "{{ if }}a{{ endif }}\n{{ x == }}\n{{ for in x }}{{ endfor }}\n{{ x | y }}",
+			expected: []string{
+				"1:7: error parsing if statement: unexpected token in expression: \"}}\" at 1:7 (syntax)",
+				"2:9: error parsing expression: unexpected token in expression: \"}}\" at 2:9 (syntax)",
+				"3:8: error parsing for statement: expected iteratee after 'for', got \"in\" at 3:8 (syntax)",
+				"4:6: unexpected character '|' (syntax)",
+			},
+		},
+		{
+			name:    "Unclosed blocks don't hide parsing errors",
+			content: "{{ for i in x }}{{ if y }}{{ endfor }}\n{{ x y }}\n{{ endif }}{{ if x == }}",
+			expected: []string{
+				"1:17: 'if' is never closed with 'endif' (unclosed-block)",
+				"2:6: error parsing expression: expected '}}', got \"y\" at 2:6 (syntax)",
+				"3:1: 'endif' has no 'if' to close (unclosed-block)",
+				"3:12: 'if' is never closed with 'endif' (unclosed-block)",
+				"3:23: error parsing if statement: unexpected token in expression: \"}}\" at 3:23 (syntax)",
+			},
+		},
+		{
+			name:    "Broken tag whose stand-in fails too",
+			content: "{{ elif x == }}{{ x y }}",
+			expected: []string{
+				"1:1: malformed tokens. 'elif' cannot be used without 'if' (syntax)",
+				"1:21: error parsing expression: expected '}}', got \"y\" at 1:21 (syntax)",
+			},
+		},
+		{
+			name:    "Unclosed blocks",
+			content: "{{ for i in x }}\n{{ if y }}{{ switch i }}{{ case 1 }}{{ endfor }}\n{{ macro m() }}",
+			expected: []string{
+				"2:1: 'if' is never closed with 'endif' (unclosed-block)",
+				"2:11: 'switch' is never closed with 'endswitch' (unclosed-block)",
+				"3:1: 'macro' is never closed with 'endmacro' (unclosed-block)",
+			},
+		},
+		{
+			name:     "Closing tags without a block",
+			content:  "{{ if x }}{{ endif }}{{ endif }}",
+			expected: []string{"1:22: 'endif' has no 'if' to close (unclosed-block)"},
+		},
+		{
+			name:     "Inline conditionals don't open blocks",
+			content:  "{{ a if b else c }}",
+			expected: nil,
+		},
+		{
+			name:    "Shadowed variables",
+			content: "{{ item }}{{ for item in items }}{{ for item in item.children }}{{ endfor }}{{ endfor }}{{ macro m(row) }}{{ for row in rows }}{{ endfor }}{{ endmacro }}",
+			expected: []string{
+				"1:18: loop variable 'item' shadows the context key 'item' used at 1:4 (shadowed-variable)",
+				"1:41: loop variable 'item' shadows the loop variable at 1:18 (shadowed-variable)",
+				"1:114: loop variable 'row' shadows the macro parameter at 1:100 (shadowed-variable)",
+			},
+		},
+		{
+			name:     "Duplicate conditions",
+			content:  "{{ if role == 'admin' }}{{ elif isMod }}{{ elif role == 'admin' }}{{ endif }}",
+			expected: []string{"1:41: elif condition repeats the condition at 1:7, its branch never runs (duplicate-condition)"},
+		},
+		{
+			name:    "Unreachable branches",
+			content: "{{ if x }}{{ elif 1 == 1 }}{{ elif y }}{{ else }}-{{ endif }}{{ if !false }}{{ else }}-{{ endif }}",
+			expected: []string{
+				"1:28: elif branch never runs, the condition at 1:19 is always true (unreachable-branch)",
+				"1:40: else branch never runs, the condition at 1:19 is always true (unreachable-branch)",
+				"1:77: else branch never runs, the condition at 1:68 is always true (unreachable-branch)",
+			},
+		},
+		{
+			name:    "Incompatible comparisons",
+			content: "{{ if '18' == 18 || true < 1 }}{{ endif }}{{ x != 'a' }}{{ nil == 1 }}{{ 'a' < 'b' }}{{ [x == 1, 'a' != 2] }}",
+			expected: []string{
+				"1:7: comparing a string with a number using '==' compares them as text (incompatible-comparison)",
+				"1:21: ordering a boolean against a number using '<' compares them as text (incompatible-comparison)",
+				"1:98: comparing a string with a number using '!=' compares them as text (incompatible-comparison)",
+			},
+		},
+		{
+			name:    "Comparisons of different types as the renderer does them",
+			content: "{{ if '5' == 5 }}{{ else }}-{{ endif }}{{ if true != 'true' }}-{{ elif x }}{{ endif }}{{ false < true }}",
+			expected: []string{
+				"1:7: comparing a string with a number using '==' compares them as text (incompatible-comparison)",
+				"1:18: else branch never runs, the condition at 1:7 is always true (unreachable-branch)",
+				"1:46: comparing a boolean with a string using '!=' compares them as text (incompatible-comparison)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var issues []string
+			for _, issue := range Check(tt.content) {
+				issues = append(issues, issue.String())
+			}
+			require.Equal(t, tt.expected, issues)
+		})
+	}
+}
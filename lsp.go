@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ogzhanolguncu/zencefil/lsp"
+	"github.com/ogzhanolguncu/zencefil/schema"
+)
+
+func lspCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	schemaFile := flags.String("schema", "", "`file` describing the context, one 'path: TYPE' per line, its keys are completed")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: zencefil lsp [flags]\n\n"+
+			"Runs a language server over stdin and stdout for editors to give diagnostics, hovers, go-to-definition,\n"+
+			"completion, document symbols and semantic highlighting in templates.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	rest, err := parseFlags(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if len(rest) > 0 {
+		fmt.Fprintf(stderr, "zencefil lsp: unexpected argument '%s'\n\n", rest[0])
+		flags.Usage()
+		return exitUsage
+	}
+
+	server := lsp.NewServer()
+	if *schemaFile != "" {
+		content, err := os.ReadFile(*schemaFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "zencefil lsp: %v\n", err)
+			return exitFailure
+		}
+		if server.Schema, err = schema.Parse(string(content)); err != nil {
+			fmt.Fprintf(stderr, "zencefil lsp: %s: %v\n", *schemaFile, err)
+			return exitFailure
+		}
+	}
+
+	if err := server.Serve(stdin, stdout); err != nil {
+		fmt.Fprintf(stderr, "zencefil lsp: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,282 @@
+package lsp
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// Tags starting with these keywords open a block, continue it or close it
+var (
+	blockOpeners  = map[string]bool{"if": true, "for": true, "macro": true, "call": true, "switch": true}
+	blockBranches = map[string]bool{"elif": true, "else": true, "case": true, "default": true}
+)
+
+// document is an open template along with what the server found in it.
+// Tags and blocks come from the tokens alone, so they're there while the template is being typed and doesn't parse.
+type document struct {
+	uri     string
+	content string
+	lines   []int // offsets the lines start at
+	tokens  []lexer.Token
+	nodes   []parser.Node // nil when the template doesn't parse
+	tags    []*tag
+	blocks  []*block       // outermost blocks
+	blockOf map[int]*block // the block each block tag belongs to, keyed by the tag's start
+}
+
+// tag is a '{{ ... }}' of the template
+type tag struct {
+	start, end int // offsets of the opening delimiter and of the end of the closing one
+	open       int // index of the opening delimiter token
+	close      int // index of the closing delimiter token, len(tokens) when the tag isn't closed
+	keyword    string
+}
+
+// block is a statement from its opening tag to its closing tag, e.g. an if from '{{ if }}' to '{{ endif }}'
+type block struct {
+	tags     []*tag // opening tag, branches, then the closing tag if there is one
+	closed   bool
+	children []*block
+}
+
+func newDocument(uri, content string) *document {
+	d := &document{uri: uri, content: content, lines: []int{0}, blockOf: make(map[int]*block)}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' {
+			d.lines = append(d.lines, i+1)
+		}
+	}
+
+	tokens, err := lexer.New(content).Tokenize()
+	d.tokens = tokens
+	if err == nil {
+		if nodes, err := parser.New(tokens).Parse(); err == nil {
+			d.nodes = nodes
+		}
+	}
+	d.findTags()
+	return d
+}
+
+// findTags finds the tags and matches the block tags up into blocks
+func (d *document) findTags() {
+	var open []*block
+	for i := 0; i < len(d.tokens); i++ {
+		if d.tokens[i].Type != lexer.OPEN_CURLY {
+			continue
+		}
+		t := &tag{start: d.tokens[i].Pos.Offset, open: i, close: i + 1}
+		for t.close < len(d.tokens) && d.tokens[t.close].Type != lexer.CLOSE_CURLY {
+			t.close++
+		}
+		if t.close < len(d.tokens) {
+			t.end = d.tokens[t.close].Pos.Offset + len(d.tokens[t.close].Value)
+		} else {
+			t.end = len(d.content)
+		}
+		if i+1 < t.close && d.tokens[i+1].Type == lexer.KEYWORD {
+			t.keyword = d.tokens[i+1].Value
+		}
+		d.tags = append(d.tags, t)
+		i = t.close
+
+		switch {
+		case blockOpeners[t.keyword]:
+			b := &block{tags: []*tag{t}}
+			if len(open) > 0 {
+				parent := open[len(open)-1]
+				parent.children = append(parent.children, b)
+			} else {
+				d.blocks = append(d.blocks, b)
+			}
+			open = append(open, b)
+			d.blockOf[t.start] = b
+		case len(open) == 0:
+		case blockBranches[t.keyword]:
+			b := open[len(open)-1]
+			b.tags = append(b.tags, t)
+			d.blockOf[t.start] = b
+		case t.keyword == "end"+open[len(open)-1].tags[0].keyword:
+			b := open[len(open)-1]
+			b.tags = append(b.tags, t)
+			b.closed = true
+			d.blockOf[t.start] = b
+			open = open[:len(open)-1]
+		}
+	}
+}
+
+// keyword is the keyword of the block's opening tag
+func (b *block) keyword() string {
+	return b.tags[0].keyword
+}
+
+// bodyContains reports whether offset is between the end of the block's opening tag and the start of its closing tag
+func (b *block) bodyContains(d *document, offset int) bool {
+	end := len(d.content)
+	if b.closed {
+		end = b.tags[len(b.tags)-1].start
+	}
+	return offset >= b.tags[0].end && offset <= end
+}
+
+// enclosing returns the blocks whose body holds offset, outermost first
+func (d *document) enclosing(offset int) []*block {
+	var blocks []*block
+	for level := d.blocks; ; {
+		i := sort.Search(len(level), func(i int) bool { return level[i].tags[0].start > offset }) - 1
+		if i < 0 || !level[i].bodyContains(d, offset) {
+			return blocks
+		}
+		blocks = append(blocks, level[i])
+		level = level[i].children
+	}
+}
+
+// tagAt returns the tag offset is in, the end of a tag counts as being in it
+func (d *document) tagAt(offset int) *tag {
+	i := sort.Search(len(d.tags), func(i int) bool { return d.tags[i].start > offset }) - 1
+	if i < 0 || offset > d.tags[i].end {
+		return nil
+	}
+	return d.tags[i]
+}
+
+// inner returns the tokens between the delimiters of a tag
+func (d *document) inner(t *tag) []lexer.Token {
+	return d.tokens[t.open+1 : t.close]
+}
+
+// source returns what's written between the delimiters of a tag with its whitespace collapsed, e.g. "for x in xs"
+func (d *document) source(t *tag) string {
+	start := t.start + len(d.tokens[t.open].Value)
+	end := t.end
+	if t.close < len(d.tokens) {
+		end = d.tokens[t.close].Pos.Offset
+	}
+	return strings.Join(strings.Fields(d.content[start:end]), " ")
+}
+
+// tokenAt returns the index of the token under offset, a token just before offset also counts so the end of a word
+// being typed is found. Text is not a token for this.
+func (d *document) tokenAt(offset int) (int, bool) {
+	found := -1
+	for i, token := range d.tokens {
+		if token.Type == lexer.TEXT {
+			continue
+		}
+		if token.Pos.Offset > offset {
+			break
+		}
+		end := d.tokenEnd(i)
+		if offset < end {
+			return i, true
+		}
+		if offset == end && token.Type != lexer.CLOSE_CURLY {
+			found = i
+		}
+	}
+	return found, found >= 0
+}
+
+// tokenEnd returns the offset a token ends at in the source. String values have their escapes resolved,
+// so their end is found in the source.
+func (d *document) tokenEnd(i int) int {
+	token := d.tokens[i]
+	start := token.Pos.Offset
+	if token.Type != lexer.STRING {
+		return min(start+len(token.Value), len(d.content))
+	}
+	quote := d.content[start]
+	for j := start + 1; j < len(d.content); j++ {
+		switch d.content[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1
+		case '\n':
+			return j
+		}
+	}
+	return len(d.content)
+}
+
+// nodeAt returns the innermost node starting where the token under offset does, along with the nodes it's in.
+// Statements start at their '{{', so anywhere else in a block tag finds the statement.
+func (d *document) nodeAt(offset int) (parser.Node, []parser.Node, bool) {
+	i, ok := d.tokenAt(offset)
+	if !ok || d.nodes == nil {
+		return parser.Node{}, nil, false
+	}
+	if node, parents, ok := findNode(d.nodes, nil, d.tokens[i].Pos.Offset); ok {
+		return node, parents, true
+	}
+	if t := d.tagAt(offset); t != nil {
+		start := t.start
+		// Closing tags and empty else branches have no node of their own
+		if b := d.blockOf[t.start]; b != nil {
+			if node, parents, ok := findNode(d.nodes, nil, t.start); ok {
+				return node, parents, true
+			}
+			start = b.tags[0].start
+		}
+		return findNode(d.nodes, nil, start)
+	}
+	return parser.Node{}, nil, false
+}
+
+func findNode(nodes []parser.Node, parents []parser.Node, offset int) (parser.Node, []parser.Node, bool) {
+	var found parser.Node
+	var foundParents []parser.Node
+	ok := false
+	for _, node := range nodes {
+		// Grouping nodes such as THEN_BRANCH have no position
+		if node.Pos != (lexer.Position{}) && node.Pos.Offset == offset {
+			found, foundParents, ok = node, parents, true
+		}
+		if child, childParents, childOK := findNode(node.Children, append(parents[:len(parents):len(parents)], node), offset); childOK {
+			return child, childParents, true
+		}
+		if ok {
+			return found, foundParents, true
+		}
+	}
+	return found, foundParents, ok
+}
+
+// position turns an offset into a position
+func (d *document) position(offset int) Position {
+	line := sort.Search(len(d.lines), func(i int) bool { return d.lines[i] > offset }) - 1
+	return Position{Line: line, Character: utf16Len(d.content[d.lines[line]:offset])}
+}
+
+// offset turns a position into an offset, positions past the end of their line are at its end
+func (d *document) offset(pos Position) int {
+	if pos.Line >= len(d.lines) {
+		return len(d.content)
+	}
+	offset := d.lines[pos.Line]
+	for units := 0; units < pos.Character && offset < len(d.content) && d.content[offset] != '\n'; {
+		r, size := utf8.DecodeRuneInString(d.content[offset:])
+		units += max(utf16.RuneLen(r), 1)
+		offset += size
+	}
+	return offset
+}
+
+func (d *document) rangeOf(start, end int) Range {
+	return Range{Start: d.position(start), End: d.position(end)}
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += max(utf16.RuneLen(r), 1)
+	}
+	return n
+}
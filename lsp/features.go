@@ -0,0 +1,470 @@
+package lsp
+
+import (
+	"cmp"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/analyzer"
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+	"github.com/ogzhanolguncu/zencefil/renderer"
+	"github.com/ogzhanolguncu/zencefil/schema"
+)
+
+var (
+	// A key being typed after a chain of keys, e.g. 'user.address.' or 'user.na'
+	memberPattern = regexp.MustCompile(`([A-Za-z_]\w*(?:\.[A-Za-z_]\w*)*)\.\w*$`)
+	// A test name being typed, e.g. 'x is ' or 'x is not ev'
+	testPattern = regexp.MustCompile(`\bis\s+(?:not\s+)?\w*$`)
+)
+
+// definition is a name the template defines, found from its tags
+type definition struct {
+	name     string
+	kind     CompletionItemKind
+	start    int    // offset of the name where it's defined
+	detail   string // the tag defining it
+	template string // for imports, the imported template
+	macro    string // for names imported with 'from', the name of the macro in the imported template
+	// source is the path of the context a loop variable goes over, e.g. "order.items".
+	// It's empty for the other locals and for loops over anything but a chain of keys.
+	source string
+}
+
+// globals returns the macros and imported names of the template, they can be used anywhere in it
+func (d *document) globals() []definition {
+	var defs []definition
+	for _, t := range d.tags {
+		tokens := d.inner(t)
+		switch {
+		case t.keyword == "macro" && len(tokens) > 1 && tokens[1].Type == lexer.IDENTIFIER:
+			defs = append(defs, definition{name: tokens[1].Value, kind: CompletionFunction, start: tokens[1].Pos.Offset, detail: d.source(t)})
+
+		// import 'forms.html' as forms
+		case t.keyword == "import" && len(tokens) == 4 && tokens[1].Type == lexer.STRING && tokens[3].Type == lexer.IDENTIFIER:
+			defs = append(defs, definition{name: tokens[3].Value, kind: CompletionModule, start: tokens[3].Pos.Offset, detail: d.source(t), template: tokens[1].Value})
+
+		// from 'forms.html' import field, button as btn
+		case t.keyword == "from" && len(tokens) > 3 && tokens[1].Type == lexer.STRING:
+			for j := 3; j < len(tokens); j++ {
+				if tokens[j].Type != lexer.IDENTIFIER || (tokens[j-1].Type != lexer.COMMA && tokens[j-1].Value != "import") {
+					continue
+				}
+				def := definition{name: tokens[j].Value, kind: CompletionFunction, start: tokens[j].Pos.Offset, detail: d.source(t), template: tokens[1].Value, macro: tokens[j].Value}
+				if j+2 < len(tokens) && tokens[j+1].Value == "as" && tokens[j+2].Type == lexer.IDENTIFIER {
+					def.name, def.start = tokens[j+2].Value, tokens[j+2].Pos.Offset
+				}
+				defs = append(defs, def)
+			}
+		}
+	}
+	return defs
+}
+
+// locals returns the loop variables and macro parameters available at offset, the innermost ones last
+func (d *document) locals(offset int) []definition {
+	var defs []definition
+	for _, b := range d.enclosing(offset) {
+		open := b.tags[0]
+		tokens := d.inner(open)
+		switch b.keyword() {
+		case "for":
+			// for item in order.items
+			if len(tokens) < 4 || tokens[1].Type != lexer.IDENTIFIER {
+				continue
+			}
+			def := definition{name: tokens[1].Value, kind: CompletionVariable, start: tokens[1].Pos.Offset, detail: d.source(open)}
+			if source, ok := keyPath(tokens[3:]); ok {
+				def.source = source
+			}
+			defs = append(defs, def)
+
+		case "macro":
+			// Parameters are the names right after '(' or ',' outside of default values
+			depth := 0
+			for j, token := range tokens {
+				switch token.Type {
+				case lexer.LPAREN, lexer.OPEN_BRACKET, lexer.LBRACE:
+					depth++
+				case lexer.RPAREN, lexer.CLOSE_BRACKET, lexer.RBRACE:
+					depth--
+				case lexer.IDENTIFIER:
+					if depth == 1 && (tokens[j-1].Type == lexer.LPAREN || tokens[j-1].Type == lexer.COMMA) {
+						defs = append(defs, definition{name: token.Value, kind: CompletionVariable, start: token.Pos.Offset, detail: d.source(open)})
+					}
+				}
+			}
+		}
+	}
+	return defs
+}
+
+// keyPath returns the path written by tokens that are only a chain of keys, e.g. "order.items"
+func keyPath(tokens []lexer.Token) (string, bool) {
+	var sb strings.Builder
+	for i, token := range tokens {
+		if (i%2 == 0) != (token.Type == lexer.IDENTIFIER) || (i%2 == 1 && token.Type != lexer.DOT) {
+			return "", false
+		}
+		sb.WriteString(token.Value)
+	}
+	return sb.String(), len(tokens)%2 == 1
+}
+
+// lookup finds what a name used at offset refers to, locals shadow globals
+func (d *document) lookup(name string, offset int) (definition, bool) {
+	locals := d.locals(offset)
+	for i := len(locals) - 1; i >= 0; i-- {
+		if locals[i].name == name {
+			return locals[i], true
+		}
+	}
+	for _, def := range d.globals() {
+		if def.name == name {
+			return def, true
+		}
+	}
+	return definition{}, false
+}
+
+// contextPath turns a path used at offset into the context path it reads, e.g. "item.name" in a loop over
+// order.items reads "order.items[].name". It's false for paths on locals that don't come from the context.
+func (d *document) contextPath(path string, offset int) (string, bool) {
+	root, rest, hasRest := strings.Cut(path, ".")
+	def, found := d.lookup(root, offset)
+	if !found {
+		return path, true
+	}
+	if def.source == "" {
+		return "", false
+	}
+	// The loop's source is resolved where the loop is, outside of its body
+	resolved, ok := d.contextPath(def.source, def.start)
+	if !ok {
+		return "", false
+	}
+	resolved += "[]"
+	if hasRest {
+		resolved += "." + rest
+	}
+	return resolved, true
+}
+
+func (d *document) location(start, end int) Location {
+	return Location{URI: d.uri, Range: d.rangeOf(start, end)}
+}
+
+// hover shows the kind of the node under the cursor and, for context values, their path and type in the schema
+func (s *Server) hover(d *document, offset int) *Hover {
+	node, parents, ok := d.nodeAt(offset)
+	if !ok {
+		return nil
+	}
+
+	text := "`" + node.Type.String() + "`"
+	if path, ok := usePath(d.nodes, node, parents); ok {
+		text += "\n\n`" + path + "`"
+		if field := s.lookupField(path); field != nil {
+			text += ": " + field.Type.String()
+			if field.Optional {
+				text += " (optional)"
+			}
+		}
+	}
+
+	var hoverRange Range
+	if i, ok := d.tokenAt(offset); ok {
+		hoverRange = d.rangeOf(d.tokens[i].Pos.Offset, d.tokenEnd(i))
+	}
+	return &Hover{Contents: markupContent{Kind: "markdown", Value: text}, Range: hoverRange}
+}
+
+// usePath returns the context path read by a variable or by a key accessed on it, e.g. "items[].name"
+// for 'name' in {{ for item in items }}{{ item.name }}
+func usePath(nodes []parser.Node, node parser.Node, parents []parser.Node) (string, bool) {
+	start := node
+	switch node.Type {
+	case parser.VARIABLE_NODE:
+	case parser.OBJECT_ACCESOR:
+		start, parents = parents[len(parents)-1], parents[:len(parents)-1]
+	default:
+		return "", false
+	}
+
+	// The analyzer reports the whole chain of accesses, the keys after the node aren't part of its path
+	after := 0
+	for len(parents) > 0 {
+		parent := parents[len(parents)-1]
+		if parent.Type != parser.OBJECT_ACCESS_NODE || parent.Children[0].Type != start.Type || parent.Children[0].Pos != start.Pos {
+			break
+		}
+		start, parents = parent, parents[:len(parents)-1]
+		after++
+	}
+
+	for _, variable := range analyzer.Analyze(nodes).Variables {
+		for _, use := range variable.Uses {
+			if use.Pos == start.Pos && len(use.Path) >= after {
+				return analyzer.FormatPath(variable.Name, use.Path[:len(use.Path)-after]), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (s *Server) lookupField(path string) *schema.Field {
+	if s.Schema == nil {
+		return nil
+	}
+	return s.Schema.Lookup(path)
+}
+
+// definition finds where the name under the cursor is defined: macros, loop variables, macro parameters and imported
+// names. Imported templates go to their file and the tags in a block go to the tag opening it.
+func (s *Server) definition(d *document, offset int) *Location {
+	i, ok := d.tokenAt(offset)
+	if !ok {
+		return nil
+	}
+	token := d.tokens[i]
+	t := d.tagAt(token.Pos.Offset)
+	if t == nil {
+		return nil
+	}
+
+	switch token.Type {
+	case lexer.KEYWORD:
+		if b := d.blockOf[t.start]; b != nil && b.tags[0] != t {
+			loc := d.location(b.tags[0].start, b.tags[0].end)
+			return &loc
+		}
+
+	case lexer.STRING:
+		if t.keyword == "import" || t.keyword == "from" {
+			if target := s.load(d, token.Value); target != nil {
+				return &Location{URI: target.uri}
+			}
+		}
+
+	case lexer.IDENTIFIER:
+		// Keyword arguments aren't names
+		if i+1 < t.close && d.tokens[i+1].Type == lexer.ASSIGN && t.keyword != "macro" {
+			return nil
+		}
+		if i > 0 && d.tokens[i-1].Type == lexer.DOT {
+			// A macro of an imported template, e.g. 'field' in forms.field()
+			if i < 2 || d.tokens[i-2].Type != lexer.IDENTIFIER || (i > 2 && d.tokens[i-3].Type == lexer.DOT) {
+				return nil
+			}
+			def, found := d.lookup(d.tokens[i-2].Value, token.Pos.Offset)
+			if !found || def.template == "" || def.macro != "" {
+				return nil
+			}
+			return s.macroLocation(d, def.template, token.Value)
+		}
+
+		def, found := d.lookup(token.Value, token.Pos.Offset)
+		switch {
+		case !found:
+			return nil
+		case def.macro != "":
+			return s.macroLocation(d, def.template, def.macro)
+		case def.template != "":
+			if target := s.load(d, def.template); target != nil {
+				return &Location{URI: target.uri}
+			}
+			return nil
+		}
+		loc := d.location(def.start, def.start+len(def.name))
+		return &loc
+	}
+	return nil
+}
+
+// macroLocation finds a macro defined in a template imported by d
+func (s *Server) macroLocation(d *document, template, macro string) *Location {
+	target := s.load(d, template)
+	if target == nil {
+		return nil
+	}
+	for _, def := range target.globals() {
+		if def.name == macro && def.template == "" {
+			loc := target.location(def.start, def.start+len(def.name))
+			return &loc
+		}
+	}
+	return nil
+}
+
+// completion offers what can be written at the cursor inside a tag: tests after 'is', keys of the context and
+// macros of imported templates after a '.', and names anywhere else
+func (s *Server) completion(d *document, offset int) []CompletionItem {
+	items := []CompletionItem{}
+	t := d.tagAt(offset)
+	if t == nil {
+		return items
+	}
+	start := t.start + len(d.tokens[t.open].Value)
+	if offset < start || (t.close < len(d.tokens) && offset > d.tokens[t.close].Pos.Offset) {
+		return items
+	}
+	before := d.content[start:offset]
+
+	if testPattern.MatchString(before) {
+		for _, test := range renderer.TestNames() {
+			items = append(items, CompletionItem{Label: test, Kind: CompletionFunction, Detail: "test"})
+		}
+		return items
+	}
+	if match := memberPattern.FindStringSubmatch(before); match != nil {
+		return s.members(d, match[1], offset)
+	}
+
+	seen := make(map[string]bool)
+	add := func(item CompletionItem) {
+		if !seen[item.Label] {
+			seen[item.Label] = true
+			items = append(items, item)
+		}
+	}
+	locals := d.locals(offset)
+	for i := len(locals) - 1; i >= 0; i-- {
+		add(CompletionItem{Label: locals[i].name, Kind: locals[i].kind, Detail: locals[i].detail})
+	}
+	for _, def := range d.globals() {
+		add(CompletionItem{Label: def.name, Kind: def.kind, Detail: def.detail})
+	}
+	if s.Schema != nil {
+		for _, name := range slices.Sorted(maps.Keys(s.Schema.Fields)) {
+			add(CompletionItem{Label: name, Kind: CompletionVariable, Detail: s.Schema.Fields[name].Type.String()})
+		}
+	}
+	for _, name := range renderer.BuiltinNames() {
+		add(CompletionItem{Label: name, Kind: CompletionFunction, Detail: "builtin"})
+	}
+	for _, keyword := range lexer.Keywords() {
+		add(CompletionItem{Label: keyword, Kind: CompletionKeyword})
+	}
+	return items
+}
+
+// members offers what can come after 'path.'
+func (s *Server) members(d *document, path string, offset int) []CompletionItem {
+	items := []CompletionItem{}
+	if def, found := d.lookup(path, offset); found && def.template != "" && def.macro == "" {
+		if target := s.load(d, def.template); target != nil {
+			for _, macro := range target.globals() {
+				if macro.kind == CompletionFunction && macro.template == "" {
+					items = append(items, CompletionItem{Label: macro.name, Kind: CompletionFunction, Detail: macro.detail})
+				}
+			}
+		}
+		return items
+	}
+
+	contextPath, ok := d.contextPath(path, offset)
+	if !ok {
+		return items
+	}
+	field := s.lookupField(contextPath)
+	if field == nil {
+		return items
+	}
+	for _, key := range slices.Sorted(maps.Keys(field.Fields)) {
+		items = append(items, CompletionItem{Label: key, Kind: CompletionField, Detail: field.Fields[key].Type.String()})
+	}
+	if field.Type == schema.STRING {
+		for _, method := range renderer.StringMethodNames() {
+			items = append(items, CompletionItem{Label: method, Kind: CompletionMethod, Detail: "string method"})
+		}
+	}
+	return items
+}
+
+// symbols lists the blocks of the template, nested in each other, and its imports
+func (s *Server) symbols(d *document) []DocumentSymbol {
+	symbols := blockSymbols(d, d.blocks)
+	for _, t := range d.tags {
+		if (t.keyword == "import" || t.keyword == "from") && len(d.enclosing(t.start)) == 0 {
+			r := d.rangeOf(t.start, t.end)
+			symbols = append(symbols, DocumentSymbol{Name: d.source(t), Kind: SymbolModule, Range: r, SelectionRange: r})
+		}
+	}
+	slices.SortFunc(symbols, func(a, b DocumentSymbol) int {
+		return cmp.Or(cmp.Compare(a.Range.Start.Line, b.Range.Start.Line), cmp.Compare(a.Range.Start.Character, b.Range.Start.Character))
+	})
+	return symbols
+}
+
+func blockSymbols(d *document, blocks []*block) []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	for _, b := range blocks {
+		open := b.tags[0]
+		end := len(d.content)
+		if b.closed {
+			end = b.tags[len(b.tags)-1].end
+		}
+		kind := SymbolNamespace
+		switch b.keyword() {
+		case "macro":
+			kind = SymbolFunction
+		case "for":
+			kind = SymbolArray
+		}
+		symbols = append(symbols, DocumentSymbol{
+			Name:           d.source(open),
+			Kind:           kind,
+			Range:          d.rangeOf(open.start, end),
+			SelectionRange: d.rangeOf(open.start, open.end),
+			Children:       blockSymbols(d, b.children),
+		})
+	}
+	return symbols
+}
+
+// semanticTokens classifies the tokens inside tags for highlighting, text and delimiters are left to the editor
+func (s *Server) semanticTokens(d *document) semanticTokens {
+	data := []int{}
+	var prev Position
+	for i, token := range d.tokens {
+		var tokenType int
+		switch token.Type {
+		case lexer.TEXT, lexer.OPEN_CURLY, lexer.CLOSE_CURLY, lexer.ILLEGAL, lexer.EOF:
+			continue
+		case lexer.KEYWORD, lexer.BOOLEAN, lexer.NIL:
+			tokenType = tokenKeyword
+		case lexer.STRING:
+			tokenType = tokenString
+		case lexer.NUMBER:
+			tokenType = tokenNumber
+		case lexer.IDENTIFIER:
+			switch {
+			case i+1 < len(d.tokens) && d.tokens[i+1].Type == lexer.LPAREN:
+				tokenType = tokenFunction
+			case i > 0 && d.tokens[i-1].Type == lexer.DOT:
+				tokenType = tokenProperty
+			case i > 0 && (d.tokens[i-1].Value == "is" || (d.tokens[i-1].Value == "not" && i > 1 && d.tokens[i-2].Value == "is")):
+				// Tests
+				tokenType = tokenFunction
+			default:
+				tokenType = tokenVariable
+			}
+		default:
+			tokenType = tokenOperator
+		}
+
+		// Each token is encoded relative to the previous one
+		start := d.position(token.Pos.Offset)
+		deltaChar := start.Character
+		if start.Line == prev.Line {
+			deltaChar -= prev.Character
+		}
+		length := utf16Len(d.content[token.Pos.Offset:d.tokenEnd(i)])
+		data = append(data, start.Line-prev.Line, deltaChar, length, tokenType, 0)
+		prev = start
+	}
+	return semanticTokens{Data: data}
+}
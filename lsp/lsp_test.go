@@ -0,0 +1,273 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ogzhanolguncu/zencefil/schema"
+	"github.com/stretchr/testify/require"
+)
+
+// session sends messages to a server and collects what it writes back
+type session struct {
+	t      *testing.T
+	server *Server
+	input  bytes.Buffer
+	nextID int
+}
+
+func newSession(t *testing.T) *session {
+	return &session{t: t, server: NewServer()}
+}
+
+func (s *session) send(method string, params interface{}) int {
+	s.nextID++
+	s.write(map[string]interface{}{"jsonrpc": "2.0", "id": s.nextID, "method": method, "params": params})
+	return s.nextID
+}
+
+func (s *session) notify(method string, params interface{}) {
+	s.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *session) write(message interface{}) {
+	require.NoError(s.t, writeMessage(&s.input, message))
+}
+
+// run serves everything sent so far and returns the results by request ID and the notifications in order
+func (s *session) run() (map[int]json.RawMessage, []notification) {
+	var output bytes.Buffer
+	require.NoError(s.t, s.server.Serve(&s.input, &output))
+
+	results := make(map[int]json.RawMessage)
+	var notifications []notification
+	reader := bufio.NewReader(&output)
+	for {
+		body, err := readMessage(reader)
+		if err != nil {
+			break
+		}
+		var message struct {
+			ID     *int            `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+			Error  *responseError  `json:"error"`
+		}
+		require.NoError(s.t, json.Unmarshal(body, &message))
+		switch {
+		case message.Error != nil:
+			results[*message.ID] = json.RawMessage(fmt.Sprintf(`{"error": %d}`, message.Error.Code))
+		case message.ID != nil:
+			results[*message.ID] = message.Result
+		default:
+			notifications = append(notifications, notification{Method: message.Method, Params: message.Params})
+		}
+	}
+	return results, notifications
+}
+
+func docID(uri string) map[string]interface{} {
+	return map[string]interface{}{"uri": uri}
+}
+
+func at(uri string, line, character int) map[string]interface{} {
+	return map[string]interface{}{"textDocument": docID(uri), "position": Position{Line: line, Character: character}}
+}
+
+func decode[T any](t *testing.T, raw json.RawMessage) T {
+	var value T
+	require.NoError(t, json.Unmarshal(raw, &value))
+	return value
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "forms.html"), []byte("{{ macro field(name) }}<input>{{ endmacro }}\n{{ macro button() }}<button>{{ endmacro }}"), 0o644))
+	uri := pathURI(filepath.Join(dir, "page.html"))
+	content := strings.Join([]string{
+		"{{ import 'forms.html' as forms }}{{ from 'forms.html' import button as btn }}",
+		"{{ macro greet(who, greeting='Hi') }}{{ greeting }} {{ who }}{{ endmacro }}",
+		"{{ for item in order.items }}",
+		"  {{ if item.qty > 1 }}{{ item.name }}{{ else }}{{ greet(item.name) }}{{ endif }}",
+		"{{ endfor }}{{ forms.field('x') }}{{ btn() }}",
+	}, "\n")
+
+	s := newSession(t)
+	var err error
+	s.server.Schema, err = schema.Parse("order.items[].name: STRING\norder.items[].qty: NUMBER\ntitle: STRING (optional)")
+	require.NoError(t, err)
+
+	initialize := s.send("initialize", map[string]interface{}{})
+	s.notify("initialized", map[string]interface{}{})
+	s.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "text": content}})
+
+	hoverAccessor := s.send("textDocument/hover", at(uri, 3, 32))
+	hoverVariable := s.send("textDocument/hover", at(uri, 1, 41))
+	hoverEnd := s.send("textDocument/hover", at(uri, 3, 75))
+	hoverText := s.send("textDocument/hover", at(uri, 4, 100))
+
+	definitionLoopVar := s.send("textDocument/definition", at(uri, 3, 9))
+	definitionParam := s.send("textDocument/definition", at(uri, 1, 56))
+	definitionMacro := s.send("textDocument/definition", at(uri, 3, 52))
+	definitionEndfor := s.send("textDocument/definition", at(uri, 4, 4))
+	definitionImported := s.send("textDocument/definition", at(uri, 4, 21))
+	definitionFrom := s.send("textDocument/definition", at(uri, 4, 38))
+	definitionTemplate := s.send("textDocument/definition", at(uri, 0, 12))
+
+	symbols := s.send("textDocument/documentSymbol", map[string]interface{}{"textDocument": docID(uri)})
+	tokens := s.send("textDocument/semanticTokens/full", map[string]interface{}{"textDocument": docID(uri)})
+
+	// Completion happens while typing, when the template doesn't parse
+	typing := strings.Replace(content, "{{ item.name }}", "{{ item. }}{{ x is  }}", 1)
+	s.notify("textDocument/didChange", map[string]interface{}{"textDocument": docID(uri), "contentChanges": []map[string]string{{"text": typing}}})
+	completeMember := s.send("textDocument/completion", at(uri, 3, 31))
+	completeTest := s.send("textDocument/completion", at(uri, 3, 42))
+	completeName := s.send("textDocument/completion", at(uri, 3, 27))
+	completeImported := s.send("textDocument/completion", at(uri, 4, 21))
+
+	unknown := s.send("textDocument/formatting", map[string]interface{}{"textDocument": docID(uri)})
+	s.notify("textDocument/didClose", map[string]interface{}{"textDocument": docID(uri)})
+	shutdown := s.send("shutdown", nil)
+	s.notify("exit", nil)
+	s.send("hover", nil) // never read
+
+	results, notifications := s.run()
+
+	t.Run("Initialize", func(t *testing.T) {
+		capabilities := decode[map[string]map[string]interface{}](t, results[initialize])["capabilities"]
+		require.Equal(t, true, capabilities["definitionProvider"])
+		require.Contains(t, capabilities, "semanticTokensProvider")
+		require.Equal(t, "null", string(results[shutdown]))
+		require.Len(t, results, 20, "nothing after 'exit' is answered")
+		require.JSONEq(t, `{"error": -32601}`, string(results[unknown]))
+	})
+
+	t.Run("Diagnostics", func(t *testing.T) {
+		require.Len(t, notifications, 3)
+		opened := decode[publishDiagnosticsParams](t, notifications[0].Params.(json.RawMessage))
+		require.Equal(t, uri, opened.URI)
+		require.Empty(t, opened.Diagnostics)
+
+		changed := decode[publishDiagnosticsParams](t, notifications[1].Params.(json.RawMessage))
+		require.Equal(t, []Diagnostic{{
+			Range:    Range{Start: Position{Line: 3, Character: 32}, End: Position{Line: 3, Character: 34}},
+			Severity: SeverityError,
+			Code:     "syntax",
+			Source:   "zencefil",
+			Message:  "error parsing for statement: error parsing for body: error parsing nested if statement: error parsing then block: expected attribute name after '.', got \"}}\" at 4:33",
+		}, {
+			Range:    Range{Start: Position{Line: 3, Character: 43}, End: Position{Line: 3, Character: 45}},
+			Severity: SeverityError,
+			Code:     "syntax",
+			Source:   "zencefil",
+			Message:  "error parsing for statement: error parsing for body: error parsing nested if statement: error parsing then block: expected test name after 'is', got \"}}\" at 4:44",
+		}}, changed.Diagnostics)
+
+		closed := decode[publishDiagnosticsParams](t, notifications[2].Params.(json.RawMessage))
+		require.Empty(t, closed.Diagnostics)
+	})
+
+	t.Run("Hover", func(t *testing.T) {
+		hover := decode[Hover](t, results[hoverAccessor])
+		require.Equal(t, "`OBJECT_ACCESOR`\n\n`order.items[].name`: STRING", hover.Contents.Value)
+		require.Equal(t, Range{Start: Position{Line: 3, Character: 31}, End: Position{Line: 3, Character: 35}}, hover.Range)
+
+		// Macro parameters aren't read from the context
+		require.Equal(t, "`VARIABLE_NODE`", decode[Hover](t, results[hoverVariable]).Contents.Value)
+		require.Equal(t, "`IF_NODE`", decode[Hover](t, results[hoverEnd]).Contents.Value)
+		require.Equal(t, "null", string(results[hoverText]))
+	})
+
+	t.Run("Definition", func(t *testing.T) {
+		location := func(id int) Location {
+			return decode[Location](t, results[id])
+		}
+		span := func(line, start, end int) Range {
+			return Range{Start: Position{Line: line, Character: start}, End: Position{Line: line, Character: end}}
+		}
+		require.Equal(t, Location{URI: uri, Range: span(2, 7, 11)}, location(definitionLoopVar))
+		require.Equal(t, Location{URI: uri, Range: span(1, 15, 18)}, location(definitionParam))
+		require.Equal(t, Location{URI: uri, Range: span(1, 9, 14)}, location(definitionMacro))
+		require.Equal(t, Location{URI: uri, Range: span(2, 0, 29)}, location(definitionEndfor))
+
+		forms := pathURI(filepath.Join(dir, "forms.html"))
+		require.Equal(t, Location{URI: forms, Range: span(0, 9, 14)}, location(definitionImported))
+		require.Equal(t, Location{URI: forms, Range: span(1, 9, 15)}, location(definitionFrom))
+		require.Equal(t, Location{URI: forms}, location(definitionTemplate))
+	})
+
+	t.Run("Symbols", func(t *testing.T) {
+		var names []string
+		var walk func(symbols []DocumentSymbol, indent string)
+		walk = func(symbols []DocumentSymbol, indent string) {
+			for _, symbol := range symbols {
+				names = append(names, fmt.Sprintf("%s%s %d:%d-%d:%d", indent, symbol.Name, symbol.Range.Start.Line, symbol.Range.Start.Character, symbol.Range.End.Line, symbol.Range.End.Character))
+				walk(symbol.Children, indent+"  ")
+			}
+		}
+		walk(decode[[]DocumentSymbol](t, results[symbols]), "")
+		require.Equal(t, []string{
+			"import 'forms.html' as forms 0:0-0:34",
+			"from 'forms.html' import button as btn 0:34-0:78",
+			"macro greet(who, greeting='Hi') 1:0-1:75",
+			"for item in order.items 2:0-4:12",
+			"  if item.qty > 1 3:2-3:81",
+		}, names)
+	})
+
+	t.Run("Semantic tokens", func(t *testing.T) {
+		data := decode[semanticTokens](t, results[tokens]).Data
+		require.Equal(t, 0, len(data)%5)
+		// {{ import 'forms.html' as forms }}
+		require.Equal(t, []int{
+			0, 3, 6, tokenKeyword, 0,
+			0, 7, 12, tokenString, 0,
+			0, 13, 2, tokenKeyword, 0,
+			0, 3, 5, tokenVariable, 0,
+		}, data[:20])
+	})
+
+	t.Run("Completion", func(t *testing.T) {
+		labels := func(id int) []string {
+			var labels []string
+			for _, item := range decode[[]CompletionItem](t, results[id]) {
+				labels = append(labels, item.Label)
+			}
+			return labels
+		}
+		require.Equal(t, []string{"name", "qty"}, labels(completeMember))
+		require.Contains(t, labels(completeTest), "even")
+		require.Contains(t, labels(completeTest), "defined")
+
+		names := labels(completeName)
+		require.Equal(t, []string{"item", "forms", "btn", "greet", "order", "title", "range"}, names[:7])
+		require.Contains(t, names, "endfor")
+		require.Equal(t, []string{"field", "button"}, labels(completeImported))
+	})
+}
+
+func TestReadMessage(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("Content-Length: 2\r\nContent-Type: application/vscode-jsonrpc\r\n\r\n{}Content-Type: x\r\n\r\n"))
+	body, err := readMessage(reader)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(body))
+
+	_, err = readMessage(reader)
+	require.EqualError(t, err, "message without a Content-Length header")
+}
+
+func TestPositions(t *testing.T) {
+	d := newDocument("file:///t.html", "héllo\n😀{{ x }}")
+	require.Equal(t, Position{Line: 1, Character: 2}, d.position(len("héllo\n😀")))
+	require.Equal(t, len("héllo\n😀"), d.offset(Position{Line: 1, Character: 2}))
+	require.Equal(t, len("hé"), d.offset(Position{Line: 0, Character: 2}))
+	require.Equal(t, len("héllo"), d.offset(Position{Line: 0, Character: 99}))
+	require.Equal(t, len(d.content), d.offset(Position{Line: 5}))
+}
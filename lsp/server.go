@@ -0,0 +1,222 @@
+// Package lsp is a Language Server Protocol server for templates. It gives editors diagnostics, hovers,
+// go-to-definition, completion, document symbols and semantic highlighting over stdio.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/ogzhanolguncu/zencefil/lint"
+	"github.com/ogzhanolguncu/zencefil/schema"
+)
+
+// Server keeps the open templates and answers the client's requests about them
+type Server struct {
+	// Schema describes the context templates are rendered with, its keys are offered as completions.
+	// It's nil when there is none.
+	Schema *schema.Schema
+
+	documents map[string]*document
+	out       io.Writer
+}
+
+func NewServer() *Server {
+	return &Server{documents: make(map[string]*document)}
+}
+
+// Serve answers the messages read from in until the client sends 'exit' or in is closed
+func (s *Server) Serve(in io.Reader, out io.Writer) error {
+	s.out = out
+	reader := bufio.NewReader(in)
+	for {
+		body, err := readMessage(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			if err := s.reply(nil, nil, &responseError{Code: codeParseError, Message: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+
+		result, err := s.handle(req)
+		// Notifications don't get a response
+		if req.ID == nil {
+			continue
+		}
+		if err := s.reply(req.ID, result, err); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, err error) error {
+	resp := response{JSONRPC: "2.0", ID: id}
+	if err != nil {
+		var respErr *responseError
+		if !errors.As(err, &respErr) {
+			respErr = &responseError{Code: codeInvalidParams, Message: err.Error()}
+		}
+		resp.Error = respErr
+	} else {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		resp.Result = encoded
+	}
+	return writeMessage(s.out, resp)
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	return writeMessage(s.out, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// handle runs a request or a notification and returns its result
+func (s *Server) handle(req request) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		return capabilities(), nil
+	case "initialized", "shutdown":
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.open(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		// The server asks for whole documents, so the last change is the new content
+		return nil, s.open(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return nil, s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+
+	case "textDocument/hover":
+		return withPosition(s, req, s.hover)
+	case "textDocument/definition":
+		return withPosition(s, req, s.definition)
+	case "textDocument/completion":
+		return withPosition(s, req, s.completion)
+	case "textDocument/documentSymbol":
+		return withDocument(s, req, s.symbols)
+	case "textDocument/semanticTokens/full":
+		return withDocument(s, req, s.semanticTokens)
+	}
+
+	if req.ID == nil {
+		// Unknown notifications, such as '$/cancelRequest', can be ignored
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: "method not supported: " + req.Method}
+}
+
+// withPosition runs a request about a position in a document, it's answered with null when the document isn't open
+func withPosition[T any](s *Server, req request, answer func(d *document, offset int) T) (interface{}, error) {
+	var params positionParams
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return nil, err
+	}
+	d, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		return nil, nil
+	}
+	return answer(d, d.offset(params.Position)), nil
+}
+
+// withDocument runs a request about a whole document, it's answered with null when the document isn't open
+func withDocument[T any](s *Server, req request, answer func(d *document) T) (interface{}, error) {
+	var params textDocumentParams
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return nil, err
+	}
+	d, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		return nil, nil
+	}
+	return answer(d), nil
+}
+
+// open stores the new content of a document and publishes its diagnostics
+func (s *Server) open(uri, content string) error {
+	d := newDocument(uri, content)
+	s.documents[uri] = d
+	return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: diagnostics(d)})
+}
+
+// diagnostics are the syntax errors and lint issues of a document
+func diagnostics(d *document) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	for _, issue := range lint.Check(d.content) {
+		severity := SeverityWarning
+		if issue.Rule == lint.RuleSyntax || issue.Rule == lint.RuleUnclosedBlock {
+			severity = SeverityError
+		}
+		// Issues point at a token, which is highlighted whole
+		start, end := issue.Pos.Offset, issue.Pos.Offset
+		if i, ok := d.tokenAt(start); ok && d.tokens[i].Pos.Offset == start {
+			end = d.tokenEnd(i)
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Range:    d.rangeOf(start, end),
+			Severity: severity,
+			Code:     string(issue.Rule),
+			Source:   "zencefil",
+			Message:  issue.Message,
+		})
+	}
+	return diagnostics
+}
+
+// load returns an imported template, from the open documents if it's one of them or else from disk.
+// The name is relative to the directory of the importing template.
+func (s *Server) load(from *document, name string) *document {
+	path := filepath.Join(filepath.Dir(uriPath(from.uri)), filepath.FromSlash(name))
+	uri := pathURI(path)
+	if d, exists := s.documents[uri]; exists {
+		return d
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return newDocument(uri, string(content))
+}
+
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
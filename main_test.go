@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeFiles writes files into a temporary directory and returns it
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestRenderCommand(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"page.html":    "{{ import 'forms.html' as forms }}{{ title }}: {{ for item in items }}{{ forms.label(item) }} {{ endfor }}{{ if user.admin }}(admin {{ user.name }}){{ endif }}",
+		"forms.html":   "{{ macro label(text) }}[{{ text }}]{{ endmacro }}",
+		"ctx.json":     `{"title": "Shop", "items": ["a", "b"], "user": {"name": "Ann", "admin": false}}`,
+		"ctx.yaml":     "title: Store\nuser:\n  admin: true\n",
+		"ctx.toml":     "items = ['x']\n[user]\nname = \"Bob\"\n",
+		"ctx.env":      "title=\"Env Shop\"\n",
+		"bad.json":     "{\n  \"title\": ,\n}",
+		"broken.html":  "{{ if user.admin }}\n{{ missing }}{{ endif }}",
+		"lexing.html":  "a {{ 'x }}",
+		"parsing.html": "{{ x }}\n{{ x y }}",
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		expected string
+		stderr   string
+		code     int
+	}{
+		{
+			name:     "JSON data",
+			args:     []string{"render", path("page.html"), "--data", path("ctx.json")},
+			expected: "Shop: [a] [b] ",
+		},
+		{
+			name:     "Merged data files",
+			args:     []string{"render", "--data", path("ctx.json"), path("page.html"), "--data", path("ctx.yaml"), "--data", path("ctx.toml")},
+			expected: "Store: [x] (admin Bob)",
+		},
+		{
+			name:     "Set flags override data files",
+			args:     []string{"render", path("page.html"), "--data", path("ctx.json"), "--set", "items=[1]", "--set", "user.admin=true", "--data", path("ctx.env")},
+			expected: "Env Shop: [1] (admin Ann)",
+		},
+		{
+			name:     "Data from stdin",
+			args:     []string{"render", path("page.html"), "--data", path("ctx.json"), "--data", "-", "--format", "yaml"},
+			stdin:    "title: Piped",
+			expected: "Piped: [a] [b] ",
+		},
+		{
+			name:     "Template from stdin",
+			args:     []string{"render", "-", "--set", "name=Ann"},
+			stdin:    "Hello {{ name }}",
+			expected: "Hello Ann",
+		},
+		{
+			name:   "Render errors have positions",
+			args:   []string{"render", path("broken.html"), "--set", "user.admin=true"},
+			stderr: path("broken.html") + ":2:4: render error: variable 'missing' not found in context\n",
+			code:   exitFailure,
+		},
+		{
+			name:   "Lexing errors have positions",
+			args:   []string{"render", path("lexing.html")},
+			stderr: path("lexing.html") + ":1:6: unterminated string\n",
+			code:   exitFailure,
+		},
+		{
+			name:   "Parsing errors have positions",
+			args:   []string{"render", path("parsing.html")},
+			stderr: path("parsing.html") + ":2:6: error parsing expression: expected '}}', got \"y\" at 2:6\n",
+			code:   exitFailure,
+		},
+		{
+			name:   "Data errors have positions",
+			args:   []string{"render", path("page.html"), "--data", path("bad.json")},
+			stderr: path("bad.json") + ":2:12: invalid character ',' looking for beginning of value\n",
+			code:   exitFailure,
+		},
+		{
+			name:   "Stdin read twice",
+			args:   []string{"render", "-", "--data", "-"},
+			stderr: "zencefil render: stdin can only be read once\n",
+			code:   exitUsage,
+		},
+		{
+			name: "Missing template",
+			args: []string{"render", "--data", path("ctx.json")},
+			code: exitUsage,
+		},
+		{
+			name: "Unknown command",
+			args: []string{"paint"},
+			code: exitUsage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			require.Equal(t, tt.code, code, stderr.String())
+			require.Equal(t, tt.expected, stdout.String())
+			if tt.stderr != "" {
+				require.Equal(t, tt.stderr, stderr.String())
+			}
+		})
+	}
+
+	t.Run("Output file", func(t *testing.T) {
+		out := path("out.txt")
+		code := run([]string{"render", path("page.html"), "--data", path("ctx.json"), "--out", out}, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+		require.Equal(t, exitOK, code)
+		content, err := os.ReadFile(out)
+		require.NoError(t, err)
+		require.Equal(t, "Shop: [a] [b] ", string(content))
+	})
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected map[string]interface{}
+		err      string
+	}{
+		{
+			name: "Values",
+			content: `# comment
+title = "Shop\t\"A\"" # trailing comment
+literal = 'C:\path'
+count = 1_000
+hex = 0xff
+price = 9.5
+enabled = true
+released = 1979-05-27T07:32:00Z
+tags = [
+  "a",
+  'b', # comment
+]
+point = { x = 1, y.z = 2 }
+multiline = """
+one \
+  two"""
+"quoted key" = 1
+`,
+			expected: map[string]interface{}{
+				"title":      "Shop\t\"A\"",
+				"literal":    `C:\path`,
+				"count":      int64(1000),
+				"hex":        int64(255),
+				"price":      9.5,
+				"enabled":    true,
+				"released":   "1979-05-27T07:32:00Z",
+				"tags":       []interface{}{"a", "b"},
+				"point":      map[string]interface{}{"x": int64(1), "y": map[string]interface{}{"z": int64(2)}},
+				"multiline":  "one two",
+				"quoted key": int64(1),
+			},
+		},
+		{
+			name:    "Tables and arrays of tables",
+			content: "site.name = 'x'\n[user]\nname = 'Ann'\n[user.address]\ncity = 'Oslo'\n[[items]]\nid = 1\n[items.meta]\nnew = true\n[[items]]\nid = 2\n",
+			expected: map[string]interface{}{
+				"site": map[string]interface{}{"name": "x"},
+				"user": map[string]interface{}{"name": "Ann", "address": map[string]interface{}{"city": "Oslo"}},
+				"items": []interface{}{
+					map[string]interface{}{"id": int64(1), "meta": map[string]interface{}{"new": true}},
+					map[string]interface{}{"id": int64(2)},
+				},
+			},
+		},
+		{
+			name:    "Duplicate keys",
+			content: "a = 1\n\na = 2",
+			err:     "3:2: Key 'a' has already been defined.",
+		},
+		{
+			name:    "Tables defined twice",
+			content: "[t]\na = 1\n[t]\nb = 2",
+			err:     "3:2: Key 't' has already been defined.",
+		},
+		{
+			name:    "Unterminated string",
+			content: "a = \"x\nb = 1",
+			err:     "1:7: strings cannot contain newlines",
+		},
+		{
+			name:    "Missing equals",
+			content: "[t]\na 1",
+			err:     "2:3: expected '.' or '=', but got '1' instead",
+		},
+		{
+			name:    "Trailing content",
+			content: "a = 1 b",
+			err:     "1:6: expected a top-level item to end with a newline, comment, or EOF, but got 'b' instead",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := parseTOML(tt.content)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, data)
+		})
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	data, err := parseEnv("# comment\nexport NAME=\"Ann \\\"A\\\"\\nB\"\nEMPTY=\nLITERAL='a\\n' \nPLAIN = value # comment\n")
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"NAME":    "Ann \"A\"\nB",
+		"EMPTY":   "",
+		"LITERAL": `a\n`,
+		"PLAIN":   "value",
+	}, data)
+
+	_, err = parseEnv("A=1\nB\n")
+	require.EqualError(t, err, "2: expected KEY=VALUE, got 'B'")
+}
+
+func TestLoadContext(t *testing.T) {
+	context := map[string]interface{}{
+		"user": map[string]interface{}{"name": "Ann", "roles": []interface{}{"admin"}},
+	}
+	merge(context, map[string]interface{}{
+		"user":  map[string]interface{}{"roles": []interface{}{"editor"}, "age": 30},
+		"title": "Shop",
+	})
+	require.NoError(t, setValue(context, "user.address.city=Oslo"))
+	require.NoError(t, setValue(context, "count=3"))
+	require.NoError(t, setValue(context, "label=hello world"))
+	require.Equal(t, map[string]interface{}{
+		"user": map[string]interface{}{
+			"name":    "Ann",
+			"roles":   []interface{}{"editor"},
+			"age":     30,
+			"address": map[string]interface{}{"city": "Oslo"},
+		},
+		"title": "Shop",
+		"count": 3.0,
+		"label": "hello world",
+	}, context)
+
+	require.EqualError(t, setValue(context, "novalue"), "invalid --set 'novalue', expected key=value")
+}
+
+func TestCheckCommand(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"ok.html":     "{{ for item in items }}{{ item }}{{ endfor }}",
+		"broken.html": "{{ if x }}\n{{ for i in y }}{{ endif }}",
+		"lint.html":   "{{ if x }}{{ elif x }}{{ endif }}",
+	})
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "nested", "deeper"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nested", "deeper", "syntax.html"), []byte("{{ x y }}"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nested", "notes.txt"), []byte("{{ if }}"), 0o644))
+	path := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+		code     int
+	}{
+		{
+			name: "No issues",
+			args: []string{"check", path("ok.html")},
+		},
+		{
+			name: "Patterns",
+			args: []string{"check", filepath.ToSlash(dir) + "/**/*.html"},
+			expected: path("broken.html") + ":2:1: 'for' is never closed with 'endfor' (unclosed-block)\n" +
+				path("lint.html") + ":1:11: elif condition repeats the condition at 1:7, its branch never runs (duplicate-condition)\n" +
+				path("nested/deeper/syntax.html") + ":1:6: error parsing expression: expected '}}', got \"y\" at 1:6 (syntax)\n",
+			code: exitFailure,
+		},
+		{
+			name: "JSON output",
+			args: []string{"check", "--format", "json", path("lint.html"), path("ok.html")},
+			expected: `[
+  {
+    "file": "` + path("lint.html") + `",
+    "line": 1,
+    "column": 11,
+    "rule": "duplicate-condition",
+    "message": "elif condition repeats the condition at 1:7, its branch never runs"
+  }
+]
+`,
+			code: exitFailure,
+		},
+		{
+			name:     "JSON output without issues",
+			args:     []string{"check", "--format", "json", path("ok.html")},
+			expected: "[]\n",
+		},
+		{
+			name: "Pattern without matches",
+			args: []string{"check", filepath.ToSlash(dir) + "/**/*.tmpl"},
+			code: exitUsage,
+		},
+		{
+			name: "Unknown format",
+			args: []string{"check", "--format", "xml", path("ok.html")},
+			code: exitUsage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(""), &stdout, &stderr)
+			require.Equal(t, tt.code, code, stderr.String())
+			require.Equal(t, tt.expected, stdout.String())
+		})
+	}
+}
+
+func TestFmtCommand(t *testing.T) {
+	unformatted := "<ul>\n{{for item in items}}\n  <li>{{item.name}}</li>\n{{endfor}}\n</ul>\n"
+	formatted := "<ul>\n{{ for item in items }}\n  <li>{{ item.name }}</li>\n{{ endfor }}\n</ul>\n"
+	dir := writeFiles(t, map[string]string{
+		"a.html":      unformatted,
+		"ok.html":     formatted,
+		"broken.html": "{{ if x }}",
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	t.Run("Check", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"fmt", "--check", path("a.html"), path("ok.html")}, strings.NewReader(""), &stdout, &stderr)
+		require.Equal(t, exitFailure, code, stderr.String())
+		require.Equal(t, path("a.html")+"\n", stdout.String())
+
+		stdout.Reset()
+		code = run([]string{"fmt", "--check", path("ok.html")}, strings.NewReader(""), &stdout, &stderr)
+		require.Equal(t, exitOK, code, stderr.String())
+		require.Empty(t, stdout.String())
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"fmt", "--diff", path("a.html")}, strings.NewReader(""), &stdout, &stderr)
+		require.Equal(t, exitOK, code, stderr.String())
+		require.Equal(t, "--- "+path("a.html")+"\n+++ "+path("a.html")+" (formatted)\n"+
+			"@@ -1,5 +1,5 @@\n"+
+			" <ul>\n"+
+			"-{{for item in items}}\n"+
+			"-  <li>{{item.name}}</li>\n"+
+			"-{{endfor}}\n"+
+			"+{{ for item in items }}\n"+
+			"+  <li>{{ item.name }}</li>\n"+
+			"+{{ endfor }}\n"+
+			" </ul>\n", stdout.String())
+	})
+
+	t.Run("Stdin", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"fmt", "-"}, strings.NewReader(unformatted), &stdout, &stderr)
+		require.Equal(t, exitOK, code, stderr.String())
+		require.Equal(t, formatted, stdout.String())
+	})
+
+	t.Run("Syntax errors", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"fmt", path("broken.html")}, strings.NewReader(""), &stdout, &stderr)
+		require.Equal(t, exitFailure, code)
+		require.Contains(t, stderr.String(), path("broken.html")+":1:")
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"fmt", path("a.html"), path("ok.html")}, strings.NewReader(""), &stdout, &stderr)
+		require.Equal(t, exitOK, code, stderr.String())
+		content, err := os.ReadFile(path("a.html"))
+		require.NoError(t, err)
+		require.Equal(t, formatted, string(content))
+	})
+}
+
+func TestLSPCommand(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"context.schema": "user.name: STRING\n",
+		"broken.schema":  "user.name STRING\n",
+	})
+
+	var stdout, stderr bytes.Buffer
+	initialize := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`
+	exit := `{"jsonrpc":"2.0","method":"exit"}`
+	stdin := fmt.Sprintf("Content-Length: %d\r\n\r\n%sContent-Length: %d\r\n\r\n%s", len(initialize), initialize, len(exit), exit)
+	code := run([]string{"lsp", "--schema", filepath.Join(dir, "context.schema")}, strings.NewReader(stdin), &stdout, &stderr)
+	require.Equal(t, exitOK, code, stderr.String())
+	require.Contains(t, stdout.String(), `"hoverProvider":true`)
+
+	stderr.Reset()
+	code = run([]string{"lsp", "--schema", filepath.Join(dir, "broken.schema")}, strings.NewReader(""), &stdout, &stderr)
+	require.Equal(t, exitFailure, code)
+	require.Contains(t, stderr.String(), "line 1: expected 'path: TYPE'")
+}
+
+func TestWatcher(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"page.html":  "{{ import 'parts.html' as parts }}<body>{{ parts.hello(name) }}</body>",
+		"parts.html": "{{ macro hello(who) }}Hello {{ who }}{{ endmacro }}",
+		"data.json":  `{"name": "Ada"}`,
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+	// Modification times are moved on by hand, file systems don't all tell writes apart within a second
+	touch := func(name, content string, at time.Time) {
+		require.NoError(t, os.WriteFile(path(name), []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path(name), at, at))
+	}
+	later := time.Now().Add(time.Hour)
+
+	var stderr bytes.Buffer
+	w := &watcher{template: path("page.html"), dataFiles: []string{path("data.json")}, out: path("out.html"), stderr: &stderr}
+	w.update()
+	output, err := os.ReadFile(path("out.html"))
+	require.NoError(t, err)
+	require.Equal(t, "<body>Hello Ada</body>", string(output))
+	require.False(t, w.changed())
+
+	// Imported templates are watched as well
+	touch("parts.html", "{{ macro hello(who) }}Hi {{ who }}{{ endmacro }}", later)
+	require.True(t, w.changed())
+	w.update()
+	require.False(t, w.changed())
+
+	touch("data.json", `{"name": `, later.Add(time.Minute))
+	require.True(t, w.changed())
+	w.update()
+	output, err = os.ReadFile(path("out.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(output), "<pre")
+	require.Contains(t, stderr.String(), "data.json")
+
+	touch("data.json", `{"name": "Bob"}`, later.Add(2*time.Minute))
+	require.True(t, w.changed())
+	w.update()
+	output, err = os.ReadFile(path("out.html"))
+	require.NoError(t, err)
+	require.Equal(t, "<body>Hi Bob</body>", string(output))
+
+	t.Run("Plain text error", func(t *testing.T) {
+		w := &watcher{template: path("missing.txt"), out: path("out.txt"), stderr: io.Discard}
+		w.update()
+		output, err := os.ReadFile(path("out.txt"))
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(string(output), path("missing.txt")+": open "), string(output))
+
+		// A missing template is watched until it's created
+		require.False(t, w.changed())
+		touch("missing.txt", "ok", later)
+		require.True(t, w.changed())
+	})
+}
+
+func TestLiveServer(t *testing.T) {
+	live := newLiveServer()
+	live.publish("<html><body>one</body></html>")
+	server := httptest.NewServer(live)
+	defer server.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	require.Equal(t, "<html><body>one"+reloadScript+"</body></html>", get("/"))
+	require.Equal(t, get("/"), get("/page.html"))
+
+	resp, err := http.Get(server.URL + "/_zencefil/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	live.publish("two")
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "event: reload\n", line)
+	require.Equal(t, "two"+reloadScript, get("/"))
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	before := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12"
+	after := "1\nTWO\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+	require.Equal(t, "--- f\n+++ f (formatted)\n"+
+		"@@ -1,5 +1,5 @@\n 1\n-2\n+TWO\n 3\n 4\n 5\n"+
+		"@@ -9,4 +9,5 @@\n 9\n 10\n 11\n-12\n\\ No newline at end of file\n+12\n+13\n", unifiedDiff("f", before, after))
+	require.Empty(t, unifiedDiff("f", before, before))
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches []string
+		misses  []string
+	}{
+		{"templates/*.html", []string{"templates/a.html", "./templates/a.html"}, []string{"templates/sub/a.html", "templates/a.txt"}},
+		{"templates/**/*.html", []string{"templates/a.html", "templates/x/y/a.html"}, []string{"other/a.html"}},
+		{"t/[ab]?.html", []string{"t/a1.html", "t/bz.html"}, []string{"t/c1.html", "t/a.html"}},
+		{"t/[!a]*", []string{"t/b"}, []string{"t/a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			re, err := globRegexp(tt.pattern)
+			require.NoError(t, err)
+			for _, path := range tt.matches {
+				require.True(t, re.MatchString(path), path)
+			}
+			for _, path := range tt.misses {
+				require.False(t, re.MatchString(path), path)
+			}
+		})
+	}
+}
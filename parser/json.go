@@ -0,0 +1,245 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+)
+
+// ASTVersion is the version of the JSON encoding of ASTs. It changes when node kinds are renamed or removed,
+// or their children are laid out differently, so ASTs encoded by an older version aren't read wrong.
+const ASTVersion = 1
+
+// ParseNodeType returns the node type with the given name, e.g. "IF_NODE"
+func ParseNodeType(name string) (NodeType, error) {
+	for i, typeName := range nodeTypeNames {
+		if typeName == name {
+			return NodeType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown node kind '%s'", name)
+}
+
+// MarshalText encodes a node type as its name, which unlike its number stays the same when node types are added
+func (tt NodeType) MarshalText() ([]byte, error) {
+	if tt < 0 || int(tt) >= len(nodeTypeNames) {
+		return nil, fmt.Errorf("unknown node type %d", int(tt))
+	}
+	return []byte(nodeTypeNames[tt]), nil
+}
+
+func (tt *NodeType) UnmarshalText(text []byte) error {
+	nodeType, err := ParseNodeType(string(text))
+	if err != nil {
+		return err
+	}
+	*tt = nodeType
+	return nil
+}
+
+// jsonNode is how a node is encoded, e.g. {"kind": "VARIABLE_NODE", "value": "name", "pos": {...}}.
+// A node without a value, a position or children leaves the field out, as does a number literal that
+// isn't parsed ahead of rendering.
+type jsonNode struct {
+	Kind     NodeType        `json:"kind"`
+	Value    *string         `json:"value,omitempty"`
+	Number   *float64        `json:"number,omitempty"`
+	Pos      *lexer.Position `json:"pos,omitempty"`
+	Children []Node          `json:"children,omitempty"`
+}
+
+func (n Node) MarshalJSON() ([]byte, error) {
+	encoded := jsonNode{Kind: n.Type, Value: n.Value, Number: n.Number, Children: n.Children}
+	if n.Pos != (lexer.Position{}) {
+		encoded.Pos = &n.Pos
+	}
+	return json.Marshal(encoded)
+}
+
+func (n *Node) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		Kind     *NodeType       `json:"kind"`
+		Value    *string         `json:"value"`
+		Number   *float64        `json:"number"`
+		Pos      *lexer.Position `json:"pos"`
+		Children []Node          `json:"children"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Kind == nil {
+		return fmt.Errorf("node without a kind: %s", data)
+	}
+	*n = Node{Type: *decoded.Kind, Value: decoded.Value, Number: decoded.Number, Children: decoded.Children}
+	if decoded.Pos != nil {
+		n.Pos = *decoded.Pos
+	}
+	return n.checkLayout()
+}
+
+// checkLayout reports a decoded node the renderer can't render, such as a FOR_NODE without its body.
+// Its children are decoded before it, so each node only checks the children it has itself.
+func (n Node) checkLayout() error {
+	switch n.Type {
+	case TEXT_NODE, VARIABLE_NODE, STRING_LITERAL_NODE, NUMBER_LITERAL_NODE, BOOLEAN_LITERAL_NODE, OBJECT_ACCESOR,
+		ITERATEE_ITEM, MACRO_NODE, MACRO_PARAM, KEYWORD_ARG, TEST_NODE, IMPORT_NODE, FROM_IMPORT_NODE, IMPORT_NAME, IMPORT_ALIAS:
+		if n.Value == nil {
+			return n.layoutError("needs a value")
+		}
+	case ITERATOR_ITEM:
+		// A plain variable is its value, anything else its child
+		if n.Value == nil && len(n.Children) != 1 {
+			return n.layoutError("needs a value or 1 child")
+		}
+	}
+
+	switch n.Type {
+	case FOR_NODE:
+		return n.expectChildren(ITERATEE_ITEM, ITERATOR_ITEM, FOR_BODY)
+	case IF_NODE:
+		if len(n.Children) < 2 || n.Children[1].Type != THEN_BRANCH {
+			return n.layoutError("expects a condition and a THEN_BRANCH")
+		}
+		rest := n.Children[2:]
+		if len(rest) > 0 && rest[0].Type == ELIF_BRANCH {
+			rest = rest[1:]
+		}
+		if len(rest) > 0 && rest[0].Type == ELSE_BRANCH {
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			return n.layoutError("expects an ELIF_BRANCH and an ELSE_BRANCH after its THEN_BRANCH at most")
+		}
+	case ELIF_BRANCH:
+		return n.expectOnly(ELIF_ITEM)
+	case ELIF_ITEM:
+		if len(n.Children) == 0 {
+			return n.layoutError("expects a condition")
+		}
+	case SWITCH_NODE:
+		if len(n.Children) == 0 {
+			return n.layoutError("expects a subject")
+		}
+		for i, branch := range n.Children[1:] {
+			if branch.Type != CASE_NODE && (branch.Type != DEFAULT_BRANCH || i != len(n.Children)-2) {
+				return n.layoutError("expects CASE_NODE children after its subject, and a DEFAULT_BRANCH last")
+			}
+		}
+	case CASE_NODE:
+		return n.expectChildren(CASE_VALUES, CASE_BODY)
+	case MACRO_NODE:
+		return n.expectChildren(MACRO_PARAMS, MACRO_BODY)
+	case MACRO_PARAMS:
+		return n.expectOnly(MACRO_PARAM)
+	case MACRO_PARAM:
+		// The child is the default value
+		if len(n.Children) > 1 {
+			return n.layoutError("expects 1 child at most")
+		}
+	case CALL_NODE:
+		if len(n.Children) == 0 {
+			return n.layoutError("expects what it calls")
+		}
+	case CALL_BLOCK_NODE:
+		return n.expectChildren(CALL_NODE, CALL_BODY)
+	case OBJECT_ACCESS_NODE:
+		if len(n.Children) != 2 || n.Children[1].Type != OBJECT_ACCESOR {
+			return n.layoutError("expects an object and an OBJECT_ACCESOR")
+		}
+	case EXPRESSION_NODE:
+		if len(n.Children) == 0 {
+			return n.layoutError("expects children")
+		}
+	case TEST_NODE, KEYWORD_ARG:
+		if len(n.Children) != 1 {
+			return n.layoutError("expects 1 child")
+		}
+	case CONDITIONAL_NODE:
+		if len(n.Children) != 3 {
+			return n.layoutError("expects 3 children")
+		}
+	case MAP_ENTRY:
+		if len(n.Children) != 2 {
+			return n.layoutError("expects 2 children")
+		}
+	case MAP_LITERAL_NODE:
+		return n.expectOnly(MAP_ENTRY)
+	case IMPORT_NODE:
+		return n.expectChildren(IMPORT_ALIAS)
+	case FROM_IMPORT_NODE:
+		return n.expectOnly(IMPORT_NAME)
+	case IMPORT_NAME:
+		if len(n.Children) > 1 || (len(n.Children) == 1 && n.Children[0].Type != IMPORT_ALIAS) {
+			return n.layoutError("expects an IMPORT_ALIAS at most")
+		}
+	}
+	return nil
+}
+
+// expectChildren checks that a node has exactly children of the given kinds, in order
+func (n Node) expectChildren(kinds ...NodeType) error {
+	matches := len(n.Children) == len(kinds)
+	for i := 0; matches && i < len(kinds); i++ {
+		matches = n.Children[i].Type == kinds[i]
+	}
+	if matches {
+		return nil
+	}
+	names := make([]string, len(kinds))
+	for i, kind := range kinds {
+		names[i] = kind.String()
+	}
+	return n.layoutError("expects children %s", strings.Join(names, ", "))
+}
+
+// expectOnly checks that the children of a node are all of one kind
+func (n Node) expectOnly(kind NodeType) error {
+	for _, child := range n.Children {
+		if child.Type != kind {
+			return n.layoutError("expects only %s children, got %s", kind, child.Type)
+		}
+	}
+	return nil
+}
+
+func (n Node) layoutError(format string, args ...interface{}) error {
+	where := n.Type.String()
+	if n.Pos != (lexer.Position{}) {
+		where += " at " + n.Pos.String()
+	}
+	return fmt.Errorf("%s %s", where, fmt.Sprintf(format, args...))
+}
+
+// jsonAST is how a template's AST is encoded
+type jsonAST struct {
+	Version int    `json:"version"`
+	Nodes   []Node `json:"nodes"`
+}
+
+// MarshalAST encodes the nodes of a parsed template as JSON, along with the version of the encoding
+func MarshalAST(nodes []Node) ([]byte, error) {
+	if nodes == nil {
+		nodes = []Node{}
+	}
+	return json.Marshal(jsonAST{Version: ASTVersion, Nodes: nodes})
+}
+
+// UnmarshalAST decodes an AST encoded by MarshalAST, it can be rendered without parsing the template again
+func UnmarshalAST(data []byte) ([]Node, error) {
+	var decoded struct {
+		Version *int   `json:"version"`
+		Nodes   []Node `json:"nodes"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, fmt.Errorf("error decoding AST: %w", err)
+	}
+	if decoded.Version == nil {
+		return nil, fmt.Errorf("error decoding AST: no version")
+	}
+	if *decoded.Version != ASTVersion {
+		return nil, fmt.Errorf("error decoding AST: version %d isn't supported, expected %d", *decoded.Version, ASTVersion)
+	}
+	return decoded.Nodes, nil
+}
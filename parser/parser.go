@@ -40,31 +40,81 @@ const (
 	ITERATOR_ITEM
 	ITERATEE_ITEM
 	FOR_BODY
+	CALL_NODE
+	KEYWORD_ARG
+	MACRO_NODE
+	MACRO_PARAMS
+	MACRO_PARAM
+	MACRO_BODY
+	CALL_BLOCK_NODE
+	CALL_BODY
+	IMPORT_NODE
+	FROM_IMPORT_NODE
+	IMPORT_NAME
+	IMPORT_ALIAS
+	LIST_LITERAL_NODE
+	MAP_LITERAL_NODE
+	MAP_ENTRY
+	BOOLEAN_LITERAL_NODE
+	NIL_LITERAL_NODE
+	OP_RANGE
+	OP_IN
+	OP_NOT_IN
+	OP_CONTAINS
+	OP_STARTSWITH
+	OP_ENDSWITH
+	TEST_NODE
+	CONDITIONAL_NODE
+	SWITCH_NODE
+	CASE_NODE
+	CASE_VALUES
+	CASE_BODY
+	DEFAULT_BRANCH
 )
 
+var nodeTypeNames = [...]string{
+	"TEXT_NODE",
+	"VARIABLE_NODE",
+	"OBJECT_ACCESS_NODE", "OBJECT_ACCESOR",
+	"EXPRESSION_NODE",
+	"OP_EQUALS", "OP_NOT_EQUALS",
+	"OP_AND", "OP_OR",
+	"OP_LT", "OP_GT", "OP_LTE", "OP_GTE",
+	"OP_BANG",
+	"OP_NULL_COALESCE",
+	"RPAREN", "LPAREN",
+	"OPEN_BRACKET", "CLOSE_BRACKET",
+	"STRING_LITERAL_NODE", "NUMBER_LITERAL_NODE",
+	"IF_NODE", "THEN_BRANCH", "ELIF_BRANCH", "ELIF_ITEM", "ELSE_BRANCH",
+	"FOR_NODE", "ITERATOR_ITEM", "ITERATEE_ITEM", "FOR_BODY",
+	"CALL_NODE", "KEYWORD_ARG",
+	"MACRO_NODE", "MACRO_PARAMS", "MACRO_PARAM", "MACRO_BODY",
+	"CALL_BLOCK_NODE", "CALL_BODY",
+	"IMPORT_NODE", "FROM_IMPORT_NODE", "IMPORT_NAME", "IMPORT_ALIAS",
+	"LIST_LITERAL_NODE", "MAP_LITERAL_NODE", "MAP_ENTRY", "BOOLEAN_LITERAL_NODE", "NIL_LITERAL_NODE",
+	"OP_RANGE",
+	"OP_IN", "OP_NOT_IN", "OP_CONTAINS", "OP_STARTSWITH", "OP_ENDSWITH",
+	"TEST_NODE",
+	"CONDITIONAL_NODE",
+	"SWITCH_NODE",
+	"CASE_NODE",
+	"CASE_VALUES",
+	"CASE_BODY",
+	"DEFAULT_BRANCH",
+}
+
 func (tt NodeType) String() string {
-	return [...]string{
-		"TEXT_NODE",
-		"VARIABLE_NODE",
-		"OBJECT_ACCESS_NODE", "OBJECT_ACCESOR",
-		"EXPRESSION_NODE",
-		"OP_EQUALS", "OP_NOT_EQUALS",
-		"OP_AND", "OP_OR",
-		"OP_LT", "OP_GT", "OP_LTE", "OP_GTE",
-		"OP_BANG",
-		"OP_NULL_COALESCE",
-		"RPAREN", "LPAREN",
-		"OPEN_BRACKET", "CLOSE_BRACKET",
-		"STRING_LITERAL_NODE", "NUMBER_LITERAL_NODE",
-		"IF_NODE", "THEN_BRANCH", "ELIF_BRANCH", "ELIF_ITEM", "ELSE_BRANCH",
-		"FOR_NODE", "ITERATOR_ITEM", "ITERATEE_ITEM", "FOR_BODY",
-	}[tt]
+	return nodeTypeNames[tt]
 }
 
 type Node struct {
 	Value    *string
 	Children []Node
 	Type     NodeType
+	Pos      lexer.Position // where the node starts in the template, statements start at their '{{'
+	// Number is the value of a NUMBER_LITERAL_NODE parsed ahead of rendering, see renderer.Optimize.
+	// It's nil until then, and for other nodes.
+	Number *float64
 }
 
 func NewNode(nodeType NodeType, value *string, children ...Node) Node {
@@ -91,7 +141,9 @@ func NewIfNode(condition, thenBranch, elifBranch, elseBranch Node) Node {
 
 	// Add ELSE_BRANCH even if empty
 	if len(elseBranch.Children) > 0 {
-		children = append(children, NewNode(ELSE_BRANCH, nil, elseBranch.Children...))
+		elseNode := NewNode(ELSE_BRANCH, nil, elseBranch.Children...)
+		elseNode.Pos = elseBranch.Pos
+		children = append(children, elseNode)
 	}
 
 	return Node{
@@ -107,9 +159,50 @@ func NewForNode(iterator, iteratee, body Node) Node {
 	}
 }
 
+// TokenSource hands out tokens one at a time, returning a lexer.EOF token once there are none left.
+// *lexer.Lexer implements it.
+type TokenSource interface {
+	NextToken() lexer.Token
+}
+
+// NewCallNode creates a call of callee, args are expressions or KEYWORD_ARG nodes
+func NewCallNode(callee Node, args ...Node) Node {
+	return Node{
+		Type:     CALL_NODE,
+		Children: append([]Node{callee}, args...),
+	}
+}
+
+// NewMacroNode creates a macro definition, params are MACRO_PARAM nodes whose only child, if any, is the default value
+func NewMacroNode(name string, params []Node, body []Node) Node {
+	return Node{
+		Type:     MACRO_NODE,
+		Value:    &name,
+		Children: []Node{NewNode(MACRO_PARAMS, nil, params...), NewNode(MACRO_BODY, nil, body...)},
+	}
+}
+
+// NewConditionalNode creates an inline conditional, only one of the branches is evaluated
+func NewConditionalNode(condition, thenBranch, elseBranch Node) Node {
+	return Node{
+		Type:     CONDITIONAL_NODE,
+		Children: []Node{condition, thenBranch, elseBranch},
+	}
+}
+
+// NewSwitchNode creates a switch statement, its children are the subject followed by CASE_NODEs and an optional DEFAULT_BRANCH
+func NewSwitchNode(subject Node, branches ...Node) Node {
+	return Node{
+		Type:     SWITCH_NODE,
+		Children: append([]Node{subject}, branches...),
+	}
+}
+
 type Parser struct {
 	tokens []lexer.Token
 	crrPos int
+	src    TokenSource // nil when all tokens are given up front
+	eof    lexer.Token // the EOF token of src once it's been reached
 }
 
 func New(tokens []lexer.Token) *Parser {
@@ -118,7 +211,50 @@ func New(tokens []lexer.Token) *Parser {
 	}
 }
 
+// NewFromSource creates a parser that pulls tokens from src as it needs them,
+// so the whole token list never has to be held in memory.
+func NewFromSource(src TokenSource) *Parser {
+	return &Parser{
+		src: src,
+	}
+}
+
+// Error is a syntax error returned by Parse, its message is the one of Err
+type Error struct {
+	Pos lexer.Position // where parsing stopped, the last token when the template ended too early
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Parse parses the whole template, a syntax error is returned as an *Error
 func (p *Parser) Parse() ([]Node, error) {
+	nodes, err := p.parse()
+	if err != nil {
+		return nil, &Error{Pos: p.errorPos(), Err: err}
+	}
+	return nodes, nil
+}
+
+// errorPos is the position of the token parsing stopped at
+func (p *Parser) errorPos() lexer.Position {
+	switch {
+	case !p.isAtEnd():
+		return p.peek().Pos
+	case p.crrPos > 0:
+		return p.previous().Pos
+	default:
+		return lexer.Position{}
+	}
+}
+
+func (p *Parser) parse() ([]Node, error) {
 	var nodes []Node
 
 	for {
@@ -127,13 +263,17 @@ func (p *Parser) Parse() ([]Node, error) {
 		}
 
 		if p.isBlockEnd() {
-			return nil, fmt.Errorf("malformed tokens. 'else' or 'endif' cannot be used without 'if'")
+			keyword := p.peekNext().Value
+			return nil, fmt.Errorf("malformed tokens. '%s' cannot be used without '%s'", keyword, blockOpeners[keyword])
 		}
 
 		if p.match(lexer.TEXT) {
 			prevVal := p.previous().Value
-			nodes = append(nodes, NewNode(TEXT_NODE, &prevVal))
+			text := NewNode(TEXT_NODE, &prevVal)
+			text.Pos = p.previous().Pos
+			nodes = append(nodes, text)
 		} else if p.match(lexer.OPEN_CURLY) {
+			start := p.previous().Pos
 			if p.match(lexer.KEYWORD) {
 				prevVal := p.previous().Value
 				switch prevVal {
@@ -142,17 +282,24 @@ func (p *Parser) Parse() ([]Node, error) {
 					if err != nil {
 						return nil, fmt.Errorf("error parsing if statement: %w", err)
 					}
+					IfNode.Pos = start
 					nodes = append(nodes, IfNode)
 				case "for":
 					forNode, err := p.parseFor()
 					if err != nil {
 						return nil, fmt.Errorf("error parsing for statement: %w", err)
 					}
+					forNode.Pos = start
 					nodes = append(nodes, forNode)
 				default:
-					panic("Unknown KEYWORD")
+					node, err := p.parseStatement(prevVal)
+					if err != nil {
+						return nil, err
+					}
+					node.Pos = start
+					nodes = append(nodes, node)
 				}
-			} else if p.check(lexer.IDENTIFIER) || p.check(lexer.LPAREN) || p.check(lexer.BANG) {
+			} else if p.isExpressionStart() {
 				exprNode, err := p.parseExpression()
 				if err != nil {
 					return nil, fmt.Errorf("error parsing expression: %w", err)
@@ -167,121 +314,579 @@ func (p *Parser) Parse() ([]Node, error) {
 	}
 }
 
+// parseExpression parses an expression up to and including the closing '}}'
 func (p *Parser) parseExpression() (Node, error) {
+	nodes, err := p.parseOperation()
+	if err != nil {
+		return Node{}, err
+	}
+	if err := p.expectCloseCurly(); err != nil {
+		return Node{}, err
+	}
+	return collapseExpression(nodes), nil
+}
+
+// parseOperation parses a whole expression. Inline conditionals, 'a if cond else b' or 'cond ? a : b',
+// bind looser than any operator and become a single CONDITIONAL_NODE.
+// It stops at the first token that can't continue the expression, e.g. '}}', ')' or ','.
+func (p *Parser) parseOperation() ([]Node, error) {
+	nodes, err := p.parseBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.matchKeyword("if"):
+		condition, err := p.parseBinary()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing inline if condition: %w", err)
+		}
+		if !p.matchKeyword("else") {
+			return nil, fmt.Errorf("expected 'else' in inline if, got %v", p.peek())
+		}
+		elseBranch, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		conditional := NewConditionalNode(collapseExpression(condition), collapseExpression(nodes), collapseExpression(elseBranch))
+		conditional.Pos = nodes[0].Pos
+		return []Node{conditional}, nil
+
+	case p.match(lexer.QUESTION):
+		thenBranch, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		if !p.match(lexer.COLON) {
+			return nil, fmt.Errorf("expected ':' in conditional expression, got %v", p.peek())
+		}
+		elseBranch, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		conditional := NewConditionalNode(collapseExpression(nodes), collapseExpression(thenBranch), collapseExpression(elseBranch))
+		conditional.Pos = nodes[0].Pos
+		return []Node{conditional}, nil
+	}
+
+	return nodes, nil
+}
+
+// parseBinary parses operands separated by binary operators into a flat list, the renderer takes care of precedence.
+func (p *Parser) parseBinary() ([]Node, error) {
 	var nodes []Node
-	for !p.isAtEnd() {
-		if p.check(lexer.CLOSE_CURLY) {
-			p.advance() // consume closing curly
-			break
+	for {
+		for p.match(lexer.BANG) {
+			val := p.previous().Value
+			nodes = append(nodes, Node{Type: OP_BANG, Value: &val, Pos: p.previous().Pos})
+		}
+
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, operand)
+
+		operator, exists := binaryOperators[p.peek().Type]
+		if p.check(lexer.KEYWORD) {
+			operator, exists = keywordOperators[p.peek().Value]
+		}
+		if !exists {
+			return nodes, nil
+		}
+		opToken := p.advance()
+		val := opToken.Value
+		if operator == OP_NOT_IN {
+			if !p.matchKeyword("in") {
+				return nil, fmt.Errorf("expected 'in' after 'not', got %v", p.peek())
+			}
+			val = "not in"
 		}
+		nodes = append(nodes, Node{Type: operator, Value: &val, Pos: opToken.Pos})
+	}
+}
 
-		switch p.peek().Type {
-		case lexer.LPAREN:
-			p.advance() // consume '('
-			nestedExpr, err := p.parseExpression()
+// parseOperand parses a single value of an expression along with any object accesses and calls following it
+func (p *Parser) parseOperand() (Node, error) {
+	var node Node
+	start := p.peek().Pos
+	switch p.peek().Type {
+	case lexer.LPAREN:
+		p.advance() // consume '('
+		nestedExpr, err := p.parseOperation()
+		if err != nil {
+			return Node{}, err
+		}
+		if !p.match(lexer.RPAREN) {
+			return Node{}, fmt.Errorf("expected ')', got %v", p.peek())
+		}
+		node = Node{Type: EXPRESSION_NODE, Children: nestedExpr}
+
+	case lexer.IDENTIFIER:
+		p.advance()
+		val := p.previous().Value
+		node = Node{Type: VARIABLE_NODE, Value: &val}
+
+	case lexer.STRING:
+		p.advance()
+		val := p.previous().Value
+		node = Node{Type: STRING_LITERAL_NODE, Value: &val}
+
+	case lexer.NUMBER:
+		p.advance()
+		val := p.previous().Value
+		node = Node{Type: NUMBER_LITERAL_NODE, Value: &val}
+
+	case lexer.BOOLEAN:
+		p.advance()
+		val := p.previous().Value
+		node = Node{Type: BOOLEAN_LITERAL_NODE, Value: &val}
+
+	case lexer.NIL:
+		p.advance()
+		node = Node{Type: NIL_LITERAL_NODE}
+
+	case lexer.OPEN_BRACKET:
+		p.advance() // consume '['
+		items, err := p.parseList(lexer.CLOSE_BRACKET, func() (Node, error) {
+			item, err := p.parseOperation()
 			if err != nil {
 				return Node{}, err
 			}
-			nodes = append(nodes, nestedExpr)
+			return collapseExpression(item), nil
+		})
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing list: %w", err)
+		}
+		node = Node{Type: LIST_LITERAL_NODE, Children: items}
 
-		case lexer.RPAREN:
-			p.advance() // consume ')'
-			return Node{Type: EXPRESSION_NODE, Children: nodes}, nil
+	case lexer.LBRACE:
+		p.advance() // consume '{'
+		entries, err := p.parseList(lexer.RBRACE, p.parseMapEntry)
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing map: %w", err)
+		}
+		node = Node{Type: MAP_LITERAL_NODE, Children: entries}
 
-		case lexer.BANG:
-			p.advance()
-			val := p.previous().Value
-			bangNode := Node{Type: OP_BANG, Value: &val}
+	default:
+		return Node{}, fmt.Errorf("unexpected token in expression: %v", p.peek())
+	}
+	node.Pos = start
 
-			if p.check(lexer.LPAREN) {
-				p.advance() // consume '('
-				nestedExpr, err := p.parseExpression()
-				if err != nil {
-					return Node{}, err
-				}
-				nodes = append(nodes, bangNode, nestedExpr)
-			} else if p.match(lexer.IDENTIFIER) {
-				val := p.previous().Value
-				nodes = append(nodes, bangNode, Node{Type: VARIABLE_NODE, Value: &val})
+	for {
+		switch {
+		case p.match(lexer.OPEN_BRACKET):
+			p.advance() // Consume 'string' token for objAccessor, or 'number' token for list index
+			objAccessor := p.previous()
+			if objAccessor.Type != lexer.STRING && objAccessor.Type != lexer.NUMBER {
+				return Node{}, fmt.Errorf("object accessor has to be STRING or NUMBER token, but its %v", objAccessor.Type)
+			}
+			if !p.match(lexer.CLOSE_BRACKET) {
+				return Node{}, fmt.Errorf("expected ']', got %v", p.peek())
 			}
+			node = Node{Type: OBJECT_ACCESS_NODE, Pos: start, Children: []Node{node, {Type: OBJECT_ACCESOR, Value: &objAccessor.Value, Pos: objAccessor.Pos}}}
 
-		case lexer.IDENTIFIER:
-			p.advance()
-			val := p.previous().Value
-			if p.check(lexer.OPEN_BRACKET) {
-				p.advance() // Consume '['
-				p.advance() // Consume 'string' token for objAccessor
-				objAccessor := p.previous()
-				if objAccessor.Type != lexer.STRING {
-					return Node{}, fmt.Errorf("object accessor has to be STRING token, but its %v", objAccessor.Type)
-				}
-				objNode := Node{Type: OBJECT_ACCESS_NODE}
-				objNode.Children = []Node{{Type: VARIABLE_NODE, Value: &val}, {Type: OBJECT_ACCESOR, Value: &objAccessor.Value}}
-				p.advance() // Consume ']'
+		case p.match(lexer.DOT):
+			if !p.match(lexer.IDENTIFIER) {
+				return Node{}, fmt.Errorf("expected attribute name after '.', got %v", p.peek())
+			}
+			attribute := p.previous().Value
+			node = Node{Type: OBJECT_ACCESS_NODE, Pos: start, Children: []Node{node, {Type: OBJECT_ACCESOR, Value: &attribute, Pos: p.previous().Pos}}}
 
-				nodes = append(nodes, objNode)
-			} else {
-				nodes = append(nodes, Node{Type: VARIABLE_NODE, Value: &val})
+		case p.match(lexer.LPAREN):
+			args, err := p.parseArguments()
+			if err != nil {
+				return Node{}, err
 			}
+			node = NewCallNode(node, args...)
+			node.Pos = start
 
-		case lexer.STRING:
-			p.advance()
-			val := strings.Trim(p.previous().Value, "'")
-			nodes = append(nodes, Node{Type: STRING_LITERAL_NODE, Value: &val})
-		case lexer.NUMBER:
-			p.advance()
-			val := p.previous().Value
-			nodes = append(nodes, Node{Type: NUMBER_LITERAL_NODE, Value: &val})
+		case p.matchKeyword("is"):
+			negated := p.matchKeyword("not")
+			if !p.match(lexer.IDENTIFIER, lexer.NIL) {
+				return Node{}, fmt.Errorf("expected test name after 'is', got %v", p.peek())
+			}
+			testName := p.previous().Value
+			node = Node{Type: TEST_NODE, Value: &testName, Pos: start, Children: []Node{node}}
+			// 'x is not even' is parsed as '!(x is even)'
+			if negated {
+				bang := "not"
+				node = Node{Type: EXPRESSION_NODE, Pos: start, Children: []Node{{Type: OP_BANG, Value: &bang, Pos: start}, node}}
+			}
 
 		default:
-			// Check for operators
-			if operator, exists := lexer.Operators[p.peek().Value]; exists {
-				p.advance()
-				val := p.previous().Value
-				nodes = append(nodes, p.createOperatorNode(operator, &val))
-			} else {
-				return Node{}, fmt.Errorf("unexpected token in expression: %v", p.peek())
+			return node, nil
+		}
+	}
+}
+
+// parseList parses comma separated items up to and including the closing token, a trailing comma is allowed
+func (p *Parser) parseList(closing lexer.TokenType, parseItem func() (Node, error)) ([]Node, error) {
+	var items []Node
+	for !p.match(closing) {
+		if len(items) > 0 && !p.match(lexer.COMMA) {
+			return nil, fmt.Errorf("expected ',' or %v, got %v", closing, p.peek())
+		}
+		// Allow a trailing comma
+		if p.match(closing) {
+			break
+		}
+		item, err := parseItem()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseMapEntry parses 'key: value' inside a map literal
+func (p *Parser) parseMapEntry() (Node, error) {
+	key, err := p.parseOperation()
+	if err != nil {
+		return Node{}, err
+	}
+	if !p.match(lexer.COLON) {
+		return Node{}, fmt.Errorf("expected ':' after map key, got %v", p.peek())
+	}
+	value, err := p.parseOperation()
+	if err != nil {
+		return Node{}, err
+	}
+	return Node{Type: MAP_ENTRY, Pos: key[0].Pos, Children: []Node{collapseExpression(key), collapseExpression(value)}}, nil
+}
+
+// parseArguments parses call arguments after the opening '(' up to and including the closing ')'
+func (p *Parser) parseArguments() ([]Node, error) {
+	var args []Node
+	for !p.match(lexer.RPAREN) {
+		if len(args) > 0 && !p.match(lexer.COMMA) {
+			return nil, fmt.Errorf("expected ',' or ')' in arguments, got %v", p.peek())
+		}
+
+		// Keyword arguments look like 'name=value'
+		if p.check(lexer.IDENTIFIER) && p.checkNext(lexer.ASSIGN) {
+			nameToken := p.advance()
+			name := nameToken.Value
+			p.advance() // consume '='
+			value, err := p.parseOperation()
+			if err != nil {
+				return nil, fmt.Errorf("error parsing keyword argument '%s': %w", name, err)
 			}
+			args = append(args, Node{Type: KEYWORD_ARG, Value: &name, Pos: nameToken.Pos, Children: []Node{collapseExpression(value)}})
+			continue
 		}
+
+		if len(args) > 0 && args[len(args)-1].Type == KEYWORD_ARG {
+			return nil, fmt.Errorf("positional argument follows keyword argument: %v", p.peek())
+		}
+		value, err := p.parseOperation()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing argument: %w", err)
+		}
+		args = append(args, collapseExpression(value))
 	}
+	return args, nil
+}
 
+// collapseExpression returns a single operand as is, and wraps anything else in an EXPRESSION_NODE
+func collapseExpression(nodes []Node) Node {
 	// If we only have one node and it's already an expression, return it directly
 	if len(nodes) == 1 && nodes[0].Type == EXPRESSION_NODE {
-		return nodes[0], nil
+		return nodes[0]
 	}
 
 	// If we have a single node that's not an operator, return it directly
-	if len(nodes) == 1 && !isOperator(nodes[0].Type) {
-		return nodes[0], nil
+	if len(nodes) == 1 && !IsOperator(nodes[0].Type) {
+		return nodes[0]
 	}
 
-	return Node{Type: EXPRESSION_NODE, Children: nodes}, nil
+	return Node{Type: EXPRESSION_NODE, Pos: nodes[0].Pos, Children: nodes}
+}
+
+// isExpressionStart checks if the current token can start an expression
+func (p *Parser) isExpressionStart() bool {
+	switch p.peek().Type {
+	case lexer.IDENTIFIER, lexer.STRING, lexer.NUMBER, lexer.BOOLEAN, lexer.NIL,
+		lexer.LPAREN, lexer.BANG, lexer.OPEN_BRACKET, lexer.LBRACE:
+		return true
+	default:
+		return false
+	}
 }
 
-func isOperator(nodeType NodeType) bool {
+// IsOperator reports whether nodes of the type are operators within an EXPRESSION_NODE
+func IsOperator(nodeType NodeType) bool {
 	switch nodeType {
 	case OP_EQUALS, OP_NOT_EQUALS, OP_AND, OP_OR, OP_LT, OP_GT,
-		OP_LTE, OP_GTE, OP_BANG, OP_NULL_COALESCE:
+		OP_LTE, OP_GTE, OP_BANG, OP_NULL_COALESCE, OP_RANGE,
+		OP_IN, OP_NOT_IN, OP_CONTAINS, OP_STARTSWITH, OP_ENDSWITH:
 		return true
 	default:
 		return false
 	}
 }
 
-func (p *Parser) createOperatorNode(op lexer.TokenType, value *string) Node {
-	opTypeMap := map[lexer.TokenType]NodeType{
-		lexer.AMPERSAND:     OP_AND,
-		lexer.PIPE:          OP_OR,
-		lexer.EQ:            OP_EQUALS,
-		lexer.NEQ:           OP_NOT_EQUALS,
-		lexer.GT:            OP_GT,
-		lexer.LT:            OP_LT,
-		lexer.GTE:           OP_GTE,
-		lexer.LTE:           OP_LTE,
-		lexer.BANG:          OP_BANG,
-		lexer.NULL_COALESCE: OP_NULL_COALESCE,
+var binaryOperators = map[lexer.TokenType]NodeType{
+	lexer.AMPERSAND:     OP_AND,
+	lexer.PIPE:          OP_OR,
+	lexer.EQ:            OP_EQUALS,
+	lexer.NEQ:           OP_NOT_EQUALS,
+	lexer.GT:            OP_GT,
+	lexer.LT:            OP_LT,
+	lexer.GTE:           OP_GTE,
+	lexer.LTE:           OP_LTE,
+	lexer.NULL_COALESCE: OP_NULL_COALESCE,
+	lexer.RANGE:         OP_RANGE,
+}
+
+// Binary operators spelled as keywords, 'not' is always followed by 'in'
+var keywordOperators = map[string]NodeType{
+	"in":         OP_IN,
+	"not":        OP_NOT_IN,
+	"contains":   OP_CONTAINS,
+	"startswith": OP_STARTSWITH,
+	"endswith":   OP_ENDSWITH,
+}
+
+// parseStatement parses the tags starting with keywords other than 'if' and 'for', the keyword is already consumed
+func (p *Parser) parseStatement(keyword string) (Node, error) {
+	switch keyword {
+	case "macro":
+		node, err := p.parseMacro()
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing macro: %w", err)
+		}
+		return node, nil
+	case "call":
+		node, err := p.parseCallBlock()
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing call block: %w", err)
+		}
+		return node, nil
+	case "import":
+		node, err := p.parseImport()
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing import: %w", err)
+		}
+		return node, nil
+	case "from":
+		node, err := p.parseFromImport()
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing import: %w", err)
+		}
+		return node, nil
+	case "switch":
+		node, err := p.parseSwitch()
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing switch statement: %w", err)
+		}
+		return node, nil
+	default:
+		return Node{}, fmt.Errorf("unexpected keyword '%s' after '{{'", keyword)
+	}
+}
+
+// {{ macro name(param, other='default') }}...{{ endmacro }}
+func (p *Parser) parseMacro() (Node, error) {
+	if !p.match(lexer.IDENTIFIER) {
+		return Node{}, fmt.Errorf("expected macro name after 'macro', got %v", p.peek())
+	}
+	name := p.previous().Value
+
+	if !p.match(lexer.LPAREN) {
+		return Node{}, fmt.Errorf("expected '(' after macro name, got %v", p.peek())
+	}
+	var params []Node
+	for !p.match(lexer.RPAREN) {
+		if len(params) > 0 && !p.match(lexer.COMMA) {
+			return Node{}, fmt.Errorf("expected ',' or ')' in macro parameters, got %v", p.peek())
+		}
+		if !p.match(lexer.IDENTIFIER) {
+			return Node{}, fmt.Errorf("expected parameter name, got %v", p.peek())
+		}
+		paramName := p.previous().Value
+		param := Node{Type: MACRO_PARAM, Value: &paramName, Pos: p.previous().Pos}
+		if p.match(lexer.ASSIGN) {
+			defaultValue, err := p.parseOperation()
+			if err != nil {
+				return Node{}, fmt.Errorf("error parsing default value of '%s': %w", paramName, err)
+			}
+			param.Children = []Node{collapseExpression(defaultValue)}
+		}
+		params = append(params, param)
+	}
+
+	if err := p.expectCloseCurly(); err != nil {
+		return Node{}, err
+	}
+
+	body, err := p.parseBlock()
+	if err != nil {
+		return Node{}, fmt.Errorf("error parsing macro body: %w", err)
+	}
+
+	if err := p.expectAndConsumeEnd("endmacro"); err != nil {
+		return Node{}, err
+	}
+
+	return NewMacroNode(name, params, body), nil
+}
+
+// {{ call name(args) }}...{{ endcall }}, the body is passed to the macro as 'caller'
+func (p *Parser) parseCallBlock() (Node, error) {
+	nodes, err := p.parseOperation()
+	if err != nil {
+		return Node{}, err
+	}
+	call := collapseExpression(nodes)
+	if call.Type != CALL_NODE {
+		return Node{}, fmt.Errorf("expected a macro call after 'call', got %v", p.peek())
+	}
+
+	if err := p.expectCloseCurly(); err != nil {
+		return Node{}, err
+	}
+
+	body, err := p.parseBlock()
+	if err != nil {
+		return Node{}, fmt.Errorf("error parsing call body: %w", err)
+	}
+
+	if err := p.expectAndConsumeEnd("endcall"); err != nil {
+		return Node{}, err
+	}
+
+	return NewNode(CALL_BLOCK_NODE, nil, call, NewNode(CALL_BODY, nil, body...)), nil
+}
+
+// {{ switch status }}{{ case 'pending', 'new' }}...{{ default }}...{{ endswitch }}
+func (p *Parser) parseSwitch() (Node, error) {
+	subject, err := p.parseExpression()
+	if err != nil {
+		return Node{}, err
+	}
+
+	// Only whitespace may come before the first case, it isn't rendered
+	for p.check(lexer.TEXT) {
+		if strings.TrimSpace(p.peek().Value) != "" {
+			return Node{}, fmt.Errorf("expected 'case' after 'switch', got text %q", p.peek().Value)
+		}
+		p.advance()
+	}
+
+	var branches []Node
+	for p.isKeywordTag("case") {
+		start := p.advance().Pos // {{
+		p.advance()              // case
+
+		var values []Node
+		for len(values) == 0 || p.match(lexer.COMMA) {
+			value, err := p.parseOperation()
+			if err != nil {
+				return Node{}, fmt.Errorf("error parsing case value: %w", err)
+			}
+			values = append(values, collapseExpression(value))
+		}
+		if err := p.expectCloseCurly(); err != nil {
+			return Node{}, err
+		}
+
+		body, err := p.parseBlock()
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing case body: %w", err)
+		}
+		caseNode := NewNode(CASE_NODE, nil,
+			NewNode(CASE_VALUES, nil, values...),
+			NewNode(CASE_BODY, nil, body...))
+		caseNode.Pos = start
+		branches = append(branches, caseNode)
+	}
+
+	if p.isKeywordTag("default") {
+		start := p.advance().Pos // {{
+		p.advance()              // default
+		if err := p.expectCloseCurly(); err != nil {
+			return Node{}, err
+		}
+		body, err := p.parseBlock()
+		if err != nil {
+			return Node{}, fmt.Errorf("error parsing default body: %w", err)
+		}
+		defaultBranch := NewNode(DEFAULT_BRANCH, nil, body...)
+		defaultBranch.Pos = start
+		branches = append(branches, defaultBranch)
+
+		if p.isKeywordTag("case") || p.isKeywordTag("default") {
+			return Node{}, fmt.Errorf("'default' must be the last branch of a switch statement")
+		}
+	}
+
+	if err := p.expectAndConsumeEnd("endswitch"); err != nil {
+		return Node{}, err
+	}
+
+	return NewSwitchNode(subject, branches...), nil
+}
+
+// {{ import 'forms.html' as forms }}
+func (p *Parser) parseImport() (Node, error) {
+	if !p.match(lexer.STRING) {
+		return Node{}, fmt.Errorf("expected template name after 'import', got %v", p.peek())
+	}
+	name := p.previous().Value
+
+	if !p.matchKeyword("as") {
+		return Node{}, fmt.Errorf("expected 'as' after template name, got %v", p.peek())
+	}
+	if !p.match(lexer.IDENTIFIER) {
+		return Node{}, fmt.Errorf("expected name after 'as', got %v", p.peek())
+	}
+	alias := p.previous().Value
+
+	if err := p.expectCloseCurly(); err != nil {
+		return Node{}, err
+	}
+
+	return NewNode(IMPORT_NODE, &name, NewNode(IMPORT_ALIAS, &alias)), nil
+}
+
+// {{ from 'forms.html' import field, button as btn }}
+func (p *Parser) parseFromImport() (Node, error) {
+	if !p.match(lexer.STRING) {
+		return Node{}, fmt.Errorf("expected template name after 'from', got %v", p.peek())
+	}
+	name := p.previous().Value
+
+	if !p.matchKeyword("import") {
+		return Node{}, fmt.Errorf("expected 'import' after template name, got %v", p.peek())
+	}
+
+	var names []Node
+	for !p.match(lexer.CLOSE_CURLY) {
+		if len(names) > 0 && !p.match(lexer.COMMA) {
+			return Node{}, fmt.Errorf("expected ',' or '}}' after imported name, got %v", p.peek())
+		}
+		if !p.match(lexer.IDENTIFIER) {
+			return Node{}, fmt.Errorf("expected name to import, got %v", p.peek())
+		}
+		importName := p.previous().Value
+		importNode := NewNode(IMPORT_NAME, &importName)
+		importNode.Pos = p.previous().Pos
+		if p.matchKeyword("as") {
+			if !p.match(lexer.IDENTIFIER) {
+				return Node{}, fmt.Errorf("expected name after 'as', got %v", p.peek())
+			}
+			alias := p.previous().Value
+			importNode.Children = []Node{NewNode(IMPORT_ALIAS, &alias)}
+		}
+		names = append(names, importNode)
 	}
-	return Node{Type: opTypeMap[op], Value: value}
+	if len(names) == 0 {
+		return Node{}, fmt.Errorf("expected at least one name to import from '%s'", name)
+	}
+
+	return NewNode(FROM_IMPORT_NODE, &name, names...), nil
 }
 
 func (p *Parser) parseIf() (Node, error) {
@@ -324,7 +929,7 @@ func (p *Parser) parseIf() (Node, error) {
 
 func (p *Parser) parseFor() (Node, error) {
 	iteratee, err := p.expectForIteratee()
-	iterateeNode := Node{Type: ITERATEE_ITEM, Value: &iteratee}
+	iterateeNode := Node{Type: ITERATEE_ITEM, Value: &iteratee, Pos: p.previous().Pos}
 	if err != nil {
 		return Node{}, err
 	}
@@ -333,10 +938,14 @@ func (p *Parser) parseFor() (Node, error) {
 		return Node{}, err
 	}
 
-	iterator, err := p.expectForIterator()
-	iteratorNode := Node{Type: ITERATOR_ITEM, Value: &iterator}
+	// A plain variable is kept as the value of the iterator, anything else becomes its child
+	iterator, err := p.parseOperation()
 	if err != nil {
-		return Node{}, err
+		return Node{}, fmt.Errorf("expected iterator after 'in': %w", err)
+	}
+	iteratorNode := Node{Type: ITERATOR_ITEM, Pos: iterator[0].Pos, Children: []Node{collapseExpression(iterator)}}
+	if iteratorNode.Children[0].Type == VARIABLE_NODE {
+		iteratorNode = Node{Type: ITERATOR_ITEM, Value: iteratorNode.Children[0].Value, Pos: iteratorNode.Pos}
 	}
 
 	if err := p.expectCloseCurly(); err != nil {
@@ -357,7 +966,7 @@ func (p *Parser) parseFor() (Node, error) {
 }
 
 func (p *Parser) parseElse() (Node, error) {
-	p.advance()
+	start := p.advance().Pos
 	p.advance()
 	if err := p.expectCloseCurly(); err != nil {
 		return Node{}, err
@@ -366,12 +975,14 @@ func (p *Parser) parseElse() (Node, error) {
 	if err != nil {
 		return Node{}, err
 	}
-	return NewNode(ELSE_BRANCH, nil, elseBlock...), nil
+	elseBranch := NewNode(ELSE_BRANCH, nil, elseBlock...)
+	elseBranch.Pos = start
+	return elseBranch, nil
 }
 
 func (p *Parser) parseElif() (Node, error) {
-	p.advance() // consume {{
-	p.advance() // consume elif
+	start := p.advance().Pos // consume {{
+	p.advance()              // consume elif
 
 	var nodes []Node
 	condition, err := p.parseExpression()
@@ -386,7 +997,9 @@ func (p *Parser) parseElif() (Node, error) {
 	}
 	nodes = append(nodes, block...)
 
-	return NewNode(ELIF_ITEM, nil, nodes...), nil
+	elifItem := NewNode(ELIF_ITEM, nil, nodes...)
+	elifItem.Pos = start
+	return elifItem, nil
 }
 
 func (p *Parser) parseBlock() ([]Node, error) {
@@ -395,8 +1008,11 @@ func (p *Parser) parseBlock() ([]Node, error) {
 	for !p.isAtEnd() && !p.isBlockEnd() {
 		if p.match(lexer.TEXT) {
 			prevVal := p.previous().Value
-			nodes = append(nodes, NewNode(TEXT_NODE, &prevVal))
+			text := NewNode(TEXT_NODE, &prevVal)
+			text.Pos = p.previous().Pos
+			nodes = append(nodes, text)
 		} else if p.match(lexer.OPEN_CURLY) {
+			start := p.previous().Pos
 			if p.match(lexer.KEYWORD) {
 				switch p.previous().Value {
 				case "if":
@@ -404,19 +1020,24 @@ func (p *Parser) parseBlock() ([]Node, error) {
 					if err != nil {
 						return nil, fmt.Errorf("error parsing nested if statement: %w", err)
 					}
+					ifNode.Pos = start
 					nodes = append(nodes, ifNode)
 				case "for":
 					forNode, err := p.parseFor()
 					if err != nil {
 						return nil, fmt.Errorf("error parsing nested for statement: %w", err)
 					}
+					forNode.Pos = start
 					nodes = append(nodes, forNode)
 				default:
-					panic("Unknown KEYWORD")
+					node, err := p.parseStatement(p.previous().Value)
+					if err != nil {
+						return nil, err
+					}
+					node.Pos = start
+					nodes = append(nodes, node)
 				}
-			} else if p.match(lexer.IDENTIFIER) {
-				// In order for 'parseExpression' to parse IDENTIFIER it has to match. And, it won't match without going a step back.
-				p.crrPos--
+			} else if p.isExpressionStart() {
 				node, err := p.parseExpression()
 				if err != nil {
 					return nil, err
@@ -432,24 +1053,47 @@ func (p *Parser) parseBlock() ([]Node, error) {
 	return nodes, nil
 }
 
+// Maps the keywords ending a block to the keyword opening it
+var blockOpeners = map[string]string{
+	"elif":      "if",
+	"else":      "if",
+	"endif":     "if",
+	"endfor":    "for",
+	"endmacro":  "macro",
+	"endcall":   "call",
+	"case":      "switch",
+	"default":   "switch",
+	"endswitch": "switch",
+}
+
 func (p *Parser) isBlockEnd() bool {
-	return p.isElseKeyword() || p.isElifKeyword() || p.isEndIfKeyword() || p.isEndForKeyword()
+	for keyword := range blockOpeners {
+		if p.isKeywordTag(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the current tag starts with the given keyword, e.g. '{{ endif'
+func (p *Parser) isKeywordTag(keyword string) bool {
+	return p.check(lexer.OPEN_CURLY) && p.checkNext(lexer.KEYWORD) && p.peekNext().Value == keyword
 }
 
 func (p *Parser) isElifKeyword() bool {
-	return p.check(lexer.OPEN_CURLY) && p.checkNext(lexer.KEYWORD) && p.tokens[p.crrPos+1].Value == "elif"
+	return p.isKeywordTag("elif")
 }
 
 func (p *Parser) isElseKeyword() bool {
-	return p.check(lexer.OPEN_CURLY) && p.checkNext(lexer.KEYWORD) && p.tokens[p.crrPos+1].Value == "else"
+	return p.isKeywordTag("else")
 }
 
 func (p *Parser) isEndIfKeyword() bool {
-	return p.check(lexer.OPEN_CURLY) && p.checkNext(lexer.KEYWORD) && p.tokens[p.crrPos+1].Value == "endif"
+	return p.isKeywordTag("endif")
 }
 
 func (p *Parser) isEndForKeyword() bool {
-	return p.check(lexer.OPEN_CURLY) && p.checkNext(lexer.KEYWORD) && p.tokens[p.crrPos+1].Value == "endfor"
+	return p.isKeywordTag("endfor")
 }
 
 func (p *Parser) expectIfIdentifier() (string, error) {
@@ -473,28 +1117,21 @@ func (p *Parser) expectForIteratee() (string, error) {
 	return p.previous().Value, nil
 }
 
-func (p *Parser) expectForIterator() (string, error) {
-	if !p.match(lexer.IDENTIFIER) {
-		return "", fmt.Errorf("expected iterator after 'in', got %v", p.peek())
-	}
-	return p.previous().Value, nil
-}
-
 func (p *Parser) expectAndConsumeEndIf() error {
-	if !p.isEndIfKeyword() {
-		return fmt.Errorf("expected '{{ endif }}' to close if statement, got: %v", p.peek())
-	}
-	p.advance() // {{
-	p.advance() // endif
-	return p.expectCloseCurly()
+	return p.expectAndConsumeEnd("endif")
 }
 
 func (p *Parser) expectAndConsumeEndFor() error {
-	if !p.isEndForKeyword() {
-		return fmt.Errorf("expected '{{ endfor }}' to close for statement, got: %v", p.peek())
+	return p.expectAndConsumeEnd("endfor")
+}
+
+// Consumes the whole '{{ keyword }}' tag closing a block
+func (p *Parser) expectAndConsumeEnd(keyword string) error {
+	if !p.isKeywordTag(keyword) {
+		return fmt.Errorf("expected '{{ %s }}' to close %s statement, got: %v", keyword, blockOpeners[keyword], p.peek())
 	}
 	p.advance() // {{
-	p.advance() // endif
+	p.advance() // keyword
 	return p.expectCloseCurly()
 }
 
@@ -525,11 +1162,21 @@ func (p *Parser) match(types ...lexer.TokenType) bool {
 	return false
 }
 
+// Consumes the current token if it's the given keyword
+func (p *Parser) matchKeyword(keyword string) bool {
+	if p.check(lexer.KEYWORD) && p.peek().Value == keyword {
+		p.advance()
+		return true
+	}
+	return false
+}
+
 // Consumes one token
 func (p *Parser) advance() lexer.Token {
 	if !p.isAtEnd() {
 		p.crrPos++
 	}
+	p.compact()
 	return p.previous()
 }
 
@@ -540,7 +1187,15 @@ func (p *Parser) previous() lexer.Token {
 
 // If we are not at the end return next tokens type
 func (p *Parser) checkNext(t lexer.TokenType) bool {
-	return p.crrPos+1 < len(p.tokens) && p.tokens[p.crrPos+1].Type == t
+	return p.fill(p.crrPos+1) && p.tokens[p.crrPos+1].Type == t
+}
+
+// Checks the token after the current one without consuming anything
+func (p *Parser) peekNext() lexer.Token {
+	if !p.fill(p.crrPos + 1) {
+		return p.end()
+	}
+	return p.tokens[p.crrPos+1]
 }
 
 // Check returns true if the current token matches the given type
@@ -551,12 +1206,53 @@ func (p *Parser) check(t lexer.TokenType) bool {
 // Checks current token without consuming it
 func (p *Parser) peek() lexer.Token {
 	if p.isAtEnd() {
-		return lexer.Token{Type: -1, Value: "EOF"}
+		return p.end()
 	}
 	return p.tokens[p.crrPos]
 }
 
+// end returns the EOF token peeked at past the last token: the one of the source when there is one,
+// otherwise one right after the last token
+func (p *Parser) end() lexer.Token {
+	eof := p.eof
+	if eof.Type != lexer.EOF {
+		eof = lexer.Token{Type: lexer.EOF}
+		if len(p.tokens) > 0 {
+			last := p.tokens[len(p.tokens)-1]
+			eof.Pos = last.Pos.Advance(last.Value)
+		}
+	}
+	if eof.Value == "" {
+		eof.Value = "EOF"
+	}
+	return eof
+}
+
 // Checks if we are at the end of token list
 func (p *Parser) isAtEnd() bool {
-	return p.crrPos >= len(p.tokens)
+	return !p.fill(p.crrPos)
+}
+
+// Pulls tokens from the source until index i is loaded, returns false if there are not that many tokens
+func (p *Parser) fill(i int) bool {
+	for p.src != nil && i >= len(p.tokens) {
+		token := p.src.NextToken()
+		if token.Type == lexer.EOF {
+			p.src, p.eof = nil, token
+			break
+		}
+		p.tokens = append(p.tokens, token)
+	}
+	return i < len(p.tokens)
+}
+
+// When streaming, drops consumed tokens except the previous one, which 'previous' and backing up still need
+func (p *Parser) compact() {
+	const maxConsumed = 1024
+	if p.src == nil || p.crrPos < maxConsumed {
+		return
+	}
+	n := copy(p.tokens, p.tokens[p.crrPos-1:])
+	p.tokens = p.tokens[:n]
+	p.crrPos = 1
 }
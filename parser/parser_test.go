@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/ogzhanolguncu/zencefil/lexer"
@@ -291,11 +292,299 @@ func TestParser(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "macro definition",
+			content: "{{ macro field(name, type='text') }}<input name='{{ name }}'>{{ endmacro }}",
+			expected: []Node{
+				{Type: MACRO_NODE, Value: ptrStr("field"), Children: []Node{
+					{Type: MACRO_PARAMS, Children: []Node{
+						{Type: MACRO_PARAM, Value: ptrStr("name")},
+						{Type: MACRO_PARAM, Value: ptrStr("type"), Children: []Node{
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("text")},
+						}},
+					}},
+					{Type: MACRO_BODY, Children: []Node{
+						{Type: TEXT_NODE, Value: ptrStr("<input name='")},
+						{Type: VARIABLE_NODE, Value: ptrStr("name")},
+						{Type: TEXT_NODE, Value: ptrStr("'>")},
+					}},
+				}},
+			},
+		},
+		{
+			name:    "macro call with keyword arguments",
+			content: "{{ forms.field('email', type=kind ?? 'text') }}",
+			expected: []Node{
+				{Type: CALL_NODE, Children: []Node{
+					{Type: OBJECT_ACCESS_NODE, Children: []Node{
+						{Type: VARIABLE_NODE, Value: ptrStr("forms")},
+						{Type: OBJECT_ACCESOR, Value: ptrStr("field")},
+					}},
+					{Type: STRING_LITERAL_NODE, Value: ptrStr("email")},
+					{Type: KEYWORD_ARG, Value: ptrStr("type"), Children: []Node{
+						{Type: EXPRESSION_NODE, Children: []Node{
+							{Type: VARIABLE_NODE, Value: ptrStr("kind")},
+							{Type: OP_NULL_COALESCE, Value: ptrStr("??")},
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("text")},
+						}},
+					}},
+				}},
+			},
+		},
+		{
+			name:    "call block",
+			content: "{{ call card('Title') }}body{{ endcall }}",
+			expected: []Node{
+				{Type: CALL_BLOCK_NODE, Children: []Node{
+					{Type: CALL_NODE, Children: []Node{
+						{Type: VARIABLE_NODE, Value: ptrStr("card")},
+						{Type: STRING_LITERAL_NODE, Value: ptrStr("Title")},
+					}},
+					{Type: CALL_BODY, Children: []Node{
+						{Type: TEXT_NODE, Value: ptrStr("body")},
+					}},
+				}},
+			},
+		},
+		{
+			name:    "imports",
+			content: "{{ import 'forms.html' as forms }}{{ from 'cards.html' import card, badge as b }}",
+			expected: []Node{
+				{Type: IMPORT_NODE, Value: ptrStr("forms.html"), Children: []Node{
+					{Type: IMPORT_ALIAS, Value: ptrStr("forms")},
+				}},
+				{Type: FROM_IMPORT_NODE, Value: ptrStr("cards.html"), Children: []Node{
+					{Type: IMPORT_NAME, Value: ptrStr("card")},
+					{Type: IMPORT_NAME, Value: ptrStr("badge"), Children: []Node{
+						{Type: IMPORT_ALIAS, Value: ptrStr("b")},
+					}},
+				}},
+			},
+		},
+		{
+			name:    "for over a list literal",
+			content: "{{ for size in ['S', 'M', 'L',] }}{{ size }}{{ endfor }}",
+			expected: []Node{
+				{Type: FOR_NODE, Children: []Node{
+					{Type: ITERATEE_ITEM, Value: ptrStr("size")},
+					{Type: ITERATOR_ITEM, Children: []Node{
+						{Type: LIST_LITERAL_NODE, Children: []Node{
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("S")},
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("M")},
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("L")},
+						}},
+					}},
+					{Type: FOR_BODY, Children: []Node{
+						{Type: VARIABLE_NODE, Value: ptrStr("size")},
+					}},
+				}},
+			},
+		},
+		{
+			name:    "map, range and literal keywords",
+			content: "{{ {'a': 1, 'b': x}['a'] ?? 1..n ?? [true, false, nil][0] }}",
+			expected: []Node{
+				{Type: EXPRESSION_NODE, Children: []Node{
+					{Type: OBJECT_ACCESS_NODE, Children: []Node{
+						{Type: MAP_LITERAL_NODE, Children: []Node{
+							{Type: MAP_ENTRY, Children: []Node{
+								{Type: STRING_LITERAL_NODE, Value: ptrStr("a")},
+								{Type: NUMBER_LITERAL_NODE, Value: ptrStr("1")},
+							}},
+							{Type: MAP_ENTRY, Children: []Node{
+								{Type: STRING_LITERAL_NODE, Value: ptrStr("b")},
+								{Type: VARIABLE_NODE, Value: ptrStr("x")},
+							}},
+						}},
+						{Type: OBJECT_ACCESOR, Value: ptrStr("a")},
+					}},
+					{Type: OP_NULL_COALESCE, Value: ptrStr("??")},
+					{Type: NUMBER_LITERAL_NODE, Value: ptrStr("1")},
+					{Type: OP_RANGE, Value: ptrStr("..")},
+					{Type: VARIABLE_NODE, Value: ptrStr("n")},
+					{Type: OP_NULL_COALESCE, Value: ptrStr("??")},
+					{Type: OBJECT_ACCESS_NODE, Children: []Node{
+						{Type: LIST_LITERAL_NODE, Children: []Node{
+							{Type: BOOLEAN_LITERAL_NODE, Value: ptrStr("true")},
+							{Type: BOOLEAN_LITERAL_NODE, Value: ptrStr("false")},
+							{Type: NIL_LITERAL_NODE},
+						}},
+						{Type: OBJECT_ACCESOR, Value: ptrStr("0")},
+					}},
+				}},
+			},
+		},
+		{
+			name:        "Map entry without a colon",
+			content:     "{{ {'a' 1} }}",
+			shouldError: true,
+		},
+		{
+			name:    "membership operators and tests",
+			content: "{{ role in ['admin'] && name not in banned || tags contains 'go' && x is not defined }}",
+			expected: []Node{
+				{Type: EXPRESSION_NODE, Children: []Node{
+					{Type: VARIABLE_NODE, Value: ptrStr("role")},
+					{Type: OP_IN, Value: ptrStr("in")},
+					{Type: LIST_LITERAL_NODE, Children: []Node{
+						{Type: STRING_LITERAL_NODE, Value: ptrStr("admin")},
+					}},
+					{Type: OP_AND, Value: ptrStr("&&")},
+					{Type: VARIABLE_NODE, Value: ptrStr("name")},
+					{Type: OP_NOT_IN, Value: ptrStr("not in")},
+					{Type: VARIABLE_NODE, Value: ptrStr("banned")},
+					{Type: OP_OR, Value: ptrStr("||")},
+					{Type: VARIABLE_NODE, Value: ptrStr("tags")},
+					{Type: OP_CONTAINS, Value: ptrStr("contains")},
+					{Type: STRING_LITERAL_NODE, Value: ptrStr("go")},
+					{Type: OP_AND, Value: ptrStr("&&")},
+					{Type: EXPRESSION_NODE, Children: []Node{
+						{Type: OP_BANG, Value: ptrStr("not")},
+						{Type: TEST_NODE, Value: ptrStr("defined"), Children: []Node{
+							{Type: VARIABLE_NODE, Value: ptrStr("x")},
+						}},
+					}},
+				}},
+			},
+		},
+		{
+			name:    "Inline if binds looser than operators",
+			content: "{{ 'Full' if verified && mfa else 'Partial' if verified else 'None' }}",
+			expected: []Node{
+				{Type: CONDITIONAL_NODE, Children: []Node{
+					{Type: EXPRESSION_NODE, Children: []Node{
+						{Type: VARIABLE_NODE, Value: ptrStr("verified")},
+						{Type: OP_AND, Value: ptrStr("&&")},
+						{Type: VARIABLE_NODE, Value: ptrStr("mfa")},
+					}},
+					{Type: STRING_LITERAL_NODE, Value: ptrStr("Full")},
+					{Type: CONDITIONAL_NODE, Children: []Node{
+						{Type: VARIABLE_NODE, Value: ptrStr("verified")},
+						{Type: STRING_LITERAL_NODE, Value: ptrStr("Partial")},
+						{Type: STRING_LITERAL_NODE, Value: ptrStr("None")},
+					}},
+				}},
+			},
+		},
+		{
+			name:    "Question mark conditional",
+			content: "{{ if (count > 1 ? plural : single) }}x{{ endif }}{{ a ? b : c ? d : e }}",
+			expected: []Node{
+				{Type: IF_NODE, Children: []Node{
+					{Type: EXPRESSION_NODE, Children: []Node{
+						{Type: CONDITIONAL_NODE, Children: []Node{
+							{Type: EXPRESSION_NODE, Children: []Node{
+								{Type: VARIABLE_NODE, Value: ptrStr("count")},
+								{Type: OP_GT, Value: ptrStr(">")},
+								{Type: NUMBER_LITERAL_NODE, Value: ptrStr("1")},
+							}},
+							{Type: VARIABLE_NODE, Value: ptrStr("plural")},
+							{Type: VARIABLE_NODE, Value: ptrStr("single")},
+						}},
+					}},
+					{Type: THEN_BRANCH, Children: []Node{
+						{Type: TEXT_NODE, Value: ptrStr("x")},
+					}},
+				}},
+				{Type: CONDITIONAL_NODE, Children: []Node{
+					{Type: VARIABLE_NODE, Value: ptrStr("a")},
+					{Type: VARIABLE_NODE, Value: ptrStr("b")},
+					{Type: CONDITIONAL_NODE, Children: []Node{
+						{Type: VARIABLE_NODE, Value: ptrStr("c")},
+						{Type: VARIABLE_NODE, Value: ptrStr("d")},
+						{Type: VARIABLE_NODE, Value: ptrStr("e")},
+					}},
+				}},
+			},
+		},
+		{
+			name:        "Inline if without else",
+			content:     "{{ 'x' if a }}",
+			shouldError: true,
+		},
+		{
+			name:        "Conditional without colon",
+			content:     "{{ a ? b }}",
+			shouldError: true,
+		},
+		{
+			name:    "Switch with multiple values per case and a default",
+			content: "{{ switch order.status }}\n  {{ case 'pending', 'new' }}Waiting{{ case 'shipped' }}On its way{{ default }}Unknown{{ endswitch }}",
+			expected: []Node{
+				{Type: SWITCH_NODE, Children: []Node{
+					{Type: OBJECT_ACCESS_NODE, Children: []Node{
+						{Type: VARIABLE_NODE, Value: ptrStr("order")},
+						{Type: OBJECT_ACCESOR, Value: ptrStr("status")},
+					}},
+					{Type: CASE_NODE, Children: []Node{
+						{Type: CASE_VALUES, Children: []Node{
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("pending")},
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("new")},
+						}},
+						{Type: CASE_BODY, Children: []Node{
+							{Type: TEXT_NODE, Value: ptrStr("Waiting")},
+						}},
+					}},
+					{Type: CASE_NODE, Children: []Node{
+						{Type: CASE_VALUES, Children: []Node{
+							{Type: STRING_LITERAL_NODE, Value: ptrStr("shipped")},
+						}},
+						{Type: CASE_BODY, Children: []Node{
+							{Type: TEXT_NODE, Value: ptrStr("On its way")},
+						}},
+					}},
+					{Type: DEFAULT_BRANCH, Children: []Node{
+						{Type: TEXT_NODE, Value: ptrStr("Unknown")},
+					}},
+				}},
+			},
+		},
+		{
+			name:        "Text before the first case",
+			content:     "{{ switch a }}x{{ case 1 }}{{ endswitch }}",
+			shouldError: true,
+		},
+		{
+			name:        "Case after default",
+			content:     "{{ switch a }}{{ default }}x{{ case 1 }}y{{ endswitch }}",
+			shouldError: true,
+		},
+		{
+			name:        "Case without switch",
+			content:     "{{ case 1 }}x",
+			shouldError: true,
+		},
+		{
+			name:        "Unclosed switch",
+			content:     "{{ switch a }}{{ case 1 }}x",
+			shouldError: true,
+		},
+		{
+			name:        "'not' without 'in'",
+			content:     "{{ a not b }}",
+			shouldError: true,
+		},
+		{
+			name:        "Unclosed macro",
+			content:     "{{ macro field(name) }}<input>",
+			shouldError: true,
+		},
+		{
+			name:        "Positional argument after keyword argument",
+			content:     "{{ field(type='text', 'email') }}",
+			shouldError: true,
+		},
+		{
+			name:        "Call block without a call",
+			content:     "{{ call card }}body{{ endcall }}",
+			shouldError: true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tokens := lexer.New(tt.content).Tokenize()
+			tokens, err := lexer.New(tt.content).Tokenize()
+			require.NoError(t, err)
 			ast, err := New(tokens).Parse()
 
 			if tt.allowPrettyPrintToken {
@@ -313,9 +602,300 @@ func TestParser(t *testing.T) {
 				PrettifyAST(ast)
 			}
 
-			require.Equal(t, tt.expected, ast)
+			require.Equal(t, tt.expected, withoutPositions(ast))
+
+			streamed, err := NewFromSource(lexer.New(tt.content)).Parse()
+			require.NoError(t, err)
+			require.Equal(t, withoutPositions(ast), withoutPositions(streamed))
+			require.Equal(t, ast, streamed)
+
+			encoded, err := MarshalAST(ast)
+			require.NoError(t, err)
+			decoded, err := UnmarshalAST(encoded)
+			require.NoError(t, err)
+			require.Equal(t, ast, decoded)
 		})
 	}
 }
 
+func TestParserFromSourceCompactsTokens(t *testing.T) {
+	content := strings.Repeat("<p>{{ if a > 1 }}{{ name }}{{ else }}none{{ endif }}</p>\n", 2000)
+	p := NewFromSource(lexer.New(content))
+	ast, err := p.Parse()
+	require.NoError(t, err)
+	require.Len(t, ast, 2*2000+1)
+	require.LessOrEqual(t, cap(p.tokens), 2048)
+}
+
+func BenchmarkParse(b *testing.B) {
+	content := strings.Repeat("<li>{{ item.name }} - {{ if item.price > 10 }}expensive{{ else }}cheap{{ endif }}</li>\n", 40000)
+	b.Run("tokens", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for range b.N {
+			tokens, err := lexer.New(content).Tokenize()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := New(tokens).Parse(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("source", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for range b.N {
+			if _, err := NewFromSource(lexer.NewReader(strings.NewReader(content), lexer.Options{})).Parse(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestParserPositions(t *testing.T) {
+	content := "Hi {{ user.name }}\n{{ for item in items }}\n  {{ if item['qty'] > 1 }}{{ item }}{{ else }}-{{ endif }}\n{{ endfor }}"
+	tokens, err := lexer.New(content).Tokenize()
+	require.NoError(t, err)
+	ast, err := New(tokens).Parse()
+	require.NoError(t, err)
+
+	pos := func(line, column int) lexer.Position {
+		offset := 0
+		for l := 1; l < line; l++ {
+			offset += strings.Index(content[offset:], "\n") + 1
+		}
+		return lexer.Position{Offset: offset + column - 1, Line: line, Column: column}
+	}
+
+	require.Equal(t, pos(1, 1), ast[0].Pos) // Hi
+	require.Equal(t, pos(1, 7), ast[1].Pos) // user.name
+	require.Equal(t, pos(1, 12), ast[1].Children[1].Pos)
+	forNode := ast[3]
+	require.Equal(t, FOR_NODE, forNode.Type)
+	require.Equal(t, pos(2, 1), forNode.Pos)
+	require.Equal(t, pos(2, 8), forNode.Children[0].Pos)  // item
+	require.Equal(t, pos(2, 16), forNode.Children[1].Pos) // items
+	ifNode := forNode.Children[2].Children[1]
+	require.Equal(t, IF_NODE, ifNode.Type)
+	require.Equal(t, pos(3, 3), ifNode.Pos)
+	condition := ifNode.Children[0]
+	require.Equal(t, pos(3, 9), condition.Pos)
+	require.Equal(t, pos(3, 21), condition.Children[1].Pos) // >
+	require.Equal(t, ELSE_BRANCH, ifNode.Children[2].Type)
+	require.Equal(t, pos(3, 37), ifNode.Children[2].Pos)
+
+	// Syntax errors have the position parsing stopped at
+	tokens, err = lexer.New("{{ x }}\n{{ if }}{{ endif }}").Tokenize()
+	require.NoError(t, err)
+	_, err = New(tokens).Parse()
+	var parseErr *Error
+	require.ErrorAs(t, err, &parseErr)
+	require.Equal(t, lexer.Position{Offset: 14, Line: 2, Column: 7}, parseErr.Pos)
+
+	// Templates ending too early report where they end
+	content = "{{ if x }}\na"
+	tokens, err = lexer.New(content).Tokenize()
+	require.NoError(t, err)
+	_, err = New(tokens).Parse()
+	require.ErrorContains(t, err, `got: "EOF" at 2:2`)
+	_, err = NewFromSource(lexer.New(content)).Parse()
+	require.ErrorContains(t, err, `got: "EOF" at 2:2`)
+}
+
+func TestASTJSON(t *testing.T) {
+	tokens, err := lexer.New("Hi {{ user.name }}\n{{ if !ok }}!{{ endif }}").Tokenize()
+	require.NoError(t, err)
+	ast, err := New(tokens).Parse()
+	require.NoError(t, err)
+
+	encoded, err := MarshalAST(ast)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 1, "nodes": [
+		{"kind": "TEXT_NODE", "value": "Hi ", "pos": {"offset": 0, "line": 1, "column": 1}},
+		{"kind": "OBJECT_ACCESS_NODE", "pos": {"offset": 6, "line": 1, "column": 7}, "children": [
+			{"kind": "VARIABLE_NODE", "value": "user", "pos": {"offset": 6, "line": 1, "column": 7}},
+			{"kind": "OBJECT_ACCESOR", "value": "name", "pos": {"offset": 11, "line": 1, "column": 12}}
+		]},
+		{"kind": "TEXT_NODE", "value": "\n", "pos": {"offset": 18, "line": 1, "column": 19}},
+		{"kind": "IF_NODE", "pos": {"offset": 19, "line": 2, "column": 1}, "children": [
+			{"kind": "EXPRESSION_NODE", "pos": {"offset": 25, "line": 2, "column": 7}, "children": [
+				{"kind": "OP_BANG", "value": "!", "pos": {"offset": 25, "line": 2, "column": 7}},
+				{"kind": "VARIABLE_NODE", "value": "ok", "pos": {"offset": 26, "line": 2, "column": 8}}
+			]},
+			{"kind": "THEN_BRANCH", "children": [
+				{"kind": "TEXT_NODE", "value": "!", "pos": {"offset": 31, "line": 2, "column": 13}}
+			]}
+		]}
+	]}`, string(encoded))
+
+	decoded, err := UnmarshalAST(encoded)
+	require.NoError(t, err)
+	require.Equal(t, ast, decoded)
+
+	encoded, err = MarshalAST(nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 1, "nodes": []}`, string(encoded))
+
+	_, err = MarshalAST([]Node{{Type: NodeType(1000)}})
+	require.ErrorContains(t, err, "unknown node type 1000")
+
+	for input, expected := range map[string]string{
+		`{"version": 2, "nodes": []}`:                      "error decoding AST: version 2 isn't supported, expected 1",
+		`{"nodes": []}`:                                    "error decoding AST: no version",
+		`{"version": 1, "nodes": [{"kind": "NOPE"}]}`:      "error decoding AST: unknown node kind 'NOPE'",
+		`{"version": 1, "nodes": [{"value": "x"}]}`:        `error decoding AST: node without a kind: {"value": "x"}`,
+		`{"version": 1, "nodes": [{"kind": "TEXT_NODE", "`: "error decoding AST: unexpected end of JSON input",
+		`{"version": 1, "nodes": [{"kind": "FOR_NODE"}]}`:  "error decoding AST: FOR_NODE expects children ITERATEE_ITEM, ITERATOR_ITEM, FOR_BODY",
+		`{"version": 1, "nodes": [{"kind": "TEXT_NODE"}]}`: "error decoding AST: TEXT_NODE needs a value",
+		`{"version": 1, "nodes": [{"kind": "IF_NODE", "pos": {"offset": 0, "line": 1, "column": 1}, "children": [{"kind": "VARIABLE_NODE", "value": "ok"}]}]}`:              "error decoding AST: IF_NODE at 1:1 expects a condition and a THEN_BRANCH",
+		`{"version": 1, "nodes": [{"kind": "SWITCH_NODE", "children": [{"kind": "VARIABLE_NODE", "value": "x"}, {"kind": "DEFAULT_BRANCH"}, {"kind": "DEFAULT_BRANCH"}]}]}`: "error decoding AST: SWITCH_NODE expects CASE_NODE children after its subject, and a DEFAULT_BRANCH last",
+		`{"version": 1, "nodes": [{"kind": "SWITCH_NODE", "children": [{"kind": "VARIABLE_NODE", "value": "x"}, {"kind": "CASE_NODE"}]}]}`:                                  "error decoding AST: CASE_NODE expects children CASE_VALUES, CASE_BODY",
+		`{"version": 1, "nodes": [{"kind": "MACRO_NODE", "value": "m", "children": [{"kind": "MACRO_BODY"}]}]}`:                                                             "error decoding AST: MACRO_NODE expects children MACRO_PARAMS, MACRO_BODY",
+		`{"version": 1, "nodes": [{"kind": "CALL_NODE"}]}`:                                                                    "error decoding AST: CALL_NODE expects what it calls",
+		`{"version": 1, "nodes": [{"kind": "OBJECT_ACCESS_NODE", "children": [{"kind": "VARIABLE_NODE", "value": "user"}]}]}`: "error decoding AST: OBJECT_ACCESS_NODE expects an object and an OBJECT_ACCESOR",
+		`{"version": 1, "nodes": [{"kind": "MACRO_PARAMS", "children": [{"kind": "VARIABLE_NODE", "value": "x"}]}]}`:          "error decoding AST: MACRO_PARAMS expects only MACRO_PARAM children, got VARIABLE_NODE",
+	} {
+		_, err := UnmarshalAST([]byte(input))
+		require.EqualError(t, err, expected, input)
+	}
+}
+
+// withoutPositions strips node positions, so expected trees don't have to spell them out
+func withoutPositions(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+	stripped := make([]Node, len(nodes))
+	for i, node := range nodes {
+		node.Pos = lexer.Position{}
+		node.Children = withoutPositions(node.Children)
+		stripped[i] = node
+	}
+	return stripped
+}
+
 func ptrStr(s string) *string { return &s }
+
+func TestFprintAST(t *testing.T) {
+	tokens, err := lexer.New("Hi\n{{ if ok }}{{ name }}{{ endif }}").Tokenize()
+	require.NoError(t, err)
+	ast, err := New(tokens).Parse()
+	require.NoError(t, err)
+
+	var sb strings.Builder
+	require.NoError(t, FprintAST(&sb, ast, lexer.PrintOptions{Color: lexer.ColorNever}))
+	require.Equal(t, "TEXT_NODE: Hi\\n\nIF_NODE:\n  VARIABLE_NODE: ok\n  THEN_BRANCH:\n    VARIABLE_NODE: name\n", sb.String())
+
+	sb.Reset()
+	require.NoError(t, FprintAST(&sb, ast, lexer.PrintOptions{Color: lexer.ColorNever, Positions: true}))
+	require.Equal(t, "TEXT_NODE: Hi\\n (1:1)\nIF_NODE: (2:1)\n  VARIABLE_NODE: ok (2:7)\n  THEN_BRANCH:\n    VARIABLE_NODE: name (2:15)\n", sb.String())
+
+	sb.Reset()
+	require.NoError(t, FprintAST(&sb, ast[:1], lexer.PrintOptions{Color: lexer.ColorAlways}))
+	require.Equal(t, "\x1b[36;1mTEXT_NODE\x1b[0;22m: \x1b[32mHi\\n\x1b[0m\n", sb.String())
+}
+
+func TestFprintDOT(t *testing.T) {
+	long := strings.Repeat("x", 50)
+	tokens, err := lexer.New("Say \"hi\"\n{{ if ok }}" + long + "{{ endif }}").Tokenize()
+	require.NoError(t, err)
+	ast, err := New(tokens).Parse()
+	require.NoError(t, err)
+
+	var sb strings.Builder
+	require.NoError(t, FprintDOT(&sb, ast))
+	require.Equal(t, `digraph AST {
+	node [shape=box, fontname="monospace"];
+	n0 [label="template", shape=ellipse];
+	n1 [label="TEXT_NODE\nSay \"hi\"\\n"];
+	n0 -> n1;
+	n2 [label="IF_NODE"];
+	n0 -> n2;
+	n3 [label="VARIABLE_NODE\nok"];
+	n2 -> n3;
+	n4 [label="THEN_BRANCH"];
+	n2 -> n4;
+	n5 [label="TEXT_NODE\n`+strings.Repeat("x", 39)+`…"];
+	n4 -> n5;
+}
+`, sb.String())
+}
+
+// loopDepth records the variables of a template along with how many for loops they're in
+type loopDepth struct {
+	depth int
+	found *[]string
+}
+
+func (v loopDepth) Visit(node Node) Visitor {
+	switch node.Type {
+	case VARIABLE_NODE, ITERATOR_ITEM, ITERATEE_ITEM:
+		*v.found = append(*v.found, fmt.Sprintf("%s@%d", *node.Value, v.depth))
+	case FOR_BODY:
+		return loopDepth{depth: v.depth + 1, found: v.found}
+	}
+	return v
+}
+
+func parse(t *testing.T, content string) []Node {
+	t.Helper()
+	tokens, err := lexer.New(content).Tokenize()
+	require.NoError(t, err)
+	ast, err := New(tokens).Parse()
+	require.NoError(t, err)
+	return ast
+}
+
+func TestWalk(t *testing.T) {
+	ast := parse(t, "{{ a }}{{ for x in xs }}{{ for y in x }}{{ y }}{{ endfor }}{{ b }}{{ endfor }}{{ c }}")
+
+	var found []string
+	Walk(ast, loopDepth{found: &found})
+	require.Equal(t, []string{"a@0", "x@0", "xs@0", "y@1", "x@1", "y@2", "b@1", "c@0"}, found)
+
+	var types []NodeType
+	Inspect(ast, func(node Node) bool {
+		types = append(types, node.Type)
+		// Loop bodies are skipped
+		return node.Type != FOR_BODY
+	})
+	require.Equal(t, []NodeType{VARIABLE_NODE, FOR_NODE, ITERATEE_ITEM, ITERATOR_ITEM, FOR_BODY, VARIABLE_NODE}, types)
+
+	Inspect(nil, func(Node) bool {
+		t.Fatal("no nodes to inspect")
+		return true
+	})
+}
+
+func TestRewrite(t *testing.T) {
+	ast := parse(t, "Hi {{ if true }}<b>{{ name }}</b>{{ else }}-{{ endif }}!")
+	dump := func(nodes []Node) string {
+		var sb strings.Builder
+		require.NoError(t, FprintAST(&sb, nodes, lexer.PrintOptions{Color: lexer.ColorNever}))
+		return sb.String()
+	}
+	before := dump(ast)
+
+	rewritten := Rewrite(ast, func(node Node) []Node {
+		switch node.Type {
+		case TEXT_NODE:
+			if *node.Value == "!" {
+				return nil
+			}
+			upper := strings.ToUpper(*node.Value)
+			node.Value = &upper
+		case IF_NODE:
+			// The then branch takes the place of an if whose condition is true
+			if node.Children[0].Type == BOOLEAN_LITERAL_NODE && *node.Children[0].Value == "true" {
+				return node.Children[1].Children
+			}
+		}
+		return []Node{node}
+	})
+	require.Equal(t, "TEXT_NODE: HI \nTEXT_NODE: <B>\nVARIABLE_NODE: name\nTEXT_NODE: </B>\n", dump(rewritten))
+	require.Equal(t, before, dump(ast), "the nodes passed in don't change")
+	require.Equal(t, ast[0].Pos, rewritten[0].Pos)
+
+	require.Nil(t, Rewrite(nil, func(node Node) []Node { return []Node{node} }))
+}
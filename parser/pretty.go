@@ -2,67 +2,141 @@ package parser
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/fatih/color"
+	"github.com/ogzhanolguncu/zencefil/lexer"
 )
 
+// PrettifyAST prints the nodes to stdout as FprintAST does, coloured when stdout is a terminal
 func PrettifyAST(nodes []Node) {
+	FprintAST(os.Stdout, nodes, lexer.PrintOptions{})
+}
+
+// FprintAST writes the nodes one per line as 'TYPE: value', children indented under their parent
+func FprintAST(w io.Writer, nodes []Node, opts lexer.PrintOptions) error {
 	var sb strings.Builder
-	prettifyNodes(&sb, nodes, 0)
-	fmt.Printf("%%\n%s\n", sb.String())
+	prettifyNodes(&sb, nodes, 0, opts, lexer.Palette(opts.Color.Enabled(w)))
+	_, err := io.WriteString(w, sb.String())
+	return err
 }
 
-func prettifyNodes(sb *strings.Builder, nodes []Node, indent int) {
+func prettifyNodes(sb *strings.Builder, nodes []Node, indent int, opts lexer.PrintOptions, paint func(attributes ...color.Attribute) func(a ...interface{}) string) {
 	for _, node := range nodes {
 		sb.WriteString(strings.Repeat("  ", indent))
 
 		// Color for node type
-		nodeTypeColor := color.New(color.FgCyan, color.Bold).SprintFunc()
+		nodeTypeColor := paint(color.FgCyan, color.Bold)
 
 		// Color for node value
 		var nodeValueColor func(a ...interface{}) string
 		switch node.Type {
 		case TEXT_NODE:
-			nodeValueColor = color.New(color.FgGreen).SprintFunc()
+			nodeValueColor = paint(color.FgGreen)
 		case VARIABLE_NODE:
-			nodeValueColor = color.New(color.FgYellow).SprintFunc()
+			nodeValueColor = paint(color.FgYellow)
 
 		case IF_NODE:
-			nodeValueColor = color.New(color.FgMagenta).SprintFunc()
+			nodeValueColor = paint(color.FgMagenta)
 		case THEN_BRANCH:
-			nodeValueColor = color.New(color.FgMagenta).SprintFunc()
+			nodeValueColor = paint(color.FgMagenta)
 		case ELIF_BRANCH:
-			nodeValueColor = color.New(color.FgMagenta).SprintFunc()
+			nodeValueColor = paint(color.FgMagenta)
 		case ELIF_ITEM:
-			nodeValueColor = color.New(color.FgMagenta).SprintFunc()
+			nodeValueColor = paint(color.FgMagenta)
 		case ELSE_BRANCH:
-			nodeValueColor = color.New(color.FgMagenta).SprintFunc()
+			nodeValueColor = paint(color.FgMagenta)
 
 		case FOR_NODE:
-			nodeValueColor = color.New(color.FgBlue).SprintFunc()
+			nodeValueColor = paint(color.FgBlue)
 		case ITERATEE_ITEM:
-			nodeValueColor = color.New(color.FgBlue).SprintFunc()
+			nodeValueColor = paint(color.FgBlue)
 		case ITERATOR_ITEM:
-			nodeValueColor = color.New(color.FgBlue).SprintFunc()
+			nodeValueColor = paint(color.FgBlue)
 		case FOR_BODY:
-			nodeValueColor = color.New(color.FgBlue).SprintFunc()
+			nodeValueColor = paint(color.FgBlue)
+
+		case SWITCH_NODE, CASE_NODE, CASE_VALUES, CASE_BODY, DEFAULT_BRANCH:
+			nodeValueColor = paint(color.FgMagenta)
+
+		case MACRO_NODE, MACRO_PARAM, CALL_NODE, KEYWORD_ARG, IMPORT_NODE, FROM_IMPORT_NODE, IMPORT_NAME, IMPORT_ALIAS:
+			nodeValueColor = paint(color.FgHiBlue)
 
 		default:
-			nodeValueColor = color.New(color.FgWhite).SprintFunc()
+			nodeValueColor = paint(color.FgWhite)
 		}
 
 		// Always print the node type
+		fmt.Fprintf(sb, "%s:", nodeTypeColor(node.Type))
 		if node.Value != nil {
-			fmt.Fprintf(sb, "%s: %s\n",
-				nodeTypeColor(node.Type),
-				nodeValueColor(strings.ReplaceAll(strings.ReplaceAll(*node.Value, "\n", "\\n"), "\t", "\\t")))
-		} else {
-			fmt.Fprintf(sb, "%s: \n", nodeTypeColor(node.Type))
+			fmt.Fprintf(sb, " %s", nodeValueColor(strings.ReplaceAll(strings.ReplaceAll(*node.Value, "\n", "\\n"), "\t", "\\t")))
+		}
+		// Grouping nodes such as THEN_BRANCH have no position
+		if opts.Positions && node.Pos != (lexer.Position{}) {
+			fmt.Fprintf(sb, " %s", paint(color.Faint)("("+node.Pos.String()+")"))
 		}
+		sb.WriteByte('\n')
 
 		if len(node.Children) > 0 {
-			prettifyNodes(sb, node.Children, indent+1)
+			prettifyNodes(sb, node.Children, indent+1, opts, paint)
+		}
+	}
+}
+
+// maxDOTValue is how many characters of a node's value its label in a DOT graph shows
+const maxDOTValue = 40
+
+// FprintDOT writes the nodes as a Graphviz graph, e.g. for 'dot -Tsvg', rooted at a 'template' node.
+// Each node is labelled with its type and value, long values are cut short.
+func FprintDOT(w io.Writer, nodes []Node) error {
+	var sb strings.Builder
+	sb.WriteString("digraph AST {\n")
+	sb.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+	sb.WriteString("\tn0 [label=\"template\", shape=ellipse];\n")
+	next := 1
+	var writeNodes func(parent int, nodes []Node)
+	writeNodes = func(parent int, nodes []Node) {
+		for _, node := range nodes {
+			id := next
+			next++
+			label := node.Type.String()
+			if node.Value != nil {
+				value := []rune(*node.Value)
+				if len(value) > maxDOTValue {
+					value = append(value[:maxDOTValue-1], '…')
+				}
+				label += "\n" + strings.ReplaceAll(strings.ReplaceAll(string(value), "\n", "\\n"), "\t", "\\t")
+			}
+			fmt.Fprintf(&sb, "\tn%d [label=%s];\n", id, dotQuote(label))
+			fmt.Fprintf(&sb, "\tn%d -> n%d;\n", parent, id)
+			writeNodes(id, node.Children)
+		}
+	}
+	writeNodes(0, nodes)
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// dotQuote quotes a label for a DOT graph, a newline in it starts a new line of the label
+func dotQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			// Graphviz doesn't take carriage returns in labels
+		default:
+			sb.WriteRune(r)
 		}
 	}
+	sb.WriteByte('"')
+	return sb.String()
 }
@@ -0,0 +1,50 @@
+package parser
+
+// A Visitor's Visit method is called by Walk for every node. When it returns a visitor, Walk visits the node's
+// children with that one, when it returns nil the children are skipped.
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk visits the nodes depth first, each node before its children. The visitor returned for a node can carry
+// what holds for its children only, such as the variable a for loop declares.
+func Walk(nodes []Node, v Visitor) {
+	for _, node := range nodes {
+		if w := v.Visit(node); w != nil {
+			Walk(node.Children, w)
+		}
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect calls f for every node depth first, each node before its children. The children of a node are skipped
+// when f returns false for it.
+func Inspect(nodes []Node, f func(Node) bool) {
+	Walk(nodes, inspector(f))
+}
+
+// Rewrite returns a copy of the nodes with each node replaced by what f returns for it: the node to keep it,
+// nothing to remove it, or any nodes to take its place. f is called bottom up, so the node it gets has its
+// children rewritten already. The nodes passed in aren't changed, as long as f sets a new Value rather than
+// writing through the pointer.
+//
+// Nodes such as FOR_NODE and IF_NODE have children in a fixed layout, f keeps it or the tree can't be rendered.
+func Rewrite(nodes []Node, f func(Node) []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+	rewritten := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		node.Children = Rewrite(node.Children, f)
+		rewritten = append(rewritten, f(node)...)
+	}
+	return rewritten
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+	"github.com/ogzhanolguncu/zencefil/renderer"
+)
+
+// stringsFlag collects the values of a flag that can be given more than once
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func renderCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var dataFiles, sets stringsFlag
+	flags.Var(&dataFiles, "data", "read context from `file` (.json, .yaml, .yml, .toml or .env), '-' reads stdin. Later files override earlier ones")
+	flags.Var(&sets, "set", "set a context value as `key=value` after reading the data files, dotted keys set nested values")
+	format := flags.String("format", "", "`format` of data read from stdin or from files without a known extension: json, yaml, toml or env")
+	out := flags.String("out", "", "write the output to `file` instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: zencefil render <template> [flags]\n\nRenders a template, '-' reads it from stdin.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseFlags(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintf(stderr, "zencefil render: expected one template, got %d\n\n", len(positional))
+		flags.Usage()
+		return exitUsage
+	}
+	templateFile := positional[0]
+
+	stdinReads := 0
+	for _, file := range append([]string{templateFile}, dataFiles...) {
+		if file == "-" {
+			stdinReads++
+		}
+	}
+	if stdinReads > 1 {
+		fmt.Fprintln(stderr, "zencefil render: stdin can only be read once")
+		return exitUsage
+	}
+
+	context, err := loadContext(dataFiles, sets, *format, stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+
+	result, err := renderFile(templateFile, context, stdin)
+	if err != nil {
+		reportError(stderr, templateFile, err)
+		return exitFailure
+	}
+
+	if *out == "" {
+		_, err = io.WriteString(stdout, result)
+	} else {
+		err = os.WriteFile(*out, []byte(result), 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "zencefil render: error writing output: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// parseFlags parses flags given before and after the positional arguments, which it returns
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// renderFile renders the template in file, its imports are loaded from the directory it's in
+func renderFile(file string, context map[string]interface{}, stdin io.Reader) (string, error) {
+	var content []byte
+	var err error
+	dir := filepath.Dir(file)
+	if file == "-" {
+		content, err = io.ReadAll(stdin)
+		dir = "."
+	} else {
+		content, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return "", err
+	}
+	return renderSource(string(content), context, renderer.NewDirLoader(dir))
+}
+
+// renderSource renders the content of a template, the templates it imports come from loader
+func renderSource(content string, context map[string]interface{}, loader renderer.Loader) (string, error) {
+	tokens, err := lexer.New(content).Tokenize()
+	if err != nil {
+		return "", err
+	}
+	ast, err := parser.New(tokens).Parse()
+	if err != nil {
+		return "", err
+	}
+
+	r := renderer.New(ast, context)
+	r.Loader = loader
+	return r.Render()
+}
+
+// reportError prints an error about a template, prefixed by the file name and, when it's known, the position
+func reportError(w io.Writer, file string, err error) {
+	if file == "-" {
+		file = "stdin"
+	}
+
+	var lexErrors lexer.ErrorList
+	if errors.As(err, &lexErrors) {
+		for _, lexErr := range lexErrors {
+			fmt.Fprintf(w, "%s:%s\n", file, lexErr)
+		}
+		return
+	}
+
+	var parseErr *parser.Error
+	if errors.As(err, &parseErr) {
+		fmt.Fprintf(w, "%s:%s: %v\n", file, parseErr.Pos, err)
+		return
+	}
+
+	// Only an error raised in this template has a position in it, not one wrapped by an import
+	if renderErr, ok := err.(*renderer.RenderError); ok && renderErr.Node.Pos != (lexer.Position{}) {
+		fmt.Fprintf(w, "%s:%s: %v\n", file, renderErr.Node.Pos, err)
+		return
+	}
+	fmt.Fprintf(w, "%s: %v\n", file, err)
+}
@@ -0,0 +1,162 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// builtin is a function templates can call without it being in the context
+type builtin func(r *Renderer, args []interface{}, kwargs map[string]interface{}) (interface{}, error)
+
+var builtins = map[string]builtin{
+	"range": rangeBuiltin,
+}
+
+// BuiltinNames returns the names of the functions every template can call, sorted
+func BuiltinNames() []string {
+	return sortedNames(builtins)
+}
+
+// StringMethodNames returns the names of the methods every string has, sorted
+func StringMethodNames() []string {
+	return sortedNames(stringMethods)
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// stringMethods can be called on any string, e.g. {{ name.upper() }} or {{ 'a,b'.split(',') }}.
+// Methods that can make a string longer check the size of their result with the renderer before building it.
+var stringMethods = map[string]func(r *Renderer, s string, args []interface{}) (interface{}, error){
+	"upper":      noArgs(strings.ToUpper),
+	"lower":      noArgs(strings.ToLower),
+	"title":      noArgs(title),
+	"capitalize": noArgs(capitalize),
+	"strip":      noArgs(strings.TrimSpace),
+	"split": func(_ *Renderer, s string, args []interface{}) (interface{}, error) {
+		sep, err := stringArgs("split", args, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		var parts []string
+		if len(sep) == 0 {
+			parts = strings.Fields(s)
+		} else {
+			parts = strings.Split(s, sep[0])
+		}
+		items := make([]interface{}, len(parts))
+		for i, part := range parts {
+			items[i] = part
+		}
+		return items, nil
+	},
+	"replace": func(r *Renderer, s string, args []interface{}) (interface{}, error) {
+		replace, err := stringArgs("replace", args, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkSize(len(s) + strings.Count(s, replace[0])*(len(replace[1])-len(replace[0]))); err != nil {
+			return nil, err
+		}
+		return strings.ReplaceAll(s, replace[0], replace[1]), nil
+	},
+}
+
+// noArgs adapts a string function to a string method without arguments
+func noArgs(fn func(string) string) func(*Renderer, string, []interface{}) (interface{}, error) {
+	return func(_ *Renderer, s string, args []interface{}) (interface{}, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("method takes no arguments but %d were given", len(args))
+		}
+		return fn(s), nil
+	}
+}
+
+// stringArgs checks the arguments of a string method are between min and max strings
+func stringArgs(name string, args []interface{}, min, max int) ([]string, error) {
+	if len(args) < min || len(args) > max {
+		return nil, fmt.Errorf("%s takes %d to %d arguments but %d were given", name, min, max, len(args))
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s arguments must be strings, got %v", name, arg)
+		}
+		strs[i] = str
+	}
+	return strs, nil
+}
+
+// title upper cases the first letter of every word
+func title(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if i == 0 || unicode.IsSpace(runes[i-1]) {
+			runes[i] = unicode.ToUpper(r)
+		}
+	}
+	return string(runes)
+}
+
+// capitalize upper cases the first letter and lower cases the rest
+func capitalize(s string) string {
+	first, size := utf8.DecodeRuneInString(s)
+	if first == utf8.RuneError {
+		return s
+	}
+	return string(unicode.ToUpper(first)) + strings.ToLower(s[size:])
+}
+
+// rangeBuiltin works like Python's range: range(stop), range(start, stop) or range(start, stop, step), stop is excluded
+func rangeBuiltin(r *Renderer, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("range takes no keyword arguments")
+	}
+	if len(args) < 1 || len(args) > 3 {
+		return nil, fmt.Errorf("range takes 1 to 3 arguments but %d were given", len(args))
+	}
+
+	bounds := make([]float64, len(args))
+	for i, arg := range args {
+		num, ok := toFloat64(arg)
+		if !ok || num != math.Trunc(num) {
+			return nil, fmt.Errorf("range arguments must be integers, got %v", arg)
+		}
+		bounds[i] = num
+	}
+
+	start, stop, step := 0.0, bounds[0], 1.0
+	if len(bounds) > 1 {
+		start, stop = bounds[0], bounds[1]
+	}
+	if len(bounds) > 2 {
+		step = bounds[2]
+	}
+	if step == 0 {
+		return nil, fmt.Errorf("range step must not be zero")
+	}
+	if err := r.checkRange(start, stop, step); err != nil {
+		return nil, err
+	}
+	return makeRange(start, stop, step), nil
+}
+
+// makeRange returns the numbers from start up to, but not including, stop
+func makeRange(start, stop, step float64) []interface{} {
+	var items []interface{}
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		items = append(items, i)
+	}
+	return items
+}
@@ -0,0 +1,177 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+)
+
+var (
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	kwargsType = reflect.TypeOf(map[string]interface{}(nil))
+)
+
+// AllowMethods only lets templates call the named methods on values of the same type as value,
+// pointers and the values they point to share the same list. Functions in struct fields and map keys are
+// called like methods and need to be listed as well, other exported fields can still be read.
+func (r *Renderer) AllowMethods(value interface{}, names ...string) {
+	if r.AllowedMethods == nil {
+		r.AllowedMethods = make(map[reflect.Type][]string)
+	}
+	t := indirectType(reflect.TypeOf(value))
+	r.AllowedMethods[t] = append(r.AllowedMethods[t], names...)
+}
+
+// methodAllowed reports whether templates may call the named method on values of type t
+func (r *Renderer) methodAllowed(t reflect.Type, name string) bool {
+	if r.AllowedMethods == nil {
+		return true
+	}
+	return slices.Contains(r.AllowedMethods[indirectType(t)], name)
+}
+
+// method returns the named method of obj bound to it, string methods are looked up first
+func (r *Renderer) method(obj interface{}, name string) (interface{}, error) {
+	if s, ok := obj.(string); ok {
+		if fn, exists := stringMethods[name]; exists {
+			return builtin(func(r *Renderer, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+				if len(kwargs) > 0 {
+					return nil, fmt.Errorf("%s takes no keyword arguments", name)
+				}
+				return fn(r, s, args)
+			}), nil
+		}
+		return nil, fmt.Errorf("string has no method '%s'", name)
+	}
+
+	rv := reflect.ValueOf(obj)
+	if !rv.IsValid() {
+		return nil, fmt.Errorf("cannot call method '%s' on nil", name)
+	}
+	m := rv.MethodByName(name)
+	if !m.IsValid() && rv.Kind() != reflect.Pointer {
+		// Methods with pointer receivers can still be called on a copy of the value
+		ptr := reflect.New(rv.Type())
+		ptr.Elem().Set(rv)
+		m = ptr.MethodByName(name)
+	}
+	if !m.IsValid() {
+		return nil, fmt.Errorf("%T has no method '%s'", obj, name)
+	}
+	if !r.methodAllowed(rv.Type(), name) {
+		return nil, fmt.Errorf("method '%s' of %T is not allowed", name, obj)
+	}
+	return m.Interface(), nil
+}
+
+// callFunction calls a Go function with template values, converting the arguments to its parameter types.
+// It must return a value, an error, or a value and an error.
+func callFunction(fn reflect.Value, args []interface{}, kwargs map[string]interface{}) (result interface{}, err error) {
+	t := fn.Type()
+	numIn := t.NumIn()
+	takesKwargs := !t.IsVariadic() && numIn > 0 && t.In(numIn-1) == kwargsType
+	// A function taking a map as its last argument can still be given it positionally
+	if takesKwargs && len(kwargs) == 0 && len(args) == numIn {
+		takesKwargs = false
+	}
+	if takesKwargs {
+		numIn--
+	} else if len(kwargs) > 0 {
+		return nil, fmt.Errorf("function takes no keyword arguments")
+	}
+
+	switch {
+	case t.IsVariadic() && len(args) < numIn-1:
+		return nil, fmt.Errorf("function takes at least %d arguments but %d were given", numIn-1, len(args))
+	case !t.IsVariadic() && len(args) != numIn:
+		return nil, fmt.Errorf("function takes %d arguments but %d were given", numIn, len(args))
+	}
+
+	in := make([]reflect.Value, 0, len(args)+1)
+	for i, arg := range args {
+		var paramType reflect.Type
+		if t.IsVariadic() && i >= numIn-1 {
+			paramType = t.In(numIn - 1).Elem()
+		} else {
+			paramType = t.In(i)
+		}
+		value, err := convertArgument(arg, paramType)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		in = append(in, value)
+	}
+	if takesKwargs {
+		in = append(in, reflect.ValueOf(kwargs))
+	}
+
+	switch {
+	case t.NumOut() == 1, t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		return nil, fmt.Errorf("function must return a value, an error, or a value and an error")
+	}
+
+	// A panicking function fails the render instead of crashing the program
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result, err = nil, fmt.Errorf("function panicked: %v", recovered)
+		}
+	}()
+
+	out := fn.Call(in)
+	if last := out[len(out)-1]; t.Out(len(out)-1) == errorType {
+		if !last.IsNil() {
+			return nil, last.Interface().(error)
+		}
+		if len(out) == 1 {
+			return nil, nil
+		}
+	}
+	return out[0].Interface(), nil
+}
+
+// convertArgument turns a template value into a value of the given parameter type.
+// Template numbers are float64, they are converted to any numeric type as long as no precision is lost.
+func convertArgument(arg interface{}, to reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		switch to.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return reflect.Zero(to), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use nil as %s", to)
+	}
+
+	v := reflect.ValueOf(arg)
+	if v.Type().AssignableTo(to) {
+		return v, nil
+	}
+	if num, ok := toFloat64(arg); ok {
+		switch to.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if num != math.Trunc(num) {
+				return reflect.Value{}, fmt.Errorf("cannot use %v as %s", arg, to)
+			}
+			return reflect.ValueOf(num).Convert(to), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if num != math.Trunc(num) || num < 0 {
+				return reflect.Value{}, fmt.Errorf("cannot use %v as %s", arg, to)
+			}
+			return reflect.ValueOf(num).Convert(to), nil
+		case reflect.Float32, reflect.Float64:
+			return reflect.ValueOf(num).Convert(to), nil
+		}
+	}
+	// Named types such as 'type Status string'
+	if v.Kind() == to.Kind() && v.Type().ConvertibleTo(to) {
+		return v.Convert(to), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %v (%T) as %s", arg, arg, to)
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,41 @@
+package renderer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Loader returns the source of the templates used by 'import' and 'from' tags
+type Loader interface {
+	Load(name string) (string, error)
+}
+
+// MapLoader serves templates from memory, keyed by name
+type MapLoader map[string]string
+
+func (l MapLoader) Load(name string) (string, error) {
+	source, exists := l[name]
+	if !exists {
+		return "", fmt.Errorf("template '%s' not found", name)
+	}
+	return source, nil
+}
+
+// FSLoader reads templates from a file system, names are slash separated paths within it
+type FSLoader struct {
+	FS fs.FS
+}
+
+// NewDirLoader creates a loader reading templates from the given directory
+func NewDirLoader(dir string) *FSLoader {
+	return &FSLoader{FS: os.DirFS(dir)}
+}
+
+func (l *FSLoader) Load(name string) (string, error) {
+	source, err := fs.ReadFile(l.FS, name)
+	if err != nil {
+		return "", err
+	}
+	return string(source), nil
+}
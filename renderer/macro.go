@@ -0,0 +1,208 @@
+package renderer
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// macro is a template fragment defined with '{{ macro }}', rendered every time it's called
+type macro struct {
+	name   string
+	params []parser.Node // MACRO_PARAM nodes, the child of a param is its default value
+	body   []parser.Node
+	env    *Renderer // renderer the macro was defined in, its body sees the same context and names
+}
+
+// call renders the macro body with the arguments bound to its parameters. Macros are scoped dynamically, the body
+// sees the context of the renderer it's defined in as it is when called, loop variables included.
+// caller is the body of a '{{ call }}' block, it's nil for plain calls.
+func (m *macro) call(args []interface{}, kwargs map[string]interface{}, caller *macro) (string, error) {
+	if len(args) > len(m.params) {
+		return "", &RenderError{Message: fmt.Sprintf("macro '%s' takes %d arguments but %d were given", m.name, len(m.params), len(args))}
+	}
+
+	scope := make(map[string]interface{}, len(m.env.Context)+len(m.params)+1)
+	for key, value := range m.env.Context {
+		scope[key] = value
+	}
+	if caller != nil {
+		scope["caller"] = caller
+	}
+	body := m.env.child(scope, m.env.names)
+	if err := body.enter(); err != nil {
+		return "", err
+	}
+	defer body.leave()
+
+	for i, param := range m.params {
+		name := *param.Value
+		kwarg, hasKwarg := kwargs[name]
+		switch {
+		case i < len(args) && hasKwarg:
+			return "", &RenderError{Message: fmt.Sprintf("macro '%s' got multiple values for argument '%s'", m.name, name)}
+		case i < len(args):
+			scope[name] = args[i]
+		case hasKwarg:
+			scope[name] = kwarg
+		case len(param.Children) > 0:
+			// Defaults are evaluated on every call and can refer to the parameters before them
+			value, err := body.evaluateOperand(param.Children[0])
+			if err != nil {
+				return "", fmt.Errorf("error evaluating default value of '%s' in macro '%s': %w", name, m.name, err)
+			}
+			scope[name] = value
+		default:
+			return "", &RenderError{Message: fmt.Sprintf("macro '%s' is missing argument '%s'", m.name, name)}
+		}
+		delete(kwargs, name)
+	}
+	for name := range kwargs {
+		return "", &RenderError{Message: fmt.Sprintf("macro '%s' has no argument '%s'", m.name, name)}
+	}
+
+	return body.renderNodes(m.body)
+}
+
+// evaluateCall calls the macro, function or method a CALL_NODE refers to and returns its result
+func (r *Renderer) evaluateCall(node parser.Node, caller *macro) (interface{}, error) {
+	callee, err := r.evaluateCallee(node.Children[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var args []interface{}
+	kwargs := make(map[string]interface{})
+	for _, arg := range node.Children[1:] {
+		if arg.Type == parser.KEYWORD_ARG {
+			value, err := r.evaluateOperand(arg.Children[0])
+			if err != nil {
+				return nil, err
+			}
+			kwargs[*arg.Value] = value
+			continue
+		}
+		value, err := r.evaluateOperand(arg)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	switch fn := callee.(type) {
+	case *macro:
+		return fn.call(args, kwargs, caller)
+	case nil:
+		return nil, &RenderError{Message: fmt.Sprintf("'%s' is not a function or macro", calleeName(node.Children[0])), Node: node}
+	}
+	if caller != nil {
+		return nil, &RenderError{Message: fmt.Sprintf("'%s' is not a macro", calleeName(node.Children[0])), Node: node}
+	}
+
+	var value interface{}
+	if fn, ok := callee.(builtin); ok {
+		value, err = fn(r, args, kwargs)
+	} else if fn := reflect.ValueOf(callee); fn.Kind() == reflect.Func {
+		value, err = callFunction(fn, args, kwargs)
+	} else {
+		return nil, &RenderError{Message: fmt.Sprintf("'%s' is not a function or macro", calleeName(node.Children[0])), Node: node}
+	}
+	if isLimitExceeded(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &RenderError{Message: fmt.Sprintf("error calling '%s': %v", calleeName(node.Children[0]), err), Node: node}
+	}
+	return value, nil
+}
+
+// evaluateCallee resolves what is being called. Names not in the context or the template fall back to
+// the renderer's functions and then to builtins, 'obj.name' falls back to the methods of obj.
+func (r *Renderer) evaluateCallee(node parser.Node) (interface{}, error) {
+	switch node.Type {
+	case parser.VARIABLE_NODE:
+		if _, exists := r.variableLookup(*node.Value); !exists {
+			if fn, exists := r.Functions[*node.Value]; exists {
+				return fn, nil
+			}
+			if fn, exists := builtins[*node.Value]; exists {
+				return fn, nil
+			}
+		}
+
+	case parser.OBJECT_ACCESS_NODE:
+		obj, err := r.evaluateAccessTarget(node.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		name := *node.Children[1].Value
+		if _, isString := obj.(string); !isString {
+			if value, found, _ := lookupKey(obj, name); found {
+				// Functions in fields and map keys are called like methods, so the allowlist covers them too
+				if reflect.ValueOf(value).Kind() == reflect.Func && !r.methodAllowed(reflect.TypeOf(obj), name) {
+					return nil, &RenderError{Message: fmt.Sprintf("function '%s' of %T is not allowed", name, obj), Node: node}
+				}
+				return value, nil
+			}
+		}
+		fn, err := r.method(obj, name)
+		if err != nil {
+			return nil, &RenderError{Message: err.Error(), Node: node}
+		}
+		return fn, nil
+	}
+	return r.evaluateOperand(node)
+}
+
+// calleeName describes what is being called for error messages, e.g. 'forms.field'
+func calleeName(node parser.Node) string {
+	switch node.Type {
+	case parser.VARIABLE_NODE:
+		return *node.Value
+	case parser.OBJECT_ACCESS_NODE:
+		return calleeName(node.Children[0]) + "." + *node.Children[1].Value
+	default:
+		return node.Type.String()
+	}
+}
+
+// importTemplate renders the named template on its own and returns the macros it defines
+func (r *Renderer) importTemplate(name string) (map[string]interface{}, error) {
+	if r.Loader == nil {
+		return nil, &RenderError{Message: fmt.Sprintf("cannot import '%s': renderer has no loader", name)}
+	}
+	for _, importing := range r.importing {
+		if importing == name {
+			return nil, &RenderError{Message: fmt.Sprintf("import cycle: %s -> %s", strings.Join(r.importing, " -> "), name)}
+		}
+	}
+
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	source, err := r.Loader.Load(name)
+	if err != nil {
+		return nil, fmt.Errorf("error loading '%s': %w", name, err)
+	}
+	tokens, err := lexer.New(source).Tokenize()
+	if err != nil {
+		return nil, fmt.Errorf("error lexing '%s': %w", name, err)
+	}
+	ast, err := parser.New(tokens).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing '%s': %w", name, err)
+	}
+
+	// Imported templates don't see the context of the importing one
+	imported := r.child(make(map[string]interface{}), make(map[string]interface{}))
+	imported.importing = append(r.importing[:len(r.importing):len(r.importing)], name)
+	if _, err := imported.renderNodes(ast); err != nil {
+		return nil, fmt.Errorf("error rendering '%s': %w", name, err)
+	}
+	return imported.names, nil
+}
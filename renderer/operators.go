@@ -0,0 +1,114 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// isTests are the checks available after 'is', e.g. '{{ if count is even }}'
+var isTests = map[string]func(value interface{}) bool{
+	"none":    func(value interface{}) bool { return value == nil },
+	"nil":     func(value interface{}) bool { return value == nil },
+	"boolean": func(value interface{}) bool { _, ok := value.(bool); return ok },
+	"string":  func(value interface{}) bool { _, ok := value.(string); return ok },
+	"number": func(value interface{}) bool {
+		_, ok := toFloat64(value)
+		return ok
+	},
+	"even": func(value interface{}) bool {
+		num, ok := toFloat64(value)
+		return ok && math.Mod(num, 2) == 0
+	},
+	"odd": func(value interface{}) bool {
+		num, ok := toFloat64(value)
+		return ok && math.Abs(math.Mod(num, 2)) == 1
+	},
+	"iterable": func(value interface{}) bool {
+		_, err := iterate(value)
+		return value != nil && err == nil
+	},
+	"mapping": func(value interface{}) bool {
+		return value != nil && reflect.TypeOf(value).Kind() == reflect.Map
+	},
+}
+
+// TestNames returns the names of the tests available after 'is', sorted
+func TestNames() []string {
+	// 'defined' and 'undefined' don't evaluate their subject, so they aren't in isTests
+	names := append(sortedNames(isTests), "defined", "undefined")
+	slices.Sort(names)
+	return names
+}
+
+// evaluateTest evaluates a TEST_NODE, 'defined' and 'undefined' check the subject exists instead of evaluating it
+func (r *Renderer) evaluateTest(node parser.Node) (interface{}, error) {
+	subject := node.Children[0]
+	switch *node.Value {
+	case "defined":
+		return r.isDefined(subject), nil
+	case "undefined":
+		return !r.isDefined(subject), nil
+	}
+
+	test, exists := isTests[*node.Value]
+	if !exists {
+		return false, &RenderError{Message: fmt.Sprintf("unknown test '%s'", *node.Value), Node: node}
+	}
+	value, err := r.evaluateOperand(subject)
+	if err != nil {
+		return false, err
+	}
+	return test(value), nil
+}
+
+// isDefined checks if a variable, or a key of an object, exists
+func (r *Renderer) isDefined(node parser.Node) bool {
+	switch node.Type {
+	case parser.VARIABLE_NODE:
+		_, exists := r.variableLookup(*node.Value)
+		return exists
+	case parser.OBJECT_ACCESS_NODE:
+		if !r.isDefined(node.Children[0]) {
+			return false
+		}
+		_, found, err := r.evaluateObjectAccess(node)
+		return err == nil && found
+	default:
+		return true
+	}
+}
+
+// contains checks if item is an element of a list, a key of a map or a substring of a string
+func contains(container, item interface{}) (bool, error) {
+	if text, ok := container.(string); ok {
+		substring, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("cannot check if string contains %T", item)
+		}
+		return strings.Contains(text, substring), nil
+	}
+
+	rv := reflect.ValueOf(container)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if compareValues(rv.Index(i).Interface(), item) == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		key := reflect.ValueOf(item)
+		if !key.IsValid() || !key.Type().AssignableTo(rv.Type().Key()) {
+			return false, nil
+		}
+		return rv.MapIndex(key).IsValid(), nil
+	default:
+		return false, fmt.Errorf("cannot check membership in %T", container)
+	}
+}
@@ -0,0 +1,444 @@
+package renderer
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// maxFoldedRange caps the ranges Optimize evaluates, so '1..1000000000' in a template isn't allocated ahead of time
+const maxFoldedRange = 10000
+
+// Optimize returns a copy of a parsed template that renders the same with less work on every render:
+//   - Expressions with only literals in them are evaluated, e.g. 'prod' == 'prod' becomes true. So are '??', '&&'
+//     and '||' when their left side decides the result, e.g. 'a' ?? x becomes 'a', and inline ifs with a literal condition.
+//   - Branches of if and switch statements that can't be taken are removed, a branch that's always taken replaces
+//     its statement.
+//   - Literals output by a tag become text, and adjacent text is merged.
+//   - Number literals are parsed once, instead of every time they're evaluated. parser.MarshalAST keeps them parsed.
+//
+// Operands that are removed aren't evaluated anymore, so a variable missing from the context doesn't fail
+// the render when it's only used in one.
+func Optimize(ast []parser.Node) []parser.Node {
+	return optimizeBody(parser.Rewrite(ast, optimizeNode))
+}
+
+// optimizeNode optimizes a node whose children are optimized already, it returns the nodes taking its place
+func optimizeNode(node parser.Node) []parser.Node {
+	switch node.Type {
+	case parser.NUMBER_LITERAL_NODE:
+		if num, err := strconv.ParseFloat(*node.Value, 64); err == nil {
+			node.Number = &num
+		}
+	case parser.EXPRESSION_NODE:
+		node = foldExpression(node)
+	case parser.TEST_NODE:
+		if _, constant := literalValue(node.Children[0]); constant {
+			if value, err := evaluateConstant(node); err == nil {
+				node = literalOr(value, node)
+			}
+		}
+	case parser.CONDITIONAL_NODE:
+		if condition, constant := literalValue(node.Children[0]); constant {
+			taken := node.Children[2]
+			if isTruthy(condition) {
+				taken = node.Children[1]
+			}
+			node = asOperand(taken, node)
+		}
+	case parser.IF_NODE:
+		return optimizeIf(node)
+	case parser.SWITCH_NODE:
+		return optimizeSwitch(node)
+	case parser.THEN_BRANCH, parser.ELSE_BRANCH, parser.FOR_BODY, parser.MACRO_BODY, parser.CALL_BODY,
+		parser.CASE_BODY, parser.DEFAULT_BRANCH:
+		node.Children = optimizeBody(node.Children)
+	case parser.ELIF_ITEM:
+		// The condition comes before the body
+		node.Children = append([]parser.Node{node.Children[0]}, optimizeBody(node.Children[1:])...)
+	}
+	return []parser.Node{node}
+}
+
+// optimizeBody turns the literals output by a list of statements into text and merges adjacent text
+func optimizeBody(nodes []parser.Node) []parser.Node {
+	var body []parser.Node
+	for _, node := range nodes {
+		if value, constant := literalValue(node); constant {
+			text := fmt.Sprintf("%v", value)
+			node = parser.Node{Type: parser.TEXT_NODE, Value: &text, Pos: node.Pos}
+		}
+		if node.Type != parser.TEXT_NODE {
+			body = append(body, node)
+			continue
+		}
+		if *node.Value == "" {
+			continue
+		}
+		if last := len(body) - 1; last >= 0 && body[last].Type == parser.TEXT_NODE {
+			merged := *body[last].Value + *node.Value
+			body[last].Value = &merged
+			continue
+		}
+		body = append(body, node)
+	}
+	if body == nil && nodes != nil {
+		return []parser.Node{}
+	}
+	return body
+}
+
+// branch is the condition and body of an if or an elif
+type branch struct {
+	node      parser.Node // the IF_NODE or ELIF_ITEM
+	condition parser.Node
+	body      []parser.Node
+}
+
+// optimizeIf removes the branches of an if statement whose condition is a falsy literal. A branch whose condition
+// is a truthy literal becomes the else branch, the ones after it are removed, or it replaces the statement when
+// it's the first one left.
+func optimizeIf(node parser.Node) []parser.Node {
+	branches := []branch{{node: node, condition: node.Children[0]}}
+	var elseBranch *parser.Node
+	for i := 1; i < len(node.Children); i++ {
+		child := node.Children[i]
+		switch child.Type {
+		case parser.THEN_BRANCH:
+			branches[0].body = child.Children
+		case parser.ELIF_BRANCH:
+			for _, item := range child.Children {
+				branches = append(branches, branch{node: item, condition: item.Children[0], body: item.Children[1:]})
+			}
+		case parser.ELSE_BRANCH:
+			elseBranch = &node.Children[i]
+		}
+	}
+
+	var kept []branch
+	changed := false
+	for _, b := range branches {
+		condition, constant := literalValue(b.condition)
+		if !constant {
+			kept = append(kept, b)
+			continue
+		}
+		changed = true
+		if !isTruthy(condition) {
+			continue
+		}
+		if len(kept) == 0 {
+			return b.body
+		}
+		elseBranch = &parser.Node{Type: parser.ELSE_BRANCH, Pos: b.node.Pos, Children: b.body}
+		break
+	}
+	if !changed {
+		return []parser.Node{node}
+	}
+	if len(kept) == 0 {
+		if elseBranch == nil {
+			return nil
+		}
+		return elseBranch.Children
+	}
+
+	children := []parser.Node{kept[0].condition, {Type: parser.THEN_BRANCH, Children: kept[0].body}}
+	if len(kept) > 1 {
+		elifBranch := parser.Node{Type: parser.ELIF_BRANCH}
+		for _, b := range kept[1:] {
+			elifBranch.Children = append(elifBranch.Children, parser.Node{
+				Type:     parser.ELIF_ITEM,
+				Pos:      b.node.Pos,
+				Children: append([]parser.Node{b.condition}, b.body...),
+			})
+		}
+		children = append(children, elifBranch)
+	}
+	if elseBranch != nil && len(elseBranch.Children) > 0 {
+		children = append(children, *elseBranch)
+	}
+	return []parser.Node{{Type: parser.IF_NODE, Pos: node.Pos, Children: children}}
+}
+
+// optimizeSwitch removes the cases of a switch on a literal whose values are all literals not equal to it, and the
+// cases after one that's always taken. The body of the first case matching it, or of the default branch, replaces
+// the statement when the cases before it are all removed.
+func optimizeSwitch(node parser.Node) []parser.Node {
+	subject, constant := literalValue(node.Children[0])
+	if !constant {
+		return []parser.Node{node}
+	}
+
+	kept := []parser.Node{node.Children[0]}
+	for _, branch := range node.Children[1:] {
+		if branch.Type == parser.DEFAULT_BRANCH {
+			if len(kept) == 1 {
+				return branch.Children
+			}
+			kept = append(kept, branch)
+			break
+		}
+
+		// A case is taken when one of its values matches, the values before it are evaluated too
+		matched, decided := false, true
+		for _, valueNode := range branch.Children[0].Children {
+			value, constant := literalValue(valueNode)
+			if !constant {
+				decided = false
+				continue
+			}
+			if compareValues(subject, value) == 0 {
+				matched = true
+				break
+			}
+		}
+		if matched && decided && len(kept) == 1 {
+			return branch.Children[1].Children
+		}
+		if matched || !decided {
+			kept = append(kept, branch)
+		}
+		if matched {
+			break
+		}
+	}
+	if len(kept) == 1 {
+		return nil
+	}
+	return []parser.Node{{Type: parser.SWITCH_NODE, Pos: node.Pos, Children: kept}}
+}
+
+// exprTree is an expression laid out the way the renderer evaluates it: an operand, '!' applied to one tree,
+// or a binary operator applied to two
+type exprTree struct {
+	operand     *parser.Node
+	operator    *parser.Node
+	left, right *exprTree // right is nil for '!'
+}
+
+// foldExpression evaluates the parts of an expression that only depend on literals. When nothing is left but
+// an operand that isn't a literal, it stays in an expression so it's still evaluated as one.
+func foldExpression(node parser.Node) parser.Node {
+	tree := buildExprTree(node.Children)
+	if tree == nil {
+		return node
+	}
+	folded, changed := foldExprTree(tree)
+	if _, constant := leafValue(folded); !changed && !constant {
+		return node
+	}
+	if folded.operand != nil {
+		return asOperand(*folded.operand, node)
+	}
+	return parser.Node{Type: parser.EXPRESSION_NODE, Pos: node.Pos, Children: flattenExprTree(folded)}
+}
+
+// buildExprTree arranges the operands and operators of an expression the way evaluateExpression does,
+// it returns nil for an expression that can't be evaluated
+func buildExprTree(children []parser.Node) *exprTree {
+	var operands []*exprTree
+	var operators []*parser.Node
+	reduce := func() bool {
+		op := operators[len(operators)-1]
+		operators = operators[:len(operators)-1]
+		if op.Type == parser.OP_BANG {
+			if len(operands) < 1 {
+				return false
+			}
+			operands[len(operands)-1] = &exprTree{operator: op, left: operands[len(operands)-1]}
+			return true
+		}
+		if len(operands) < 2 {
+			return false
+		}
+		left, right := operands[len(operands)-2], operands[len(operands)-1]
+		operands = append(operands[:len(operands)-2], &exprTree{operator: op, left: left, right: right})
+		return true
+	}
+
+	for i := range children {
+		child := &children[i]
+		switch {
+		case child.Type == parser.OP_BANG:
+			operators = append(operators, child)
+		case parser.IsOperator(child.Type):
+			for len(operators) > 0 && hasHigherPrecedence(operators[len(operators)-1].Type, child.Type) {
+				if !reduce() {
+					return nil
+				}
+			}
+			operators = append(operators, child)
+		default:
+			operands = append(operands, &exprTree{operand: child})
+			// A '!' applies to the operand right after it
+			if len(operators) > 0 && operators[len(operators)-1].Type == parser.OP_BANG && !reduce() {
+				return nil
+			}
+		}
+	}
+	for len(operators) > 0 {
+		if !reduce() {
+			return nil
+		}
+	}
+	if len(operands) != 1 {
+		return nil
+	}
+	return operands[0]
+}
+
+// foldExprTree replaces the parts of a tree that only depend on literals with their value
+func foldExprTree(tree *exprTree) (*exprTree, bool) {
+	if tree.operand != nil {
+		return tree, false
+	}
+	var leftChanged, rightChanged bool
+	tree.left, leftChanged = foldExprTree(tree.left)
+	if tree.right != nil {
+		tree.right, rightChanged = foldExprTree(tree.right)
+	}
+	changed := leftChanged || rightChanged
+
+	left, leftConstant := leafValue(tree.left)
+	_, rightConstant := leafValue(tree.right)
+
+	if leftConstant && (tree.right == nil || rightConstant) {
+		expression := parser.Node{Type: parser.EXPRESSION_NODE, Children: flattenExprTree(tree)}
+		if value, err := evaluateConstant(expression); err == nil {
+			if literal, ok := literal(value, tree.left.operand.Pos); ok {
+				return &exprTree{operand: &literal}, true
+			}
+		}
+	}
+
+	// '&&', '||' and '??' give back one of their sides, which the left one decides
+	if leftConstant && tree.right != nil {
+		switch tree.operator.Type {
+		case parser.OP_AND:
+			if !isTruthy(left) {
+				return tree.left, true
+			}
+			return tree.right, true
+		case parser.OP_OR:
+			if isTruthy(left) {
+				return tree.left, true
+			}
+			return tree.right, true
+		case parser.OP_NULL_COALESCE:
+			if left == nil || !isTruthy(left) {
+				return tree.right, true
+			}
+			return tree.left, true
+		}
+	}
+	return tree, changed
+}
+
+// leafValue returns the value of a tree that's a literal operand
+func leafValue(tree *exprTree) (interface{}, bool) {
+	if tree == nil || tree.operand == nil {
+		return nil, false
+	}
+	return literalValue(*tree.operand)
+}
+
+// flattenExprTree lays a tree out as the children of an expression, with parentheses where the renderer would
+// group it differently otherwise
+func flattenExprTree(tree *exprTree) []parser.Node {
+	if tree.operand != nil {
+		return []parser.Node{*tree.operand}
+	}
+	if tree.right == nil {
+		// '!' applies to the operand right after it
+		return append([]parser.Node{*tree.operator}, grouped(tree.left, tree.left.operator != nil && tree.left.right != nil)...)
+	}
+	left := grouped(tree.left, tree.left.operand == nil && tree.left.right != nil && !hasHigherPrecedence(tree.left.operator.Type, tree.operator.Type))
+	right := grouped(tree.right, tree.right.operand == nil && tree.right.right != nil && hasHigherPrecedence(tree.operator.Type, tree.right.operator.Type))
+	return append(append(left, *tree.operator), right...)
+}
+
+// grouped flattens a tree, within a nested expression when it needs parentheses
+func grouped(tree *exprTree, parens bool) []parser.Node {
+	nodes := flattenExprTree(tree)
+	if !parens {
+		return nodes
+	}
+	return []parser.Node{{Type: parser.EXPRESSION_NODE, Pos: nodes[0].Pos, Children: nodes}}
+}
+
+// literalValue returns the value of a literal, including lists and maps of literals
+func literalValue(node parser.Node) (interface{}, bool) {
+	switch node.Type {
+	case parser.STRING_LITERAL_NODE, parser.NUMBER_LITERAL_NODE, parser.BOOLEAN_LITERAL_NODE, parser.NIL_LITERAL_NODE:
+	case parser.LIST_LITERAL_NODE:
+		for _, item := range node.Children {
+			if _, constant := literalValue(item); !constant {
+				return nil, false
+			}
+		}
+	case parser.MAP_LITERAL_NODE:
+		for _, entry := range node.Children {
+			if _, constant := literalValue(entry.Children[0]); !constant {
+				return nil, false
+			}
+			if _, constant := literalValue(entry.Children[1]); !constant {
+				return nil, false
+			}
+		}
+	default:
+		return nil, false
+	}
+	value, err := evaluateConstant(node)
+	return value, err == nil
+}
+
+// evaluateConstant evaluates a node that doesn't depend on the context
+func evaluateConstant(node parser.Node) (interface{}, error) {
+	return scratch(nil).evaluateOperand(node)
+}
+
+// scratch returns a renderer evaluating nodes ahead of rendering against the given context, ranges longer
+// than maxFoldedRange fail to evaluate
+func scratch(context map[string]interface{}) *Renderer {
+	r := New(nil, context)
+	r.Sandbox = &Sandbox{MaxLoopIterations: maxFoldedRange}
+	return r.sandboxed()
+}
+
+// literal returns the literal node for a value, ok is false for values literals can't hold, such as lists
+func literal(value interface{}, pos lexer.Position) (parser.Node, bool) {
+	switch v := value.(type) {
+	case string:
+		return parser.Node{Type: parser.STRING_LITERAL_NODE, Value: &v, Pos: pos}, true
+	case float64:
+		text := strconv.FormatFloat(v, 'f', -1, 64)
+		return parser.Node{Type: parser.NUMBER_LITERAL_NODE, Value: &text, Number: &v, Pos: pos}, true
+	case bool:
+		text := strconv.FormatBool(v)
+		return parser.Node{Type: parser.BOOLEAN_LITERAL_NODE, Value: &text, Pos: pos}, true
+	case nil:
+		return parser.Node{Type: parser.NIL_LITERAL_NODE, Pos: pos}, true
+	default:
+		return parser.Node{}, false
+	}
+}
+
+// literalOr returns the literal for the value of node, or node when there's no literal for it
+func literalOr(value interface{}, node parser.Node) parser.Node {
+	if literal, ok := literal(value, node.Pos); ok {
+		return literal
+	}
+	return node
+}
+
+// asOperand returns what replaces the expression node folded into operand: literals as they are, anything
+// else within an expression, so statements evaluate it the way they evaluated the expression
+func asOperand(operand parser.Node, node parser.Node) parser.Node {
+	if _, constant := literalValue(operand); constant || operand.Type == parser.EXPRESSION_NODE {
+		return operand
+	}
+	return parser.Node{Type: parser.EXPRESSION_NODE, Pos: node.Pos, Children: []parser.Node{operand}}
+}
@@ -2,21 +2,30 @@ package renderer
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/ogzhanolguncu/zencefil/lexer"
 	"github.com/ogzhanolguncu/zencefil/parser"
 )
 
 func hasHigherPrecedence(op1, op2 parser.NodeType) bool {
 	precedence := map[parser.NodeType]int{
-		parser.OP_BANG:       5,
+		parser.OP_BANG:       6,
+		parser.OP_RANGE:      5,
 		parser.OP_EQUALS:     4,
 		parser.OP_NOT_EQUALS: 4,
 		parser.OP_GT:         4,
 		parser.OP_LT:         4,
 		parser.OP_GTE:        4,
 		parser.OP_LTE:        4,
+		parser.OP_IN:         4,
+		parser.OP_NOT_IN:     4,
+		parser.OP_CONTAINS:   4,
+		parser.OP_STARTSWITH: 4,
+		parser.OP_ENDSWITH:   4,
 		parser.OP_AND:        2,
 		parser.OP_OR:         1,
 	}
@@ -34,11 +43,31 @@ var operatorStringMap = map[parser.NodeType]string{
 	parser.OP_LTE:           "<=",
 	parser.OP_BANG:          "!",
 	parser.OP_NULL_COALESCE: "??",
+	parser.OP_RANGE:         "..",
+	parser.OP_IN:            "in",
+	parser.OP_NOT_IN:        "not in",
+	parser.OP_CONTAINS:      "contains",
+	parser.OP_STARTSWITH:    "startswith",
+	parser.OP_ENDSWITH:      "endswith",
 }
 
 type Renderer struct {
 	Context map[string]interface{}
 	AST     []parser.Node
+	// Loader resolves the templates named in 'import' and 'from' tags
+	Loader Loader
+	// Functions can be called by name from templates, e.g. {{ formatDate(order.date, 'Jan 2') }}.
+	// A trailing map[string]interface{} parameter receives the keyword arguments.
+	Functions map[string]interface{}
+	// AllowedMethods limits the methods templates can call on values of a type, see AllowMethods.
+	// When it's nil every exported method can be called.
+	AllowedMethods map[reflect.Type][]string
+	// Sandbox limits the resources used by Render and the context keys templates can read, nil means no limits
+	Sandbox *Sandbox
+
+	usage     *sandboxUsage          // resources used by the render so far
+	names     map[string]interface{} // macros and imports defined by the template, context keys take precedence over them
+	importing []string               // templates being imported, to detect import cycles
 }
 
 func New(ast []parser.Node, context map[string]interface{}) *Renderer {
@@ -48,6 +77,21 @@ func New(ast []parser.Node, context map[string]interface{}) *Renderer {
 	return &Renderer{
 		Context: context,
 		AST:     ast,
+		names:   make(map[string]interface{}),
+	}
+}
+
+// child creates a renderer for a macro body or an imported template, sharing the configuration of r
+func (r *Renderer) child(context map[string]interface{}, names map[string]interface{}) *Renderer {
+	return &Renderer{
+		Context:        context,
+		Loader:         r.Loader,
+		Functions:      r.Functions,
+		AllowedMethods: r.AllowedMethods,
+		Sandbox:        r.Sandbox,
+		usage:          r.usage,
+		names:          names,
+		importing:      r.importing,
 	}
 }
 
@@ -61,7 +105,13 @@ func (e *RenderError) Error() string {
 }
 
 func (r *Renderer) Render() (string, error) {
-	return r.renderNodes(r.AST)
+	if r.Sandbox != nil {
+		return r.sandboxed().renderNodes(r.AST)
+	}
+	// Depth is tracked without a sandbox too, so recursive macros fail instead of overflowing the stack
+	tracked := r.child(r.Context, r.names)
+	tracked.usage = &sandboxUsage{}
+	return tracked.renderNodes(r.AST)
 }
 
 func (r *Renderer) renderNodes(nodes []parser.Node) (string, error) {
@@ -69,9 +119,16 @@ func (r *Renderer) renderNodes(nodes []parser.Node) (string, error) {
 	for _, node := range nodes {
 		rendered, err := r.renderNode(node)
 		if err != nil {
+			// Errors raised without a node point at the statement they happened in
+			if renderErr, ok := err.(*RenderError); ok && renderErr.Node.Pos == (lexer.Position{}) {
+				renderErr.Node = node
+			}
 			return "", err
 		}
 		sb.WriteString(rendered)
+		if err := r.checkOutput(sb.Len()); err != nil {
+			return "", err
+		}
 	}
 	return sb.String(), nil
 }
@@ -98,27 +155,65 @@ func (r *Renderer) renderNode(node parser.Node) (string, error) {
 		return fmt.Sprintf("%v", variable), nil
 
 	case parser.OBJECT_ACCESS_NODE:
-		objVar := node.Children[0]
-		objAccessor := node.Children[1].Value
+		val, found, err := r.evaluateObjectAccess(node)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", &RenderError{Message: fmt.Sprintf("key '%s' not found in object '%v'", *node.Children[1].Value, node.Children[0])}
+		}
+		return fmt.Sprintf("%v", val), nil
 
-		obj, ok := r.variableLookup(*objVar.Value)
-		if !ok {
-			return "", &RenderError{Message: fmt.Sprintf("object '%v' is missing", objVar)}
+	case parser.CALL_NODE:
+		val, err := r.evaluateCall(node, nil)
+		if err != nil {
+			return "", err
 		}
-		switch m := obj.(type) {
-		case map[string]interface{}:
-			if val, exists := m[*objAccessor]; exists {
-				return fmt.Sprintf("%v", val), nil
+		return fmt.Sprintf("%v", val), nil
+
+	case parser.CALL_BLOCK_NODE:
+		caller := &macro{name: "caller", body: node.Children[1].Children, env: r}
+		val, err := r.evaluateCall(node.Children[0], caller)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v", val), nil
+
+	case parser.MACRO_NODE:
+		r.define(*node.Value, &macro{
+			name:   *node.Value,
+			params: node.Children[0].Children,
+			body:   node.Children[1].Children,
+			env:    r,
+		})
+		return "", nil
+
+	case parser.IMPORT_NODE:
+		exports, err := r.importTemplate(*node.Value)
+		if err != nil {
+			return "", err
+		}
+		r.define(*node.Children[0].Value, exports)
+		return "", nil
+
+	case parser.FROM_IMPORT_NODE:
+		exports, err := r.importTemplate(*node.Value)
+		if err != nil {
+			return "", err
+		}
+		for _, importName := range node.Children {
+			val, exists := exports[*importName.Value]
+			if !exists {
+				return "", &RenderError{Message: fmt.Sprintf("'%s' is not defined in '%s'", *importName.Value, *node.Value), Node: importName}
 			}
-		case map[interface{}]interface{}:
-			if val, exists := m[*objAccessor]; exists {
-				return fmt.Sprintf("%v", val), nil
+			alias := *importName.Value
+			if len(importName.Children) > 0 {
+				alias = *importName.Children[0].Value
 			}
-		default:
-			return "", &RenderError{Message: fmt.Sprintf("object '%v' is not a map type", objVar)}
+			r.define(alias, val)
 		}
+		return "", nil
 
-		return "", &RenderError{Message: fmt.Sprintf("key '%s' not found in object '%v'", *objAccessor, objVar)}
 	case parser.EXPRESSION_NODE:
 		expr, err := r.evaluateExpression(node)
 		if err != nil {
@@ -126,12 +221,23 @@ func (r *Renderer) renderNode(node parser.Node) (string, error) {
 		}
 		return fmt.Sprintf("%v", expr), nil
 
+	case parser.STRING_LITERAL_NODE, parser.NUMBER_LITERAL_NODE, parser.BOOLEAN_LITERAL_NODE, parser.NIL_LITERAL_NODE,
+		parser.LIST_LITERAL_NODE, parser.MAP_LITERAL_NODE, parser.TEST_NODE, parser.CONDITIONAL_NODE:
+		val, err := r.evaluateOperand(node)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v", val), nil
+
 	case parser.IF_NODE:
 		return r.renderIfNode(node)
 
 	case parser.FOR_NODE:
 		return r.renderForNode(node)
 
+	case parser.SWITCH_NODE:
+		return r.renderSwitchNode(node)
+
 	default:
 		return "", &RenderError{
 			Message: fmt.Sprintf("unknown node type: %v", node.Type),
@@ -149,56 +255,87 @@ func (r *Renderer) renderForNode(node parser.Node) (string, error) {
 	}
 	iteratee = *node.Children[0].Value
 
-	if node.Children[1].Value == nil {
-		return "", &RenderError{Message: "iterator item has nil value", Node: node.Children[1]}
+	if err := r.enter(); err != nil {
+		return "", err
 	}
-	variable, found := r.variableLookup(*node.Children[1].Value)
-	if !found {
-		return "", &RenderError{
-			Message: fmt.Sprintf("iterator variable '%s' not found in context", *node.Children[1].Value),
-		}
+	defer r.leave()
+
+	variable, err := r.evaluateIterator(node.Children[1])
+	if err != nil {
+		return "", err
+	}
+	items, err := iterate(variable)
+	if err != nil {
+		return "", &RenderError{Message: err.Error(), Node: node}
 	}
 
-	switch m := variable.(type) {
-	case []interface{}:
-		forBody := node.Children[2]
-		if forBody.Type == parser.FOR_BODY {
-			// Store original value to restore after loop
-			originalValue, hadOriginal := r.Context[iteratee]
-
-			for _, item := range m {
-				r.Context[iteratee] = item
-				rendered, err := r.renderNodes(forBody.Children)
-				if err != nil {
-					return "", &RenderError{
-						Message: fmt.Sprintf("error in for loop: %v", err),
-						Node:    node,
-					}
+	forBody := node.Children[2]
+	if forBody.Type == parser.FOR_BODY {
+		// Store original value to restore after loop
+		originalValue, hadOriginal := r.Context[iteratee]
+
+		for _, item := range items {
+			if err := r.countIteration(); err != nil {
+				return "", err
+			}
+			r.Context[iteratee] = item
+			rendered, err := r.renderNodes(forBody.Children)
+			if isLimitExceeded(err) {
+				return "", err
+			}
+			if err != nil {
+				loopErr := &RenderError{Message: fmt.Sprintf("error in for loop: %v", err), Node: node}
+				// Keep pointing at where in the body the error happened
+				if bodyErr, ok := err.(*RenderError); ok && bodyErr.Node.Pos != (lexer.Position{}) {
+					loopErr.Node = bodyErr.Node
 				}
-				sb.WriteString(rendered)
+				return "", loopErr
 			}
-			// Restore original context
-			if hadOriginal {
-				r.Context[iteratee] = originalValue
-			} else {
-				delete(r.Context, iteratee)
+			sb.WriteString(rendered)
+			if err := r.checkOutput(sb.Len()); err != nil {
+				return "", err
 			}
 		}
-
-	default:
-		return "", &RenderError{Message: "something went wrong in for loop"}
+		// Restore original context
+		if hadOriginal {
+			r.Context[iteratee] = originalValue
+		} else {
+			delete(r.Context, iteratee)
+		}
 	}
 
 	return sb.String(), nil
 }
 
+// evaluateIterator evaluates what a for loop iterates over, either a variable or any other expression
+func (r *Renderer) evaluateIterator(node parser.Node) (interface{}, error) {
+	if len(node.Children) > 0 {
+		return r.evaluateOperand(node.Children[0])
+	}
+	if node.Value == nil {
+		return nil, &RenderError{Message: "iterator item has nil value", Node: node}
+	}
+	variable, found := r.variableLookup(*node.Value)
+	if !found {
+		return nil, &RenderError{
+			Message: fmt.Sprintf("iterator variable '%s' not found in context", *node.Value),
+		}
+	}
+	return variable, nil
+}
+
 // renderIfNode handles rendering if/elif/else conditional blocks
 func (r *Renderer) renderIfNode(node parser.Node) (string, error) {
 	conditionNode := node.Children[0]
-	if conditionNode.Type != parser.VARIABLE_NODE && conditionNode.Type != parser.EXPRESSION_NODE {
+	if conditionNode.Type == parser.VARIABLE_NODE && conditionNode.Value == nil {
 		return "", &RenderError{Message: "if node has nil condition", Node: node}
 	}
 
+	if err := r.enter(); err != nil {
+		return "", err
+	}
+	defer r.leave()
+
 	if conditionNode.Type == parser.VARIABLE_NODE {
 		condition, err := r.evaluateCondition(*conditionNode.Value)
 		if err != nil {
@@ -207,10 +344,8 @@ func (r *Renderer) renderIfNode(node parser.Node) (string, error) {
 		if condition {
 			return r.renderConditionalBranch(node.Children, parser.THEN_BRANCH)
 		}
-	}
-
-	if conditionNode.Type == parser.EXPRESSION_NODE {
-		condition, err := r.evaluateExpression(conditionNode)
+	} else {
+		condition, err := r.evaluateOperand(conditionNode)
 		if err != nil {
 			return "", err
 		}
@@ -218,19 +353,17 @@ func (r *Renderer) renderIfNode(node parser.Node) (string, error) {
 			return r.renderConditionalBranch(node.Children, parser.THEN_BRANCH)
 		}
 	}
-	// Check elif branches
-	if elifResult, err := r.renderElifBranches(node.Children); err != nil {
-		return "", err
-	} else if elifResult != "" {
-		return elifResult, nil
+	// Check elif branches, a branch that's taken may render nothing
+	if elifResult, taken, err := r.renderElifBranches(node.Children); err != nil || taken {
+		return elifResult, err
 	}
 
 	// If no conditions matched, try else branch
 	return r.renderConditionalBranch(node.Children, parser.ELSE_BRANCH)
 }
 
-// renderElifBranches handles rendering elif branches
-func (r *Renderer) renderElifBranches(nodes []parser.Node) (string, error) {
+// renderElifBranches renders the first elif branch whose condition holds, taken is false when there's none
+func (r *Renderer) renderElifBranches(nodes []parser.Node) (result string, taken bool, err error) {
 	for _, node := range nodes {
 		if node.Type != parser.ELIF_BRANCH {
 			continue
@@ -243,33 +376,63 @@ func (r *Renderer) renderElifBranches(nodes []parser.Node) (string, error) {
 			conditionNode := elifNode.Children[0]
 			elifNode.Children = elifNode.Children[1:]
 
-			if conditionNode.Type != parser.VARIABLE_NODE && conditionNode.Type != parser.EXPRESSION_NODE {
-				return "", &RenderError{Message: "elif node has nil condition", Node: node}
+			if conditionNode.Type == parser.VARIABLE_NODE && conditionNode.Value == nil {
+				return "", false, &RenderError{Message: "elif node has nil condition", Node: node}
 			}
 
 			if conditionNode.Type == parser.VARIABLE_NODE {
 				condition, err := r.evaluateCondition(*conditionNode.Value)
 				if err != nil {
-					return "", err
+					return "", false, err
 				}
 
 				if condition {
-					return r.renderNodes(elifNode.Children)
+					result, err := r.renderNodes(elifNode.Children)
+					return result, true, err
 				}
-			}
-
-			if conditionNode.Type == parser.EXPRESSION_NODE {
-				condition, err := r.evaluateExpression(conditionNode)
+			} else {
+				condition, err := r.evaluateOperand(conditionNode)
 				if err != nil {
-					return "", err
+					return "", false, err
 				}
 
 				if isTruthy(condition) {
-					return r.renderNodes(elifNode.Children)
+					result, err := r.renderNodes(elifNode.Children)
+					return result, true, err
 				}
 			}
 		}
 	}
+	return "", false, nil
+}
+
+// renderSwitchNode renders the first case with a value equal to the subject, or the default branch.
+// The subject is evaluated once, case values are evaluated in order until one matches.
+func (r *Renderer) renderSwitchNode(node parser.Node) (string, error) {
+	if err := r.enter(); err != nil {
+		return "", err
+	}
+	defer r.leave()
+
+	subject, err := r.evaluateOperand(node.Children[0])
+	if err != nil {
+		return "", err
+	}
+
+	for _, branch := range node.Children[1:] {
+		if branch.Type == parser.DEFAULT_BRANCH {
+			return r.renderNodes(branch.Children)
+		}
+		for _, valueNode := range branch.Children[0].Children {
+			value, err := r.evaluateOperand(valueNode)
+			if err != nil {
+				return "", err
+			}
+			if compareValues(subject, value) == 0 {
+				return r.renderNodes(branch.Children[1].Children)
+			}
+		}
+	}
 	return "", nil
 }
 
@@ -311,83 +474,34 @@ func (r *Renderer) evaluateExpression(node parser.Node) (interface{}, error) {
 		v := node.Children[i]
 
 		switch v.Type {
-		case parser.VARIABLE_NODE:
-			if v.Value == nil {
-				return false, fmt.Errorf("variable node has nil value")
-			}
-			value, exists := r.variableLookup(*v.Value)
-			if !exists {
-				return false, &RenderError{
-					Message: fmt.Sprintf("variable '%s' not found in context", *v.Value),
-					Node:    v,
-				}
-			}
-			operandStack = append(operandStack, value)
-			applyPendingBang(&operandStack, &operatorStack)
-
-		case parser.OBJECT_ACCESS_NODE:
-			objVar := v.Children[0]
-			objAccessor := v.Children[1].Value
-
-			obj, ok := r.variableLookup(*objVar.Value)
-			if !ok {
-				return "", &RenderError{Message: fmt.Sprintf("object '%v' is missing", objVar)}
-			}
-
-			switch m := obj.(type) {
-			case map[string]interface{}:
-				if val, exists := m[*objAccessor]; exists {
-					operandStack = append(operandStack, val)
-					applyPendingBang(&operandStack, &operatorStack)
-				}
-			case map[interface{}]interface{}:
-				if val, exists := m[*objAccessor]; exists {
-					operandStack = append(operandStack, val)
-					applyPendingBang(&operandStack, &operatorStack)
-				}
-			default:
-				return "", &RenderError{Message: fmt.Sprintf("object '%v' is not a map type", objVar)}
-			}
-
-		case parser.EXPRESSION_NODE:
-			value, err := r.evaluateExpression(v)
-			if err != nil {
-				return false, fmt.Errorf("failed to evaluate nested expression: %w", err)
-			}
-			operandStack = append(operandStack, value)
-			applyPendingBang(&operandStack, &operatorStack)
-
-		case parser.STRING_LITERAL_NODE:
-			operandStack = append(operandStack, *v.Value)
-			applyPendingBang(&operandStack, &operatorStack)
-
-		case parser.NUMBER_LITERAL_NODE:
-			if num, err := strconv.ParseFloat(*v.Value, 64); err == nil {
-				operandStack = append(operandStack, num)
-			} else {
-				return false, fmt.Errorf("invalid number literal: %s", *v.Value)
-			}
-			applyPendingBang(&operandStack, &operatorStack)
-
 		case parser.OP_BANG:
 			operatorStack = append(operatorStack, parser.OP_BANG)
 
 		case parser.OP_AND, parser.OP_OR, parser.OP_EQUALS, parser.OP_NOT_EQUALS,
-			parser.OP_GT, parser.OP_LT, parser.OP_GTE, parser.OP_LTE, parser.OP_NULL_COALESCE:
+			parser.OP_GT, parser.OP_LT, parser.OP_GTE, parser.OP_LTE, parser.OP_NULL_COALESCE, parser.OP_RANGE,
+			parser.OP_IN, parser.OP_NOT_IN, parser.OP_CONTAINS, parser.OP_STARTSWITH, parser.OP_ENDSWITH:
 			// Evaluate immediately if operator has higher or equal precedence
 			for len(operatorStack) > 0 && hasHigherPrecedence(operatorStack[len(operatorStack)-1], v.Type) {
-				err := evaluateTopOperator(&operandStack, &operatorStack)
+				err := r.evaluateTopOperator(&operandStack, &operatorStack)
 				if err != nil {
 					return false, err
 				}
 			}
 			operatorStack = append(operatorStack, v.Type)
+
+		default:
+			value, err := r.evaluateOperand(v)
+			if err != nil {
+				return false, err
+			}
+			operandStack = append(operandStack, value)
+			applyPendingBang(&operandStack, &operatorStack)
 		}
 	}
 
 	// Evaluate remaining operators
 	for len(operatorStack) > 0 {
-		if err := evaluateTopOperator(&operandStack, &operatorStack); err != nil {
+		if err := r.evaluateTopOperator(&operandStack, &operatorStack); err != nil {
 			return false, err
 		}
 	}
@@ -399,12 +513,230 @@ func (r *Renderer) evaluateExpression(node parser.Node) (interface{}, error) {
 	return operandStack[0], nil
 }
 
+// evaluateOperand evaluates a single value of an expression, including nested expressions
+func (r *Renderer) evaluateOperand(node parser.Node) (interface{}, error) {
+	if err := r.countEvaluation(); err != nil {
+		return false, err
+	}
+
+	switch node.Type {
+	case parser.VARIABLE_NODE:
+		if node.Value == nil {
+			return false, fmt.Errorf("variable node has nil value")
+		}
+		value, exists := r.variableLookup(*node.Value)
+		if !exists {
+			return false, &RenderError{
+				Message: fmt.Sprintf("variable '%s' not found in context", *node.Value),
+				Node:    node,
+			}
+		}
+		return value, nil
+
+	case parser.OBJECT_ACCESS_NODE:
+		// A missing key evaluates to nil, so it can be handled with '??'
+		value, _, err := r.evaluateObjectAccess(node)
+		return value, err
+
+	case parser.EXPRESSION_NODE:
+		value, err := r.evaluateExpression(node)
+		if err != nil {
+			return false, fmt.Errorf("failed to evaluate nested expression: %w", err)
+		}
+		return value, nil
+
+	case parser.STRING_LITERAL_NODE:
+		return *node.Value, nil
+
+	case parser.NUMBER_LITERAL_NODE:
+		if node.Number != nil {
+			return *node.Number, nil
+		}
+		num, err := strconv.ParseFloat(*node.Value, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid number literal: %s", *node.Value)
+		}
+		return num, nil
+
+	case parser.BOOLEAN_LITERAL_NODE:
+		return *node.Value == "true", nil
+
+	case parser.NIL_LITERAL_NODE:
+		return nil, nil
+
+	case parser.LIST_LITERAL_NODE:
+		list := make([]interface{}, 0, len(node.Children))
+		for _, item := range node.Children {
+			value, err := r.evaluateOperand(item)
+			if err != nil {
+				return false, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+
+	case parser.MAP_LITERAL_NODE:
+		m := make(map[string]interface{}, len(node.Children))
+		for _, entry := range node.Children {
+			key, err := r.evaluateOperand(entry.Children[0])
+			if err != nil {
+				return false, err
+			}
+			value, err := r.evaluateOperand(entry.Children[1])
+			if err != nil {
+				return false, err
+			}
+			m[fmt.Sprintf("%v", key)] = value
+		}
+		return m, nil
+
+	case parser.CALL_NODE:
+		return r.evaluateCall(node, nil)
+
+	case parser.TEST_NODE:
+		return r.evaluateTest(node)
+
+	case parser.CONDITIONAL_NODE:
+		condition, err := r.evaluateOperand(node.Children[0])
+		if err != nil {
+			return false, err
+		}
+		// The branch that isn't taken is never evaluated, so it may refer to missing variables
+		if isTruthy(condition) {
+			return r.evaluateOperand(node.Children[1])
+		}
+		return r.evaluateOperand(node.Children[2])
+
+	default:
+		return false, &RenderError{Message: fmt.Sprintf("unexpected %v in expression", node.Type), Node: node}
+	}
+}
+
+// evaluateObjectAccess looks up the key of an OBJECT_ACCESS_NODE, found is false if the object doesn't have it
+func (r *Renderer) evaluateObjectAccess(node parser.Node) (value interface{}, found bool, err error) {
+	objVar := node.Children[0]
+	obj, err := r.evaluateAccessTarget(objVar)
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, found, err = lookupKey(obj, *node.Children[1].Value)
+	if err != nil {
+		return nil, false, &RenderError{Message: fmt.Sprintf("object '%v' %v", objVar, err)}
+	}
+	return value, found, nil
+}
+
+// evaluateAccessTarget evaluates the object on the left of '.' or '[]'
+func (r *Renderer) evaluateAccessTarget(objVar parser.Node) (interface{}, error) {
+	if objVar.Type != parser.VARIABLE_NODE {
+		return r.evaluateOperand(objVar)
+	}
+	obj, ok := r.variableLookup(*objVar.Value)
+	if !ok {
+		return nil, &RenderError{Message: fmt.Sprintf("object '%v' is missing", objVar)}
+	}
+	return obj, nil
+}
+
 func (r *Renderer) variableLookup(key string) (interface{}, bool) {
-	value, exists := r.Context[key]
+	if value, exists := r.Context[key]; exists {
+		return value, true
+	}
+	value, exists := r.names[key]
 	return value, exists
 }
 
+// define makes a macro or an imported template available to the rest of the template
+func (r *Renderer) define(name string, value interface{}) {
+	if r.names == nil {
+		r.names = make(map[string]interface{})
+	}
+	r.names[name] = value
+}
+
 // HELPERS
+
+// lookupKey returns a map entry, a list element or an exported struct field of obj
+func lookupKey(obj interface{}, key string) (interface{}, bool, error) {
+	switch m := obj.(type) {
+	case map[string]interface{}:
+		value, found := m[key]
+		return value, found, nil
+	case map[interface{}]interface{}:
+		value, found := m[key]
+		return value, found, nil
+	}
+
+	rv := reflect.ValueOf(obj)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, false, nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false, fmt.Errorf("is not a map type")
+		}
+		value := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+		if !value.IsValid() {
+			return nil, false, nil
+		}
+		return value.Interface(), true, nil
+	case reflect.Slice, reflect.Array:
+		index, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, false, fmt.Errorf("can only be indexed with numbers, got '%s'", key)
+		}
+		if index < 0 || index >= rv.Len() {
+			return nil, false, nil
+		}
+		return rv.Index(index).Interface(), true, nil
+	case reflect.Struct:
+		field, exists := rv.Type().FieldByName(key)
+		if !exists || !field.IsExported() {
+			return nil, false, nil
+		}
+		return rv.FieldByIndex(field.Index).Interface(), true, nil
+	default:
+		return nil, false, fmt.Errorf("is not a map type")
+	}
+}
+
+// iterate returns the items a for loop goes over: the elements of a list, or the sorted keys of a map
+func iterate(value interface{}) ([]interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case nil:
+		return nil, nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = rv.Index(i).Interface()
+		}
+		return items, nil
+	case reflect.Map:
+		keys := make([]interface{}, 0, rv.Len())
+		for _, key := range rv.MapKeys() {
+			keys = append(keys, key.Interface())
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return compareValues(keys[i], keys[j]) < 0
+		})
+		return keys, nil
+	default:
+		return nil, fmt.Errorf("cannot iterate over %T", value)
+	}
+}
+
 func isTruthy(v interface{}) bool {
 	switch v := v.(type) {
 	case nil:
@@ -511,7 +843,7 @@ func applyPendingBang(operandStack *[]interface{}, operatorStack *[]parser.NodeT
 	}
 }
 
-func evaluateTopOperator(operandStack *[]interface{}, operatorStack *[]parser.NodeType) error {
+func (r *Renderer) evaluateTopOperator(operandStack *[]interface{}, operatorStack *[]parser.NodeType) error {
 	if len(*operatorStack) < 1 {
 		return fmt.Errorf("invalid expression: no operator")
 	}
@@ -562,6 +894,44 @@ func evaluateTopOperator(operandStack *[]interface{}, operatorStack *[]parser.No
 		} else {
 			result = left
 		}
+	case parser.OP_RANGE:
+		start, startOk := toFloat64(left)
+		end, endOk := toFloat64(right)
+		if !startOk || !endOk {
+			return fmt.Errorf("range bounds must be numbers, got %v and %v", left, right)
+		}
+		step := 1.0
+		if start > end {
+			step = -1
+		}
+		// Unlike range(), '..' includes its end
+		if err := r.checkRange(start, end+step, step); err != nil {
+			return err
+		}
+		result = makeRange(start, end+step, step)
+	case parser.OP_IN, parser.OP_NOT_IN:
+		found, err := contains(right, left)
+		if err != nil {
+			return err
+		}
+		result = found == (op == parser.OP_IN)
+	case parser.OP_CONTAINS:
+		found, err := contains(left, right)
+		if err != nil {
+			return err
+		}
+		result = found
+	case parser.OP_STARTSWITH, parser.OP_ENDSWITH:
+		text, textOk := left.(string)
+		affix, affixOk := right.(string)
+		if !textOk || !affixOk {
+			return fmt.Errorf("'%s' needs strings on both sides, got %T and %T", operatorStringMap[op], left, right)
+		}
+		if op == parser.OP_STARTSWITH {
+			result = strings.HasPrefix(text, affix)
+		} else {
+			result = strings.HasSuffix(text, affix)
+		}
 	case parser.OP_EQUALS:
 		result = compareValues(left, right) == 0
 	case parser.OP_NOT_EQUALS:
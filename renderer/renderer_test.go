@@ -1,7 +1,11 @@
 package renderer
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/ogzhanolguncu/zencefil/lexer"
 	"github.com/ogzhanolguncu/zencefil/parser"
@@ -17,6 +21,9 @@ func TestRenderer(t *testing.T) {
 		errorContains       string
 		shouldError         bool
 		allowPrettyPrintAST bool
+		lexerOptions        lexer.Options
+		// stateful is set when rendering changes the context, so the optimized template isn't rendered with it again
+		stateful bool
 	}{
 		// Basic functionality tests
 		{
@@ -304,11 +311,226 @@ func TestRenderer(t *testing.T) {
 			allowPrettyPrintAST: true,
 			expected:            "Users:\nJohn: New York\nAlice: London",
 		},
+		{
+			name:    "String literals with escapes and Unicode",
+			content: `{{ if şehir == "İstanbul" }}{{ greeting ?? 'Merhaba\u0021' }}{{ endif }}`,
+			context: map[string]interface{}{
+				"şehir":    "İstanbul",
+				"greeting": nil,
+			},
+			expected: "Merhaba!",
+		},
+		// Comments and raw blocks
+		{
+			name:    "Comment is not rendered",
+			content: "Hello{# {{ name }} #}, {{ name }}!",
+			context: map[string]interface{}{
+				"name": "Oz",
+			},
+			expected: "Hello, Oz!",
+		},
+		{
+			name:     "Raw block is rendered verbatim",
+			content:  "{{ raw }}<p>{{ message }}</p>{{ endraw }}",
+			context:  map[string]interface{}{},
+			expected: "<p>{{ message }}</p>",
+		},
+		// Whitespace control
+		{
+			name:    "Trim markers",
+			content: "<ul>\n  {{- for item in items }}\n  <li>{{ item }}</li>\n  {{- endfor }}\n</ul>",
+			context: map[string]interface{}{
+				"items": []interface{}{"a", "b"},
+			},
+			expected: "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>",
+		},
+		{
+			name:    "Trim and lstrip blocks",
+			content: "items:\n  {{ for item in items }}\n  - {{ item }}\n  {{ endfor }}\ndone",
+			context: map[string]interface{}{
+				"items": []interface{}{"a", "b"},
+			},
+			lexerOptions: lexer.Options{TrimBlocks: true, LstripBlocks: true},
+			expected:     "items:\n  - a\n  - b\ndone",
+		},
+		// Custom delimiters
+		{
+			name:    "Custom delimiters and line statements",
+			content: "%% if isAdmin\n{{ .Values.name }}: <<name>>\n%% endif\n",
+			context: map[string]interface{}{
+				"isAdmin": true,
+				"name":    "Oz",
+			},
+			lexerOptions: lexer.Options{Delimiters: lexer.Delimiters{
+				BlockStart:          "<%",
+				BlockEnd:            "%>",
+				VariableStart:       "<<",
+				VariableEnd:         ">>",
+				LineStatementPrefix: "%%",
+			}},
+			expected: "{{ .Values.name }}: Oz\n",
+		},
+		// Literals
+		{
+			name:     "Loop over list literal",
+			content:  "{{ for size in ['S', 'M', 'L'] }}[{{ size }}]{{ endfor }}",
+			context:  map[string]interface{}{},
+			expected: "[S][M][L]",
+		},
+		{
+			name:     "Loop over ranges",
+			content:  "{{ for i in 1..3 }}{{ i }}{{ endfor }}|{{ for i in 3..1 }}{{ i }}{{ endfor }}|{{ for i in range(1, 10, 3) }}{{ i }}{{ endfor }}|{{ for i in range(n) }}{{ i }}{{ endfor }}",
+			context:  map[string]interface{}{"n": 2},
+			expected: "123|321|147|01",
+		},
+		{
+			name:     "Map literal access and iteration",
+			content:  "{{ {'a': 1, 'b': name}['b'] }}|{{ for key in {'z': 1, 'y': 2} }}{{ key }}{{ endfor }}",
+			context:  map[string]interface{}{"name": "Oz"},
+			expected: "Oz|yz",
+		},
+		{
+			name:     "Boolean and nil literals",
+			content:  "{{ if isAdmin == true }}admin{{ endif }}|{{ nothing ?? 'none' }}|{{ !false }}|{{ [nil, 'x'][1] }}",
+			context:  map[string]interface{}{"isAdmin": true, "nothing": nil},
+			expected: "admin|none|true|x",
+		},
+		{
+			name:     "Loop over a typed slice",
+			content:  "{{ for tag in tags }}#{{ tag }} {{ endfor }}",
+			context:  map[string]interface{}{"tags": []string{"go", "templates"}},
+			expected: "#go #templates ",
+		},
+		// Membership operators and tests
+		{
+			name:    "In and not in",
+			content: "{{ if role in ['admin', 'mod'] }}staff{{ endif }}|{{ 'b' in letters }}|{{ 'z' not in letters }}|{{ 'id' in user }}|{{ 'ell' in word }}|{{ 3 in 1..5 }}",
+			context: map[string]interface{}{
+				"role":    "mod",
+				"letters": []string{"a", "b"},
+				"user":    map[string]interface{}{"id": 1},
+				"word":    "hello",
+			},
+			expected: "staff|true|true|true|true|true",
+		},
+		{
+			name:     "Contains, startswith and endswith",
+			content:  "{{ tags contains 'go' }}|{{ name startswith 'Oz' }}|{{ name endswith 'han' && true }}",
+			context:  map[string]interface{}{"tags": []interface{}{"go", "rust"}, "name": "Ozzy"},
+			expected: "true|true|false",
+		},
+		{
+			name: "Is tests",
+			content: "{{ x is defined }}|{{ missing is undefined }}|{{ user['email'] is defined }}|{{ nothing is none }}|{{ 4 is even }}|{{ 3 is odd }}" +
+				"|{{ items is iterable }}|{{ name is string }}|{{ 1.5 is number }}|{{ user is mapping }}|{{ x is not even }}",
+			context: map[string]interface{}{
+				"x":       7,
+				"user":    map[string]interface{}{"id": 1},
+				"nothing": nil,
+				"items":   []interface{}{},
+				"name":    "Oz",
+			},
+			expected: "true|true|false|true|true|true|true|true|true|true|true",
+		},
+		// Inline conditionals
+		{
+			name:     "Inline if and question mark",
+			content:  "{{ 'Yes' if active else 'No' }}|{{ verified && mfa ? 'Full' : 'Incomplete' }}|{{ score > 90 ? 'A' : score > 80 ? 'B' : 'C' }}",
+			context:  map[string]interface{}{"active": false, "verified": true, "mfa": true, "score": 85},
+			expected: "No|Full|B",
+		},
+		{
+			name:     "Falsy value in the taken branch",
+			content:  "{{ verified ? '' : 'Incomplete' }}|{{ verified ? 0 : 1 }}",
+			context:  map[string]interface{}{"verified": true},
+			expected: "|0",
+		},
+		{
+			name:     "Untaken branch is not evaluated",
+			content:  "{{ user ? user.name : 'guest' }}|{{ missing.name if false else 'ok' }}|{{ for i in (items is defined ? items : [0]) }}{{ i }}{{ endfor }}",
+			context:  map[string]interface{}{"user": nil},
+			expected: "guest|ok|0",
+		},
+		// Switch statements
+		{
+			name: "Switch",
+			content: "{{ for order in orders }}{{ switch order['status'] }}\n" +
+				"{{ case 'pending', 'new' }}waiting{{ case 'shipped' }}on its way{{ case 'delivered' }}done{{ default }}?{{ endswitch }},{{ endfor }}",
+			context: map[string]interface{}{"orders": []interface{}{
+				map[string]interface{}{"status": "new"},
+				map[string]interface{}{"status": "shipped"},
+				map[string]interface{}{"status": "cancelled"},
+				map[string]interface{}{"status": "pending"},
+			}},
+			expected: "waiting,on its way,?,waiting,",
+		},
+		{
+			name:     "Switch on numbers without a match",
+			content:  "[{{ switch count }}{{ case 0 }}none{{ case 1 }}one{{ endswitch }}]",
+			context:  map[string]interface{}{"count": 5},
+			expected: "[]",
+		},
+		{
+			name:     "Subject is evaluated once and case values lazily",
+			content:  "{{ switch next() }}{{ case 2 }}two{{ case 1 }}one{{ case missing }}never{{ endswitch }}",
+			context:  map[string]interface{}{"next": counter()},
+			expected: "one",
+			stateful: true,
+		},
+		{
+			name:          "Unknown test",
+			content:       "{{ x is prime }}",
+			context:       map[string]interface{}{"x": 7},
+			shouldError:   true,
+			errorContains: "unknown test 'prime'",
+		},
+		{
+			name:          "Membership in a number",
+			content:       "{{ 1 in count }}",
+			context:       map[string]interface{}{"count": 3},
+			shouldError:   true,
+			errorContains: "cannot check membership in int",
+		},
+		{
+			name:          "Loop over a number",
+			content:       "{{ for i in count }}{{ i }}{{ endfor }}",
+			context:       map[string]interface{}{"count": 3},
+			shouldError:   true,
+			errorContains: "cannot iterate over int",
+		},
+		{
+			name:     "Elif taken with an empty body",
+			content:  "{{ if false }}a{{ elif true }}{{ else }}b{{ endif }}",
+			context:  map[string]interface{}{},
+			expected: "",
+		},
+		{
+			name:          "Range longer than the default limit",
+			content:       "{{ for i in 1..1000000000000 }}{{ i }}{{ endfor }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "range too long: ranges can't have more than 1000000 numbers",
+		},
+		{
+			name:          "Range builtin longer than the default limit",
+			content:       "{{ 5 in range(1000000000000) }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "range too long: ranges can't have more than 1000000 numbers",
+		},
+		{
+			name:          "Range with a zero step",
+			content:       "{{ for i in range(1, 5, 0) }}{{ i }}{{ endfor }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "range step must not be zero",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tokens := lexer.New(tt.content).Tokenize()
+			tokens, err := lexer.NewWithOptions(tt.content, tt.lexerOptions).Tokenize()
+			require.NoError(t, err, "Lexer should not fail")
 			ast, err := parser.New(tokens).Parse()
 			require.NoError(t, err, "Parser should not fail")
 
@@ -328,10 +550,510 @@ func TestRenderer(t *testing.T) {
 
 			require.NoError(t, err)
 			require.Equal(t, tt.expected, template)
+			if tt.stateful {
+				return
+			}
+
+			optimized, err := New(Optimize(ast), tt.context).Render()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, optimized, "Optimized template should render the same")
 		})
 	}
 }
 
+func TestRendererMacros(t *testing.T) {
+	loader := MapLoader{
+		"forms.html": "{{ macro field(name, label, type='text') }}<label>{{ label }}</label><input type='{{ type }}' name='{{ name }}'>{{ endmacro }}" +
+			"{{ macro button(text) }}<button>{{ text }}</button>{{ endmacro }}",
+		"cards.html": "{{ from 'forms.html' import button }}{{ macro card(title) }}<div><h2>{{ title }}</h2>{{ caller() }}{{ button('OK') }}</div>{{ endmacro }}",
+		"loop.html":  "{{ import 'cycle.html' as cycle }}",
+		"cycle.html": "{{ import 'loop.html' as loop }}",
+	}
+
+	tests := []struct {
+		context       map[string]interface{}
+		name          string
+		content       string
+		expected      string
+		errorContains string
+		shouldError   bool
+	}{
+		{
+			name:     "Macro with default and keyword arguments",
+			content:  "{{ macro tag(name, class='plain') }}<{{ name }} class='{{ class }}'>{{ endmacro }}{{ tag('p') }}{{ tag('div', class='card') }}{{ tag(class='x', name='a') }}",
+			context:  map[string]interface{}{},
+			expected: "<p class='plain'><div class='card'><a class='x'>",
+		},
+		{
+			name:    "Macro sees the context and its arguments shadow it",
+			content: "{{ macro greet(name) }}{{ greeting }}, {{ name }}!{{ endmacro }}{{ for user in users }}{{ greet(user) }} {{ endfor }}{{ name }}",
+			context: map[string]interface{}{
+				"greeting": "Hi",
+				"name":     "Oz",
+				"users":    []interface{}{"Ada", "Bob"},
+			},
+			expected: "Hi, Ada! Hi, Bob! Oz",
+		},
+		{
+			name:     "Macro sees the loop variables where it's called",
+			content:  "{{ macro row() }}[{{ item }}]{{ endmacro }}{{ for item in items }}{{ row() }}{{ endfor }}",
+			context:  map[string]interface{}{"items": []interface{}{1, 2}},
+			expected: "[1][2]",
+		},
+		{
+			name:     "Default value refers to an earlier parameter",
+			content:  "{{ macro link(url, text=url) }}<a href='{{ url }}'>{{ text }}</a>{{ endmacro }}{{ link('/home') }}",
+			context:  map[string]interface{}{},
+			expected: "<a href='/home'>/home</a>",
+		},
+		{
+			name:    "Recursive macro",
+			content: "{{ macro tree(name, children) }}{{ name }}{{ for child in children }}({{ tree(child['name'], child['children'] ?? none) }}){{ endfor }}{{ endmacro }}{{ tree('a', kids) }}",
+			context: map[string]interface{}{
+				"none": []interface{}{},
+				"kids": []interface{}{
+					map[string]interface{}{"name": "b", "children": []interface{}{
+						map[string]interface{}{"name": "c"},
+					}},
+					map[string]interface{}{"name": "d"},
+				},
+			},
+			expected: "a(b(c))(d)",
+		},
+		{
+			name:    "Call block passes its body as caller",
+			content: "{{ macro panel(title) }}<section><h1>{{ title }}</h1>{{ caller() }}</section>{{ endmacro }}{{ call panel('Orders') }}<p>{{ count }} orders</p>{{ endcall }}",
+			context: map[string]interface{}{
+				"count": 3,
+			},
+			expected: "<section><h1>Orders</h1><p>3 orders</p></section>",
+		},
+		{
+			name:     "Import as namespace",
+			content:  "{{ import 'forms.html' as forms }}{{ forms.field('email', 'E-mail', type='email') }}",
+			context:  map[string]interface{}{},
+			expected: "<label>E-mail</label><input type='email' name='email'>",
+		},
+		{
+			name:     "From import with alias",
+			content:  "{{ from 'forms.html' import field, button as btn }}{{ field('name', 'Name') }}{{ btn('Save') }}",
+			context:  map[string]interface{}{},
+			expected: "<label>Name</label><input type='text' name='name'><button>Save</button>",
+		},
+		{
+			name:     "Imported macro with caller",
+			content:  "{{ from 'cards.html' import card }}{{ call card('Hello') }}<p>{{ body }}</p>{{ endcall }}",
+			context:  map[string]interface{}{"body": "World"},
+			expected: "<div><h2>Hello</h2><p>World</p><button>OK</button></div>",
+		},
+		{
+			name:          "Missing argument",
+			content:       "{{ macro field(name, label) }}{{ endmacro }}{{ field('email') }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "macro 'field' is missing argument 'label'",
+		},
+		{
+			name:          "Too many arguments",
+			content:       "{{ macro field(name) }}{{ endmacro }}{{ field('email', 'E-mail') }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "macro 'field' takes 1 arguments but 2 were given",
+		},
+		{
+			name:          "Unknown keyword argument",
+			content:       "{{ macro field(name) }}{{ endmacro }}{{ field('email', size=3) }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "macro 'field' has no argument 'size'",
+		},
+		{
+			name:          "Calling something that is not a macro",
+			content:       "{{ name('x') }}",
+			context:       map[string]interface{}{"name": "Oz"},
+			shouldError:   true,
+			errorContains: "'name' is not a function or macro",
+		},
+		{
+			name:          "Importing a missing name",
+			content:       "{{ from 'forms.html' import checkbox }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "'checkbox' is not defined in 'forms.html'",
+		},
+		{
+			name:          "Import cycle",
+			content:       "{{ import 'loop.html' as loop }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "import cycle: loop.html -> cycle.html -> loop.html",
+		},
+		{
+			name:          "Macro calling itself",
+			content:       "{{ macro m() }}{{ m() }}{{ endmacro }}{{ m() }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "nesting too deep: blocks, macro calls and imports can't be nested more than 1000 levels",
+		},
+		{
+			name:          "Macros calling each other",
+			content:       "{{ macro ping() }}{{ pong() }}{{ endmacro }}{{ macro pong() }}{{ ping() }}{{ endmacro }}{{ ping() }}",
+			context:       map[string]interface{}{},
+			shouldError:   true,
+			errorContains: "nesting too deep: blocks, macro calls and imports can't be nested more than 1000 levels",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexer.New(tt.content).Tokenize()
+			require.NoError(t, err, "Lexer should not fail")
+			ast, err := parser.New(tokens).Parse()
+			require.NoError(t, err, "Parser should not fail")
+
+			renderer := New(ast, tt.context)
+			renderer.Loader = loader
+			template, err := renderer.Render()
+
+			if tt.shouldError {
+				require.Error(t, err)
+				if tt.errorContains != "" {
+					require.Contains(t, err.Error(), tt.errorContains)
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, template)
+		})
+	}
+}
+
+// counter returns a function counting how many times it was called
+func counter() func() int {
+	calls := 0
+	return func() int {
+		calls++
+		return calls
+	}
+}
+
+type testUser struct {
+	First, Last string
+	Roles       []string
+	Token       func() string
+	password    string
+}
+
+func (u testUser) FullName() string { return u.First + " " + u.Last }
+
+func (u testUser) Greet(greeting string, times int) string {
+	return strings.Repeat(greeting+" "+u.First+"! ", times)
+}
+
+func (u *testUser) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *testUser) Password() string { return u.password }
+
+func TestRendererFunctions(t *testing.T) {
+	user := &testUser{First: "Ada", Last: "Lovelace", Roles: []string{"admin"}, Token: func() string { return "t0k3n" }, password: "hunter2"}
+	functions := map[string]interface{}{
+		"add":   func(a, b int) int { return a + b },
+		"join":  func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"upper": strings.ToUpper,
+		"link": func(href string, kwargs map[string]interface{}) string {
+			return fmt.Sprintf(`<a href="%s" class="%v">`, href, kwargs["class"])
+		},
+		"fail":  func() (string, error) { return "", fmt.Errorf("boom") },
+		"panic": func() string { panic("oops") },
+		"void":  func() {},
+	}
+
+	tests := []struct {
+		name          string
+		content       string
+		context       map[string]interface{}
+		allow         []string // methods of testUser templates may call, nil allows all of them
+		expected      string
+		errorContains string
+	}{
+		{
+			name:     "Registered functions",
+			content:  "{{ add(1, 2) }}|{{ join('-', 'a', 'b', 'c') }}|{{ upper(add(1, 1) > 1 ? 'yes' : 'no') }}|{{ link('/home', class='nav') }}",
+			expected: `3|a-b-c|YES|<a href="/home" class="nav">`,
+		},
+		{
+			name:     "Context values take precedence over functions",
+			content:  "{{ add }}",
+			context:  map[string]interface{}{"add": "plus"},
+			expected: "plus",
+		},
+		{
+			name:     "Struct fields and methods",
+			content:  "{{ user.First }} {{ user.FullName() }}|{{ user.Greet('Hi', 2) }}|{{ user.HasRole('admin') }}|{{ user.Roles[0] }}|{{ user.password ?? 'hidden' }}",
+			context:  map[string]interface{}{"user": user},
+			expected: "Ada Ada Lovelace|Hi Ada! Hi Ada! |true|admin|hidden",
+		},
+		{
+			name:     "Methods with pointer receivers on values",
+			content:  "{{ if user.HasRole('admin') && !user.HasRole('owner') }}admin{{ endif }}",
+			context:  map[string]interface{}{"user": *user},
+			expected: "admin",
+		},
+		{
+			name:     "String methods",
+			content:  "{{ 'abc'.upper() }}|{{ name.title() }}|{{ name.capitalize() }}|{{ '  x '.strip() }}|{{ for p in 'a,b'.split(',') }}[{{ p }}]{{ endfor }}|{{ name.replace('ada', 'grace').upper() }}",
+			context:  map[string]interface{}{"name": "ada lovelace"},
+			expected: "ABC|Ada Lovelace|Ada lovelace|x|[a][b]|GRACE LOVELACE",
+		},
+		{
+			name:     "Allowed methods",
+			content:  "{{ user.FullName() }}",
+			context:  map[string]interface{}{"user": user},
+			allow:    []string{"FullName"},
+			expected: "Ada Lovelace",
+		},
+		{
+			name:          "Method not in the allowlist",
+			content:       "{{ user.Password() }}",
+			context:       map[string]interface{}{"user": user},
+			allow:         []string{"FullName"},
+			errorContains: "method 'Password' of *renderer.testUser is not allowed",
+		},
+		{
+			name:          "Function field not in the allowlist",
+			content:       "{{ user.First }} {{ user.Token() }}",
+			context:       map[string]interface{}{"user": user},
+			allow:         []string{"FullName"},
+			errorContains: "function 'Token' of *renderer.testUser is not allowed",
+		},
+		{
+			name:     "Function field in the allowlist",
+			content:  "{{ user.Token() }}",
+			context:  map[string]interface{}{"user": user},
+			allow:    []string{"Token"},
+			expected: "t0k3n",
+		},
+		{
+			name:          "Unknown method",
+			content:       "{{ user.Delete() }}",
+			context:       map[string]interface{}{"user": user},
+			errorContains: "*renderer.testUser has no method 'Delete'",
+		},
+		{
+			name:          "Unknown string method",
+			content:       "{{ 'abc'.reverse() }}",
+			errorContains: "string has no method 'reverse'",
+		},
+		{
+			name:          "Wrong number of arguments",
+			content:       "{{ add(1) }}",
+			errorContains: "error calling 'add': function takes 2 arguments but 1 were given",
+		},
+		{
+			name:          "Argument of the wrong type",
+			content:       "{{ add(1.5, 'x') }}",
+			errorContains: "argument 1: cannot use 1.5 as int",
+		},
+		{
+			name:          "Keyword arguments to a function without them",
+			content:       "{{ add(1, b=2) }}",
+			errorContains: "function takes no keyword arguments",
+		},
+		{
+			name:          "Function returning an error",
+			content:       "{{ fail() }}",
+			errorContains: "error calling 'fail': boom",
+		},
+		{
+			name:          "Panicking function",
+			content:       "{{ panic() }}",
+			errorContains: "function panicked: oops",
+		},
+		{
+			name:          "Function without a result",
+			content:       "{{ void() }}",
+			errorContains: "function must return a value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexer.New(tt.content).Tokenize()
+			require.NoError(t, err)
+			ast, err := parser.New(tokens).Parse()
+			require.NoError(t, err)
+
+			renderer := New(ast, tt.context)
+			renderer.Functions = functions
+			if tt.allow != nil {
+				renderer.AllowMethods(testUser{}, tt.allow...)
+			}
+			template, err := renderer.Render()
+
+			if tt.errorContains != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.errorContains)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, template)
+		})
+	}
+}
+
+func TestRendererSandbox(t *testing.T) {
+	loader := MapLoader{
+		"self.html": "{{ import 'self.html' as self }}",
+	}
+
+	tests := []struct {
+		name          string
+		content       string
+		context       map[string]interface{}
+		sandbox       Sandbox
+		expected      string
+		limit         Limit
+		errorContains string
+	}{
+		{
+			name:     "Within limits",
+			content:  "{{ for i in items }}{{ if i > 1 }}{{ i }}{{ endif }}{{ endfor }}",
+			context:  map[string]interface{}{"items": []interface{}{1, 2, 3}},
+			sandbox:  Sandbox{MaxLoopIterations: 3, MaxDepth: 2, MaxOutputBytes: 2, MaxEvaluations: 9, Timeout: time.Second},
+			expected: "23",
+		},
+		{
+			name:    "Loop iterations are counted across loops",
+			content: "{{ for i in items }}{{ for j in items }}.{{ endfor }}{{ endfor }}",
+			context: map[string]interface{}{"items": []interface{}{1, 2, 3}},
+			sandbox: Sandbox{MaxLoopIterations: 10},
+			limit:   LimitLoopIterations,
+		},
+		{
+			name:    "Ranges longer than the loop limit are not allocated",
+			content: "{{ 5 in 1..1000000000 }}|{{ range(1000000000) }}",
+			sandbox: Sandbox{MaxLoopIterations: 1000},
+			limit:   LimitLoopIterations,
+		},
+		{
+			name:    "Nested blocks",
+			content: "{{ if true }}{{ for i in [1] }}{{ switch i }}{{ case 1 }}one{{ endswitch }}{{ endfor }}{{ endif }}",
+			sandbox: Sandbox{MaxDepth: 2},
+			limit:   LimitDepth,
+		},
+		{
+			name:    "Recursive macros",
+			content: "{{ macro down(n) }}{{ down(n) }}{{ endmacro }}{{ down(0) }}",
+			sandbox: Sandbox{MaxDepth: 50},
+			limit:   LimitDepth,
+		},
+		{
+			name:    "Recursive imports",
+			content: "{{ import 'self.html' as self }}",
+			sandbox: Sandbox{MaxDepth: 5},
+			// Import cycles are caught before the depth limit
+			errorContains: "import cycle",
+		},
+		{
+			name:    "Output bytes",
+			content: "{{ for i in 1..100 }}0123456789{{ endfor }}",
+			sandbox: Sandbox{MaxOutputBytes: 64},
+			limit:   LimitOutputBytes,
+		},
+		{
+			name:    "Strings grown past the output limit are not built",
+			content: "{{ s.replace('a', s).replace('a', s).replace('a', s) }}",
+			context: map[string]interface{}{"s": strings.Repeat("a", 300)},
+			sandbox: Sandbox{MaxOutputBytes: 100},
+			limit:   LimitOutputBytes,
+		},
+		{
+			name:    "Evaluations",
+			content: "{{ for i in items }}{{ i > 0 && i < 10 }}{{ endfor }}",
+			context: map[string]interface{}{"items": []interface{}{1, 2, 3, 4, 5}},
+			sandbox: Sandbox{MaxEvaluations: 10},
+			limit:   LimitEvaluations,
+		},
+		{
+			name:    "Timeout",
+			content: "{{ for i in 1..1000 }}{{ for j in 1..1000 }}{{ sleep() }}{{ endfor }}{{ endfor }}",
+			context: map[string]interface{}{"sleep": func() string { time.Sleep(time.Millisecond); return "" }},
+			sandbox: Sandbox{Timeout: 20 * time.Millisecond},
+			limit:   LimitTimeout,
+		},
+		{
+			name:     "Allowed keys",
+			content:  "{{ name }}{{ for i in [1] }}{{ i }}{{ endfor }}{{ macro m(x) }}{{ x }}{{ endmacro }}{{ m('!') }}|{{ secret is defined }}",
+			context:  map[string]interface{}{"name": "Oz", "secret": "s3cret"},
+			sandbox:  Sandbox{AllowedKeys: []string{"name"}},
+			expected: "Oz1!|false",
+		},
+		{
+			name:          "Keys that aren't allowed are missing",
+			content:       "{{ secret }}",
+			context:       map[string]interface{}{"secret": "s3cret"},
+			sandbox:       Sandbox{AllowedKeys: []string{}},
+			errorContains: "variable 'secret' not found in context",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexer.New(tt.content).Tokenize()
+			require.NoError(t, err)
+			ast, err := parser.New(tokens).Parse()
+			require.NoError(t, err)
+
+			renderer := New(ast, tt.context)
+			renderer.Loader = loader
+			renderer.Sandbox = &tt.sandbox
+			template, err := renderer.Render()
+
+			switch {
+			case tt.limit != "":
+				var limitErr *LimitExceededError
+				require.ErrorAs(t, err, &limitErr)
+				require.Equal(t, tt.limit, limitErr.Limit)
+			case tt.errorContains != "":
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.errorContains)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, tt.expected, template)
+			}
+		})
+	}
+}
+
+func TestFSLoader(t *testing.T) {
+	loader := &FSLoader{FS: fstest.MapFS{
+		"macros/forms.html": {Data: []byte("{{ macro hello(name) }}Hello, {{ name }}!{{ endmacro }}")},
+	}}
+
+	tokens, err := lexer.New("{{ from 'macros/forms.html' import hello }}{{ hello('Oz') }}").Tokenize()
+	require.NoError(t, err)
+	ast, err := parser.New(tokens).Parse()
+	require.NoError(t, err)
+
+	renderer := New(ast, nil)
+	renderer.Loader = loader
+	result, err := renderer.Render()
+	require.NoError(t, err)
+	require.Equal(t, "Hello, Oz!", result)
+
+	_, err = loader.Load("missing.html")
+	require.Error(t, err)
+}
+
 // TestRendererNilCases tests nil handling
 func TestRendererNilCases(t *testing.T) {
 	tests := []struct {
@@ -380,3 +1102,278 @@ func TestRendererNilCases(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderErrorPositions(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected lexer.Position
+	}{
+		{
+			name:     "Error raised on a node",
+			content:  "a\n{{ missing }}",
+			expected: lexer.Position{Offset: 5, Line: 2, Column: 4},
+		},
+		{
+			name:     "Error raised without a node points at its statement",
+			content:  "a\n  {{ if flag }}{{ endif }}",
+			expected: lexer.Position{Offset: 4, Line: 2, Column: 3},
+		},
+		{
+			name:     "Errors in loops point into the body",
+			content:  "{{ for i in [1] }}\n{{ if flag }}{{ endif }}{{ endfor }}",
+			expected: lexer.Position{Offset: 19, Line: 2, Column: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexer.New(tt.content).Tokenize()
+			require.NoError(t, err)
+			ast, err := parser.New(tokens).Parse()
+			require.NoError(t, err)
+
+			_, err = New(ast, nil).Render()
+			require.IsType(t, &RenderError{}, err)
+			require.Equal(t, tt.expected, err.(*RenderError).Node.Pos)
+		})
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name:     "Literal expression",
+			content:  "{{ 'prod' == 'prod' }}",
+			expected: "TEXT_NODE: true\n",
+		},
+		{
+			name:     "Literals folded within an expression",
+			content:  "{{ x && 1 == 1 }}",
+			expected: "EXPRESSION_NODE:\n  VARIABLE_NODE: x\n  OP_AND: &&\n  BOOLEAN_LITERAL_NODE: true\n",
+		},
+		{
+			name:     "Left side decides the result",
+			content:  "{{ 'a' ?? x }}{{ false || x }}",
+			expected: "TEXT_NODE: a\nEXPRESSION_NODE:\n  VARIABLE_NODE: x\n",
+		},
+		{
+			name:     "Operand left on its own stays an expression",
+			content:  "{{ if true && flag }}a{{ endif }}",
+			expected: "IF_NODE:\n  EXPRESSION_NODE:\n    VARIABLE_NODE: flag\n  THEN_BRANCH:\n    TEXT_NODE: a\n",
+		},
+		{
+			name:     "Side left of an operator",
+			content:  "{{ true && x || !(false) }}",
+			expected: "EXPRESSION_NODE:\n  VARIABLE_NODE: x\n  OP_OR: ||\n  BOOLEAN_LITERAL_NODE: true\n",
+		},
+		{
+			name:     "Branches never taken removed",
+			content:  "{{ if false }}a{{ elif flag }}b{{ elif 0 }}c{{ else }}d{{ endif }}",
+			expected: "IF_NODE:\n  VARIABLE_NODE: flag\n  THEN_BRANCH:\n    TEXT_NODE: b\n  ELSE_BRANCH:\n    TEXT_NODE: d\n",
+		},
+		{
+			name:     "Branch always taken becomes the else branch",
+			content:  "{{ if flag }}a{{ elif 1 < 2 }}b{{ else }}c{{ endif }}",
+			expected: "IF_NODE:\n  VARIABLE_NODE: flag\n  THEN_BRANCH:\n    TEXT_NODE: a\n  ELSE_BRANCH:\n    TEXT_NODE: b\n",
+		},
+		{
+			name:     "Branch always taken replaces the statement and text merged",
+			content:  "a{{ if 1 }}b{{ endif }}{{ if '' }}c{{ endif }}d",
+			expected: "TEXT_NODE: abd\n",
+		},
+		{
+			name:     "Switch on a literal",
+			content:  "{{ switch 'b' }}{{ case 'a' }}A{{ case 'b', x }}B{{ default }}D{{ endswitch }}",
+			expected: "TEXT_NODE: B\n",
+		},
+		{
+			name:     "Switch cases after one that isn't a literal kept",
+			content:  "{{ switch 'b' }}{{ case 'a' }}A{{ case x }}X{{ case 'b' }}B{{ case 'c' }}C{{ endswitch }}",
+			expected: "SWITCH_NODE:\n  STRING_LITERAL_NODE: b\n  CASE_NODE:\n    CASE_VALUES:\n      VARIABLE_NODE: x\n    CASE_BODY:\n      TEXT_NODE: X\n  CASE_NODE:\n    CASE_VALUES:\n      STRING_LITERAL_NODE: b\n    CASE_BODY:\n      TEXT_NODE: B\n",
+		},
+		{
+			name:     "Inline if on a literal",
+			content:  "{{ 'yes' if true else x }}{{ x if 0 else 'no' }}",
+			expected: "TEXT_NODE: yesno\n",
+		},
+		{
+			name:     "Test on a literal",
+			content:  "{{ 3 is odd }}",
+			expected: "TEXT_NODE: true\n",
+		},
+		{
+			name:     "Large ranges not evaluated",
+			content:  "{{ 5 in 1..100000000 }}",
+			expected: "EXPRESSION_NODE:\n  NUMBER_LITERAL_NODE: 5\n  OP_IN: in\n  NUMBER_LITERAL_NODE: 1\n  OP_RANGE: ..\n  NUMBER_LITERAL_NODE: 100000000\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexer.New(tt.content).Tokenize()
+			require.NoError(t, err)
+			ast, err := parser.New(tokens).Parse()
+			require.NoError(t, err)
+
+			var before, after strings.Builder
+			require.NoError(t, parser.FprintAST(&before, ast, lexer.PrintOptions{Color: lexer.ColorNever}))
+			optimized := Optimize(ast)
+			require.NoError(t, parser.FprintAST(&after, optimized, lexer.PrintOptions{Color: lexer.ColorNever}))
+			require.Equal(t, tt.expected, after.String())
+
+			var unchanged strings.Builder
+			require.NoError(t, parser.FprintAST(&unchanged, ast, lexer.PrintOptions{Color: lexer.ColorNever}))
+			require.Equal(t, before.String(), unchanged.String(), "Optimize shouldn't change the AST passed in")
+		})
+	}
+
+	t.Run("Numbers parsed ahead", func(t *testing.T) {
+		tokens, err := lexer.New("{{ x == 1.50 }}").Tokenize()
+		require.NoError(t, err)
+		ast, err := parser.New(tokens).Parse()
+		require.NoError(t, err)
+
+		number := Optimize(ast)[0].Children[2]
+		require.NotNil(t, number.Number)
+		require.Equal(t, 1.5, *number.Number)
+		require.Nil(t, ast[0].Children[2].Number)
+	})
+
+	t.Run("Optimized trees encoded as JSON", func(t *testing.T) {
+		tokens, err := lexer.New("{{ if x == 1.5 }}{{ 'a' ?? y }}{{ endif }}").Tokenize()
+		require.NoError(t, err)
+		ast, err := parser.New(tokens).Parse()
+		require.NoError(t, err)
+
+		optimized := Optimize(ast)
+		encoded, err := parser.MarshalAST(optimized)
+		require.NoError(t, err)
+		require.Contains(t, string(encoded), `"number":1.5`)
+		decoded, err := parser.UnmarshalAST(encoded)
+		require.NoError(t, err)
+		require.Equal(t, optimized, decoded)
+	})
+}
+
+func TestSpecialize(t *testing.T) {
+	tests := []struct {
+		partial  map[string]interface{}
+		rest     map[string]interface{}
+		name     string
+		content  string
+		expected string
+		// expectedAST is the specialized template, when it's set
+		expectedAST string
+	}{
+		{
+			name:        "Known keys written into the template",
+			content:     "Hello from {{ brand }}, {{ user }}! Your plan: {{ plans.pro }}",
+			partial:     map[string]interface{}{"brand": "Acme", "plans": map[string]interface{}{"pro": 10}},
+			rest:        map[string]interface{}{"user": "Ada"},
+			expected:    "Hello from Acme, Ada! Your plan: 10",
+			expectedAST: "TEXT_NODE: Hello from Acme, \nVARIABLE_NODE: user\nTEXT_NODE: ! Your plan: 10\n",
+		},
+		{
+			name:        "Branches decided by known keys removed",
+			content:     "{{ if features.beta }}beta {{ elif legacy }}legacy {{ endif }}{{ switch locale }}{{ case 'de' }}Hallo{{ default }}Hello{{ endswitch }} {{ user }}",
+			partial:     map[string]interface{}{"features": map[string]interface{}{"beta": false}, "legacy": true, "locale": "de"},
+			rest:        map[string]interface{}{"user": "Ada"},
+			expected:    "legacy Hallo Ada",
+			expectedAST: "TEXT_NODE: legacy Hallo \nVARIABLE_NODE: user\n",
+		},
+		{
+			name:        "Expressions mixing known and unknown keys",
+			content:     "{{ user.plan ?? defaultPlan }}{{ if beta && user.admin }}!{{ endif }}",
+			partial:     map[string]interface{}{"defaultPlan": "free", "beta": false},
+			rest:        map[string]interface{}{"user": map[string]interface{}{"admin": true}},
+			expected:    "free",
+			expectedAST: "EXPRESSION_NODE:\n  OBJECT_ACCESS_NODE:\n    VARIABLE_NODE: user\n    OBJECT_ACCESOR: plan\n  OP_NULL_COALESCE: ??\n  STRING_LITERAL_NODE: free\n",
+		},
+		{
+			name:    "Loops over known lists unrolled",
+			content: "{{ for link in links }}<a href='{{ link.url }}'>{{ upper(user) }}</a>{{ endfor }}",
+			partial: map[string]interface{}{"links": []interface{}{
+				map[string]interface{}{"url": "/a"},
+				map[string]interface{}{"url": "/b"},
+			}},
+			rest:        map[string]interface{}{"user": "Ada"},
+			expected:    "<a href='/a'>ADA</a><a href='/b'>ADA</a>",
+			expectedAST: "TEXT_NODE: <a href='/a'>\nCALL_NODE:\n  VARIABLE_NODE: upper\n  VARIABLE_NODE: user\nTEXT_NODE: </a><a href='/b'>\nCALL_NODE:\n  VARIABLE_NODE: upper\n  VARIABLE_NODE: user\nTEXT_NODE: </a>\n",
+		},
+		{
+			name:     "Loops over unknown lists keep their body specialized",
+			content:  "{{ for item in cart }}{{ item }} {{ currency }};{{ endfor }}",
+			partial:  map[string]interface{}{"currency": "EUR"},
+			rest:     map[string]interface{}{"cart": []int{1, 2}},
+			expected: "1 EUR;2 EUR;",
+			expectedAST: "FOR_NODE:\n  ITERATEE_ITEM: item\n  ITERATOR_ITEM: cart\n  FOR_BODY:\n    VARIABLE_NODE: item\n" +
+				"    TEXT_NODE:  EUR;\n",
+		},
+		{
+			name:     "Loops whose body calls a macro not unrolled",
+			content:  "{{ macro row() }}{{ item }}{{ endmacro }}{{ for item in items }}{{ row() }}{{ endfor }}",
+			partial:  map[string]interface{}{"items": []interface{}{"a", "b"}},
+			expected: "ab",
+		},
+		{
+			name:        "Names the template binds left alone",
+			content:     "{{ for brand in brands }}{{ brand }}{{ endfor }}{{ brand }}{{ macro m(name) }}{{ name }}{{ endmacro }}{{ m(name) }}",
+			partial:     map[string]interface{}{"brand": "Acme", "name": "x"},
+			rest:        map[string]interface{}{"brands": []interface{}{"a", "b"}},
+			expected:    "abAcmex",
+			expectedAST: "FOR_NODE:\n  ITERATEE_ITEM: brand\n  ITERATOR_ITEM: brands\n  FOR_BODY:\n    VARIABLE_NODE: brand\nVARIABLE_NODE: brand\nMACRO_NODE: m\n  MACRO_PARAMS:\n    MACRO_PARAM: name\n  MACRO_BODY:\n    VARIABLE_NODE: name\nCALL_NODE:\n  VARIABLE_NODE: m\n  VARIABLE_NODE: name\n",
+		},
+		{
+			name:        "Plain variable conditions only written when they're booleans",
+			content:     "{{ if beta }}b{{ endif }}{{ if name }}n{{ endif }}",
+			partial:     map[string]interface{}{"beta": true, "name": true, "unused": "x"},
+			expected:    "bn",
+			expectedAST: "TEXT_NODE: bn\n",
+		},
+		{
+			name:        "Missing keys of known objects left to fail",
+			content:     "{{ brand.missing is defined }}{{ brand.name ?? 'none' }}",
+			partial:     map[string]interface{}{"brand": map[string]interface{}{}},
+			expected:    "falsenone",
+			expectedAST: "TEXT_NODE: falsenone\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexer.New(tt.content).Tokenize()
+			require.NoError(t, err)
+			ast, err := parser.New(tokens).Parse()
+			require.NoError(t, err)
+
+			context := make(map[string]interface{})
+			for key, value := range tt.partial {
+				context[key] = value
+			}
+			for key, value := range tt.rest {
+				context[key] = value
+			}
+			render := func(ast []parser.Node) string {
+				r := New(ast, context)
+				r.Functions = map[string]interface{}{"upper": strings.ToUpper}
+				out, err := r.Render()
+				require.NoError(t, err)
+				return out
+			}
+			require.Equal(t, tt.expected, render(ast))
+
+			specialized := Specialize(ast, tt.partial)
+			require.Equal(t, tt.expected, render(specialized))
+			if tt.expectedAST != "" {
+				var sb strings.Builder
+				require.NoError(t, parser.FprintAST(&sb, specialized, lexer.PrintOptions{Color: lexer.ColorNever}))
+				require.Equal(t, tt.expectedAST, sb.String())
+			}
+		})
+	}
+}
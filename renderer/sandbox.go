@@ -0,0 +1,189 @@
+package renderer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// Sandbox limits what a template can do while rendering, for templates written by untrusted users.
+// Limits left at zero are not enforced.
+type Sandbox struct {
+	// MaxLoopIterations caps the iterations of all loops in a render combined, ranges can't be longer than it either.
+	// When it's zero ranges are capped by DefaultMaxRange.
+	MaxLoopIterations int
+	// MaxDepth caps how deeply blocks, macro calls and imports can be nested, when it's zero DefaultMaxDepth does
+	MaxDepth int
+	// MaxOutputBytes caps the size of the rendered output
+	MaxOutputBytes int
+	// Timeout caps the wall-clock time of a render
+	Timeout time.Duration
+	// MaxEvaluations caps the number of values evaluated in expressions
+	MaxEvaluations int
+	// AllowedKeys are the context keys a template can read, the others behave as if they were missing.
+	// When it's nil every key can be read.
+	AllowedKeys []string
+}
+
+// DefaultMaxDepth caps how deeply blocks, macro calls and imports can be nested when no Sandbox sets MaxDepth,
+// so a macro calling itself fails the render instead of overflowing the stack
+const DefaultMaxDepth = 1000
+
+// DefaultMaxRange caps the length of ranges when no Sandbox sets MaxLoopIterations, so '1..1e12' fails the render
+// instead of exhausting memory
+const DefaultMaxRange = 1000000
+
+// Limit names one of the limits of a Sandbox
+type Limit string
+
+const (
+	LimitLoopIterations Limit = "loop iterations"
+	LimitDepth          Limit = "depth"
+	LimitOutputBytes    Limit = "output bytes"
+	LimitTimeout        Limit = "timeout"
+	LimitEvaluations    Limit = "evaluations"
+	// LimitRange is DefaultMaxRange, a Sandbox caps ranges with MaxLoopIterations instead
+	LimitRange Limit = "range length"
+)
+
+// LimitExceededError is returned when a render goes over one of the limits of its Sandbox, or over
+// DefaultMaxDepth or DefaultMaxRange, which apply without one
+type LimitExceededError struct {
+	Limit Limit
+	// Default is set when the limit gone over is DefaultMaxDepth or DefaultMaxRange rather than one set by the Sandbox
+	Default bool
+}
+
+func (e *LimitExceededError) Error() string {
+	switch {
+	case e.Default && e.Limit == LimitDepth:
+		return fmt.Sprintf("nesting too deep: blocks, macro calls and imports can't be nested more than %d levels", DefaultMaxDepth)
+	case e.Default && e.Limit == LimitRange:
+		return fmt.Sprintf("range too long: ranges can't have more than %d numbers", DefaultMaxRange)
+	}
+	return fmt.Sprintf("sandbox limit exceeded: %s", e.Limit)
+}
+
+// isLimitExceeded reports whether err is a LimitExceededError, those are passed on as they are instead of being wrapped
+func isLimitExceeded(err error) bool {
+	var limitErr *LimitExceededError
+	return errors.As(err, &limitErr)
+}
+
+// sandboxUsage is what a render has used so far, it's shared by the renderers of macros and imports.
+// Renders without a Sandbox track it as well, to enforce DefaultMaxDepth.
+type sandboxUsage struct {
+	iterations  int
+	depth       int
+	evaluations int
+	deadline    time.Time
+}
+
+// sandboxed returns the renderer a sandboxed render runs in, its context only has the allowed keys
+func (r *Renderer) sandboxed() *Renderer {
+	context := r.Context
+	if r.Sandbox.AllowedKeys != nil {
+		context = make(map[string]interface{}, len(r.Sandbox.AllowedKeys))
+		for key, value := range r.Context {
+			if slices.Contains(r.Sandbox.AllowedKeys, key) {
+				context[key] = value
+			}
+		}
+	}
+
+	// Macros are defined again by each render, so they don't keep the usage of an earlier one
+	sandboxed := r.child(context, make(map[string]interface{}))
+	sandboxed.usage = &sandboxUsage{}
+	if r.Sandbox.Timeout > 0 {
+		sandboxed.usage.deadline = time.Now().Add(r.Sandbox.Timeout)
+	}
+	return sandboxed
+}
+
+// checkDeadline fails once the render has taken longer than the timeout
+func (r *Renderer) checkDeadline() error {
+	if r.usage == nil || r.Sandbox == nil || r.usage.deadline.IsZero() || time.Now().Before(r.usage.deadline) {
+		return nil
+	}
+	return &LimitExceededError{Limit: LimitTimeout}
+}
+
+// countEvaluation is called for every value evaluated in an expression
+func (r *Renderer) countEvaluation() error {
+	if r.usage == nil || r.Sandbox == nil {
+		return nil
+	}
+	r.usage.evaluations++
+	if r.Sandbox.MaxEvaluations > 0 && r.usage.evaluations > r.Sandbox.MaxEvaluations {
+		return &LimitExceededError{Limit: LimitEvaluations}
+	}
+	return r.checkDeadline()
+}
+
+// countIteration is called for every iteration of a loop
+func (r *Renderer) countIteration() error {
+	if r.usage == nil || r.Sandbox == nil {
+		return nil
+	}
+	r.usage.iterations++
+	if r.Sandbox.MaxLoopIterations > 0 && r.usage.iterations > r.Sandbox.MaxLoopIterations {
+		return &LimitExceededError{Limit: LimitLoopIterations}
+	}
+	return r.checkDeadline()
+}
+
+// checkRange fails for ranges longer than the loop iterations a render may do, before they are allocated
+func (r *Renderer) checkRange(start, stop, step float64) error {
+	length := math.Ceil((stop - start) / step)
+	if r.Sandbox != nil && r.Sandbox.MaxLoopIterations > 0 {
+		if length > float64(r.Sandbox.MaxLoopIterations) {
+			return &LimitExceededError{Limit: LimitLoopIterations}
+		}
+		return nil
+	}
+	if length > DefaultMaxRange {
+		return &LimitExceededError{Limit: LimitRange, Default: true}
+	}
+	return nil
+}
+
+// checkOutput fails once rendered output grows past the output limit
+func (r *Renderer) checkOutput(size int) error {
+	if r.usage != nil && r.Sandbox != nil && r.Sandbox.MaxOutputBytes > 0 && size > r.Sandbox.MaxOutputBytes {
+		return &LimitExceededError{Limit: LimitOutputBytes}
+	}
+	return nil
+}
+
+// checkSize fails for a value that would be larger than the output limit, before it's built, so a single
+// expression can't use up memory long before the output it's written to is checked
+func (r *Renderer) checkSize(size int) error {
+	if err := r.checkOutput(size); err != nil {
+		return err
+	}
+	return r.checkDeadline()
+}
+
+// enter is called when rendering goes into a block, macro call or import, leave when it comes out of it
+func (r *Renderer) enter() error {
+	if r.usage == nil {
+		return nil
+	}
+	r.usage.depth++
+	if r.Sandbox != nil && r.Sandbox.MaxDepth > 0 {
+		if r.usage.depth > r.Sandbox.MaxDepth {
+			return &LimitExceededError{Limit: LimitDepth}
+		}
+	} else if r.usage.depth > DefaultMaxDepth {
+		return &LimitExceededError{Limit: LimitDepth, Default: true}
+	}
+	return r.checkDeadline()
+}
+
+func (r *Renderer) leave() {
+	if r.usage != nil {
+		r.usage.depth--
+	}
+}
@@ -0,0 +1,311 @@
+package renderer
+
+import (
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// maxSafeInteger bounds the integers written as number literals, past it not every integer is a float64
+const maxSafeInteger = 1 << 53
+
+// Specialize returns a copy of a parsed template with everything that only depends on the keys of partial
+// evaluated, e.g. the data of a tenant known long before the data of each user. Values are written into the
+// template as literals, branches they decide are removed and loops over them are unrolled, then the result is
+// optimized as Optimize does. What depends on other keys is left to be rendered.
+//
+// Values that can't be written as literals, such as a list a loop iterates over when its body calls a macro,
+// are still looked up when rendering, so render the result with the whole context. Names the template binds
+// itself, such as loop variables and macro parameters, are left alone everywhere, since a macro sees the loop
+// variables of where it's called.
+func Specialize(ast []parser.Node, partial map[string]interface{}) []parser.Node {
+	s := &specializer{bound: make(map[string]bool), macros: map[string]bool{"caller": true}}
+	parser.Inspect(ast, func(node parser.Node) bool {
+		switch node.Type {
+		case parser.ITERATEE_ITEM, parser.MACRO_PARAM:
+			s.bound[*node.Value] = true
+		case parser.MACRO_NODE:
+			s.macros[*node.Value] = true
+		case parser.IMPORT_NAME, parser.IMPORT_ALIAS:
+			s.macros[*node.Value] = true
+		}
+		return true
+	})
+	s.bound["caller"] = true
+
+	known := make(map[string]interface{}, len(partial))
+	for key, value := range partial {
+		if !s.bound[key] {
+			known[key] = value
+		}
+	}
+	return Optimize(s.nodes(ast, known))
+}
+
+type specializer struct {
+	bound  map[string]bool // names the template binds, which aren't looked up in the context
+	macros map[string]bool // names of macros and imports, called macros see the context where they're called
+}
+
+// nodes specializes a list of statements, known are the values of the keys specialized for
+func (s *specializer) nodes(nodes []parser.Node, known map[string]interface{}) []parser.Node {
+	if nodes == nil {
+		return nil
+	}
+	specialized := make([]parser.Node, 0, len(nodes))
+	for _, node := range nodes {
+		specialized = append(specialized, s.statement(node, known)...)
+	}
+	return specialized
+}
+
+func (s *specializer) statement(node parser.Node, known map[string]interface{}) []parser.Node {
+	switch node.Type {
+	case parser.OBJECT_ACCESS_NODE:
+		// A key that isn't found fails the render, rather than evaluating to nil as in expressions
+		if s.closed(node, known) {
+			if value, found, err := scratch(known).evaluateObjectAccess(node); err == nil && found {
+				if literal, ok := knownLiteral(value, node.Pos); ok {
+					return []parser.Node{literal}
+				}
+			}
+			return []parser.Node{node}
+		}
+		return []parser.Node{s.operand(node, known)}
+
+	case parser.IF_NODE:
+		node.Children = append([]parser.Node{s.condition(node.Children[0], known)}, s.children(node.Children[1:], known)...)
+		return []parser.Node{node}
+
+	case parser.ELIF_BRANCH:
+		node.Children = s.children(node.Children, known)
+		return []parser.Node{node}
+
+	case parser.ELIF_ITEM:
+		node.Children = append([]parser.Node{s.condition(node.Children[0], known)}, s.nodes(node.Children[1:], known)...)
+		return []parser.Node{node}
+
+	case parser.THEN_BRANCH, parser.ELSE_BRANCH, parser.CASE_BODY, parser.DEFAULT_BRANCH, parser.CALL_BODY:
+		node.Children = s.nodes(node.Children, known)
+		return []parser.Node{node}
+
+	case parser.FOR_NODE:
+		return s.forNode(node, known)
+
+	case parser.SWITCH_NODE:
+		node.Children = append([]parser.Node{s.operand(node.Children[0], known)}, s.children(node.Children[1:], known)...)
+		return []parser.Node{node}
+
+	case parser.CASE_NODE:
+		values := node.Children[0]
+		values.Children = s.operands(values.Children, known)
+		node.Children = []parser.Node{values, s.statement(node.Children[1], known)[0]}
+		return []parser.Node{node}
+
+	case parser.MACRO_NODE:
+		// Parameters aren't in known, they're all bound names
+		params, body := node.Children[0], node.Children[1]
+		params.Children = s.operands(params.Children, known)
+		body.Children = s.nodes(body.Children, known)
+		node.Children = []parser.Node{params, body}
+		return []parser.Node{node}
+
+	case parser.CALL_BLOCK_NODE:
+		node.Children = []parser.Node{s.operand(node.Children[0], known), s.statement(node.Children[1], known)[0]}
+		return []parser.Node{node}
+
+	case parser.TEXT_NODE, parser.IMPORT_NODE, parser.FROM_IMPORT_NODE:
+		return []parser.Node{node}
+
+	default:
+		return []parser.Node{s.operand(node, known)}
+	}
+}
+
+// children specializes the branches of a statement, such as the cases of a switch, each stays a single node
+func (s *specializer) children(nodes []parser.Node, known map[string]interface{}) []parser.Node {
+	specialized := make([]parser.Node, len(nodes))
+	for i, node := range nodes {
+		specialized[i] = s.statement(node, known)[0]
+	}
+	return specialized
+}
+
+// condition specializes the condition of an if or elif, a plain variable in one has to be a boolean
+func (s *specializer) condition(node parser.Node, known map[string]interface{}) parser.Node {
+	if node.Type == parser.VARIABLE_NODE {
+		if value, ok := known[*node.Value].(bool); ok {
+			literal, _ := literal(value, node.Pos)
+			return literal
+		}
+		return node
+	}
+	return s.operand(node, known)
+}
+
+// forNode unrolls a loop over a known value into a copy of its body for each item, when none of the copies
+// depends on the loop variable anymore. Otherwise only the iterator and the body are specialized.
+func (s *specializer) forNode(node parser.Node, known map[string]interface{}) []parser.Node {
+	iteratee, iterator, body := node.Children[0], node.Children[1], node.Children[2]
+	if len(iterator.Children) > 0 {
+		iterator.Children = []parser.Node{s.operand(iterator.Children[0], known)}
+	}
+
+	if unrolled, ok := s.unroll(*iteratee.Value, iterator, body, known); ok {
+		return unrolled
+	}
+	body.Children = s.nodes(body.Children, known)
+	node.Children = []parser.Node{iteratee, iterator, body}
+	return []parser.Node{node}
+}
+
+func (s *specializer) unroll(name string, iterator, body parser.Node, known map[string]interface{}) ([]parser.Node, bool) {
+	var value interface{}
+	switch {
+	case len(iterator.Children) > 0 && s.closed(iterator.Children[0], known):
+		var err error
+		if value, err = scratch(known).evaluateOperand(iterator.Children[0]); err != nil {
+			return nil, false
+		}
+	case len(iterator.Children) == 0 && iterator.Value != nil:
+		var exists bool
+		if value, exists = known[*iterator.Value]; !exists {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	items, err := iterate(value)
+	if err != nil || len(items) > maxFoldedRange {
+		return nil, false
+	}
+
+	// Macros called in the body, or defined in it, would see the loop variable in the context
+	unrollable := true
+	parser.Inspect(body.Children, func(node parser.Node) bool {
+		switch node.Type {
+		case parser.CALL_NODE:
+			if root := rootName(node.Children[0]); root == "" || s.macros[root] {
+				unrollable = false
+			}
+		case parser.MACRO_NODE, parser.CALL_BLOCK_NODE:
+			unrollable = false
+		}
+		return unrollable
+	})
+	if !unrollable {
+		return nil, false
+	}
+
+	unrolled := []parser.Node{}
+	for _, item := range items {
+		scope := make(map[string]interface{}, len(known)+1)
+		for key, value := range known {
+			scope[key] = value
+		}
+		scope[name] = item
+		specialized := s.nodes(body.Children, scope)
+
+		resolved := true
+		parser.Inspect(specialized, func(node parser.Node) bool {
+			if (node.Type == parser.VARIABLE_NODE || node.Type == parser.ITERATOR_ITEM) && node.Value != nil && *node.Value == name {
+				resolved = false
+			}
+			return resolved
+		})
+		if !resolved {
+			return nil, false
+		}
+		unrolled = append(unrolled, specialized...)
+	}
+	return unrolled, true
+}
+
+// rootName returns the variable an object access starts from, or the variable itself
+func rootName(node parser.Node) string {
+	for node.Type == parser.OBJECT_ACCESS_NODE {
+		node = node.Children[0]
+	}
+	if node.Type != parser.VARIABLE_NODE {
+		return ""
+	}
+	return *node.Value
+}
+
+func (s *specializer) operands(nodes []parser.Node, known map[string]interface{}) []parser.Node {
+	specialized := make([]parser.Node, len(nodes))
+	for i, node := range nodes {
+		specialized[i] = s.operand(node, known)
+	}
+	return specialized
+}
+
+// operand replaces a value that only depends on known keys with its literal, or specializes its parts
+func (s *specializer) operand(node parser.Node, known map[string]interface{}) parser.Node {
+	if parser.IsOperator(node.Type) {
+		return node
+	}
+	if s.closed(node, known) {
+		if value, err := scratch(known).evaluateOperand(node); err == nil {
+			if literal, ok := knownLiteral(value, node.Pos); ok {
+				return literal
+			}
+		}
+	}
+
+	switch node.Type {
+	case parser.CALL_NODE:
+		// The callee is looked up as it is, only its arguments are specialized
+		node.Children = append([]parser.Node{node.Children[0]}, s.operands(node.Children[1:], known)...)
+	case parser.EXPRESSION_NODE, parser.OBJECT_ACCESS_NODE, parser.CONDITIONAL_NODE, parser.TEST_NODE,
+		parser.LIST_LITERAL_NODE, parser.MAP_LITERAL_NODE, parser.MAP_ENTRY, parser.KEYWORD_ARG, parser.MACRO_PARAM:
+		node.Children = s.operands(node.Children, known)
+	}
+	return node
+}
+
+// closed reports whether a node only refers to known keys, and doesn't call anything
+func (s *specializer) closed(node parser.Node, known map[string]interface{}) bool {
+	switch node.Type {
+	case parser.VARIABLE_NODE:
+		_, exists := known[*node.Value]
+		return exists
+	case parser.CALL_NODE, parser.CALL_BLOCK_NODE, parser.MACRO_PARAM, parser.KEYWORD_ARG:
+		return false
+	}
+	for _, child := range node.Children {
+		if !s.closed(child, known) {
+			return false
+		}
+	}
+	return true
+}
+
+// knownLiteral returns the literal for a value from the context, integers are written as numbers when
+// they're exactly a float64
+func knownLiteral(value interface{}, pos lexer.Position) (parser.Node, bool) {
+	var integer int64
+	switch v := value.(type) {
+	case int:
+		integer = int64(v)
+	case int8:
+		integer = int64(v)
+	case int16:
+		integer = int64(v)
+	case int32:
+		integer = int64(v)
+	case int64:
+		integer = v
+	case uint8:
+		integer = int64(v)
+	case uint16:
+		integer = int64(v)
+	case uint32:
+		integer = int64(v)
+	default:
+		return literal(value, pos)
+	}
+	if integer > maxSafeInteger || integer < -maxSafeInteger {
+		return parser.Node{}, false
+	}
+	return literal(float64(integer), pos)
+}
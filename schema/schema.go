@@ -0,0 +1,447 @@
+package schema
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ogzhanolguncu/zencefil/analyzer"
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+)
+
+// Type is what a value of the context has to be
+type Type int
+
+const (
+	ANY      Type = iota // anything, as long as it's there
+	STRING               // strings
+	NUMBER               // integers and floats
+	BOOLEAN              // booleans
+	LIST                 // slices and arrays
+	MAP                  // maps with string keys and structs, anything keys can be read from
+	ITERABLE             // anything a for loop can go over: lists, maps and nil
+)
+
+func (t Type) String() string {
+	return [...]string{
+		"ANY",
+		"STRING",
+		"NUMBER",
+		"BOOLEAN",
+		"LIST",
+		"MAP",
+		"ITERABLE",
+	}[t]
+}
+
+// Field describes the value at one path of the context
+type Field struct {
+	Type     Type
+	Optional bool              // the value may be missing, e.g. because the template checks it with 'is defined'
+	Fields   map[string]*Field // keys read from a MAP
+	Elem     *Field            // elements of a LIST or ITERABLE
+	Pos      lexer.Position    // where the template first uses the value, zero for declared fields
+
+	conflicting bool // uses didn't agree on a type, so it stays ANY
+}
+
+// Schema describes the context a template expects, keyed by variable name
+type Schema struct {
+	Fields map[string]*Field
+}
+
+func New() *Schema {
+	return &Schema{Fields: make(map[string]*Field)}
+}
+
+// Infer builds the schema of a template from how it uses its variables: what it loops over, the keys it reads,
+// plain variables used as if conditions, and comparisons with literals. Keys the template handles missing, with
+// 'is defined', '??' or as a condition, are optional.
+func Infer(nodes []parser.Node) *Schema {
+	s := New()
+	for _, variable := range analyzer.Analyze(nodes).Variables {
+		for _, use := range variable.Uses {
+			s.infer(variable.Name, use)
+		}
+	}
+	return s
+}
+
+func (s *Schema) infer(name string, use analyzer.Use) {
+	path := use.Path
+	if use.Kind == analyzer.CALLED {
+		// The last key is the name of the method
+		path = path[:len(path)-1]
+	}
+
+	field := s.root(name, use.Pos)
+	for _, key := range path {
+		switch {
+		case key == "[]":
+			field.require(ITERABLE)
+			field = field.elem(use.Pos)
+		case isIndex(key):
+			// Numeric keys index lists as well as maps, so nothing more is known about the value
+			return
+		default:
+			field.require(MAP)
+			field = field.key(key, use.Pos)
+		}
+	}
+
+	if use.Optional {
+		field.Optional = true
+	}
+	switch {
+	case use.Kind == analyzer.ITERATED:
+		field.require(ITERABLE)
+	case use.Boolean:
+		field.require(BOOLEAN)
+	case use.Kind == analyzer.TESTED && (use.Test == "defined" || use.Test == "undefined"):
+		field.Optional = true
+	case use.Compared != nil:
+		switch use.Compared.Type {
+		case parser.STRING_LITERAL_NODE:
+			field.require(STRING)
+		case parser.NUMBER_LITERAL_NODE:
+			field.require(NUMBER)
+		case parser.BOOLEAN_LITERAL_NODE:
+			field.require(BOOLEAN)
+		}
+	}
+}
+
+// Declare sets the type of the value at a path such as "items[].name", creating the fields leading to it.
+// Declared types replace inferred ones, the returned field can be changed further, e.g. to make it optional.
+func (s *Schema) Declare(path string, t Type) *Field {
+	name, keys := parsePath(path)
+	field := s.root(name, lexer.Position{})
+	for _, key := range keys {
+		if key == "[]" {
+			if field.Type != LIST {
+				field.Type = ITERABLE
+			}
+			field = field.elem(lexer.Position{})
+			continue
+		}
+		field.Type = MAP
+		field = field.key(key, lexer.Position{})
+	}
+	field.Type, field.conflicting = t, false
+	field.Pos = lexer.Position{}
+	return field
+}
+
+// Parse reads a schema in the format String writes it, one "path: TYPE" line per field with "(optional)" after the
+// type of optional ones. Blank lines and lines starting with '#' are skipped.
+func Parse(text string) (*Schema, error) {
+	types := make(map[string]Type)
+	optional := make(map[string]bool)
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path, typeName, found := strings.Cut(line, ":")
+		path, typeName = strings.TrimSpace(path), strings.TrimSpace(typeName)
+		if !found || path == "" {
+			return nil, fmt.Errorf("line %d: expected 'path: TYPE', got %q", i+1, line)
+		}
+		if rest, isOptional := strings.CutSuffix(typeName, "(optional)"); isOptional {
+			typeName = strings.TrimSpace(rest)
+			optional[path] = true
+		}
+		t, ok := parseType(typeName)
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown type '%s'", i+1, typeName)
+		}
+		types[path] = t
+	}
+
+	// Declaring a field sets the types of the fields leading to it, so parents go first and keep their own type
+	s := New()
+	for _, path := range slices.Sorted(maps.Keys(types)) {
+		s.Declare(path, types[path]).Optional = optional[path]
+	}
+	return s, nil
+}
+
+func parseType(name string) (Type, bool) {
+	for t := ANY; t <= ITERABLE; t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return ANY, false
+}
+
+// Lookup returns the field at a path such as "items[].name", or nil if the schema doesn't have it
+func (s *Schema) Lookup(path string) *Field {
+	name, keys := parsePath(path)
+	field := s.Fields[name]
+	for _, key := range keys {
+		if field == nil {
+			return nil
+		}
+		if key == "[]" {
+			field = field.Elem
+		} else {
+			field = field.Fields[key]
+		}
+	}
+	return field
+}
+
+func (s *Schema) root(name string, pos lexer.Position) *Field {
+	if s.Fields == nil {
+		s.Fields = make(map[string]*Field)
+	}
+	field, exists := s.Fields[name]
+	if !exists {
+		field = &Field{Pos: pos}
+		s.Fields[name] = field
+	}
+	return field
+}
+
+func (f *Field) key(key string, pos lexer.Position) *Field {
+	if f.Fields == nil {
+		f.Fields = make(map[string]*Field)
+	}
+	field, exists := f.Fields[key]
+	if !exists {
+		field = &Field{Pos: pos}
+		f.Fields[key] = field
+	}
+	return field
+}
+
+func (f *Field) elem(pos lexer.Position) *Field {
+	if f.Elem == nil {
+		f.Elem = &Field{Pos: pos}
+	}
+	return f.Elem
+}
+
+// require narrows the type of the field, uses that don't agree on a type leave it as ANY
+func (f *Field) require(t Type) {
+	switch {
+	case f.conflicting:
+	case f.Type == ANY, f.Type == ITERABLE && (t == LIST || t == MAP):
+		f.Type = t
+	case f.Type == t, t == ITERABLE && (f.Type == LIST || f.Type == MAP):
+	default:
+		f.Type, f.conflicting = ANY, true
+	}
+}
+
+// String lists the fields of the schema one per line sorted by path, e.g. "items[].name: STRING"
+func (s *Schema) String() string {
+	types := make(map[string]string)
+	for name, field := range s.Fields {
+		field.describe(name, types)
+	}
+	paths := make([]string, 0, len(types))
+	for path := range types {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	lines := make([]string, len(paths))
+	for i, path := range paths {
+		lines[i] = path + ": " + types[path]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describe adds the type of the field and of the fields under it to types, keyed by path
+func (f *Field) describe(path string, types map[string]string) {
+	types[path] = f.Type.String()
+	if f.Optional {
+		types[path] += " (optional)"
+	}
+	for key, field := range f.Fields {
+		field.describe(path+"."+key, types)
+	}
+	if f.Elem != nil {
+		f.Elem.describe(path+"[]", types)
+	}
+}
+
+// Error is a value of the context that doesn't match the schema
+type Error struct {
+	Path     string // where the value is, e.g. "items[2].name"
+	Expected Type
+	Got      string         // the Go type of the value, or "missing"
+	Pos      lexer.Position // where the template uses the value, zero for declared fields
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("%s: expected %s, got %s", e.Path, e.Expected, e.Got)
+	if e.Got == "missing" {
+		message = fmt.Sprintf("%s: missing", e.Path)
+	}
+	if e.Pos == (lexer.Position{}) {
+		return message
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, message)
+}
+
+// ErrorList is returned by Validate when the context has one or more values that don't match the schema
+type ErrorList []*Error
+
+func (el ErrorList) Error() string {
+	messages := make([]string, len(el))
+	for i, err := range el {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Validate checks the whole context against the schema, the returned error is an ErrorList
+// holding every mismatch, so a payload can be rejected before anything is rendered
+func (s *Schema) Validate(context map[string]interface{}) error {
+	var errors ErrorList
+	for _, name := range sortedKeys(s.Fields) {
+		value, exists := context[name]
+		errors = s.Fields[name].validate(name, value, exists, errors)
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+	return nil
+}
+
+func (f *Field) validate(path string, value interface{}, exists bool, errors ErrorList) ErrorList {
+	if !exists {
+		if f.Optional {
+			return errors
+		}
+		return append(errors, &Error{Path: path, Expected: f.Type, Got: "missing", Pos: f.Pos})
+	}
+	if !f.Type.matches(value) {
+		return append(errors, &Error{Path: path, Expected: f.Type, Got: fmt.Sprintf("%T", value), Pos: f.Pos})
+	}
+
+	for _, key := range sortedKeys(f.Fields) {
+		keyValue, exists := lookupKey(value, key)
+		errors = f.Fields[key].validate(path+"."+key, keyValue, exists, errors)
+	}
+
+	if f.Elem != nil {
+		rv := indirect(reflect.ValueOf(value))
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			for i := 0; i < rv.Len(); i++ {
+				errors = f.Elem.validate(fmt.Sprintf("%s[%d]", path, i), rv.Index(i).Interface(), true, errors)
+			}
+		}
+	}
+	return errors
+}
+
+func (t Type) matches(value interface{}) bool {
+	if t == ANY {
+		return true
+	}
+	rv := indirect(reflect.ValueOf(value))
+	if !rv.IsValid() {
+		// The renderer loops over nil as over an empty list
+		return t == ITERABLE || t == LIST
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		return t == STRING
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return t == NUMBER
+	case reflect.Bool:
+		return t == BOOLEAN
+	case reflect.Slice, reflect.Array:
+		return t == LIST || t == ITERABLE
+	case reflect.Map:
+		return t == ITERABLE || t == MAP && (rv.Type().Key().Kind() == reflect.String || rv.Type().Key().Kind() == reflect.Interface)
+	case reflect.Struct:
+		return t == MAP
+	default:
+		return false
+	}
+}
+
+// lookupKey reads a key the way the renderer does, from a map or an exported struct field
+func lookupKey(value interface{}, key string) (interface{}, bool) {
+	rv := indirect(reflect.ValueOf(value))
+	switch rv.Kind() {
+	case reflect.Map:
+		// Templates only look keys up by name, as the renderer does maps with other keys don't have them
+		keyValue := reflect.ValueOf(key)
+		switch rv.Type().Key().Kind() {
+		case reflect.String:
+			keyValue = keyValue.Convert(rv.Type().Key())
+		case reflect.Interface:
+		default:
+			return nil, false
+		}
+		found := rv.MapIndex(keyValue)
+		if !found.IsValid() {
+			return nil, false
+		}
+		return found.Interface(), true
+	case reflect.Struct:
+		field, exists := rv.Type().FieldByName(key)
+		if !exists || !field.IsExported() {
+			return nil, false
+		}
+		return rv.FieldByIndex(field.Index).Interface(), true
+	default:
+		return nil, false
+	}
+}
+
+// indirect follows pointers and interfaces, it returns the zero Value for nil
+func indirect(rv reflect.Value) reflect.Value {
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+// parsePath splits "items[].name" into "items" and ["[]", "name"]
+func parsePath(path string) (string, []string) {
+	var keys []string
+	for _, part := range strings.Split(path, ".") {
+		elems := 0
+		for strings.HasSuffix(part, "[]") {
+			part = strings.TrimSuffix(part, "[]")
+			elems++
+		}
+		keys = append(keys, part)
+		for ; elems > 0; elems-- {
+			keys = append(keys, "[]")
+		}
+	}
+	return keys[0], keys[1:]
+}
+
+func isIndex(key string) bool {
+	_, err := strconv.Atoi(key)
+	return err == nil
+}
+
+func sortedKeys(fields map[string]*Field) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,206 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/ogzhanolguncu/zencefil/lexer"
+	"github.com/ogzhanolguncu/zencefil/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func infer(t *testing.T, content string) *Schema {
+	t.Helper()
+	tokens, err := lexer.New(content).Tokenize()
+	require.NoError(t, err)
+	ast, err := parser.New(tokens).Parse()
+	require.NoError(t, err)
+	return Infer(ast)
+}
+
+func TestInfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name:     "Printed variables can be anything",
+			content:  "{{ name }}",
+			expected: "name: ANY",
+		},
+		{
+			name:    "Loops and keys",
+			content: "{{ for item in items }}{{ item.name }}{{ item['price'] }}{{ endfor }}",
+			expected: "items: ITERABLE\n" +
+				"items[]: MAP\n" +
+				"items[].name: ANY\n" +
+				"items[].price: ANY",
+		},
+		{
+			name:    "Comparisons with literals",
+			content: "{{ if user.age >= 18 && user.role == 'admin' && user.active == true }}{{ endif }}",
+			expected: "user: MAP\n" +
+				"user.active: BOOLEAN\n" +
+				"user.age: NUMBER\n" +
+				"user.role: STRING",
+		},
+		{
+			name:     "Plain variables as conditions",
+			content:  "{{ if isAdmin }}{{ elif !blocked }}{{ endif }}",
+			expected: "blocked: ANY\nisAdmin: BOOLEAN",
+		},
+		{
+			name:     "Defined tests make values optional",
+			content:  "{{ if user.email is defined }}{{ user.email }}{{ endif }}",
+			expected: "user: MAP\nuser.email: ANY (optional)",
+		},
+		{
+			name:     "Keys handled missing are optional",
+			content:  "{{ m['k'] ?? 'd' }}{{ if user.nickname }}{{ elif !user.blocked }}{{ endif }}{{ name ?? 'd' }}",
+			expected: "m: MAP\nm.k: ANY (optional)\nname: ANY\nuser: MAP\nuser.blocked: ANY (optional)\nuser.nickname: ANY (optional)",
+		},
+		{
+			name:     "Disagreeing uses",
+			content:  "{{ if x == 'a' }}{{ endif }}{{ if x == 1 }}{{ endif }}{{ for i in x }}{{ endfor }}",
+			expected: "x: ANY",
+		},
+		{
+			name:     "Methods and indexes",
+			content:  "{{ name.upper() }}{{ items[0].name }}",
+			expected: "items: ANY\nname: ANY",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, infer(t, tt.content).String())
+		})
+	}
+}
+
+type account struct {
+	Email string
+}
+
+func TestValidate(t *testing.T) {
+	content := "{{ for item in items }}{{ item.name }}{{ if item.price > 10 }}{{ endif }}{{ endfor }}" +
+		"{{ if isAdmin }}{{ endif }}{{ if user.email is defined }}{{ user.email }}{{ endif }}"
+
+	tests := []struct {
+		name     string
+		context  map[string]interface{}
+		expected []string
+	}{
+		{
+			name: "Valid context",
+			context: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"name": "Book", "price": 12.5},
+					map[string]interface{}{"name": "Pen", "price": 2},
+				},
+				"isAdmin": true,
+				"user":    map[string]interface{}{},
+			},
+		},
+		{
+			name: "Structs and typed slices",
+			context: map[string]interface{}{
+				"items":   []map[string]interface{}{{"name": "Book", "price": 12}},
+				"isAdmin": false,
+				"user":    &account{Email: "a@b.c"},
+			},
+		},
+		{
+			name: "Every mismatch at once",
+			context: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"name": "Book", "price": "12"},
+					"Pen",
+					map[string]interface{}{"price": 3},
+				},
+				"isAdmin": "yes",
+			},
+			expected: []string{
+				"1:92: isAdmin: expected BOOLEAN, got string",
+				"1:45: items[0].price: expected NUMBER, got string",
+				"1:27: items[1]: expected MAP, got string",
+				"1:27: items[2].name: missing",
+				"1:119: user: missing",
+			},
+		},
+	}
+
+	s := infer(t, content)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Validate(tt.context)
+			if tt.expected == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.IsType(t, ErrorList{}, err)
+			var messages []string
+			for _, err := range err.(ErrorList) {
+				messages = append(messages, err.Error())
+			}
+			require.Equal(t, tt.expected, messages)
+		})
+	}
+
+	t.Run("Keys handled missing", func(t *testing.T) {
+		s := infer(t, "{{ m['k'] ?? 'd' }}{{ if m['j'] }}{{ m['j'] }}{{ endif }}")
+		require.NoError(t, s.Validate(map[string]interface{}{"m": map[string]interface{}{}}))
+	})
+
+	t.Run("Maps without string keys", func(t *testing.T) {
+		// Conflicting uses make x ANY, its keys are still looked up
+		s := infer(t, "{{ x.a }}{{ if x == 1 }}y{{ endif }}")
+		err := s.Validate(map[string]interface{}{"x": map[int]string{1: "a"}})
+		require.EqualError(t, err, "1:4: x.a: missing")
+	})
+}
+
+func TestDeclare(t *testing.T) {
+	s := New()
+	s.Declare("items[].name", STRING)
+	s.Declare("items", LIST)
+	s.Declare("title", STRING).Optional = true
+	require.Equal(t, "items: LIST\nitems[]: MAP\nitems[].name: STRING\ntitle: STRING (optional)", s.String())
+
+	err := s.Validate(map[string]interface{}{
+		"items": map[string]interface{}{"name": "Book"},
+	})
+	require.EqualError(t, err, "items: expected LIST, got map[string]interface {}")
+
+	err = s.Validate(map[string]interface{}{
+		"items": []interface{}{map[string]interface{}{"name": 1}},
+		"title": "Shop",
+	})
+	require.EqualError(t, err, "items[0].name: expected STRING, got int")
+
+	// Declared types replace inferred ones
+	s = infer(t, "{{ if count == 'many' }}{{ endif }}")
+	s.Declare("count", NUMBER)
+	require.NoError(t, s.Validate(map[string]interface{}{"count": 3}))
+}
+
+func TestParse(t *testing.T) {
+	text := "# order.html\nitems: LIST\nitems[]: MAP\nitems[].name: STRING\n\ntitle: STRING (optional)\nuser.age: NUMBER"
+	s, err := Parse(text)
+	require.NoError(t, err)
+	require.Equal(t, "items: LIST\nitems[]: MAP\nitems[].name: STRING\ntitle: STRING (optional)\nuser: MAP\nuser.age: NUMBER", s.String())
+
+	parsed, err := Parse(s.String())
+	require.NoError(t, err)
+	require.Equal(t, s.String(), parsed.String())
+
+	require.Equal(t, STRING, s.Lookup("items[].name").Type)
+	require.True(t, s.Lookup("title").Optional)
+	require.Nil(t, s.Lookup("items[].price"))
+	require.Nil(t, s.Lookup("missing.key"))
+
+	_, err = Parse("items: LIST\nname STRING")
+	require.EqualError(t, err, `line 2: expected 'path: TYPE', got "name STRING"`)
+	_, err = Parse("items: ARRAY")
+	require.EqualError(t, err, "line 1: unknown type 'ARRAY'")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogzhanolguncu/zencefil/renderer"
+)
+
+func watchCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var dataFiles, sets stringsFlag
+	flags.Var(&dataFiles, "data", "read context from `file` (.json, .yaml, .yml, .toml or .env). Later files override earlier ones")
+	flags.Var(&sets, "set", "set a context value as `key=value` after reading the data files, dotted keys set nested values")
+	format := flags.String("format", "", "`format` of data files without a known extension: json, yaml, toml or env")
+	out := flags.String("out", "", "write the output to `file` on every change")
+	serve := flags.String("serve", "", "serve the output on `address`, e.g. localhost:8080, reloading the page on every change")
+	interval := flags.Duration("interval", 250*time.Millisecond, "how often to look for changes")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: zencefil watch <template> (--out file | --serve address) [flags]\n\n"+
+			"Renders a template again whenever it, the templates it imports or its data files change. Errors are shown\n"+
+			"in the output instead of stopping, until the next change fixes them. Stop with Ctrl+C.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseFlags(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintf(stderr, "zencefil watch: expected one template, got %d\n\n", len(positional))
+		flags.Usage()
+		return exitUsage
+	}
+	if *out == "" && *serve == "" {
+		fmt.Fprintf(stderr, "zencefil watch: expected --out or --serve\n\n")
+		flags.Usage()
+		return exitUsage
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(stderr, "zencefil watch: the interval must be positive")
+		return exitUsage
+	}
+	for _, file := range append(positional, dataFiles...) {
+		if file == "-" {
+			fmt.Fprintln(stderr, "zencefil watch: stdin can't be watched, use files")
+			return exitUsage
+		}
+	}
+
+	w := &watcher{template: positional[0], dataFiles: dataFiles, sets: sets, format: *format, out: *out, stderr: stderr}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *serve != "" {
+		listener, err := net.Listen("tcp", *serve)
+		if err != nil {
+			fmt.Fprintf(stderr, "zencefil watch: %v\n", err)
+			return exitFailure
+		}
+		w.live = newLiveServer()
+		server := &http.Server{Handler: w.live}
+		go server.Serve(listener)
+		defer server.Close()
+		fmt.Fprintf(stdout, "Serving %s on http://%s\n", w.template, listener.Addr())
+	}
+
+	w.update()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return exitOK
+		case <-ticker.C:
+			if w.changed() {
+				w.update()
+			}
+		}
+	}
+}
+
+// watcher renders a template and tells when a file the render read has changed since
+type watcher struct {
+	template  string
+	dataFiles []string
+	sets      []string
+	format    string
+	out       string      // file the output is written to, if any
+	live      *liveServer // server the output is served by, if any
+	stderr    io.Writer
+
+	modTimes map[string]time.Time // of the files read by the last render, zero for the ones that didn't exist
+}
+
+// track remembers the modification time of a file before it's read
+func (w *watcher) track(file string) {
+	var modTime time.Time
+	if info, err := os.Stat(file); err == nil {
+		modTime = info.ModTime()
+	}
+	w.modTimes[file] = modTime
+}
+
+// changed reports whether a file read by the last render was changed, created or removed since
+func (w *watcher) changed() bool {
+	for file, modTime := range w.modTimes {
+		var current time.Time
+		if info, err := os.Stat(file); err == nil {
+			current = info.ModTime()
+		}
+		if !current.Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// render renders the template, an error is rendered as a page showing it so it's seen where the output is looked at
+func (w *watcher) render() (string, error) {
+	w.modTimes = make(map[string]time.Time)
+	for _, file := range w.dataFiles {
+		w.track(file)
+	}
+	w.track(w.template)
+
+	result, err := w.renderFile()
+	if err == nil {
+		return result, nil
+	}
+	var message bytes.Buffer
+	reportError(&message, w.template, err)
+	if w.live != nil || isHTML(w.out) {
+		return "<!DOCTYPE html>\n<title>zencefil: error</title>\n<pre style=\"color: #b00020\">" + html.EscapeString(message.String()) + "</pre>\n", err
+	}
+	return message.String(), err
+}
+
+func (w *watcher) renderFile() (string, error) {
+	data, err := loadContext(w.dataFiles, w.sets, w.format, nil)
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(w.template)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(w.template)
+	return renderSource(string(content), data, &watchedLoader{watcher: w, dir: dir, loader: renderer.NewDirLoader(dir)})
+}
+
+// update renders the template and puts the output where it goes
+func (w *watcher) update() {
+	output, err := w.render()
+	if err != nil {
+		// The error has been rendered, it's printed too for when the output isn't in sight
+		reportError(w.stderr, w.template, err)
+	}
+	if w.out != "" {
+		if err := os.WriteFile(w.out, []byte(output), 0o644); err != nil {
+			fmt.Fprintf(w.stderr, "zencefil watch: error writing output: %v\n", err)
+		}
+	}
+	if w.live != nil {
+		w.live.publish(output)
+	}
+	if err == nil {
+		fmt.Fprintf(w.stderr, "%s rendered %s\n", time.Now().Format(time.TimeOnly), w.template)
+	}
+}
+
+// watchedLoader loads imported templates from a directory and has the watcher track the files
+type watchedLoader struct {
+	watcher *watcher
+	dir     string
+	loader  renderer.Loader
+}
+
+func (l *watchedLoader) Load(name string) (string, error) {
+	l.watcher.track(filepath.Join(l.dir, filepath.FromSlash(name)))
+	return l.loader.Load(name)
+}
+
+func isHTML(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".html" || ext == ".htm"
+}
+
+// reloadScript reloads the page when the server sends a 'reload' event
+const reloadScript = `<script>new EventSource("/_zencefil/events").addEventListener("reload", () => location.reload())</script>`
+
+// liveServer serves the latest output at every path and tells the open pages to reload when it changes
+type liveServer struct {
+	mu      sync.Mutex
+	output  string
+	changed chan struct{} // closed when the output changes, then replaced
+}
+
+func newLiveServer() *liveServer {
+	return &liveServer{changed: make(chan struct{})}
+}
+
+func (s *liveServer) publish(output string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.output = output
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *liveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/_zencefil/events" {
+		s.serveEvents(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	output := s.output
+	s.mu.Unlock()
+	// The script goes at the end of the body, or at the end when there is no body tag
+	if i := strings.LastIndex(strings.ToLower(output), "</body>"); i >= 0 {
+		output = output[:i] + reloadScript + output[i:]
+	} else {
+		output += reloadScript
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, output)
+}
+
+// serveEvents streams a 'reload' event every time the output changes
+func (s *liveServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+			if _, err := io.WriteString(w, "event: reload\ndata: \n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}